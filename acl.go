@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// s3GroupAllUsers is the URI of the S3 group of anyone, anonymous or not.
+const s3GroupAllUsers = "http://acs.amazonaws.com/groups/global/AllUsers"
+
+// s3Grant is a grant of an S3 object ACL, as reported in the ACL report.
+type s3Grant struct {
+	Grantee    string `json:"grantee"`
+	Permission string `json:"permission"`
+}
+
+// s3ObjectGrants returns the grants of an object ACL, leaving out the full
+// control every owner has.
+func s3ObjectGrants(output *s3.GetObjectAclOutput) []s3Grant {
+	var ownerID string
+	if output.Owner != nil {
+		ownerID = aws.StringValue(output.Owner.ID)
+	}
+
+	var grants []s3Grant
+	for _, grant := range output.Grants {
+		if grant.Grantee == nil {
+			continue
+		}
+		permission := aws.StringValue(grant.Permission)
+		grantee := aws.StringValue(grant.Grantee.URI)
+		switch {
+		case grantee != "":
+		case grant.Grantee.ID != nil:
+			if aws.StringValue(grant.Grantee.ID) == ownerID && permission == s3.PermissionFullControl {
+				continue
+			}
+			grantee = "id=" + aws.StringValue(grant.Grantee.ID)
+		case grant.Grantee.EmailAddress != nil:
+			grantee = "emailAddress=" + aws.StringValue(grant.Grantee.EmailAddress)
+		}
+		grants = append(grants, s3Grant{Grantee: grantee, Permission: permission})
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		if grants[i].Grantee != grants[j].Grantee {
+			return grants[i].Grantee < grants[j].Grantee
+		}
+		return grants[i].Permission < grants[j].Permission
+	})
+	return grants
+}
+
+// gcsPredefinedACL returns the predefined GCS ACL equivalent to the grants
+// of an S3 object, "" for private objects, which keep the default object
+// ACL of the bucket. ok is false if GCS has no equivalent.
+func gcsPredefinedACL(grants []s3Grant) (acl string, ok bool) {
+	switch {
+	case len(grants) == 0:
+		return "", true
+	case len(grants) == 1 && grants[0] == s3Grant{Grantee: s3GroupAllUsers, Permission: s3.PermissionRead}:
+		return "publicRead", true
+	}
+
+	// Other AWS accounts, AWS users at large and log delivery have no
+	// counterpart in Google Cloud
+	return "", false
+}
+
+// aclReportEntry is the line of the ACL report about an object whose ACL has
+// no GCS equivalent.
+type aclReportEntry struct {
+	Key       string    `json:"key"`
+	VersionID string    `json:"versionId,omitempty"`
+	Grants    []s3Grant `json:"grants"`
+}
+
+// aclReport records the objects whose ACL could not be mapped, as JSON lines.
+// A nil report only counts them.
+type aclReport struct {
+	path    string
+	file    *os.File
+	mutex   sync.Mutex
+	encoder *json.Encoder
+}
+
+func createACLReport(path string) *aclReport {
+	file, err := os.Create(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &aclReport{path: path, file: file, encoder: json.NewEncoder(file)}
+}
+
+func (r *aclReport) record(entry aclReportEntry) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.encoder.Encode(entry); err != nil {
+		log.Fatal("Error writing ACL report " + r.path + ": " + err.Error())
+	}
+}
+
+func (r *aclReport) close() {
+	if r == nil {
+		return
+	}
+	if err := r.file.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// objectACL returns the predefined GCS ACL to write an object version with.
+// Objects whose ACL has no equivalent are logged and reported, and written
+// with the default object ACL of the bucket.
+func (c *copier) objectACL(ctx context.Context, awsKey string, awsVersion string) string {
+	input := &s3.GetObjectAclInput{
+		Bucket: aws.String(c.s3Bucket),
+		Key:    aws.String(awsKey),
+	}
+	if awsVersion != "" {
+		input.VersionId = aws.String(awsVersion)
+	}
+	output, err := c.s3Client.GetObjectAclWithContext(ctx, input)
+	if err != nil {
+		fatalObject(awsKey, err, "Error getting the ACL of object "+awsKey+" from bucket "+c.s3Bucket)
+	}
+
+	grants := s3ObjectGrants(output)
+	acl, ok := gcsPredefinedACL(grants)
+	if !ok {
+		logObject(objectEvent{Key: awsKey, Action: actionMismatch, Reason: reasonACLUnmapped, Message: "Object " + awsKey + " – ACL has no GCS equivalent, using the default object ACL of the bucket"})
+		c.copyMutex.Lock()
+		c.filesACLUnmapped++
+		c.copyMutex.Unlock()
+		c.aclReport.record(aclReportEntry{Key: awsKey, VersionID: awsVersion, Grants: grants})
+	}
+	return acl
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+)
+
+// objectInfo describes an object stored in a Source or Destination.
+type objectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	ContentType  string
+
+	// CRC32C is the base64 encoded CRC32C checksum of the content, if known
+	CRC32C string
+
+	// Metadata is the user metadata of the object
+	Metadata map[string]string
+}
+
+// Source is a bucket objects are read from.
+type Source interface {
+	// List calls fn for every object whose key starts with prefix.
+	List(ctx context.Context, prefix string, fn func(objectInfo) error) error
+
+	// Open returns a reader for the content of an object.
+	Open(ctx context.Context, info objectInfo) (io.ReadCloser, error)
+
+	// String returns the URI of the source.
+	String() string
+}
+
+// Destination is a bucket objects are written to.
+type Destination interface {
+	// Stat returns the object stored under key, or nil if there is none.
+	Stat(ctx context.Context, key string) (*objectInfo, error)
+
+	// Write stores the content read from body under info.Key, along with the
+	// attributes in info. It only returns once the object is durably stored
+	// and its CRC32C checksum, when info has one, has been verified. The
+	// CRC32C checksum of what was written is returned.
+	Write(ctx context.Context, info objectInfo, body io.Reader) (string, error)
+
+	// String returns the URI of the destination.
+	String() string
+}
+
+// upToDate reports whether the destination object dst holds the content of
+// the source object src. Checksums are compared when both sides have one,
+// otherwise the destination must not be older than the source by more than
+// window.
+func upToDate(src objectInfo, dst *objectInfo, window time.Duration) bool {
+	if dst == nil || src.Size != dst.Size {
+		return false
+	}
+	if src.CRC32C != "" && dst.CRC32C != "" {
+		return src.CRC32C == dst.CRC32C
+	}
+	return !dst.LastModified.Before(src.LastModified.Add(-window))
+}
+
+// prefixedSource exposes the objects of a Source under a prefix with the
+// prefix removed from their keys.
+type prefixedSource struct {
+	Source
+	prefix string
+}
+
+func (s prefixedSource) List(ctx context.Context, prefix string, fn func(objectInfo) error) error {
+	return s.Source.List(ctx, s.prefix+prefix, func(info objectInfo) error {
+		info.Key = strings.TrimPrefix(info.Key, s.prefix)
+		return fn(info)
+	})
+}
+
+func (s prefixedSource) Open(ctx context.Context, info objectInfo) (io.ReadCloser, error) {
+	info.Key = s.prefix + info.Key
+	return s.Source.Open(ctx, info)
+}
+
+func (s prefixedSource) String() string {
+	return s.Source.String() + "/" + s.prefix
+}
+
+// prefixedDestination stores objects in a Destination with a prefix added to
+// their keys.
+type prefixedDestination struct {
+	Destination
+	prefix string
+}
+
+func (d prefixedDestination) Stat(ctx context.Context, key string) (*objectInfo, error) {
+	return d.Destination.Stat(ctx, d.prefix+key)
+}
+
+func (d prefixedDestination) Write(ctx context.Context, info objectInfo, body io.Reader) (string, error) {
+	info.Key = d.prefix + info.Key
+	return d.Destination.Write(ctx, info, body)
+}
+
+func (d prefixedDestination) String() string {
+	return d.Destination.String() + "/" + d.prefix
+}
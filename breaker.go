@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// circuitBreaker pauses the start of new copies when S3 or GCS requests are
+// retried too often, so that a throttled or failing endpoint gets time to
+// recover instead of every copy retrying against it. It opens when errors
+// requests were retried after within window, and closes again after pause,
+// with the count starting over.
+type circuitBreaker struct {
+	mutex sync.Mutex
+
+	// errors is 0 for a breaker that never opens
+	errors int
+	window time.Duration
+	pause  time.Duration
+
+	// The times of the retried errors within window, oldest first
+	retried []time.Time
+
+	// openUntil is when the breaker closes, zero if it is closed
+	openUntil time.Time
+}
+
+// retryCircuit is the circuit breaker of the run, which the S3 and GCS
+// retry hooks feed and copySlots waits for.
+var retryCircuit = &circuitBreaker{}
+
+// configure sets when the breaker opens and for how long.
+func (b *circuitBreaker) configure(errors int, window time.Duration, pause time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.errors = errors
+	b.window = window
+	b.pause = pause
+}
+
+// record counts a request retried after an error, opening the breaker if
+// it was the last one it takes.
+func (b *circuitBreaker) record() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.errors == 0 {
+		return
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return
+	}
+
+	b.retried = append(b.retried, now)
+	expired := 0
+	for expired < len(b.retried) && now.Sub(b.retried[expired]) > b.window {
+		expired++
+	}
+	b.retried = b.retried[expired:]
+	if len(b.retried) < b.errors {
+		return
+	}
+
+	b.openUntil = now.Add(b.pause)
+	b.retried = nil
+	countError("circuit breaker opened")
+	log.Printf("Circuit breaker open: %d requests retried within %s, starting no new copy for %s", b.errors, b.window, b.pause)
+}
+
+// wait returns once the breaker is closed. Copies in progress go on while
+// it is open, retrying their requests.
+func (b *circuitBreaker) wait() {
+	for {
+		b.mutex.Lock()
+		remaining := time.Until(b.openUntil)
+		b.mutex.Unlock()
+		if remaining <= 0 {
+			return
+		}
+		time.Sleep(remaining)
+
+		// Only the first copy to wake up logs the breaker closing
+		b.mutex.Lock()
+		if !b.openUntil.IsZero() && !time.Now().Before(b.openUntil) {
+			b.openUntil = time.Time{}
+			log.Print("Circuit breaker closed, starting new copies again")
+		}
+		b.mutex.Unlock()
+	}
+}
+
+// closesAt returns when the open breaker closes, zero if it is closed.
+func (b *circuitBreaker) closesAt() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if time.Now().Before(b.openUntil) {
+		return b.openUntil
+	}
+	return time.Time{}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// bucketConfig is the GCS bucket configuration translated from that of an
+// S3 bucket, with what has no GCS equivalent. A nil field leaves the GCS
+// bucket setting as it is.
+type bucketConfig struct {
+	versioning *bool
+	lifecycle  *storage.Lifecycle
+	cors       []storage.CORS
+	labels     map[string]string
+
+	// Settings left out or only approximated, in order
+	notMapped []string
+}
+
+func (b *bucketConfig) leaveOut(format string, args ...any) {
+	b.notMapped = append(b.notMapped, fmt.Sprintf(format, args...))
+}
+
+// translateVersioning maps the versioning status of the S3 bucket. A
+// suspended versioning disables it, which in GCS keeps the noncurrent
+// generations too.
+func (b *bucketConfig) translateVersioning(output *s3.GetBucketVersioningOutput) {
+	enabled := aws.StringValue(output.Status) == s3.BucketVersioningStatusEnabled
+	b.versioning = &enabled
+	if aws.StringValue(output.MFADelete) == s3.MFADeleteStatusEnabled {
+		b.leaveOut("Versioning: MFA delete, protect the bucket with a retention policy or soft delete instead")
+	}
+}
+
+// translateCORS maps the CORS rules of the S3 bucket. GCS rules allow any
+// request header.
+func (b *bucketConfig) translateCORS(rules []*s3.CORSRule) {
+	b.cors = []storage.CORS{}
+	for i, rule := range rules {
+		name := fmt.Sprintf("CORS rule %d", i+1)
+		if id := aws.StringValue(rule.ID); id != "" {
+			name = "CORS rule " + id
+		}
+		headers := aws.StringValueSlice(rule.AllowedHeaders)
+		if len(headers) > 0 && !(len(headers) == 1 && headers[0] == "*") {
+			b.leaveOut("%s: allowed headers %s, GCS allows any request header", name, strings.Join(headers, ", "))
+		}
+		b.cors = append(b.cors, storage.CORS{
+			Origins:         aws.StringValueSlice(rule.AllowedOrigins),
+			Methods:         aws.StringValueSlice(rule.AllowedMethods),
+			ResponseHeaders: aws.StringValueSlice(rule.ExposeHeaders),
+			MaxAge:          time.Duration(aws.Int64Value(rule.MaxAgeSeconds)) * time.Second,
+		})
+	}
+}
+
+// translateTags maps the tags of the S3 bucket to labels, whose keys and
+// values can only have lowercase letters, digits, - and _. The tags of AWS,
+// such as aws:cloudformation:stack-name, are left out.
+func (b *bucketConfig) translateTags(tags []*s3.Tag) {
+	b.labels = make(map[string]string)
+	for _, tag := range tags {
+		key, value := aws.StringValue(tag.Key), aws.StringValue(tag.Value)
+		if strings.HasPrefix(key, "aws:") {
+			b.leaveOut("Tag %s: set by AWS", key)
+			continue
+		}
+		labelKey, labelValue := gcsLabel(key), gcsLabel(value)
+		if labelKey == "" || labelKey[0] < 'a' || labelKey[0] > 'z' {
+			b.leaveOut("Tag %s: not a valid label key, which must start with a letter", key)
+			continue
+		}
+		if _, ok := b.labels[labelKey]; ok {
+			b.leaveOut("Tag %s: label %s already set by another tag", key, labelKey)
+			continue
+		}
+		if labelKey != key || labelValue != value {
+			b.leaveOut("Tag %s=%s: renamed to label %s=%s", key, value, labelKey, labelValue)
+		}
+		b.labels[labelKey] = labelValue
+	}
+}
+
+// gcsLabel returns s as a label key or value: lowercase, with the other
+// characters replaced by _, up to 63 characters.
+func gcsLabel(s string) string {
+	label := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '_'
+	}, s)
+	if len(label) > 63 {
+		label = label[:63]
+	}
+	return label
+}
+
+// translateLifecycle maps the enabled lifecycle rules of the S3 bucket to
+// GCS rules: expirations to Delete, transitions to SetStorageClass with the
+// storage classes of -storage-class-map default, and the expiration of
+// incomplete multipart uploads to AbortIncompleteMultipartUpload. Rules
+// filtering on tags or sizes, which GCS cannot, are left out entirely. The
+// GCS rules are left as they are unless at least one rule is translated.
+func (b *bucketConfig) translateLifecycle(rules []*s3.LifecycleRule) {
+	var lifecycle storage.Lifecycle
+	for i, rule := range rules {
+		name := fmt.Sprintf("Lifecycle rule %d", i+1)
+		if id := aws.StringValue(rule.ID); id != "" {
+			name = "Lifecycle rule " + id
+		}
+		if aws.StringValue(rule.Status) != s3.ExpirationStatusEnabled {
+			b.leaveOut("%s: disabled", name)
+			continue
+		}
+
+		prefix := aws.StringValue(rule.Prefix)
+		if filter := rule.Filter; filter != nil {
+			if filter.Prefix != nil {
+				prefix = *filter.Prefix
+			}
+			and := filter.And
+			if and == nil {
+				and = &s3.LifecycleRuleAndOperator{ObjectSizeGreaterThan: filter.ObjectSizeGreaterThan, ObjectSizeLessThan: filter.ObjectSizeLessThan}
+				if filter.Tag != nil {
+					and.Tags = []*s3.Tag{filter.Tag}
+				}
+			} else if and.Prefix != nil {
+				prefix = *and.Prefix
+			}
+			if len(and.Tags) > 0 {
+				b.leaveOut("%s: filters on tags, which GCS lifecycle rules cannot", name)
+				continue
+			}
+			if and.ObjectSizeGreaterThan != nil || and.ObjectSizeLessThan != nil {
+				b.leaveOut("%s: filters on object sizes, which GCS lifecycle rules cannot", name)
+				continue
+			}
+		}
+		matching := func() storage.LifecycleCondition {
+			var c storage.LifecycleCondition
+			if prefix != "" {
+				c.MatchesPrefix = []string{prefix}
+			}
+			return c
+		}
+		// An age of 0 days is only sent as AllObjects
+		olderThan := func(days int64) storage.LifecycleCondition {
+			c := matching()
+			c.AgeInDays = days
+			c.AllObjects = days == 0
+			return c
+		}
+		add := func(actionType string, storageClass string, c storage.LifecycleCondition) {
+			lifecycle.Rules = append(lifecycle.Rules, storage.LifecycleRule{
+				Action:    storage.LifecycleAction{Type: actionType, StorageClass: storageClass},
+				Condition: c,
+			})
+		}
+
+		// The current versions of S3 are the live generations of GCS
+		if expiration := rule.Expiration; expiration != nil {
+			switch {
+			case expiration.Days != nil:
+				c := olderThan(*expiration.Days)
+				c.Liveness = storage.Live
+				add(storage.DeleteAction, "", c)
+			case expiration.Date != nil:
+				c := matching()
+				c.CreatedBefore = *expiration.Date
+				c.Liveness = storage.Live
+				add(storage.DeleteAction, "", c)
+				b.leaveOut("%s: expires objects on %s, GCS only deletes those created before", name, expiration.Date.Format("2006-01-02"))
+			}
+			if aws.BoolValue(expiration.ExpiredObjectDeleteMarker) {
+				b.leaveOut("%s: removes expired delete markers, which GCS does not have", name)
+			}
+		}
+		for _, transition := range rule.Transitions {
+			storageClass, ok := lifecycleStorageClass(transition.StorageClass)
+			if !ok {
+				b.leaveOut("%s: transitions to %s, which has no GCS equivalent (consider Autoclass)", name, aws.StringValue(transition.StorageClass))
+				continue
+			}
+			var c storage.LifecycleCondition
+			if transition.Date != nil {
+				c = matching()
+				c.CreatedBefore = *transition.Date
+				b.leaveOut("%s: transitions objects on %s, GCS only those created before", name, transition.Date.Format("2006-01-02"))
+			} else {
+				c = olderThan(aws.Int64Value(transition.Days))
+			}
+			c.Liveness = storage.Live
+			add(storage.SetStorageClassAction, storageClass, c)
+		}
+
+		// A noncurrent version retained as one of the newest N has N newer
+		// noncurrent generations at most, and the live one
+		if expiration := rule.NoncurrentVersionExpiration; expiration != nil {
+			c := matching()
+			c.Liveness = storage.Archived
+			c.DaysSinceNoncurrentTime = aws.Int64Value(expiration.NoncurrentDays)
+			if newer := aws.Int64Value(expiration.NewerNoncurrentVersions); newer > 0 {
+				c.NumNewerVersions = newer + 1
+			}
+			add(storage.DeleteAction, "", c)
+		}
+		for _, transition := range rule.NoncurrentVersionTransitions {
+			storageClass, ok := lifecycleStorageClass(transition.StorageClass)
+			if !ok {
+				b.leaveOut("%s: transitions noncurrent versions to %s, which has no GCS equivalent", name, aws.StringValue(transition.StorageClass))
+				continue
+			}
+			if transition.NewerNoncurrentVersions != nil {
+				b.leaveOut("%s: keeps %d noncurrent versions from transitioning, GCS transitions them all", name, *transition.NewerNoncurrentVersions)
+			}
+			c := matching()
+			c.Liveness = storage.Archived
+			c.DaysSinceNoncurrentTime = aws.Int64Value(transition.NoncurrentDays)
+			add(storage.SetStorageClassAction, storageClass, c)
+		}
+
+		if abort := rule.AbortIncompleteMultipartUpload; abort != nil {
+			add(storage.AbortIncompleteMPUAction, "", olderThan(aws.Int64Value(abort.DaysAfterInitiation)))
+		}
+	}
+	// An empty lifecycle would delete the GCS rules
+	if len(lifecycle.Rules) > 0 {
+		b.lifecycle = &lifecycle
+	}
+}
+
+// lifecycleStorageClass returns the GCS storage class of an S3 lifecycle
+// transition.
+func lifecycleStorageClass(s3Class *string) (string, bool) {
+	storageClass, ok := defaultStorageClassMap[aws.StringValue(s3Class)]
+	return storageClass, ok
+}
+
+// describeLifecycleRule returns a GCS lifecycle rule as a line of the log.
+func describeLifecycleRule(rule storage.LifecycleRule) string {
+	action := rule.Action.Type
+	if rule.Action.StorageClass != "" {
+		action += " to " + rule.Action.StorageClass
+	}
+	var conditions []string
+	c := rule.Condition
+	if len(c.MatchesPrefix) > 0 {
+		conditions = append(conditions, "prefix "+strings.Join(c.MatchesPrefix, ", "))
+	}
+	switch c.Liveness {
+	case storage.Live:
+		conditions = append(conditions, "live")
+	case storage.Archived:
+		conditions = append(conditions, "noncurrent")
+	}
+	if c.AgeInDays > 0 || c.AllObjects {
+		conditions = append(conditions, fmt.Sprintf("age %d days", c.AgeInDays))
+	}
+	if !c.CreatedBefore.IsZero() {
+		conditions = append(conditions, "created before "+c.CreatedBefore.Format("2006-01-02"))
+	}
+	if c.DaysSinceNoncurrentTime > 0 {
+		conditions = append(conditions, fmt.Sprintf("noncurrent for %d days", c.DaysSinceNoncurrentTime))
+	}
+	if c.NumNewerVersions > 0 {
+		conditions = append(conditions, fmt.Sprintf("%d newer versions", c.NumNewerVersions))
+	}
+	return action + " if " + strings.Join(conditions, ", ")
+}
+
+// readBucketConfig reads the configuration of the S3 bucket and translates
+// it. Configurations the bucket does not have are left as they are in GCS.
+func readBucketConfig(ctx context.Context, s3Client *s3.S3, s3Bucket string) *bucketConfig {
+	config := &bucketConfig{}
+	bucket := aws.String(s3Bucket)
+
+	versioning, err := s3Client.GetBucketVersioningWithContext(ctx, &s3.GetBucketVersioningInput{Bucket: bucket})
+	if err != nil {
+		log.Fatal("Error getting versioning of bucket " + s3Bucket + ": " + err.Error())
+	}
+	config.translateVersioning(versioning)
+
+	lifecycle, err := s3Client.GetBucketLifecycleConfigurationWithContext(ctx, &s3.GetBucketLifecycleConfigurationInput{Bucket: bucket})
+	if err != nil && !isS3NotFound(err) {
+		log.Fatal("Error getting lifecycle configuration of bucket " + s3Bucket + ": " + err.Error())
+	}
+	if err == nil {
+		config.translateLifecycle(lifecycle.Rules)
+	}
+
+	cors, err := s3Client.GetBucketCorsWithContext(ctx, &s3.GetBucketCorsInput{Bucket: bucket})
+	if err != nil && !isS3NotFound(err) {
+		log.Fatal("Error getting CORS configuration of bucket " + s3Bucket + ": " + err.Error())
+	}
+	if err == nil {
+		config.translateCORS(cors.CORSRules)
+	}
+
+	tagging, err := s3Client.GetBucketTaggingWithContext(ctx, &s3.GetBucketTaggingInput{Bucket: bucket})
+	if err != nil && !isS3NotFound(err) {
+		log.Fatal("Error getting tags of bucket " + s3Bucket + ": " + err.Error())
+	}
+	if err == nil {
+		config.translateTags(tagging.TagSet)
+	}
+	return config
+}
+
+// log logs the GCS bucket configuration, and what was left out.
+func (b *bucketConfig) log(current *storage.BucketAttrs) {
+	if b.versioning != nil {
+		log.Printf("Versioning: %t (currently %t)", *b.versioning, current.VersioningEnabled)
+	}
+	if b.lifecycle != nil {
+		log.Printf("Lifecycle: %d rules, replacing the %d current rules", len(b.lifecycle.Rules), len(current.Lifecycle.Rules))
+		for _, rule := range b.lifecycle.Rules {
+			log.Printf("Lifecycle: %s", describeLifecycleRule(rule))
+		}
+	} else {
+		log.Print("Lifecycle: no rule translated from S3, left as it is")
+	}
+	if b.cors != nil {
+		log.Printf("CORS: %d rules, replacing the %d current rules", len(b.cors), len(current.CORS))
+		for _, rule := range b.cors {
+			log.Printf("CORS: origins %s, methods %s, response headers %s, max age %s",
+				strings.Join(rule.Origins, ", "), strings.Join(rule.Methods, ", "), strings.Join(rule.ResponseHeaders, ", "), rule.MaxAge)
+		}
+	} else {
+		log.Print("CORS: none in S3, left as it is")
+	}
+	if b.labels != nil {
+		keys := make([]string, 0, len(b.labels))
+		for key := range b.labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			log.Printf("Label: %s=%s", key, b.labels[key])
+		}
+	}
+	for _, setting := range b.notMapped {
+		log.Printf("Not mapped: %s", setting)
+	}
+}
+
+// update returns the update of the GCS bucket setting the configuration.
+// Other labels of the bucket are kept.
+func (b *bucketConfig) update() storage.BucketAttrsToUpdate {
+	var update storage.BucketAttrsToUpdate
+	if b.versioning != nil {
+		update.VersioningEnabled = *b.versioning
+	}
+	update.Lifecycle = b.lifecycle
+	if b.cors != nil {
+		update.CORS = b.cors
+	}
+	for key, value := range b.labels {
+		update.SetLabel(key, value)
+	}
+	return update
+}
+
+func runBucketConfig(args []string) {
+	flags := flag.NewFlagSet("bucket-config", flag.ExitOnError)
+	var s3Opts s3Options
+	addS3Flags(flags, &s3Opts)
+	var gcsOpts gcsOptions
+	addGCSFlags(flags, &gcsOpts)
+	dryRun := flags.Bool("dry-run", false, "Only log the GCS bucket configuration and what cannot be mapped, without changing the GCS bucket")
+	addLogFlags(flags)
+	flags.Parse(args)
+	setupLogging()
+
+	if len(flags.Args()) != 2 {
+		log.Fatal("Usage: ./s3-to-gcs bucket-config [-dry-run] <S3 bucket> <GCS bucket>")
+	}
+
+	buckets, _ := parseBucketArgs(flags.Args(), "s3", "gs")
+	s3Bucket, gcsBucket := buckets[0], buckets[1]
+
+	log.Printf("S3 bucket: %s", s3Bucket)
+	log.Printf("GCS bucket: %s", gcsBucket)
+	s3Opts.log()
+	gcsOpts.log()
+	if *dryRun {
+		log.Print("Dry run: the GCS bucket is not changed")
+	}
+
+	ctx := context.Background()
+	s3Client := newS3Client(s3Opts)
+	client := newGCSClient(ctx, gcsOpts)
+	defer client.Close()
+	gcsBucketHandle := gcsOpts.bucket(client, gcsBucket)
+
+	config := readBucketConfig(ctx, s3Client, s3Bucket)
+	current, err := gcsBucketHandle.Attrs(ctx)
+	if err != nil {
+		log.Fatal("Error getting GCS bucket " + gcsBucket + ": " + err.Error())
+	}
+	config.log(current)
+	if len(config.notMapped) > 0 {
+		log.Printf("Left out or approximated %d settings without a GCS equivalent, listed above", len(config.notMapped))
+	}
+	if *dryRun {
+		return
+	}
+
+	// The bucket is only updated as it was read, not over another change
+	update := config.update()
+	_, err = gcsBucketHandle.If(storage.BucketConditions{MetagenerationMatch: current.MetaGeneration}).Update(ctx, update)
+	if isPreconditionFailed(err) {
+		log.Fatal("GCS bucket " + gcsBucket + " changed while it was read, run again")
+	}
+	if err != nil {
+		log.Fatal("Error updating GCS bucket " + gcsBucket + ": " + err.Error())
+	}
+	log.Printf("Updated the configuration of GCS bucket %s", gcsBucket)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestTranslateLifecycle(t *testing.T) {
+	enabled := aws.String(s3.ExpirationStatusEnabled)
+	tests := []struct {
+		name      string
+		rules     []*s3.LifecycleRule
+		want      []storage.LifecycleRule
+		notMapped int
+	}{
+		{
+			name: "expiration and transition",
+			rules: []*s3.LifecycleRule{{
+				Status:      enabled,
+				Filter:      &s3.LifecycleRuleFilter{Prefix: aws.String("logs/")},
+				Expiration:  &s3.LifecycleExpiration{Days: aws.Int64(365)},
+				Transitions: []*s3.Transition{{Days: aws.Int64(30), StorageClass: aws.String(s3.TransitionStorageClassStandardIa)}},
+			}},
+			want: []storage.LifecycleRule{
+				{
+					Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+					Condition: storage.LifecycleCondition{MatchesPrefix: []string{"logs/"}, AgeInDays: 365, Liveness: storage.Live},
+				},
+				{
+					Action:    storage.LifecycleAction{Type: storage.SetStorageClassAction, StorageClass: "NEARLINE"},
+					Condition: storage.LifecycleCondition{MatchesPrefix: []string{"logs/"}, AgeInDays: 30, Liveness: storage.Live},
+				},
+			},
+		},
+		{
+			name: "transition on the first day",
+			rules: []*s3.LifecycleRule{{
+				Status:      enabled,
+				Prefix:      aws.String("cold/"),
+				Transitions: []*s3.Transition{{Days: aws.Int64(0), StorageClass: aws.String(s3.TransitionStorageClassDeepArchive)}},
+			}},
+			want: []storage.LifecycleRule{{
+				Action:    storage.LifecycleAction{Type: storage.SetStorageClassAction, StorageClass: "ARCHIVE"},
+				Condition: storage.LifecycleCondition{MatchesPrefix: []string{"cold/"}, AllObjects: true, Liveness: storage.Live},
+			}},
+		},
+		{
+			name: "noncurrent versions and incomplete uploads",
+			rules: []*s3.LifecycleRule{{
+				ID:     aws.String("versions"),
+				Status: enabled,
+				Filter: &s3.LifecycleRuleFilter{},
+				NoncurrentVersionExpiration: &s3.NoncurrentVersionExpiration{
+					NoncurrentDays:          aws.Int64(90),
+					NewerNoncurrentVersions: aws.Int64(2),
+				},
+				AbortIncompleteMultipartUpload: &s3.AbortIncompleteMultipartUpload{DaysAfterInitiation: aws.Int64(7)},
+			}},
+			want: []storage.LifecycleRule{
+				{
+					Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+					Condition: storage.LifecycleCondition{Liveness: storage.Archived, DaysSinceNoncurrentTime: 90, NumNewerVersions: 3},
+				},
+				{
+					Action:    storage.LifecycleAction{Type: storage.AbortIncompleteMPUAction},
+					Condition: storage.LifecycleCondition{AgeInDays: 7},
+				},
+			},
+		},
+		{
+			name: "rules left out",
+			rules: []*s3.LifecycleRule{
+				{Status: aws.String(s3.ExpirationStatusDisabled), Expiration: &s3.LifecycleExpiration{Days: aws.Int64(1)}},
+				{
+					Status:     enabled,
+					Filter:     &s3.LifecycleRuleFilter{Tag: &s3.Tag{Key: aws.String("temporary"), Value: aws.String("true")}},
+					Expiration: &s3.LifecycleExpiration{Days: aws.Int64(1)},
+				},
+				{
+					Status: enabled,
+					Filter: &s3.LifecycleRuleFilter{And: &s3.LifecycleRuleAndOperator{
+						Prefix:             aws.String("large/"),
+						ObjectSizeLessThan: aws.Int64(1024),
+					}},
+					Expiration: &s3.LifecycleExpiration{Days: aws.Int64(1)},
+				},
+				{
+					Status:      enabled,
+					Transitions: []*s3.Transition{{Days: aws.Int64(30), StorageClass: aws.String(s3.TransitionStorageClassIntelligentTiering)}},
+				},
+			},
+			notMapped: 4,
+		},
+		{name: "no rule"},
+	}
+	for _, test := range tests {
+		var config bucketConfig
+		config.translateLifecycle(test.rules)
+		// No rule translated leaves the rules of the GCS bucket as they are
+		if test.want == nil {
+			if config.lifecycle != nil {
+				t.Errorf("%s: lifecycle = %+v, want nil", test.name, config.lifecycle)
+			}
+		} else if config.lifecycle == nil || !reflect.DeepEqual(config.lifecycle.Rules, test.want) {
+			t.Errorf("%s: lifecycle = %+v, want rules %+v", test.name, config.lifecycle, test.want)
+		}
+		if len(config.notMapped) != test.notMapped {
+			t.Errorf("%s: %d settings not mapped, want %d: %q", test.name, len(config.notMapped), test.notMapped, config.notMapped)
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// bucketMapping is a line of a bucket map: the objects under s3Prefix in
+// s3Bucket are copied under gcsPrefix in gcsBucket.
+type bucketMapping struct {
+	s3Bucket  string
+	s3Prefix  string
+	gcsBucket string
+	gcsPrefix string
+}
+
+func (m bucketMapping) String() string {
+	return fmt.Sprintf("s3://%s/%s -> gs://%s/%s", m.s3Bucket, m.s3Prefix, m.gcsBucket, m.gcsPrefix)
+}
+
+// loadBucketMap reads a bucket map, one "s3://<bucket>/<prefix>
+// gs://<bucket>/<prefix>" mapping per line, prefixes being optional. Empty
+// lines and lines starting with # are ignored.
+func loadBucketMap(path string) ([]bucketMapping, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var mappings []bucketMapping
+	seen := make(map[bucketMapping]bool)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected s3://<bucket>/<prefix> gs://<bucket>/<prefix>", path, lineNumber)
+		}
+		source, err := parseLocation(fields[0])
+		if err != nil || source.scheme != "s3" {
+			return nil, fmt.Errorf("%s:%d: invalid source %q, expected s3://<bucket>/<prefix>", path, lineNumber, fields[0])
+		}
+		destination, err := parseLocation(fields[1])
+		if err != nil || destination.scheme != "gs" {
+			return nil, fmt.Errorf("%s:%d: invalid destination %q, expected gs://<bucket>/<prefix>", path, lineNumber, fields[1])
+		}
+		checkS3Bucket(source.bucket)
+		mapping := bucketMapping{s3Bucket: source.bucket, s3Prefix: source.prefix, gcsBucket: destination.bucket, gcsPrefix: destination.prefix}
+		if seen[mapping] {
+			return nil, fmt.Errorf("%s:%d: mapping %s given twice", path, lineNumber, mapping)
+		}
+		seen[mapping] = true
+		mappings = append(mappings, mapping)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(mappings) == 0 {
+		return nil, fmt.Errorf("%s: no mapping", path)
+	}
+	return mappings, nil
+}
+
+// options returns the copy options of the mapping: objects copied to
+// another prefix have the source prefix stripped and the destination one
+// added.
+func (m bucketMapping) options(options copyOptions) copyOptions {
+	if m.s3Prefix != m.gcsPrefix {
+		options.stripPrefix = m.s3Prefix
+		options.addPrefix = m.gcsPrefix
+	}
+	return options
+}
+
+// bucketMapRun copies the mappings of a bucket map. The copiers of all the
+// mappings share the copy slots, the bandwidth limit, the status board and
+// the output files of the first one.
+type bucketMapRun struct {
+	ctx            context.Context
+	stopCtx        context.Context
+	options        copyOptions
+	gcsOpts        gcsOptions
+	s3Client       *s3.S3
+	client         *storage.Client
+	compareWorkers int
+	maxPending     int
+	objectShard    shard
+	started        time.Time
+
+	mappings []bucketMapping
+	copiers  []*copier
+	stopped  atomic.Bool
+}
+
+// addCopier adds the copier of a mapping. Only the first one creates the
+// output files, the others record to them too.
+func (r *bucketMapRun) addCopier(m bucketMapping, versionEnabled bool) *copier {
+	options := m.options(r.options)
+	if len(r.copiers) == 0 {
+		c := newCopier(r.ctx, options, r.s3Client, m.s3Bucket, r.client, r.gcsOpts, m.gcsBucket, versionEnabled)
+		c.copyStartTime = r.started
+		r.mappings = append(r.mappings, m)
+		r.copiers = append(r.copiers, c)
+		return c
+	}
+
+	first := r.copiers[0]
+	withoutFiles := options
+	withoutFiles.transferManifest = ""
+	withoutFiles.aclReport = ""
+	withoutFiles.mismatchReport = ""
+	withoutFiles.quarantine = ""
+	c := newCopier(r.ctx, withoutFiles, r.s3Client, m.s3Bucket, r.client, r.gcsOpts, m.gcsBucket, versionEnabled)
+	c.options = options
+	c.copyStartTime = r.started
+	c.copySlots = first.copySlots
+	c.limiter = first.limiter
+	c.status = first.status
+	c.manifest = first.manifest
+	c.aclReport = first.aclReport
+	c.mismatchReport = first.mismatchReport
+	c.quarantine = first.quarantine
+	r.mappings = append(r.mappings, m)
+	r.copiers = append(r.copiers, c)
+	return c
+}
+
+// copyMapping copies the objects of a mapping like a run copying a single
+// bucket does.
+func (r *bucketMapRun) copyMapping(m bucketMapping, c *copier) {
+	log.Printf("Mapping %s – starting", m)
+	c.pending = newPendingQueue(r.maxPending)
+	stopReporting := c.reportStatsPeriodically()
+	r.compareMapping(m, c)
+
+	if r.options.deleteMarkers == deleteMarkersReplicate && r.stopCtx.Err() == nil && c.versionEnabled {
+		c.replicateDeleteMarkers(r.stopCtx, m.s3Prefix, &r.objectShard)
+	}
+	c.waitVerified()
+	stopReporting()
+
+	if r.stopCtx.Err() != nil {
+		r.stopped.Store(true)
+		log.Printf("Mapping %s – stopped before copying every object", m)
+	} else {
+		log.Printf("Mapping %s – done", m)
+	}
+	c.reportSummary()
+}
+
+// compareMapping lists the objects of a mapping and hands them to c, which
+// copies them, or adds them to its plan, until they are all copied.
+func (r *bucketMapRun) compareMapping(m bucketMapping, c *copier) {
+	type queuedObject struct {
+		s3Object *s3.Object
+		done     func()
+	}
+	compareQueue := make(chan queuedObject)
+	var objectsWg sync.WaitGroup
+	for i := 0; i < r.compareWorkers; i++ {
+		go func() {
+			for object := range compareQueue {
+				if r.stopCtx.Err() != nil {
+					object.done()
+					continue
+				}
+				s3Object := object.s3Object
+				c.copyObject(s3Object, func() {
+					c.markProcessed(1, *s3Object.Size)
+					object.done()
+				})
+			}
+		}()
+	}
+
+	list := r.objectShard.filter(bucketLister(r.ctx, r.s3Client, m.s3Bucket, m.s3Prefix))
+	err := c.pending.prefetch(list, func(page *s3.ListObjectsV2Output, lastPage bool, pageDone func()) bool {
+		var objectsLeft atomic.Int64
+		objectsLeft.Store(1)
+		objectDone := func() {
+			if objectsLeft.Add(-1) == 0 {
+				pageDone()
+			}
+		}
+		for _, s3Object := range page.Contents {
+			if r.stopCtx.Err() != nil {
+				break
+			}
+			if isFolderKey(*s3Object.Key) {
+				c.skipObject(s3Object, reasonFolderMarker, "Object %s – skipping, folder marker", *s3Object.Key)
+				continue
+			}
+			objectsLeft.Add(1)
+			objectsWg.Add(1)
+			compareQueue <- queuedObject{s3Object: s3Object, done: func() {
+				objectDone()
+				objectsWg.Done()
+			}}
+		}
+		objectDone()
+		return r.stopCtx.Err() == nil
+	})
+	if err != nil {
+		log.Fatalf("Error listing %s: %v", m, err)
+	}
+	close(compareQueue)
+	objectsWg.Wait()
+	c.wait()
+}
+
+// copyAll copies the mappings, up to parallel of them at once. Once stopped,
+// the mappings not started yet are left for the next run.
+func (r *bucketMapRun) copyAll(parallel int) {
+	semaphore := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, m := range r.mappings {
+		semaphore <- struct{}{}
+		if r.stopCtx.Err() != nil {
+			r.stopped.Store(true)
+			break
+		}
+		wg.Add(1)
+		go func(m bucketMapping, c *copier) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			r.copyMapping(m, c)
+		}(m, r.copiers[i])
+	}
+	wg.Wait()
+}
+
+// summary returns the combined summary of the mappings.
+func (r *bucketMapRun) summary(status string) runSummary {
+	total := runSummary{Status: status, Started: r.started}
+	for _, c := range r.copiers {
+		s := c.summary(status)
+		total.FilesCopied += s.FilesCopied
+		total.BytesCopied += s.BytesCopied
+		total.FilesUpToDate += s.FilesUpToDate
+		total.BytesUpToDate += s.BytesUpToDate
+		total.FilesSkipped += s.FilesSkipped
+		total.BytesRead += s.BytesRead
+	}
+	// The failures, mismatches and errors are counted for the whole run
+	total.Finished = time.Now()
+	total.ElapsedSeconds = total.Finished.Sub(r.started).Seconds()
+	if total.ElapsedSeconds > 0 {
+		total.BytesPerSecond = float64(total.BytesCopied) / total.ElapsedSeconds
+	}
+	runErrors.mutex.Lock()
+	total.FilesFailed = runErrors.failed
+	total.FilesMismatched = runErrors.mismatched
+	runErrors.mutex.Unlock()
+	total.TopErrors = topErrors(topErrorCount)
+	return total
+}
+
+// filesQuarantined returns the number of files quarantined by all the
+// mappings.
+func (r *bucketMapRun) filesQuarantined() int64 {
+	var files int64
+	for _, c := range r.copiers {
+		c.copyMutex.Lock()
+		files += c.filesQuarantined
+		c.copyMutex.Unlock()
+	}
+	return files
+}
+
+// runCopyBuckets copies every mapping of a bucket map in a single run, up to
+// -parallel-mappings of them at once, with one combined summary.
+func runCopyBuckets(args []string) {
+	flags := flag.NewFlagSet("copy-buckets", flag.ExitOnError)
+	var options copyOptions
+	addCopyFlags(flags, &options)
+	var s3Opts s3Options
+	addS3Flags(flags, &s3Opts)
+	var gcsOpts gcsOptions
+	addGCSFlags(flags, &gcsOpts)
+	addGCSKMSKeyFlag(flags, &gcsOpts)
+	var creation bucketCreation
+	addCreateBucketFlags(flags, &creation)
+	parallelMappings := flags.Int("parallel-mappings", 1, "Number of mappings copied at once, all sharing the concurrency and bandwidth limits")
+	compareWorkers := flags.Int("compare-workers", defaultCompareWorkers, "Number of objects of a mapping compared with GCS concurrently, ahead of the copies")
+	maxPending := flags.Int("max-pending", defaultMaxPending, "Maximum number of objects of a mapping listed ahead of the copies")
+	runTimeout := flags.Duration("run-timeout", 0, "Stop starting new copies after this long, e.g. 5h45m, letting the copies in progress complete (default: no limit)")
+	var objectShard shard
+	flags.Var(&objectShard, "shard", "Only copy the i-th of N disjoint sets of keys of every mapping, e.g. 2/4, to share the buckets between N instances")
+	skipPlacementCheck := flags.Bool("skip-placement-check", false, "Do not compare the regions of the buckets and of the runner before copying")
+	controlAddr := addControlFlags(flags)
+	yes := addConfirmFlags(flags)
+	summaryFile := addSummaryFlags(flags)
+	addLogFlags(flags)
+	addTracingFlags(flags)
+	flags.Parse(args)
+	setupLogging()
+	setupTracing()
+	defer shutdownTracing()
+
+	if len(flags.Args()) != 1 {
+		log.Fatal("Usage: ./s3-to-gcs copy-buckets [-parallel-mappings <n>] [-compare-workers <n>] [-max-pending <n>] [-run-timeout <duration>] [-shard <i>/<N>] [-skip-placement-check] [-control-addr <host:port>] [-summary-file <file>] [-create-bucket -create-bucket-project <project>] [-yes] [-trace] [copy flags] <bucket map>")
+	}
+
+	options.validate()
+	creation.validate(options.copyACLs)
+	if *parallelMappings < 1 {
+		log.Fatalf("Invalid -parallel-mappings value %d, must be at least 1", *parallelMappings)
+	}
+	if *compareWorkers < 1 {
+		log.Fatalf("Invalid -compare-workers value %d, must be at least 1", *compareWorkers)
+	}
+	if *maxPending < 1 {
+		log.Fatalf("Invalid -max-pending value %d, must be at least 1", *maxPending)
+	}
+	// The deletion list has no bucket, purge-source deletes from one
+	if options.deleteSource {
+		log.Fatal("-delete-source cannot be used with copy-buckets, run the buckets to delete from separately")
+	}
+
+	mappings, err := loadBucketMap(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	// A mapping to another prefix strips and adds the prefixes itself
+	for _, m := range mappings {
+		if m.s3Prefix != m.gcsPrefix && (options.stripPrefix != "" || options.addPrefix != "") {
+			log.Fatalf("Mapping %s maps a prefix to another, which cannot be used with -strip-prefix or -add-prefix", m)
+		}
+	}
+
+	log.Printf("Bucket map: %s, %d mappings", flags.Arg(0), len(mappings))
+	for _, m := range mappings {
+		log.Printf("Mapping: %s", m)
+	}
+	options.log()
+	creation.log()
+	s3Opts.log()
+	gcsOpts.log()
+	log.Printf("Parallel mappings: %d", *parallelMappings)
+	log.Printf("Compare workers: %d", *compareWorkers)
+	log.Printf("Max pending objects: %s", printer.Sprintf("%d", *maxPending))
+	if objectShard.count > 1 {
+		log.Printf("Shard: %s", objectShard.String())
+	}
+	if *runTimeout > 0 {
+		log.Printf("Run timeout: %s", *runTimeout)
+	}
+
+	ctx := context.Background()
+	stopCtx, stop := stopContext(ctx, *runTimeout)
+	defer stop()
+
+	client := newGCSClient(ctx, gcsOpts)
+	defer client.Close()
+
+	r := &bucketMapRun{
+		ctx:            ctx,
+		stopCtx:        stopCtx,
+		options:        options,
+		gcsOpts:        gcsOpts,
+		s3Client:       newS3Client(s3Opts),
+		client:         client,
+		compareWorkers: *compareWorkers,
+		maxPending:     *maxPending,
+		objectShard:    objectShard,
+		started:        time.Now(),
+	}
+	// Every mapping is checked before any is copied, and nothing is deleted
+	// before the run is confirmed. The mappings are compared first, as with
+	// -dry-run, to show how many objects -force deletes.
+	versionEnabled := make([]bool, len(mappings))
+	for i, m := range mappings {
+		versionEnabled[i] = s3VersioningEnabled(r.s3Client, m.s3Bucket, options.assumeVersioning)
+	}
+	if !*yes && options.force {
+		log.Print("Planning the run, to confirm what it deletes")
+		var deletions []string
+		planQuietly(func() {
+			for i, m := range mappings {
+				if stopCtx.Err() != nil {
+					return
+				}
+				planner := newPlanner(ctx, m.options(options), r.s3Client, m.s3Bucket, client, gcsOpts, m.gcsBucket, versionEnabled[i])
+				planner.pending = newPendingQueue(*maxPending)
+				r.compareMapping(m, planner)
+				deletions = append(deletions, options.deletions(m.s3Bucket, []string{"gs://" + m.gcsBucket + "/" + m.gcsPrefix}, planner.plan, versionEnabled[i])...)
+			}
+		})
+		if stopCtx.Err() != nil {
+			logStopReason(stopCtx, *runTimeout)
+			log.Fatal("Stopped before the run was planned, nothing was changed")
+		}
+		confirmDeletions(deletions, flags.Arg(0))
+	}
+	for i, m := range mappings {
+		creation.ensureBucket(ctx, r.s3Client, m.s3Bucket, m.gcsBucket, gcsOpts.bucket(client, m.gcsBucket), versionEnabled[i], options.copyACLs)
+		c := r.addCopier(m, versionEnabled[i])
+		// The regions of other S3 compatible services mean nothing to AWS or GCP
+		if !*skipPlacementCheck && s3Opts.endpoint == "" {
+			checkPlacement(ctx, r.s3Client, m.s3Bucket, m.gcsBucket, c.gcsBucketHandle)
+		}
+	}
+	first := r.copiers[0]
+	defer first.close()
+	failureSummary = func() {
+		summary := r.summary(runFailed)
+		summary.log()
+		summary.write(*summaryFile)
+	}
+	serveControl(*controlAddr, first)
+
+	r.copyAll(*parallelMappings)
+
+	status := runCompleted
+	if r.stopped.Load() {
+		logStopReason(stopCtx, *runTimeout)
+		log.Print("Stopped before copying every mapping, run again to copy the rest")
+		status = runStopped
+	}
+	summary := r.summary(status)
+	summary.log()
+	summary.write(*summaryFile)
+
+	// As with a single bucket, the run is incomplete
+	if status == runStopped || r.filesQuarantined() > 0 {
+		first.close()
+		shutdownTracing()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// errTransformed is the error of S3 responses that the HTTP client
+// decompressed.
+var errTransformed = errors.New("response body was decompressed by the HTTP client")
+
+// requireIdentityEncoding makes the requests of s3Client ask for the stored
+// bytes as they are. Without it, the Go HTTP client asks for gzip and
+// transparently decompresses objects stored with "Content-Encoding: gzip".
+func requireIdentityEncoding(s3Client *s3.S3) {
+	s3Client.Handlers.Build.PushBack(func(r *request.Request) {
+		r.HTTPRequest.Header.Set("Accept-Encoding", "identity")
+	})
+	s3Client.Handlers.ValidateResponse.PushBack(func(r *request.Request) {
+		if r.HTTPResponse != nil && r.HTTPResponse.Uncompressed {
+			r.Error = errTransformed
+		}
+	})
+}
+
+// withNoTransform adds the no-transform directive to a Cache-Control value,
+// so that neither GCS nor caches in front of it serve the object decompressed.
+func withNoTransform(cacheControl string) string {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-transform") {
+			return cacheControl
+		}
+	}
+	if cacheControl == "" {
+		return "no-transform"
+	}
+	return cacheControl + ", no-transform"
+}
+
+// multipartETagHash computes the ETag of an object uploaded in parts of
+// partSize bytes, the hex MD5 digest of the concatenated MD5 digests of the
+// parts followed by the number of parts.
+type multipartETagHash struct {
+	partSize int64
+	part     hash.Hash
+	partLen  int64
+	digests  []byte
+	parts    int
+}
+
+func newMultipartETagHash(partSize int64) *multipartETagHash {
+	return &multipartETagHash{partSize: partSize, part: md5.New()}
+}
+
+func (h *multipartETagHash) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		chunk := p
+		if remaining := h.partSize - h.partLen; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		h.part.Write(chunk)
+		h.partLen += int64(len(chunk))
+		p = p[len(chunk):]
+		if h.partLen == h.partSize {
+			h.endPart()
+		}
+	}
+	return n, nil
+}
+
+func (h *multipartETagHash) endPart() {
+	h.digests = h.part.Sum(h.digests)
+	h.parts++
+	h.part.Reset()
+	h.partLen = 0
+}
+
+func (h *multipartETagHash) etag() string {
+	if h.partLen > 0 {
+		h.endPart()
+	}
+	sum := md5.Sum(h.digests)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), h.parts)
+}
+
+// isMultipartETag reports whether etag is that of a multipart upload.
+func isMultipartETag(etag string) bool {
+	return strings.Contains(strings.Trim(etag, `"`), "-")
+}
+
+// byteExactCheck verifies, with -byte-exact, that the bytes copied are those
+// S3 stored, against a checksum S3 computed when the object was uploaded.
+type byteExactCheck struct {
+	contentLength int64
+	etag          string
+	md5           []byte
+	crc32c        uint32
+	hasCRC32C     bool
+
+	// Multipart uploads are checked against their ETag, computed again from
+	// the content with the size of their first part
+	multipart *multipartETagHash
+}
+
+// newByteExactCheck returns the check of the object of output, or an error
+// if S3 has no checksum the content can be verified with.
+func newByteExactCheck(ctx context.Context, s3Client *s3.S3, input *s3.GetObjectInput, output *s3.GetObjectOutput) (*byteExactCheck, error) {
+	check := &byteExactCheck{
+		contentLength: aws.Int64Value(output.ContentLength),
+		etag:          aws.StringValue(output.ETag),
+		md5:           s3ObjectMD5(output),
+	}
+	check.crc32c, check.hasCRC32C = s3ObjectCRC32C(output)
+
+	// Like their MD5 digests, the ETags of multipart uploads encrypted with
+	// SSE-KMS or SSE-C are not derived from the content
+	encrypted := output.SSECustomerAlgorithm != nil || aws.StringValue(output.ServerSideEncryption) == s3.ServerSideEncryptionAwsKms
+	if check.md5 == nil && !encrypted && isMultipartETag(check.etag) {
+		partOutput, err := s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket:     input.Bucket,
+			Key:        input.Key,
+			VersionId:  input.VersionId,
+			PartNumber: aws.Int64(1),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if partSize := aws.Int64Value(partOutput.ContentLength); partSize > 0 {
+			check.multipart = newMultipartETagHash(partSize)
+		}
+	}
+
+	if check.md5 == nil && !check.hasCRC32C && check.multipart == nil {
+		return nil, fmt.Errorf("cannot be verified byte for byte: its ETag %s is not derived from its content and S3 stored no CRC32C checksum of it", check.etag)
+	}
+	return check, nil
+}
+
+// reader returns body, feeding the multipart ETag computation as it is read.
+// A nil check returns body.
+func (check *byteExactCheck) reader(body io.Reader) io.Reader {
+	if check == nil || check.multipart == nil {
+		return body
+	}
+	return io.TeeReader(body, check.multipart)
+}
+
+// verify compares what was uploaded with the checksums of S3. A nil check
+// verifies nothing.
+func (check *byteExactCheck) verify(upload uploadResult) error {
+	if check == nil {
+		return nil
+	}
+	if upload.bytes != check.contentLength {
+		return fmt.Errorf("size mismatch:\n  S3 Content-Length: %d\n  Bytes copied: %d", check.contentLength, upload.bytes)
+	}
+	if check.md5 != nil && !bytes.Equal(check.md5, upload.md5) {
+		return fmt.Errorf("checksum mismatch:\n  S3 MD5: %s\n  Copied MD5: %s", hex.EncodeToString(check.md5), hex.EncodeToString(upload.md5))
+	}
+	if check.hasCRC32C && check.crc32c != upload.crc32c {
+		return fmt.Errorf("checksum mismatch:\n  S3 CRC32C: %s\n  Copied CRC32C: %s", encodeCRC32C(check.crc32c), encodeCRC32C(upload.crc32c))
+	}
+	if check.multipart != nil {
+		if etag := check.multipart.etag(); etag != strings.Trim(check.etag, `"`) {
+			return fmt.Errorf("ETag mismatch, assuming parts of %s:\n  S3 ETag: %s\n  Copied ETag: %s", formatBytes(check.multipart.partSize), check.etag, etag)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// errChaos is the error of the failures injected by the -chaos flags.
+var errChaos = errors.New("failure injected by -chaos-failure-rate")
+
+// chaosOptions control the failures and slowness injected into transfers, to
+// rehearse how a migration is operated when things go wrong, typically
+// against local directories.
+type chaosOptions struct {
+	// Probability of every Open, read stream and Write to fail
+	failureRate float64
+
+	// Every call waits for a random delay up to maxDelay
+	maxDelay time.Duration
+
+	// Bytes per second every object is read at, 0 for no limit
+	throttle int64
+}
+
+func addChaosFlags(flags *flag.FlagSet, options *chaosOptions) {
+	flags.Float64Var(&options.failureRate, "chaos-failure-rate", 0, "Rehearsal: fraction of object reads and writes that fail, e.g. 0.01")
+	flags.DurationVar(&options.maxDelay, "chaos-delay", 0, "Rehearsal: delay every call to the source and destination by a random duration up to this one, e.g. 500ms")
+	flags.Var((*bandwidth)(&options.throttle), "chaos-throttle", "Rehearsal: read every object at this rate, e.g. 1MiB/s")
+}
+
+// wrap returns src and dst with the chaos injected, unchanged if there is
+// none.
+func (o chaosOptions) wrap(src Source, dst Destination) (Source, Destination) {
+	if !o.enabled() {
+		return src, dst
+	}
+	return chaosSource{Source: src, options: o}, chaosDestination{Destination: dst, options: o}
+}
+
+func (o chaosOptions) enabled() bool {
+	return o.failureRate > 0 || o.maxDelay > 0 || o.throttle > 0
+}
+
+func (o chaosOptions) validate() {
+	if o.failureRate < 0 || o.failureRate > 1 {
+		log.Fatalf("Invalid -chaos-failure-rate value %g, must be between 0 and 1", o.failureRate)
+	}
+}
+
+func (o chaosOptions) log() {
+	if o.failureRate > 0 {
+		log.Printf("Chaos failure rate: %g", o.failureRate)
+	}
+	if o.maxDelay > 0 {
+		log.Printf("Chaos delay: up to %s", o.maxDelay)
+	}
+	if o.throttle > 0 {
+		log.Printf("Chaos throttle: %s/s per object", formatBytes(o.throttle))
+	}
+}
+
+// fail reports whether an injected failure should happen.
+func (o chaosOptions) fail() bool {
+	return o.failureRate > 0 && rand.Float64() < o.failureRate
+}
+
+// delay waits for a random duration up to maxDelay.
+func (o chaosOptions) delay(ctx context.Context) error {
+	if o.maxDelay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(o.maxDelay))))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// chaosSource injects failures and delays into a Source.
+type chaosSource struct {
+	Source
+	options chaosOptions
+}
+
+func (s chaosSource) List(ctx context.Context, prefix string, fn func(objectInfo) error) error {
+	if err := s.options.delay(ctx); err != nil {
+		return err
+	}
+	return s.Source.List(ctx, prefix, fn)
+}
+
+func (s chaosSource) Open(ctx context.Context, info objectInfo) (io.ReadCloser, error) {
+	if err := s.options.delay(ctx); err != nil {
+		return nil, err
+	}
+	if s.options.fail() {
+		return nil, errChaos
+	}
+	reader, err := s.Source.Open(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+
+	// Streams that fail do so after a random part of the object
+	var body io.Reader = reader
+	if s.options.fail() {
+		body = &failingReader{reader: reader, remaining: rand.Int63n(info.Size + 1)}
+	}
+	if s.options.throttle > 0 {
+		body = throttle(ctx, body, newBandwidthLimiter(s.options.throttle))
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{body, reader}, nil
+}
+
+// chaosDestination injects failures and delays into a Destination.
+type chaosDestination struct {
+	Destination
+	options chaosOptions
+}
+
+func (d chaosDestination) Stat(ctx context.Context, key string) (*objectInfo, error) {
+	if err := d.options.delay(ctx); err != nil {
+		return nil, err
+	}
+	return d.Destination.Stat(ctx, key)
+}
+
+func (d chaosDestination) Write(ctx context.Context, info objectInfo, body io.Reader) (string, error) {
+	if err := d.options.delay(ctx); err != nil {
+		return "", err
+	}
+	if d.options.fail() {
+		return "", errChaos
+	}
+	return d.Destination.Write(ctx, info, body)
+}
+
+// failingReader fails once remaining bytes have been read.
+type failingReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, errChaos
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.reader.Read(p)
+	r.remaining -= int64(n)
+	return n, err
+}
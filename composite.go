@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+)
+
+// Objects larger than -composite-threshold are uploaded as -composite-parts
+// temporary objects, "<name>.composite-00", "<name>.composite-01", ...,
+// written in parallel and composed into the object, then deleted.
+
+// compositeMaxParts is the most objects GCS composes in a request.
+const compositeMaxParts = 32
+
+func compositePartName(name string, part int) string {
+	return fmt.Sprintf("%s.composite-%02d", name, part)
+}
+
+// uploadComposite is like uploadToGCS, but uploads the size bytes of the
+// content as parts, read from the ranges fetch returns. Each part is checked
+// against what GCS stored as it is uploaded, and the CRC32C of the object,
+// combined from those of its parts, against the composed object. GCS keeps
+// no MD5 of composite objects, so the result has none. The parts are
+// deleted whether the upload succeeds or not. Only composing the object is
+// conditioned on conditions.
+func (c *copier) uploadComposite(ctx context.Context, gcsObject *storage.ObjectHandle, conditions *storage.Conditions, size int64, fetch func(ctx context.Context, offset, size int64) (io.ReadCloser, error), configure func(*storage.Writer)) (uploadResult, error) {
+	bucket := c.bucketHandles[gcsObject.BucketName()]
+	name := gcsObject.ObjectName()
+
+	// The attributes of the object, which only the composed object gets
+	var attrs storage.Writer
+	if configure != nil {
+		configure(&attrs)
+	}
+
+	partSize := (size + int64(c.options.compositeParts) - 1) / int64(c.options.compositeParts)
+	parts := make([]*storage.ObjectHandle, splitPartCount(size, partSize))
+	uploads := make([]uploadResult, len(parts))
+	defer func() {
+		for i, part := range parts {
+			if part == nil || uploads[i].generation == 0 {
+				continue
+			}
+			if err := part.Generation(uploads[i].generation).Delete(c.ctx); err != nil {
+				log.Printf("Error deleting part %s of object %s: %v", compositePartName(name, i), name, err)
+			}
+		}
+	}()
+
+	// The first part to fail stops the others
+	partsCtx, cancelParts := context.WithCancel(ctx)
+	defer cancelParts()
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	for i := range parts {
+		offset := int64(i) * partSize
+		length := partSize
+		if offset+length > size {
+			length = size - offset
+		}
+		parts[i] = bucket.Object(compositePartName(name, i)).Retryer(gcsRetryer, gcsRetryErrors, storage.WithPolicy(storage.RetryAlways))
+
+		wg.Add(1)
+		go func(i int, offset, length int64) {
+			defer wg.Done()
+			upload, err := c.uploadCompositePart(partsCtx, parts[i], offset, length, fetch, attrs.KMSKeyName)
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = fmt.Errorf("part %s: %w", compositePartName(name, i), err)
+					cancelParts()
+				})
+				return
+			}
+			uploads[i] = upload
+		}(i, offset, length)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return uploadResult{}, firstErr
+	}
+
+	result := uploadResult{}
+	sources := make([]*storage.ObjectHandle, len(parts))
+	for i, part := range parts {
+		result.bytes += uploads[i].bytes
+		result.crc32c = crc32cCombine(result.crc32c, uploads[i].crc32c, uploads[i].bytes)
+		sources[i] = part.Generation(uploads[i].generation)
+	}
+	if result.bytes != size {
+		return uploadResult{}, fmt.Errorf("expected %d bytes, got %d", size, result.bytes)
+	}
+
+	composeObject := gcsObject
+	if conditions != nil {
+		composeObject = gcsObject.If(*conditions)
+	}
+	composer := composeObject.ComposerFrom(sources...)
+	composer.ObjectAttrs = attrs.ObjectAttrs
+	composer.MD5 = nil
+	composer.SendCRC32C = attrs.SendCRC32C
+	composedAttrs, err := composer.Run(ctx)
+	if err != nil {
+		return uploadResult{}, err
+	}
+	result.generation = composedAttrs.Generation
+
+	// As with uploadToGCS, an object encrypted with another key or whose
+	// checksum is not that of its parts is deleted
+	if key := attrs.KMSKeyName; key != "" && !strings.HasPrefix(composedAttrs.KMSKeyName, key+"/") {
+		if err := gcsObject.Generation(composedAttrs.Generation).Delete(ctx); err != nil {
+			log.Printf("Error deleting object %s (generation %d) encrypted with the wrong key: %v", name, composedAttrs.Generation, err)
+		}
+		return uploadResult{}, fmt.Errorf("encryption key mismatch:\n  Requested KMS key: %s\n  GCS KMS key: %s", key, composedAttrs.KMSKeyName)
+	}
+	if composedAttrs.CRC32C != result.crc32c {
+		if err := gcsObject.Generation(composedAttrs.Generation).Delete(ctx); err != nil {
+			log.Printf("Error deleting corrupt object %s (generation %d): %v", name, composedAttrs.Generation, err)
+		}
+		return uploadResult{}, contentMismatch{fmt.Errorf("checksum mismatch:\n  Parts CRC32C: %s\n  GCS CRC32C: %s",
+			encodeCRC32C(result.crc32c), encodeCRC32C(composedAttrs.CRC32C))}
+	}
+	return result, nil
+}
+
+// uploadCompositePart uploads a part of a composite upload. Parts are
+// written in the Standard storage class, which has no minimum storage
+// duration to pay for when they are deleted.
+func (c *copier) uploadCompositePart(ctx context.Context, part *storage.ObjectHandle, offset, size int64, fetch func(ctx context.Context, offset, size int64) (io.ReadCloser, error), kmsKey string) (uploadResult, error) {
+	body, err := fetch(ctx, offset, size)
+	if err != nil {
+		return uploadResult{}, err
+	}
+	defer body.Close()
+	return uploadToGCS(ctx, part, nil, body, func(writer *storage.Writer) {
+		writer.KMSKeyName = kmsKey
+		writer.StorageClass = "STANDARD"
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// addConfirmFlags registers -yes, for the commands asking to confirm runs
+// that delete data.
+func addConfirmFlags(flags *flag.FlagSet) *bool {
+	return flags.Bool("yes", false, "Do not ask to confirm a run with -force, -delete-extra or -delete-source, which delete data, e.g. when run unattended")
+}
+
+// confirmDeletions shows what a run is about to delete and asks to type
+// expected to go on, exiting otherwise. A run deleting nothing is not
+// confirmed. Without a terminal to ask, the run must be confirmed with -yes
+// beforehand.
+func confirmDeletions(deletions []string, expected string) {
+	if len(deletions) == 0 {
+		return
+	}
+	for _, deletion := range deletions {
+		log.Printf("Deletes: %s", deletion)
+	}
+
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		log.Fatal("This run deletes data and there is no terminal to confirm it, run it with -dry-run to check what it deletes, then with -yes")
+	}
+	// The prompt is not logged, and the standard output is reserved for
+	// the plans of -dry-run
+	fmt.Fprintf(os.Stderr, "This run deletes data, run it with -dry-run first to see what for every key.\nType %s to go on: ", expected)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		log.Fatal("Run not confirmed, nothing was changed")
+	}
+	if strings.TrimSpace(answer) != expected {
+		log.Fatalf("Run not confirmed, %q is not %s, nothing was changed", strings.TrimSpace(answer), expected)
+	}
+	log.Print("Run confirmed")
+}
+
+// deletions describes what the copy options delete, to confirm, as counted
+// in the plan of the run. locations are the GCS locations copied to,
+// s3Bucket the bucket copied from.
+func (o copyOptions) deletions(s3Bucket string, locations []string, plan *dryRunPlan, versionEnabled bool) []string {
+	allVersions := ""
+	if versionEnabled {
+		allVersions = ", with all their versions,"
+	}
+	where := strings.Join(locations, ", ")
+	var deletions []string
+	if files, bytes := plan.total(planMismatch); o.force && files > 0 {
+		deletions = append(deletions, fmt.Sprintf("-force: %s objects (%s) in %s are deleted%s before they are copied again, even if identical",
+			printer.Sprintf("%d", files), formatBytes(bytes), where, allVersions))
+	}
+	if files, bytes := plan.total(planExtra); files > 0 {
+		deletions = append(deletions, fmt.Sprintf("-delete-extra: %s objects (%s) in %s not in S3 bucket %s are deleted%s",
+			printer.Sprintf("%d", files), formatBytes(bytes), where, s3Bucket, strings.TrimSuffix(allVersions, ",")))
+	}
+	if files, bytes := plan.total(planCopy, planMismatch); o.deleteSource && files > 0 {
+		deletions = append(deletions, fmt.Sprintf("-delete-source: %s objects (%s) copied from S3 bucket %s are recorded in %s, for purge-source to delete from S3",
+			printer.Sprintf("%d", files), formatBytes(bytes), s3Bucket, o.deletionList))
+	}
+	return deletions
+}
+
+// requireYes fails a run of command, driven by events and never asking to
+// confirm, that deletes data without -yes. deleteRemoved is -delete-removed.
+func (o copyOptions) requireYes(command string, yes bool, deleteRemoved bool) {
+	if yes {
+		return
+	}
+	var deleting []string
+	if o.force {
+		deleting = append(deleting, "-force")
+	}
+	if o.deleteSource {
+		deleting = append(deleting, "-delete-source")
+	}
+	if deleteRemoved {
+		deleting = append(deleting, "-delete-removed")
+	}
+	if len(deleting) > 0 {
+		log.Fatalf("%s with %s deletes data and never asks to confirm it, run it with -yes", command, strings.Join(deleting, " and "))
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCopyOptionsDeletions(t *testing.T) {
+	plan := newDryRunPlan(false)
+	plan.add(planCopy, "new.txt", 1024, "new")
+	plan.add(planMismatch, "changed.txt", 2048, "etag-changed")
+	plan.add(planSkip, "same.txt", 4096, "exists-identical")
+	plan.add(planExtra, "old.txt", 10, "not-in-s3")
+	plan.add(planExtra, "older.txt", 20, "not-in-s3")
+	locations := []string{"gs://gcs-bucket/a/", "gs://gcs-bucket/b/"}
+
+	tests := []struct {
+		name           string
+		options        copyOptions
+		plan           *dryRunPlan
+		versionEnabled bool
+		want           []string
+	}{
+		{
+			name:    "force",
+			options: copyOptions{force: true},
+			plan:    plan,
+			want: []string{
+				"-force: 1 objects (2.0 KiB) in gs://gcs-bucket/a/, gs://gcs-bucket/b/ are deleted before they are copied again, even if identical",
+				"-delete-extra: 2 objects (30 B) in gs://gcs-bucket/a/, gs://gcs-bucket/b/ not in S3 bucket s3-bucket are deleted",
+			},
+		},
+		{
+			name:           "versions",
+			options:        copyOptions{force: true},
+			plan:           plan,
+			versionEnabled: true,
+			want: []string{
+				"-force: 1 objects (2.0 KiB) in gs://gcs-bucket/a/, gs://gcs-bucket/b/ are deleted, with all their versions, before they are copied again, even if identical",
+				"-delete-extra: 2 objects (30 B) in gs://gcs-bucket/a/, gs://gcs-bucket/b/ not in S3 bucket s3-bucket are deleted, with all their versions",
+			},
+		},
+		{
+			name:    "delete source",
+			options: copyOptions{deleteSource: true, deletionList: "deletions.jsonl"},
+			plan:    plan,
+			want: []string{
+				"-delete-extra: 2 objects (30 B) in gs://gcs-bucket/a/, gs://gcs-bucket/b/ not in S3 bucket s3-bucket are deleted",
+				"-delete-source: 2 objects (3.0 KiB) copied from S3 bucket s3-bucket are recorded in deletions.jsonl, for purge-source to delete from S3",
+			},
+		},
+		// Nothing to delete is not confirmed
+		{name: "nothing", options: copyOptions{force: true, deleteSource: true}, plan: newDryRunPlan(false)},
+	}
+	for _, test := range tests {
+		got := test.options.deletions("s3-bucket", locations, test.plan, test.versionEnabled)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: deletions = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// copySlots limits the number of copies in progress, to a limit that can be
+// changed while copies are running.
+type copySlots struct {
+	mutex sync.Mutex
+	freed *sync.Cond
+	limit int
+	inUse int
+}
+
+func newCopySlots(limit int) *copySlots {
+	s := &copySlots{limit: limit}
+	s.freed = sync.NewCond(&s.mutex)
+	return s
+}
+
+// acquire waits for the circuit breaker to be closed and a slot to be free,
+// and takes it.
+func (s *copySlots) acquire() {
+	retryCircuit.wait()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for s.inUse >= s.limit {
+		s.freed.Wait()
+	}
+	s.inUse++
+}
+
+func (s *copySlots) release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.inUse--
+	s.freed.Signal()
+}
+
+// setLimit changes the number of slots. When it is lowered, the copies in
+// progress complete, and no new copy starts until fewer are running.
+func (s *copySlots) setLimit(limit int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.limit = limit
+	s.freed.Broadcast()
+}
+
+func (s *copySlots) getLimit() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.limit
+}
+
+// usage returns the number of slots in use and the limit.
+func (s *copySlots) usage() (inUse int, limit int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.inUse, s.limit
+}
+
+// addControlFlags registers the flag of the control endpoint.
+func addControlFlags(flags *flag.FlagSet) *string {
+	return flags.String("control-addr", "", "Listen on this address, e.g. 127.0.0.1:8090, for requests changing the concurrency and bandwidth limit at runtime, and the /statusz diagnostics page (default: disabled)")
+}
+
+// controlLimits is the response of the control endpoint.
+type controlLimits struct {
+	Concurrency int `json:"concurrency"`
+
+	// Bytes per second, 0 for no limit
+	BandwidthLimit int64 `json:"bandwidthLimit"`
+}
+
+// serveControl serves the /limits endpoint on addr, if not empty. GET returns
+// the current limits of c, PUT or POST change the limits given as the
+// concurrency and bandwidth-limit parameters. /statusz shows what the copies
+// are doing.
+func serveControl(addr string, c *copier) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/limits", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			// Both are checked before any is applied
+			concurrency := 0
+			if value := r.FormValue("concurrency"); value != "" {
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 1 {
+					http.Error(w, "invalid concurrency, must be at least 1", http.StatusBadRequest)
+					return
+				}
+				concurrency = n
+			}
+			var limit bandwidth = -1
+			if value := r.FormValue("bandwidth-limit"); value != "" {
+				if err := limit.Set(value); err != nil {
+					http.Error(w, "invalid bandwidth-limit: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+
+			if concurrency > 0 {
+				c.copySlots.setLimit(concurrency)
+				log.Printf("Concurrency changed to %d", concurrency)
+			}
+			if limit >= 0 {
+				c.setBandwidthLimit(int64(limit))
+				if limit == 0 {
+					log.Print("Bandwidth limit removed")
+				} else {
+					log.Printf("Bandwidth limit changed to %s", limit.String())
+				}
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(controlLimits{
+			Concurrency:    c.copySlots.getLimit(),
+			BandwidthLimit: c.bandwidthLimit(),
+		})
+	})
+
+	mux.HandleFunc("/statusz", func(w http.ResponseWriter, r *http.Request) {
+		serveStatus(w, r, c)
+	})
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Control endpoint: http://%s/limits, status page: http://%s/statusz", listener.Addr(), listener.Addr())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Fatal(err)
+		}
+	}()
+}
@@ -0,0 +1,1855 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+// copyOptions control how objects are copied.
+type copyOptions struct {
+	force         bool
+	onExists      string
+	onMismatch    string
+	compare       string
+	deleteSource  bool
+	deletionList  string
+	maxObjectSize int64
+	splitSize     int64
+
+	// mismatchReport is the file -on-mismatch report records the copies
+	// whose content does not match in
+	mismatchReport string
+
+	// quarantine is the file the objects whose copy failed are recorded in,
+	// instead of failing the run
+	quarantine string
+
+	// logSample samples the per-object lines logged for objects copied or
+	// skipped
+	logSample *logSampler
+
+	// bandwidthLimit caps the bytes per second read from S3 by all copies
+	bandwidthLimit int64
+
+	// Objects larger than parallelDownloadThreshold are downloaded with
+	// parallelDownloadRanges ranged GETs in flight
+	parallelDownloadThreshold int64
+	parallelDownloadRanges    int
+
+	// Objects larger than compositeThreshold are uploaded to GCS as
+	// compositeParts parts written in parallel and composed
+	compositeThreshold int64
+	compositeParts     int
+
+	// No new copy starts for circuitBreakerPause once circuitBreakerErrors
+	// requests were retried within circuitBreakerWindow
+	circuitBreakerErrors int
+	circuitBreakerWindow time.Duration
+	circuitBreakerPause  time.Duration
+
+	// assumeVersioning is on, off or auto, to check with GetBucketVersioning
+	assumeVersioning string
+
+	// skipIfExistsIn is a gs://bucket/prefix URI of another location whose
+	// objects are not copied again
+	skipIfExistsIn string
+
+	// modifyWindow is how far apart modification times may be and still
+	// count as equal with -compare size-mtime
+	modifyWindow time.Duration
+
+	// objectTimeout bounds the copy of an object, or of a part of a split
+	// object, 0 for no limit
+	objectTimeout time.Duration
+
+	// latestOnly copies only the current version of the objects of a
+	// versioned bucket
+	latestOnly bool
+
+	// deleteMarkers is what is done with objects deleted in S3 whose latest
+	// version is a delete marker: skip or replicate
+	deleteMarkers string
+
+	// tiers route objects to other buckets or storage classes by age
+	tiers tierRules
+
+	// storageClassMap maps the S3 storage classes of objects outside tiers
+	// with a storage class to GCS ones
+	storageClassMap storageClassMap
+
+	// copyACLs writes GCS objects with the predefined ACL equivalent to the
+	// ACL of their S3 object, reporting the ones without an equivalent in
+	// aclReport
+	copyACLs  bool
+	aclReport string
+
+	// copyTags copies the tags of S3 objects to GCS metadata entries named
+	// after them with tagPrefix prepended
+	copyTags  bool
+	tagPrefix string
+
+	// customTime sets the Custom-Time of GCS objects to the LastModified time
+	// of their S3 object
+	customTime bool
+
+	// recordParts records the part sizes of multipart uploads in the GCS
+	// metadata
+	recordParts bool
+
+	// gzip compresses and gunzip decompresses the content of the objects
+	// matching gzipExtensions or gzipContentTypes, or of every object
+	// without either
+	gzip             bool
+	gunzip           bool
+	gzipExtensions   []string
+	gzipContentTypes []string
+
+	// stripPrefix, renames, nameTemplate and addPrefix rewrite the S3 keys
+	// into the names of their GCS objects, in this order
+	stripPrefix  string
+	renames      renameRules
+	nameTemplate nameTemplate
+	addPrefix    string
+
+	// onCollision is what to do with keys rewritten into the GCS name of
+	// another key
+	onCollision string
+
+	// byteExact requires the bytes copied to be verified against a checksum
+	// S3 computed, with no decompression on the way
+	byteExact bool
+
+	// deepVerify reads every object copied back from GCS with
+	// verifyWorkers workers, independently of the copies
+	deepVerify    bool
+	verifyWorkers int
+
+	// transferManifest is the file every object processed is recorded in,
+	// as JSON lines or CSV
+	transferManifest       string
+	transferManifestFormat string
+}
+
+// addCopyFlags registers the flags controlling how objects are copied.
+func addCopyFlags(flags *flag.FlagSet, options *copyOptions) {
+	flags.BoolVar(&options.force, "force", false, "Force copying objects, skipping checksum comparison")
+	flags.StringVar(&options.onExists, "on-exists", onExistsOverwrite, "What to do with GCS objects that differ from their S3 object: overwrite, skip to keep them, overwrite-if-newer to only replace them with S3 objects modified since they were copied, or fail")
+	flags.StringVar(&options.compare, "compare", compareETag, "How to tell whether an existing GCS object is up to date: etag or size-mtime")
+	flags.DurationVar(&options.modifyWindow, "modify-window", 0, "With -compare size-mtime, treat modification times this far apart as equal, e.g. 2s")
+	flags.BoolVar(&options.deleteSource, "delete-source", false, "Record each S3 object version copied and verified in the deletion list, to be deleted by purge-source")
+	flags.StringVar(&options.deletionList, "deletion-list", defaultDeletionList, "File the S3 object versions to delete are appended to with -delete-source")
+	flags.Var((*byteSize)(&options.maxObjectSize), "max-object-size", "Skip objects larger than this size, e.g. 500GiB (default: no limit)")
+	flags.Var((*byteSize)(&options.splitSize), "split-size", "Store objects larger than this size as parts of this size plus a JSON manifest (default: never split)")
+	options.logSample = &logSampler{}
+	flags.StringVar(&options.onMismatch, "on-mismatch", onMismatchFail, "What to do with copies whose content does not match what was read from S3: fail the run, recopy to copy them again, or report to record them in -mismatch-report and go on")
+	flags.StringVar(&options.mismatchReport, "mismatch-report", "", "With -on-mismatch report, record the copies whose content does not match in this file as JSON lines")
+	flags.StringVar(&options.quarantine, "quarantine", "", "Record the objects whose copy failed, once their requests exhausted their retries, in this file as JSON lines, e.g. failed.jsonl, and go on copying the others instead of failing the run")
+	flags.Var(options.logSample, "log-sample", "Only log one in this many lines about objects copied or skipped, e.g. 1/1000 (errors and mismatches are always logged)")
+	flags.Var((*bandwidth)(&options.bandwidthLimit), "bandwidth-limit", "Limit the total transfer rate of all copies, e.g. 200MiB/s (default: no limit)")
+	flags.Var((*byteSize)(&options.parallelDownloadThreshold), "parallel-download-threshold", "Download objects larger than this size from S3 in 16 MiB ranges fetched in parallel (default: never)")
+	flags.IntVar(&options.parallelDownloadRanges, "parallel-download-ranges", 8, "Number of ranges of an object downloaded in parallel, see -parallel-download-threshold")
+	flags.Var((*byteSize)(&options.compositeThreshold), "composite-threshold", "Upload objects larger than this size to GCS as parts written in parallel and composed into the object, e.g. 10GiB (default: never)")
+	flags.IntVar(&options.compositeParts, "composite-parts", 8, "Number of parts objects are uploaded in, in parallel, see -composite-threshold (at most 32)")
+	flags.IntVar(&options.circuitBreakerErrors, "circuit-breaker-errors", 0, "Pause the start of new copies once this many S3 and GCS requests were retried within -circuit-breaker-window, e.g. 50 (default: never pause)")
+	flags.DurationVar(&options.circuitBreakerWindow, "circuit-breaker-window", time.Minute, "Time window the retried requests of -circuit-breaker-errors are counted in")
+	flags.DurationVar(&options.circuitBreakerPause, "circuit-breaker-pause", 2*time.Minute, "How long no new copy starts once the circuit breaker opened")
+	flags.StringVar(&options.assumeVersioning, "assume-versioning", assumeVersioningAuto, "Whether versioning is enabled on the S3 bucket: on, off or auto to ask S3 (needs s3:GetBucketVersioning)")
+	flags.StringVar(&options.skipIfExistsIn, "skip-if-exists-in", "", "Skip objects that already exist, with the same size, under this gs://bucket/prefix location")
+	flags.DurationVar(&options.objectTimeout, "object-timeout", 0, "Fail the copy of an object, or of a part of a split object, that takes longer than this, e.g. 2h, instead of waiting for a hung request forever (default: no limit)")
+	flags.BoolVar(&options.latestOnly, "latest-only", false, "Copy only the current version of the objects of a versioned S3 bucket, without their history")
+	flags.StringVar(&options.deleteMarkers, "delete-markers", deleteMarkersSkip, "What to do with objects whose latest S3 version is a delete marker: skip, or replicate to copy their versions and delete their live GCS generation")
+	flags.Var(&options.tiers, "tier", "Copy the objects last modified at least this long ago to another bucket or storage class, e.g. 365d=gs://cold-bucket,COLDLINE (can be repeated)")
+	flags.Var(&options.storageClassMap, "storage-class-map", "Write objects with the GCS storage class mapped from their S3 storage class, e.g. STANDARD_IA=NEARLINE,GLACIER=ARCHIVE, or default (can be repeated)")
+	flags.BoolVar(&options.copyACLs, "copy-acls", false, "Write GCS objects with the predefined ACL equivalent to the ACL of their S3 object, e.g. publicRead (needs s3:GetObjectAcl and fine-grained access control on the GCS bucket)")
+	flags.StringVar(&options.aclReport, "acl-report", "", "With -copy-acls, record the objects whose ACL has no GCS equivalent in this file as JSON lines")
+	flags.BoolVar(&options.copyTags, "copy-tags", false, "Copy the tags of S3 objects to GCS metadata entries, named after the tags with -tag-prefix prepended (needs s3:GetObjectTagging)")
+	flags.StringVar(&options.tagPrefix, "tag-prefix", defaultTagPrefix, "Prefix of the names of the GCS metadata entries holding S3 tags copied with -copy-tags")
+	flags.BoolVar(&options.customTime, "custom-time", false, "Set the Custom-Time of GCS objects, which lifecycle rules can act on, to the LastModified time of their S3 object")
+	flags.BoolVar(&options.recordParts, "record-parts", false, "Record the part count and part sizes of objects uploaded in parts in their GCS metadata (needs s3:GetObjectAttributes)")
+	flags.BoolVar(&options.gzip, "gzip", false, "Compress the content of objects without a Content-Encoding, and write them with Content-Encoding: gzip")
+	flags.BoolVar(&options.gunzip, "gunzip", false, "Decompress the content of objects with Content-Encoding: gzip, and write them without a Content-Encoding")
+	flags.Func("gzip-extensions", "With -gzip or -gunzip, only transcode objects with one of these comma separated extensions, e.g. .html,.css,.js, or of -gzip-content-types (default: every object)", func(value string) error {
+		options.gzipExtensions = parseList(value)
+		return nil
+	})
+	flags.Func("gzip-content-types", "With -gzip or -gunzip, only transcode objects with one of these comma separated content types, e.g. text/*,application/json, or of -gzip-extensions (default: every object)", func(value string) error {
+		options.gzipContentTypes = parseList(value)
+		return nil
+	})
+	flags.StringVar(&options.stripPrefix, "strip-prefix", "", "Remove this prefix from the keys starting with it to name their GCS objects, e.g. raw/")
+	flags.Var(&options.renames, "rename", "Rename GCS objects with a sed style substitution of their key, after -strip-prefix, e.g. 's#^raw/#landing/#' (can be repeated, applied in order)")
+	flags.Var(&options.nameTemplate, "name-template", "Name GCS objects after this template of their key and LastModified time, after -strip-prefix and -rename, e.g. {dir}/year={year}/month={month}/{base}")
+	flags.StringVar(&options.addPrefix, "add-prefix", "", "Prepend this prefix to the names of GCS objects, after -strip-prefix, -rename and -name-template, e.g. imported/")
+	flags.StringVar(&options.onCollision, "on-collision", collisionFail, "What to do with an S3 key that -strip-prefix, -rename, -name-template or -add-prefix rewrite into the GCS name of another key: fail, or skip to leave it uncopied")
+	flags.BoolVar(&options.byteExact, "byte-exact", false, "Fail any copy that cannot be verified byte for byte against a checksum from S3, and mark GCS objects no-transform")
+	flags.BoolVar(&options.deepVerify, "deep-verify", false, "Read every object copied back from GCS and compare its checksums with those of what was read from S3, without holding up the copies")
+	flags.IntVar(&options.verifyWorkers, "verify-workers", 4, "Number of objects read back concurrently with -deep-verify")
+	flags.StringVar(&options.transferManifest, "transfer-manifest", "", "File to record every object copied, already up to date or skipped in, with its size, version, ETag, CRC32C and duration")
+	flags.StringVar(&options.transferManifestFormat, "transfer-manifest-format", manifestFormatJSON, "Format of the transfer manifest: json for JSON lines, or csv")
+}
+
+func (o *copyOptions) validate() {
+	if o.compare != compareETag && o.compare != compareSizeMtime {
+		log.Fatalf("Invalid -compare value %q, must be %s or %s", o.compare, compareETag, compareSizeMtime)
+	}
+	switch o.onExists {
+	case onExistsOverwrite, onExistsSkip, onExistsOverwriteIfNewer, onExistsFail:
+	default:
+		log.Fatalf("Invalid -on-exists value %q, must be %s, %s, %s or %s", o.onExists, onExistsOverwrite, onExistsSkip, onExistsOverwriteIfNewer, onExistsFail)
+	}
+	switch o.onMismatch {
+	case onMismatchFail, onMismatchRecopy, onMismatchReport:
+	default:
+		log.Fatalf("Invalid -on-mismatch value %q, must be %s, %s or %s", o.onMismatch, onMismatchFail, onMismatchRecopy, onMismatchReport)
+	}
+	if o.mismatchReport != "" && o.onMismatch != onMismatchReport {
+		log.Fatal("-mismatch-report requires -on-mismatch report")
+	}
+	// -force copies objects without a look at what is in GCS
+	if o.force && o.onExists != onExistsOverwrite {
+		log.Fatalf("-force cannot be used with -on-exists %s", o.onExists)
+	}
+	if o.modifyWindow < 0 {
+		log.Fatalf("Invalid -modify-window value %s, must not be negative", o.modifyWindow)
+	}
+	if o.objectTimeout < 0 {
+		log.Fatalf("Invalid -object-timeout value %s, must not be negative", o.objectTimeout)
+	}
+	if o.parallelDownloadRanges < 1 {
+		log.Fatalf("Invalid -parallel-download-ranges value %d, must be at least 1", o.parallelDownloadRanges)
+	}
+	if o.compositeParts < 2 || o.compositeParts > compositeMaxParts {
+		log.Fatalf("Invalid -composite-parts value %d, must be between 2 and %d", o.compositeParts, compositeMaxParts)
+	}
+	if o.circuitBreakerErrors < 0 {
+		log.Fatalf("Invalid -circuit-breaker-errors value %d, must not be negative", o.circuitBreakerErrors)
+	}
+	if o.circuitBreakerWindow <= 0 || o.circuitBreakerPause <= 0 {
+		log.Fatal("-circuit-breaker-window and -circuit-breaker-pause must be positive")
+	}
+	switch o.assumeVersioning {
+	case assumeVersioningOn, assumeVersioningOff, assumeVersioningAuto:
+	default:
+		log.Fatalf("Invalid -assume-versioning value %q, must be %s, %s or %s", o.assumeVersioning, assumeVersioningOn, assumeVersioningOff, assumeVersioningAuto)
+	}
+	if o.deleteMarkers != deleteMarkersSkip && o.deleteMarkers != deleteMarkersReplicate {
+		log.Fatalf("Invalid -delete-markers value %q, must be %s or %s", o.deleteMarkers, deleteMarkersSkip, deleteMarkersReplicate)
+	}
+	// Delete markers are part of the history
+	if o.latestOnly && o.deleteMarkers == deleteMarkersReplicate {
+		log.Fatal("-delete-markers replicate cannot be used with -latest-only")
+	}
+	if o.onCollision != collisionFail && o.onCollision != collisionSkip {
+		log.Fatalf("Invalid -on-collision value %q, must be %s or %s", o.onCollision, collisionFail, collisionSkip)
+	}
+	// purge-source verifies each version under its own key in GCS
+	if o.deleteSource && o.rewritesKeys() {
+		log.Fatal("-delete-source cannot be used with -strip-prefix, -rename, -name-template or -add-prefix")
+	}
+	// purge-source only verifies against the destination bucket
+	if o.deleteSource && o.tiers.routesToOtherBuckets() {
+		log.Fatal("-delete-source cannot be used with a -tier copying to another bucket")
+	}
+	// The objects of keys with only delete markers left have no
+	// LastModified time to find their name with
+	if o.nameTemplate.usesTime() && o.deleteMarkers == deleteMarkersReplicate {
+		log.Fatal("-delete-markers replicate cannot be used with a -name-template using the modification time")
+	}
+	if o.skipIfExistsIn != "" {
+		if _, _, err := parseGCSURI(o.skipIfExistsIn); err != nil {
+			log.Fatalf("Invalid -skip-if-exists-in value: %v", err)
+		}
+	}
+	if o.aclReport != "" && !o.copyACLs {
+		log.Fatal("-acl-report requires -copy-acls")
+	}
+	// Tags would be mistaken for user metadata
+	if o.copyTags && o.tagPrefix == "" {
+		log.Fatal("-tag-prefix cannot be empty with -copy-tags")
+	}
+	if o.gzip && o.gunzip {
+		log.Fatal("-gzip cannot be used with -gunzip")
+	}
+	if (len(o.gzipExtensions) > 0 || len(o.gzipContentTypes) > 0) && !o.gzip && !o.gunzip {
+		log.Fatal("-gzip-extensions and -gzip-content-types require -gzip or -gunzip")
+	}
+	// The bytes copied are not those S3 has checksums of
+	if o.byteExact && (o.gzip || o.gunzip) {
+		log.Fatal("-byte-exact cannot be used with -gzip or -gunzip")
+	}
+	// Parts are read as ranges, which S3 has no checksum of
+	if o.byteExact && o.splitSize > 0 {
+		log.Fatal("-byte-exact cannot be used with -split-size")
+	}
+	if o.byteExact && o.compositeThreshold > 0 {
+		log.Fatal("-byte-exact cannot be used with -composite-threshold")
+	}
+	// A transcoded content has another size, not known in advance
+	if o.compositeThreshold > 0 && (o.gzip || o.gunzip) {
+		log.Fatal("-composite-threshold cannot be used with -gzip or -gunzip")
+	}
+	if o.verifyWorkers < 1 {
+		log.Fatalf("Invalid -verify-workers value %d, must be at least 1", o.verifyWorkers)
+	}
+	if o.transferManifestFormat != manifestFormatJSON && o.transferManifestFormat != manifestFormatCSV {
+		log.Fatalf("Invalid -transfer-manifest-format value %q, must be %s or %s", o.transferManifestFormat, manifestFormatJSON, manifestFormatCSV)
+	}
+}
+
+func (o *copyOptions) log() {
+	log.Printf("Force copy: %t", o.force)
+	if o.onExists != onExistsOverwrite {
+		log.Printf("On exists: %s", o.onExists)
+	}
+	if o.onMismatch != onMismatchFail {
+		log.Printf("On mismatch: %s", o.onMismatch)
+	}
+	if o.mismatchReport != "" {
+		log.Printf("Mismatch report: %s", o.mismatchReport)
+	}
+	if o.quarantine != "" {
+		log.Printf("Quarantine file: %s", o.quarantine)
+	}
+	log.Printf("Compare: %s", o.compare)
+	if o.modifyWindow > 0 {
+		log.Printf("Modify window: %s", o.modifyWindow)
+	}
+	log.Printf("Delete source objects: %t", o.deleteSource)
+	if o.deleteSource {
+		log.Printf("Deletion list: %s", o.deletionList)
+	}
+	if o.maxObjectSize > 0 {
+		log.Printf("Maximum object size: %s", formatBytes(o.maxObjectSize))
+	}
+	if o.splitSize > 0 {
+		log.Printf("Split size: %s", formatBytes(o.splitSize))
+	}
+	if o.logSample.every > 1 {
+		log.Printf("Log sample: %s", o.logSample)
+	}
+	if o.bandwidthLimit > 0 {
+		log.Printf("Bandwidth limit: %s/s", formatBytes(o.bandwidthLimit))
+	}
+	if o.parallelDownloadThreshold > 0 {
+		log.Printf("Parallel downloads: objects larger than %s, %d ranges", formatBytes(o.parallelDownloadThreshold), o.parallelDownloadRanges)
+	}
+	if o.compositeThreshold > 0 {
+		log.Printf("Composite uploads: objects larger than %s, %d parts", formatBytes(o.compositeThreshold), o.compositeParts)
+	}
+	if o.circuitBreakerErrors > 0 {
+		log.Printf("Circuit breaker: %d retried requests within %s, pausing for %s", o.circuitBreakerErrors, o.circuitBreakerWindow, o.circuitBreakerPause)
+	}
+	if o.skipIfExistsIn != "" {
+		log.Printf("Skip objects existing in: %s", o.skipIfExistsIn)
+	}
+	if o.objectTimeout > 0 {
+		log.Printf("Object timeout: %s", o.objectTimeout)
+	}
+	if o.latestOnly {
+		log.Print("Latest version only: true")
+	}
+	if o.deleteMarkers != deleteMarkersSkip {
+		log.Printf("Delete markers: %s", o.deleteMarkers)
+	}
+	for _, rule := range o.tiers {
+		log.Printf("Tier: objects older than %s", rule)
+	}
+	if len(o.storageClassMap) > 0 {
+		log.Printf("Storage class map: %s", &o.storageClassMap)
+	}
+	if o.copyACLs {
+		log.Print("Copy ACLs: true")
+	}
+	if o.aclReport != "" {
+		log.Printf("ACL report: %s", o.aclReport)
+	}
+	if o.copyTags {
+		log.Printf("Copy tags: true (prefix %q)", o.tagPrefix)
+	}
+	if o.customTime {
+		log.Print("Custom time: true")
+	}
+	if o.recordParts {
+		log.Print("Record parts: true")
+	}
+	if o.gzip || o.gunzip {
+		transcoding := transcodeGzip
+		if o.gunzip {
+			transcoding = transcodeGunzip
+		}
+		message := "Transcoding: " + transcoding
+		if len(o.gzipExtensions) > 0 {
+			message += ", extensions: " + strings.Join(o.gzipExtensions, ",")
+		}
+		if len(o.gzipContentTypes) > 0 {
+			message += ", content types: " + strings.Join(o.gzipContentTypes, ",")
+		}
+		log.Print(message)
+	}
+	if o.stripPrefix != "" {
+		log.Printf("Strip prefix: %s", o.stripPrefix)
+	}
+	for _, rule := range o.renames {
+		log.Printf("Rename: %s", rule.value)
+	}
+	if o.nameTemplate.value != "" {
+		log.Printf("Name template: %s", o.nameTemplate.value)
+	}
+	if o.addPrefix != "" {
+		log.Printf("Add prefix: %s", o.addPrefix)
+	}
+	if o.rewritesKeys() {
+		log.Printf("On collision: %s", o.onCollision)
+	}
+	if o.byteExact {
+		log.Print("Byte exact: true")
+	}
+	if o.deepVerify {
+		log.Printf("Deep verify: true (%d workers)", o.verifyWorkers)
+	}
+	if o.transferManifest != "" {
+		log.Printf("Transfer manifest: %s (%s)", o.transferManifest, o.transferManifestFormat)
+	}
+}
+
+// copier copies objects from an S3 bucket to a GCS bucket and keeps the
+// statistics of what it copied.
+type copier struct {
+	ctx             context.Context
+	options         copyOptions
+	s3Client        *s3.S3
+	s3Bucket        string
+	gcsBucket       string
+	gcsBucketHandle *storage.BucketHandle
+	versionEnabled  bool
+
+	// Cloud KMS key of -gcs-kms-key, "" for the default of the buckets
+	kmsKey string
+
+	// The destination bucket and the buckets of the -tier flags, by name
+	bucketHandles map[string]*storage.BucketHandle
+
+	// Location checked by -skip-if-exists-in
+	skipBucketHandle *storage.BucketHandle
+	skipPrefix       string
+
+	wg sync.WaitGroup
+
+	// Limits the number of concurrent copy operations
+	copySlots *copySlots
+
+	// What the copies are doing, for the status page
+	status *statusBoard
+
+	// Pages listed ahead of the copies, nil unless the bucket is listed
+	pending *pendingQueue
+
+	// The summary of the run is reported once, on its end or first failure
+	summaryOnce sync.Once
+
+	copyMutex              sync.Mutex
+	copyStartTime          time.Time
+	filesCopied            int64
+	totalBytesCopied       int64
+	bytesRead              atomic.Int64
+	filesTooLarge          int64
+	totalBytesTooLarge     int64
+	filesExistingElsewhere int64
+	filesKept              int64
+	filesArchived          int64
+	filesDeletedByMarker   int64
+	filesACLUnmapped       int64
+	filesRecopied          int64
+	filesMismatchReported  int64
+	filesQuarantined       int64
+	filesConflicted        int64
+	filesCollided          int64
+	filesTiered            map[string]int64
+	filesIdentical         int64
+	totalBytesIdentical    int64
+	sourceVersionsListed   int64
+	encryption             *encryptionKeys
+
+	// With -enumerate, the objects listed by the first pass and how many of
+	// them have been handled, copied or not
+	enumeratedFiles int64
+	enumeratedBytes int64
+	filesProcessed  int64
+	bytesProcessed  int64
+
+	// Shared by all copies to enforce -bandwidth-limit, with an infinite
+	// rate without a limit
+	limiter *rate.Limiter
+
+	// Versions copied with -delete-source are appended to the deletion list
+	deletionListFile    *os.File
+	deletionListEncoder *json.Encoder
+
+	// nil without -transfer-manifest
+	manifest *transferManifest
+
+	// nil without -acl-report
+	aclReport *aclReport
+
+	// nil without -mismatch-report
+	mismatchReport *mismatchReport
+
+	// The objects whose copy failed with -quarantine, nil without
+	quarantine *quarantine
+
+	// nil without -deep-verify
+	verifier *verifier
+
+	// With -list-gcs, the listing of gcsBucket the GCS objects are looked up
+	// in, nil to get each one
+	gcsListing *gcsListing
+
+	// With -dry-run, the plan objects are added to instead of being copied,
+	// nil to copy them
+	plan *dryRunPlan
+
+	// With keys rewritten, the S3 key of every GCS name compared in the run,
+	// in its bucket, to find keys rewritten into the same name. nil without
+	// keys rewritten.
+	namesMutex sync.Mutex
+	names      map[string]string
+}
+
+func newCopier(ctx context.Context, options copyOptions, s3Client *s3.S3, s3Bucket string, client *storage.Client, gcsOpts gcsOptions, gcsBucket string, versionEnabled bool) *copier {
+	c := &copier{
+		ctx:             ctx,
+		options:         options,
+		s3Client:        s3Client,
+		s3Bucket:        s3Bucket,
+		gcsBucket:       gcsBucket,
+		gcsBucketHandle: gcsOpts.bucket(client, gcsBucket),
+		versionEnabled:  versionEnabled,
+		kmsKey:          gcsOpts.kmsKey,
+		copySlots:       newCopySlots(defaultCopyConcurrency()),
+		status:          newStatusBoard(),
+		copyStartTime:   time.Now(),
+		encryption:      newEncryptionKeys(),
+		limiter:         newBandwidthLimiter(options.bandwidthLimit),
+		filesTiered:     make(map[string]int64),
+	}
+
+	// Without a limit, copies still share a limiter, so that one can be set
+	// at runtime
+	if c.limiter == nil {
+		c.limiter = rate.NewLimiter(rate.Inf, 0)
+	}
+
+	retryCircuit.configure(options.circuitBreakerErrors, options.circuitBreakerWindow, options.circuitBreakerPause)
+
+	if options.deleteSource {
+		deletionListFile, err := os.OpenFile(options.deletionList, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.deletionListFile = deletionListFile
+		c.deletionListEncoder = json.NewEncoder(deletionListFile)
+	}
+
+	if options.transferManifest != "" {
+		c.manifest = createTransferManifest(options.transferManifest, options.transferManifestFormat)
+	}
+
+	if options.aclReport != "" {
+		c.aclReport = createACLReport(options.aclReport)
+	}
+
+	if options.mismatchReport != "" {
+		c.mismatchReport = createMismatchReport(options.mismatchReport)
+	}
+
+	if options.quarantine != "" {
+		c.quarantine = createQuarantine(options.quarantine)
+	}
+
+	if options.rewritesKeys() {
+		c.names = make(map[string]string)
+	}
+
+	if options.deepVerify {
+		c.verifier = newVerifier(ctx, options.verifyWorkers, c.status)
+	}
+
+	c.bucketHandles = map[string]*storage.BucketHandle{gcsBucket: c.gcsBucketHandle}
+	for _, rule := range options.tiers {
+		if _, ok := c.bucketHandles[rule.bucket]; !ok && rule.bucket != "" {
+			c.bucketHandles[rule.bucket] = gcsOpts.bucket(client, rule.bucket)
+		}
+	}
+
+	if options.skipIfExistsIn != "" {
+		skipBucket, skipPrefix, _ := parseGCSURI(options.skipIfExistsIn)
+		c.skipBucketHandle = gcsOpts.bucket(client, skipBucket)
+		c.skipPrefix = skipPrefix
+	}
+
+	return c
+}
+
+// defaultCopyConcurrency is the number of objects copied concurrently.
+func defaultCopyConcurrency() int {
+	numCores := runtime.NumCPU()
+	bufferSize := numCores / 2
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+	return bufferSize
+}
+
+// logCopyStats logs the throughput of a copy. totalBytesCopied only counts
+// objects that were completely copied and verified, while bytesRead counts
+// everything read from the source, including objects still being copied.
+func logCopyStats(filesCopied, totalBytesCopied, bytesRead int64, copyStartTime time.Time) {
+	copyDuration := time.Since(copyStartTime)
+	mbPerSec := float64(totalBytesCopied) / copyDuration.Seconds() / (1024 * 1024)
+	readMBPerSec := float64(bytesRead) / copyDuration.Seconds() / (1024 * 1024)
+	formattedBytes := formatBytes(totalBytesCopied)
+	formattedFiles := printer.Sprintf("%d", filesCopied)
+	formattedDuration := formatDuration(copyDuration)
+	log.Printf("Copied %s files, total size: %s, time taken: %s, MB/sec: %.2f (read: %s, MB/sec: %.2f)",
+		formattedFiles, formattedBytes, formattedDuration, mbPerSec, formatBytes(bytesRead), readMBPerSec)
+}
+
+// logIdenticalStats logs the rate objects that were already up to date have
+// been checked at, so that runs copying little still show their progress.
+func logIdenticalStats(filesIdentical, totalBytesIdentical int64, copyStartTime time.Time) {
+	if filesIdentical == 0 {
+		return
+	}
+	copyDuration := time.Since(copyStartTime)
+	filesPerSec := float64(filesIdentical) / copyDuration.Seconds()
+	mbPerSec := float64(totalBytesIdentical) / copyDuration.Seconds() / (1024 * 1024)
+	log.Printf("Up to date %s files, total size: %s, files/sec: %.2f, MB/sec: %.2f",
+		printer.Sprintf("%d", filesIdentical), formatBytes(totalBytesIdentical), filesPerSec, mbPerSec)
+}
+
+// reportStatsPeriodically calls reportStats every 5 seconds until the
+// returned function is called, unless -quiet is set.
+func reportStatsPeriodically(reportStats func()) (stop func()) {
+	if quietLogging {
+		return func() {}
+	}
+
+	ticker := time.NewTicker(5 * time.Second)
+	quit := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				reportStats()
+			case <-quit:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() { close(quit) }
+}
+
+func (c *copier) reportStats() {
+	c.copyMutex.Lock()
+	defer c.copyMutex.Unlock()
+	logCopyStats(c.filesCopied, c.totalBytesCopied, c.bytesRead.Load(), c.copyStartTime)
+	logIdenticalStats(c.filesIdentical, c.totalBytesIdentical, c.copyStartTime)
+	c.verifier.logStats()
+	c.pending.logStats()
+	if c.enumeratedFiles > 0 {
+		logProgress(c.filesProcessed, c.bytesProcessed, c.enumeratedFiles, c.enumeratedBytes, c.copyStartTime)
+	}
+}
+
+// objectLister calls fn with every page of objects to copy until fn returns
+// false, like ListObjectsV2Pages.
+type objectLister func(fn func(page *s3.ListObjectsV2Output, lastPage bool) bool) error
+
+// bucketLister returns an objectLister listing the objects under prefix in
+// an S3 bucket.
+func bucketLister(ctx context.Context, s3Client *s3.S3, s3Bucket string, prefix string) objectLister {
+	return func(fn func(page *s3.ListObjectsV2Output, lastPage bool) bool) error {
+		input := &s3.ListObjectsV2Input{
+			Bucket: aws.String(s3Bucket),
+		}
+		if prefix != "" {
+			input.Prefix = aws.String(prefix)
+		}
+		return s3Client.ListObjectsV2PagesWithContext(ctx, input, fn)
+	}
+}
+
+// prefixesLister returns an objectLister listing the objects under each of
+// prefixes in turn, with the lister newLister returns for the prefix.
+func prefixesLister(prefixes []string, newLister func(prefix string) objectLister) objectLister {
+	if len(prefixes) == 1 {
+		return newLister(prefixes[0])
+	}
+	return func(fn func(page *s3.ListObjectsV2Output, lastPage bool) bool) error {
+		for i, prefix := range prefixes {
+			more := true
+			err := newLister(prefix)(func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+				more = fn(page, lastPage && i == len(prefixes)-1)
+				return more
+			})
+			if err != nil || !more {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// enumerate lists the objects under prefixes, so that the statistics include
+// the percentage of them handled so far and an estimate of the time left.
+// Objects are counted once, whatever their number of versions.
+func (c *copier) enumerate(prefixes []string, list objectLister) {
+	if len(prefixes) == 1 {
+		log.Printf("Enumerating objects under prefix %q", prefixes[0])
+	} else {
+		log.Printf("Enumerating objects under prefixes %q", prefixes)
+	}
+	var files, bytes int64
+	err := list(func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, s3Object := range page.Contents {
+			if !isFolderKey(*s3Object.Key) {
+				files++
+				bytes += *s3Object.Size
+			}
+		}
+		return true
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Enumerated %s files, total size: %s", printer.Sprintf("%d", files), formatBytes(bytes))
+
+	c.copyMutex.Lock()
+	c.enumeratedFiles = files
+	c.enumeratedBytes = bytes
+	c.copyStartTime = time.Now()
+	c.copyMutex.Unlock()
+}
+
+// markIdentical records an object that was already up to date in GCS.
+func (c *copier) markIdentical(size int64) {
+	c.copyMutex.Lock()
+	defer c.copyMutex.Unlock()
+	c.filesIdentical++
+	c.totalBytesIdentical += size
+}
+
+// markProcessed records that the given objects have been handled, whether
+// they were copied or not.
+func (c *copier) markProcessed(files, bytes int64) {
+	c.copyMutex.Lock()
+	defer c.copyMutex.Unlock()
+	c.filesProcessed += files
+	c.bytesProcessed += bytes
+}
+
+// logProgress logs a progress bar of the bytes handled out of the enumerated
+// total, with an estimate of the time left at the rate so far.
+func logProgress(filesProcessed, bytesProcessed, totalFiles, totalBytes int64, copyStartTime time.Time) {
+	fraction := 1.0
+	if totalBytes > 0 {
+		fraction = float64(bytesProcessed) / float64(totalBytes)
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+
+	const barWidth = 20
+	filled := int(fraction * barWidth)
+	bar := strings.Repeat("#", filled) + strings.Repeat(".", barWidth-filled)
+
+	eta := "unknown"
+	if fraction > 0 {
+		elapsed := time.Since(copyStartTime)
+		eta = formatDuration(time.Duration(float64(elapsed) * (1 - fraction) / fraction))
+	}
+
+	log.Printf("Progress: [%s] %.1f%%, %s of %s files, %s of %s, ETA: %s", bar, fraction*100,
+		printer.Sprintf("%d", filesProcessed), printer.Sprintf("%d", totalFiles),
+		formatBytes(bytesProcessed), formatBytes(totalBytes), eta)
+}
+
+func (c *copier) reportStatsPeriodically() (stop func()) {
+	return reportStatsPeriodically(c.reportStats)
+}
+
+// reportSummary logs the final statistics of the copy.
+func (c *copier) reportSummary() {
+	c.reportStats()
+
+	if c.options.deleteSource {
+		log.Printf("Recorded %s source object versions in deletion list %s, run purge-source to delete them",
+			printer.Sprintf("%d", c.sourceVersionsListed), c.options.deletionList)
+	}
+
+	c.encryption.log()
+
+	if c.filesExistingElsewhere > 0 {
+		log.Printf("Skipped %s files already in %s", printer.Sprintf("%d", c.filesExistingElsewhere), c.options.skipIfExistsIn)
+	}
+
+	if c.filesKept > 0 {
+		log.Printf("Kept %s GCS files that differ from their S3 file with -on-exists %s", printer.Sprintf("%d", c.filesKept), c.options.onExists)
+	}
+
+	if c.filesRecopied > 0 {
+		log.Printf("Copied %s files again whose copy did not match", printer.Sprintf("%d", c.filesRecopied))
+	}
+
+	if c.filesMismatchReported > 0 {
+		message := fmt.Sprintf("Left %s files whose copy did not match for the next run to copy again", printer.Sprintf("%d", c.filesMismatchReported))
+		if c.options.mismatchReport != "" {
+			message += ", recorded in " + c.options.mismatchReport
+		}
+		log.Print(message)
+	}
+
+	if c.filesConflicted > 0 {
+		log.Printf("Left %s files written to GCS by another writer during their copy, run again to compare them", printer.Sprintf("%d", c.filesConflicted))
+	}
+
+	if c.filesCollided > 0 {
+		log.Printf("Skipped %s files rewritten into the GCS name of another file", printer.Sprintf("%d", c.filesCollided))
+	}
+
+	if c.filesQuarantined > 0 {
+		log.Printf("Quarantined %s files whose copy failed in %s, copy them again with -retry-from %s",
+			printer.Sprintf("%d", c.filesQuarantined), c.options.quarantine, c.options.quarantine)
+	}
+
+	for _, rule := range c.options.tiers {
+		if files := c.filesTiered[rule.String()]; files > 0 {
+			log.Printf("Routed %s files to tier %s", printer.Sprintf("%d", files), rule)
+		}
+	}
+
+	if c.filesACLUnmapped > 0 {
+		log.Printf("Copied %s files whose ACL has no GCS equivalent with the default object ACL of the bucket", printer.Sprintf("%d", c.filesACLUnmapped))
+	}
+
+	if c.filesTooLarge > 0 {
+		log.Printf("Skipped %s files larger than %s, total size: %s",
+			printer.Sprintf("%d", c.filesTooLarge), formatBytes(c.options.maxObjectSize), formatBytes(c.totalBytesTooLarge))
+	}
+
+	if c.filesDeletedByMarker > 0 {
+		log.Printf("Deleted the live generation of %s files deleted in S3", printer.Sprintf("%d", c.filesDeletedByMarker))
+	}
+
+	if c.filesArchived > 0 {
+		log.Printf("Skipped %s archived file versions, restore them to copy them", printer.Sprintf("%d", c.filesArchived))
+	}
+}
+
+// setBandwidthLimit changes the total rate of all copies, including those in
+// progress. A limit of 0 removes the limit.
+func (c *copier) setBandwidthLimit(bytesPerSecond int64) {
+	limiter := newBandwidthLimiter(bytesPerSecond)
+	if limiter == nil {
+		c.limiter.SetLimit(rate.Inf)
+		return
+	}
+	c.limiter.SetBurst(limiter.Burst())
+	c.limiter.SetLimit(limiter.Limit())
+}
+
+// bandwidthLimit returns the current limit in bytes per second, 0 for none.
+func (c *copier) bandwidthLimit() int64 {
+	if c.limiter.Limit() == rate.Inf {
+		return 0
+	}
+	return int64(c.limiter.Limit())
+}
+
+// wait waits for all the copies that are in progress. Their verification
+// with -deep-verify may still be in progress; call waitVerified to wait for it.
+func (c *copier) wait() {
+	c.wg.Wait()
+}
+
+// waitVerified waits for the verification of the objects copied so far.
+func (c *copier) waitVerified() {
+	c.verifier.wait()
+}
+
+// recordSourceVersion adds a version of an S3 object that is safely stored
+// in GCS to the deletion list.
+func (c *copier) recordSourceVersion(awsKey string, awsVersion *string, etag string) {
+	c.copyMutex.Lock()
+	defer c.copyMutex.Unlock()
+
+	err := c.deletionListEncoder.Encode(deletionEntry{
+		Key:       awsKey,
+		VersionID: aws.StringValue(awsVersion),
+		ETag:      etag,
+	})
+	if err != nil {
+		log.Fatal("Error writing deletion list " + c.options.deletionList + ": " + err.Error())
+	}
+	c.sourceVersionsListed++
+}
+
+// close releases the resources held by the copier once it is done.
+func (c *copier) close() {
+	if c.deletionListFile != nil {
+		if err := c.deletionListFile.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	c.manifest.close()
+	c.aclReport.close()
+	c.mismatchReport.close()
+	c.quarantine.close()
+}
+
+// objectContext returns the context of the copy of an object, or of a part
+// of a split object, cancelled after -object-timeout if set.
+func (c *copier) objectContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.options.objectTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.options.objectTimeout)
+}
+
+// errObjectTimeout is the error of the copies that exceeded -object-timeout.
+var errObjectTimeout = errors.New("object timeout exceeded")
+
+// objectTimeoutError returns err, wrapped in errObjectTimeout if the copy it
+// ended failed for exceeding -object-timeout.
+func (c *copier) objectTimeoutError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w (%s): %w", errObjectTimeout, c.options.objectTimeout, err)
+	}
+	return err
+}
+
+// copyFileVersion copies an object version to gcsObject, whose live
+// generation is expected to be generation, 0 if there is none, and returns
+// its live generation once copied.
+func (c *copier) copyFileVersion(awsKey string, awsVersion string, size int64, gcsObject *storage.ObjectHandle, generation int64, storageClass string) int64 {
+	defer c.wg.Done()
+	defer c.copySlots.release() // Release the slot when the function exits
+
+	for attempt := 1; c.copyVersionAttempt(awsKey, awsVersion, size, gcsObject, &generation, storageClass, attempt); attempt++ {
+	}
+	return generation
+}
+
+// copyVersionAttempt copies an object version once, and reports whether to
+// copy it again, after a copy whose content does not match with
+// -on-mismatch recopy. attempt counts the copies of the version, from 1.
+// The upload is conditioned on the live generation of gcsObject being
+// generation, which is updated to the generation written, or to 0 once a
+// corrupt copy is deleted. A copy finding another generation is left.
+func (c *copier) copyVersionAttempt(awsKey string, awsVersion string, size int64, gcsObject *storage.ObjectHandle, generation *int64, storageClass string, attempt int) bool {
+	copyStartTime := time.Now()
+	copyCtx, cancelCopy := c.objectContext(c.ctx)
+	defer cancelCopy()
+	ctx, span := startObjectSpan(copyCtx, "copy object", awsKey, size)
+	span.SetAttributes(attribute.String("object.version", awsVersion))
+	defer span.End()
+	transfer := c.status.start(stageGetting, awsKey, awsVersion, size)
+	defer c.status.finish(transfer)
+
+	// The spans of a failed copy are ended before exiting, so they are
+	// exported. A copy quarantined is not copied again.
+	failFn := func(step trace.Span, err error, message string) bool {
+		err = c.objectTimeoutError(copyCtx, err)
+		endSpan(step, err)
+		endSpan(span, err)
+		c.failed(awsKey, awsVersion, size, err, message)
+		return false
+	}
+	mismatchFn := func(step trace.Span, err error, message string) bool {
+		endSpan(step, err)
+		endSpan(span, err)
+		*generation = 0
+		return c.mismatched(awsKey, awsVersion, attempt, err, message)
+	}
+
+	// Reading from S3 has its own context, so that a failed write to GCS
+	// stops the read
+	readCtx, cancelRead := context.WithCancel(copyCtx)
+	defer cancelRead()
+
+	// Without a version, the current version is copied
+	getObjectInput := &s3.GetObjectInput{
+		Bucket:       aws.String(c.s3Bucket),
+		Key:          aws.String(awsKey),
+		ChecksumMode: aws.String(s3.ChecksumModeEnabled),
+	}
+	if awsVersion != "" {
+		getObjectInput.VersionId = aws.String(awsVersion)
+	}
+	_, getSpan := tracer.Start(ctx, "S3 GetObject")
+	var s3ObjectOutput *s3.GetObjectOutput
+	var err error
+	// The parts of a composite upload are read as ranges of their own
+	composite := c.options.compositeThreshold > 0 && size > c.options.compositeThreshold
+	if composite {
+		getSpan.SetAttributes(attribute.Bool("gcs.composite", true))
+		s3ObjectOutput, err = headObjectOutput(readCtx, c.s3Client, getObjectInput)
+	} else if c.options.parallelDownloadThreshold > 0 && size > c.options.parallelDownloadThreshold {
+		getSpan.SetAttributes(attribute.Bool("s3.parallel_ranges", true))
+		s3ObjectOutput, err = getObjectInRanges(readCtx, c.s3Client, getObjectInput, c.options.parallelDownloadRanges)
+	} else {
+		s3ObjectOutput, err = c.s3Client.GetObjectWithContext(readCtx, getObjectInput)
+	}
+
+	// Objects of the archive storage classes cannot be read until they are
+	// restored, which may take hours, so they are left for another run
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeInvalidObjectState {
+		getSpan.End()
+		c.options.logSample.log(objectEvent{Key: awsKey, Action: actionSkip, Reason: reasonArchivedClass, Bytes: size,
+			Message: fmt.Sprintf("Object %s (version %s) – skipping, archived and not restored", awsKey, awsVersion)})
+		c.copyMutex.Lock()
+		c.filesArchived++
+		c.copyMutex.Unlock()
+		c.manifest.record(transferRecord{Key: awsKey, Size: size, VersionID: awsVersion, Action: actionSkip, Reason: reasonArchivedClass})
+		return false
+	}
+	if err != nil {
+		return failFn(getSpan, err, "Error getting object "+awsKey+" from bucket "+c.s3Bucket)
+	}
+	defer s3ObjectOutput.Body.Close()
+	// The other requests about the object are for the version read
+	if awsVersion == "" && s3ObjectOutput.VersionId != nil {
+		awsVersion = *s3ObjectOutput.VersionId
+		getObjectInput.VersionId = s3ObjectOutput.VersionId
+		span.SetAttributes(attribute.String("object.version", awsVersion))
+	}
+	var check *byteExactCheck
+	if c.options.byteExact {
+		if check, err = newByteExactCheck(readCtx, c.s3Client, getObjectInput, s3ObjectOutput); err != nil {
+			return failFn(getSpan, err, "Error copying object "+awsKey+" from bucket "+c.s3Bucket)
+		}
+	}
+	getSpan.End()
+	c.status.setStage(transfer, stageCopying)
+
+	c.encryption.add(s3ObjectOutput.ServerSideEncryption, s3ObjectOutput.SSEKMSKeyId, aws.Int64Value(s3ObjectOutput.ContentLength))
+
+	var predefinedACL string
+	if c.options.copyACLs {
+		predefinedACL = c.objectACL(ctx, awsKey, awsVersion)
+	}
+
+	// The content is read from S3 while it is written to GCS
+	writeCtx, writeSpan := tracer.Start(ctx, "GCS write")
+	var body io.Reader = transfer.reader(check.reader(&meteredReader{reader: s3ObjectOutput.Body, total: &c.bytesRead}))
+	transcoding := c.options.transcoding(awsKey, aws.StringValue(s3ObjectOutput.ContentType), aws.StringValue(s3ObjectOutput.ContentEncoding))
+	if transcoding != "" {
+		transcoded := transcodeReader(body, transcoding)
+		defer transcoded.Close()
+		body = transcoded
+	}
+	configure := func(gcsObjectWriter *storage.Writer) {
+		// Objects are served by GCS with the headers S3 served them with
+		gcsObjectWriter.ContentType = aws.StringValue(s3ObjectOutput.ContentType)
+		gcsObjectWriter.CacheControl = aws.StringValue(s3ObjectOutput.CacheControl)
+		gcsObjectWriter.ContentEncoding = transcodedEncoding(transcoding, aws.StringValue(s3ObjectOutput.ContentEncoding))
+		gcsObjectWriter.ContentDisposition = aws.StringValue(s3ObjectOutput.ContentDisposition)
+		gcsObjectWriter.ContentLanguage = aws.StringValue(s3ObjectOutput.ContentLanguage)
+		if c.options.byteExact {
+			gcsObjectWriter.CacheControl = withNoTransform(gcsObjectWriter.CacheControl)
+		}
+		gcsObjectWriter.PredefinedACL = predefinedACL
+		gcsObjectWriter.KMSKeyName = c.kmsKey
+		gcsObjectWriter.StorageClass = c.storageClass(storageClass, s3ObjectOutput.StorageClass)
+		gcsObjectWriter.CustomTime = c.customTime(s3ObjectOutput.LastModified)
+		// When S3 already knows the checksums of the content, hand them to
+		// GCS so that it rejects an upload that does not match.
+		if transcoding != "" {
+			return
+		}
+		if md5Sum := s3ObjectMD5(s3ObjectOutput); md5Sum != nil {
+			gcsObjectWriter.MD5 = md5Sum
+		}
+		if crc32cSum, ok := s3ObjectCRC32C(s3ObjectOutput); ok {
+			gcsObjectWriter.CRC32C = crc32cSum
+			gcsObjectWriter.SendCRC32C = true
+		}
+	}
+	var upload uploadResult
+	if composite {
+		fetch := func(ctx context.Context, offset, size int64) (io.ReadCloser, error) {
+			part, err := getObjectRange(ctx, c.s3Client, getObjectInput, s3ObjectOutput.ETag, offset, size)
+			if err != nil {
+				return nil, err
+			}
+			return struct {
+				io.Reader
+				io.Closer
+			}{throttle(readCtx, transfer.reader(&meteredReader{reader: part, total: &c.bytesRead}), c.limiter), part}, nil
+		}
+		upload, err = c.uploadComposite(writeCtx, gcsObject, writeConditions(*generation), aws.Int64Value(s3ObjectOutput.ContentLength), fetch, configure)
+	} else {
+		upload, err = uploadToGCS(writeCtx, gcsObject, writeConditions(*generation), throttle(readCtx, body, c.limiter), configure)
+	}
+	if isPreconditionFailed(err) {
+		cancelRead()
+		endSpan(writeSpan, err)
+		c.writeConflict(awsKey, awsVersion, size)
+		return false
+	}
+	if err != nil {
+		cancelRead()
+		message := uploadErrorMessage(err, "object "+awsKey+" from bucket "+c.s3Bucket, "object "+awsKey+" to bucket "+gcsObject.BucketName())
+		if isContentMismatch(err) {
+			return mismatchFn(writeSpan, err, message)
+		}
+		return failFn(writeSpan, err, message)
+	}
+	bytesCopied := upload.bytes
+	*generation = upload.generation
+
+	// Ranges downloaded in parallel were checksummed as they arrived, their
+	// combined checksum must be that of the object GCS stored
+	if ranged, ok := s3ObjectOutput.Body.(*parallelRangeReader); ok && transcoding == "" && ranged.checksum() != upload.crc32c {
+		if err := gcsObject.Generation(upload.generation).Delete(c.ctx); err != nil {
+			log.Printf("Error deleting corrupt object %s (generation %d): %v", awsKey, upload.generation, err)
+		}
+		return mismatchFn(writeSpan, fmt.Errorf("checksum mismatch:\n  Ranges CRC32C: %s\n  GCS CRC32C: %s",
+			encodeCRC32C(ranged.checksum()), encodeCRC32C(upload.crc32c)), "Error copying object "+awsKey+" from bucket "+c.s3Bucket)
+	}
+	if err := check.verify(upload); err != nil {
+		if err := gcsObject.Generation(upload.generation).Delete(c.ctx); err != nil {
+			log.Printf("Error deleting corrupt object %s (generation %d): %v", awsKey, upload.generation, err)
+		}
+		return mismatchFn(writeSpan, err, "Error copying object "+awsKey+" from bucket "+c.s3Bucket)
+	}
+	writeSpan.SetAttributes(attribute.Int64("object.bytes_copied", bytesCopied))
+	writeSpan.End()
+
+	c.copyMutex.Lock()
+	c.totalBytesCopied += bytesCopied
+	c.filesCopied++
+	c.copyMutex.Unlock()
+
+	// Copy metadata from S3 object to GCS object
+	gcsObjectAttrs := &storage.ObjectAttrsToUpdate{
+		Metadata: make(map[string]string),
+	}
+
+	for key, value := range s3ObjectOutput.Metadata {
+		if addUserMetadata(gcsObjectAttrs.Metadata, key, *value) {
+			log.Printf("Object %s – metadata entry %s has characters GCS metadata cannot hold, escaped, original value in %s", awsKey, key, metadataKeyOriginalPrefix+key)
+		}
+	}
+
+	// add ETag and content checksums to metadata
+	gcsObjectAttrs.Metadata[metadataKeyETag] = *s3ObjectOutput.ETag
+	gcsObjectAttrs.Metadata[metadataKeyCRC32C] = encodeCRC32C(upload.crc32c)
+	// Composite objects have no MD5
+	if upload.md5 != nil {
+		gcsObjectAttrs.Metadata[metadataKeyMD5] = base64.StdEncoding.EncodeToString(upload.md5)
+	}
+	if c.options.rewritesKeys() {
+		gcsObjectAttrs.Metadata[metadataKeySourceKey] = awsKey
+	}
+	if transcoding != "" {
+		gcsObjectAttrs.Metadata[metadataKeyTranscoded] = transcoding
+		gcsObjectAttrs.Metadata[metadataKeySourceSize] = strconv.FormatInt(aws.Int64Value(s3ObjectOutput.ContentLength), 10)
+	}
+	// Objects written before versioning was enabled have the null version
+	if awsVersion != "" && awsVersion != "null" {
+		gcsObjectAttrs.Metadata[metadataKeyVersionID] = awsVersion
+	}
+	if s3ObjectOutput.LastModified != nil {
+		gcsObjectAttrs.Metadata[metadataKeyLastModified] = s3ObjectOutput.LastModified.UTC().Format(time.RFC3339)
+		if c.options.customTime {
+			gcsObjectAttrs.Metadata[metadataKeyFileMtime] = strconv.FormatInt(s3ObjectOutput.LastModified.Unix(), 10)
+		}
+	}
+	// Parallel range downloads do not know the tag count
+	if c.options.copyTags && (s3ObjectOutput.TagCount == nil || *s3ObjectOutput.TagCount > 0) {
+		c.addTagMetadata(ctx, awsKey, awsVersion, gcsObjectAttrs.Metadata)
+	}
+	if c.options.recordParts && isMultipartETag(*s3ObjectOutput.ETag) {
+		c.addPartMetadata(ctx, awsKey, awsVersion, gcsObjectAttrs.Metadata)
+	}
+
+	c.status.setStage(transfer, stageUpdating)
+	updateCtx, updateSpan := tracer.Start(ctx, "GCS update metadata")
+	_, err = gcsObject.Generation(upload.generation).Update(updateCtx, *gcsObjectAttrs)
+	if err != nil {
+		return failFn(updateSpan, err, "Error updating object "+awsKey+" in bucket "+gcsObject.BucketName())
+	}
+	updateSpan.End()
+
+	c.logCopied(awsKey, bytesCopied, copyStartTime)
+	c.manifest.record(transferRecord{
+		Key:               awsKey,
+		Size:              bytesCopied,
+		VersionID:         awsVersion,
+		SourceETag:        *s3ObjectOutput.ETag,
+		DestinationCRC32C: encodeCRC32C(upload.crc32c),
+		Action:            actionCopied,
+		Duration:          time.Since(copyStartTime).Seconds(),
+	})
+
+	task := verifyTask{
+		key:        awsKey,
+		object:     gcsObject,
+		generation: upload.generation,
+		size:       bytesCopied,
+		crc32c:     upload.crc32c,
+		md5:        upload.md5,
+	}
+	// With -deep-verify, versions are only safely stored once read back
+	if c.options.deleteSource {
+		task.verified = func() {
+			c.recordSourceVersion(awsKey, aws.String(awsVersion), *s3ObjectOutput.ETag)
+		}
+	}
+	// Later generations may have been written by the time it is read back
+	task.mismatched = func(err error, message string) {
+		c.mismatched(awsKey, awsVersion, 0, err, message)
+	}
+	c.verifier.enqueue(task)
+	return false
+}
+
+// addTagMetadata adds the tags of an object version to metadata.
+func (c *copier) addTagMetadata(ctx context.Context, awsKey string, awsVersion string, metadata map[string]string) {
+	input := &s3.GetObjectTaggingInput{
+		Bucket: aws.String(c.s3Bucket),
+		Key:    aws.String(awsKey),
+	}
+	if awsVersion != "" {
+		input.VersionId = aws.String(awsVersion)
+	}
+	output, err := c.s3Client.GetObjectTaggingWithContext(ctx, input)
+	if err != nil {
+		fatalObject(awsKey, err, "Error getting the tags of object "+awsKey+" from bucket "+c.s3Bucket)
+	}
+	for _, tag := range output.TagSet {
+		metadata[c.options.tagPrefix+aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+}
+
+// addPartMetadata records the layout of the multipart upload of an object
+// version in metadata. Layouts too irregular to fit in the metadata only
+// have their part count recorded.
+func (c *copier) addPartMetadata(ctx context.Context, awsKey string, awsVersion string, metadata map[string]string) {
+	sizes, err := s3ObjectPartSizes(ctx, c.s3Client, c.s3Bucket, awsKey, awsVersion)
+	if err != nil {
+		fatalObject(awsKey, err, "Error getting the parts of object "+awsKey+" from bucket "+c.s3Bucket)
+	}
+	if len(sizes) == 0 {
+		return
+	}
+	metadata[metadataKeyPartCount] = strconv.Itoa(len(sizes))
+	if partSizes := formatPartSizes(sizes); len(partSizes) <= maxPartSizesLength {
+		metadata[metadataKeyPartSizes] = partSizes
+	} else {
+		log.Printf("Object %s – %d parts of irregular sizes, only recording their count", awsKey, len(sizes))
+	}
+}
+
+// listKeyVersions returns the versions and delete markers of key, from
+// every page of the version listing. The listing of the key as a prefix
+// also has its sibling keys, such as "foo.bak" for "foo", which are left out.
+func listKeyVersions(ctx context.Context, s3Client *s3.S3, s3Bucket string, key string) ([]*s3.ObjectVersion, []*s3.DeleteMarkerEntry, error) {
+	var versions []*s3.ObjectVersion
+	var markers []*s3.DeleteMarkerEntry
+	err := s3Client.ListObjectVersionsPagesWithContext(ctx, &s3.ListObjectVersionsInput{
+		Bucket: aws.String(s3Bucket),
+		Prefix: aws.String(key),
+	}, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		sibling := false
+		for _, version := range page.Versions {
+			if *version.Key == key {
+				versions = append(versions, version)
+			} else {
+				sibling = true
+			}
+		}
+		for _, marker := range page.DeleteMarkers {
+			if *marker.Key == key {
+				markers = append(markers, marker)
+			} else {
+				sibling = true
+			}
+		}
+		// Keys are listed in order, and key comes before the keys it is a
+		// prefix of, so its versions are all listed once a sibling is
+		return !sibling
+	})
+	return versions, markers, err
+}
+
+// copyFile copies the versions of an S3 object to gcsObject, whose live
+// generation was generation, 0 if there was none, when it was compared. A
+// single version is copied in the background, with done, if not nil, called
+// once it is copied; copyFile reports whether it is.
+func (c *copier) copyFile(s3Object *s3.Object, gcsObject *storage.ObjectHandle, generation int64, storageClass string, done func()) bool {
+	copyInBackground := func(awsVersion string) bool {
+		c.wg.Add(1)
+		c.copySlots.acquire()
+		go func() {
+			c.copyFileVersion(*s3Object.Key, awsVersion, *s3Object.Size, gcsObject, generation, storageClass)
+			if done != nil {
+				done()
+			}
+		}()
+		return true
+	}
+
+	// The current version is the only one of an unversioned bucket
+	if c.options.latestOnly || !c.versionEnabled {
+		return copyInBackground("")
+	}
+
+	versions, markers, err := listKeyVersions(c.ctx, c.s3Client, c.s3Bucket, *s3Object.Key)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Delete markers between versions delete the generation before them
+	if c.options.deleteMarkers != deleteMarkersReplicate {
+		markers = nil
+	}
+
+	if len(versions) == 1 && len(markers) == 0 {
+		return copyInBackground(*versions[0].VersionId)
+	}
+	log.Printf("%s – %d versions detected", *s3Object.Key, len(versions))
+	c.copyHistory(*s3Object.Key, objectHistory(versions, markers), gcsObject, generation, storageClass)
+	return false
+}
+
+// copySplitFile copies the current version of an S3 object as a set of part
+// objects, each fetched with a ranged GET, followed by its manifest, written
+// unless the manifest is no longer at manifestGeneration, 0 if there was
+// none.
+func (c *copier) copySplitFile(s3Object *s3.Object, gcsBucket string, manifestGeneration int64, storageClass string) {
+	gcsBucketHandle := c.bucketHandles[gcsBucket]
+	name := c.gcsName(s3Object)
+	partSize := c.options.splitSize
+	manifest := &splitManifest{
+		Key:      name,
+		Size:     *s3Object.Size,
+		ETag:     *s3Object.ETag,
+		PartSize: partSize,
+		Parts:    make([]splitPart, splitPartCount(*s3Object.Size, partSize)),
+	}
+	if c.options.rewritesKeys() {
+		manifest.SourceKey = *s3Object.Key
+	}
+
+	copyStartTime := time.Now()
+	ctx, span := startObjectSpan(c.ctx, "copy split object", *s3Object.Key, *s3Object.Size)
+	defer span.End()
+	// With -quarantine, the first part to fail quarantines the object, which
+	// is left without a manifest
+	var failed atomic.Bool
+	failFn := func(step trace.Span, err error, message string) {
+		endSpan(step, err)
+		if failed.CompareAndSwap(false, true) {
+			endSpan(span, err)
+			c.failed(*s3Object.Key, "", *s3Object.Size, err, message)
+		}
+	}
+
+	var versionID *string
+	var versionMutex sync.Mutex
+	tasks := make([]verifyTask, len(manifest.Parts))
+
+	// A part that does not match with -on-mismatch report leaves the object
+	// without a manifest, for the next run to copy again
+	var partReported atomic.Bool
+
+	// copyPart copies a part once, and reports whether to copy it again
+	copyPart := func(i int, offset, size int64, attempt int) bool {
+		partName := splitPartName(name, i)
+		copyCtx, cancelCopy := c.objectContext(ctx)
+		defer cancelCopy()
+		failPart := func(step trace.Span, err error, message string) {
+			failFn(step, c.objectTimeoutError(copyCtx, err), message)
+		}
+		partCtx, partSpan := tracer.Start(copyCtx, "copy part", trace.WithAttributes(
+			attribute.String("part.name", partName),
+			attribute.Int64("part.offset", offset),
+			attribute.Int64("part.size", size),
+		))
+		defer partSpan.End()
+		transfer := c.status.start(stageCopyPart, partName, "", size)
+		defer c.status.finish(transfer)
+
+		// IfMatch makes sure all the parts come from the same version
+		s3ObjectOutput, err := c.s3Client.GetObjectWithContext(partCtx, &s3.GetObjectInput{
+			Bucket:  aws.String(c.s3Bucket),
+			Key:     s3Object.Key,
+			Range:   aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+size-1)),
+			IfMatch: s3Object.ETag,
+		})
+		if err != nil {
+			failPart(partSpan, err, "Error getting part "+partName+" of object "+*s3Object.Key+" from bucket "+c.s3Bucket)
+			return false
+		}
+		defer s3ObjectOutput.Body.Close()
+
+		versionMutex.Lock()
+		versionID = s3ObjectOutput.VersionId
+		versionMutex.Unlock()
+
+		if i == 0 {
+			c.encryption.add(s3ObjectOutput.ServerSideEncryption, s3ObjectOutput.SSEKMSKeyId, *s3Object.Size)
+		}
+
+		partObject := gcsBucketHandle.Object(partName).Retryer(gcsRetryer, gcsRetryErrors, storage.WithPolicy(storage.RetryAlways))
+		body := transfer.reader(&meteredReader{reader: s3ObjectOutput.Body, total: &c.bytesRead})
+		upload, err := uploadToGCS(partCtx, partObject, nil, throttle(partCtx, body, c.limiter), func(gcsObjectWriter *storage.Writer) {
+			gcsObjectWriter.Metadata = map[string]string{metadataKeyETag: *s3Object.ETag}
+			gcsObjectWriter.KMSKeyName = c.kmsKey
+			gcsObjectWriter.StorageClass = c.storageClass(storageClass, s3ObjectOutput.StorageClass)
+			gcsObjectWriter.CustomTime = c.customTime(s3Object.LastModified)
+		})
+		if err != nil {
+			message := uploadErrorMessage(err, "part "+partName+" of object "+*s3Object.Key+" from bucket "+c.s3Bucket, "part "+partName+" of object "+*s3Object.Key+" to bucket "+gcsBucket)
+			if isContentMismatch(err) {
+				endSpan(partSpan, err)
+				if c.mismatched(*s3Object.Key, "", attempt, fmt.Errorf("part %s: %w", partName, err), message) {
+					return true
+				}
+				partReported.Store(true)
+				return false
+			}
+			failPart(partSpan, err, message)
+			return false
+		}
+		if upload.bytes != size {
+			failPart(partSpan, fmt.Errorf("expected %d bytes, got %d", size, upload.bytes), "Error copying part "+partName+" of object "+*s3Object.Key)
+			return false
+		}
+
+		manifest.Parts[i] = splitPart{
+			Name:   partName,
+			Offset: offset,
+			Size:   size,
+			CRC32C: encodeCRC32C(upload.crc32c),
+			MD5:    base64.StdEncoding.EncodeToString(upload.md5),
+		}
+		tasks[i] = verifyTask{
+			key:        partName,
+			object:     partObject,
+			generation: upload.generation,
+			size:       size,
+			crc32c:     upload.crc32c,
+			md5:        upload.md5,
+		}
+		return false
+	}
+
+	partsWg := sync.WaitGroup{}
+	for i := range manifest.Parts {
+		offset := int64(i) * partSize
+		size := partSize
+		if offset+size > *s3Object.Size {
+			size = *s3Object.Size - offset
+		}
+
+		partsWg.Add(1)
+		c.copySlots.acquire()
+		go func(i int, offset, size int64) {
+			defer partsWg.Done()
+			defer c.copySlots.release() // Release the slot when the function exits
+			for attempt := 1; copyPart(i, offset, size, attempt); attempt++ {
+			}
+		}(i, offset, size)
+	}
+	partsWg.Wait()
+	if partReported.Load() {
+		endSpan(span, errors.New("content mismatch"))
+		return
+	}
+	if failed.Load() {
+		return
+	}
+
+	manifest.VersionID = aws.StringValue(versionID)
+	err := writeSplitManifest(ctx, gcsBucketHandle, manifest, writeConditions(manifestGeneration), c.kmsKey, c.customTime(s3Object.LastModified))
+	if isPreconditionFailed(err) {
+		endSpan(span, err)
+		c.writeConflict(*s3Object.Key, manifest.VersionID, *s3Object.Size)
+		return
+	}
+	if err != nil {
+		failFn(span, err, "Error writing manifest of object "+*s3Object.Key+" to bucket "+gcsBucket)
+		return
+	}
+
+	c.copyMutex.Lock()
+	c.totalBytesCopied += *s3Object.Size
+	c.filesCopied++
+	c.copyMutex.Unlock()
+
+	c.logCopied(*s3Object.Key, *s3Object.Size, copyStartTime)
+
+	// The checksum of the whole object is combined from those of its parts
+	var crc uint32
+	for _, part := range manifest.Parts {
+		partCRC, _ := decodeCRC32C(part.CRC32C)
+		crc = crc32cCombine(crc, partCRC, part.Size)
+	}
+	c.manifest.record(transferRecord{
+		Key:               *s3Object.Key,
+		Size:              *s3Object.Size,
+		VersionID:         manifest.VersionID,
+		SourceETag:        *s3Object.ETag,
+		DestinationCRC32C: encodeCRC32C(crc),
+		Action:            actionCopied,
+		Duration:          time.Since(copyStartTime).Seconds(),
+	})
+
+	// Only the version that was copied is listed, older versions of a split
+	// object stay in S3. It is listed once all its parts are verified.
+	var partsLeft atomic.Int64
+	partsLeft.Store(int64(len(tasks)))
+	manifestObject := gcsBucketHandle.Object(splitManifestName(name))
+	for _, task := range tasks {
+		// Without its manifest, the object is copied again by the next run
+		partName := task.key
+		task.mismatched = func(err error, message string) {
+			c.mismatched(*s3Object.Key, manifest.VersionID, 0, fmt.Errorf("part %s: %w", partName, err), message)
+			if err := manifestObject.Delete(c.ctx); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+				log.Printf("Error deleting manifest of object %s: %v", *s3Object.Key, err)
+			}
+		}
+		if c.options.deleteSource {
+			task.verified = func() {
+				if partsLeft.Add(-1) == 0 {
+					c.recordSourceVersion(*s3Object.Key, versionID, *s3Object.ETag)
+				}
+			}
+		}
+		c.verifier.enqueue(task)
+	}
+}
+
+// recordObject records an object that was not copied in the transfer
+// manifest, for the given reason. destinationCRC32C is the checksum of the
+// GCS object, if known.
+func (c *copier) recordObject(s3Object *s3.Object, action string, reason string, destinationCRC32C string) {
+	if c.plan != nil {
+		c.plan.add(planSkip, *s3Object.Key, *s3Object.Size, reason)
+	}
+	c.manifest.record(transferRecord{
+		Key:               *s3Object.Key,
+		Size:              *s3Object.Size,
+		SourceETag:        aws.StringValue(s3Object.ETag),
+		DestinationCRC32C: destinationCRC32C,
+		Action:            action,
+		Reason:            reason,
+	})
+}
+
+// skipObject logs and records an S3 object that is not copied, for the
+// given reason.
+func (c *copier) skipObject(s3Object *s3.Object, reason string, format string, v ...any) {
+	c.options.logSample.log(objectEvent{
+		Key:     *s3Object.Key,
+		Action:  actionSkip,
+		Reason:  reason,
+		Bytes:   *s3Object.Size,
+		Message: fmt.Sprintf(format, v...),
+	})
+	c.recordObject(s3Object, actionSkip, reason, "")
+}
+
+// existsElsewhere reports whether the S3 object was already copied to the
+// -skip-if-exists-in location, possibly by another tool. Sizes must match,
+// and so must MD5 checksums when both sides have one.
+func (c *copier) existsElsewhere(s3Object *s3.Object) bool {
+	attrs, err := c.skipBucketHandle.Object(c.skipPrefix + *s3Object.Key).Attrs(c.ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return false
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if sourceSize(attrs) != *s3Object.Size {
+		return false
+	}
+	// The content of a transcoded object is not that of S3
+	if attrs.Metadata[metadataKeyTranscoded] != "" {
+		return attrs.Metadata[metadataKeyETag] == *s3Object.ETag
+	}
+	if md5Sum := s3ContentMD5(s3Object.ETag, nil, nil); md5Sum != nil && len(attrs.MD5) > 0 {
+		return bytes.Equal(md5Sum, attrs.MD5)
+	}
+	return true
+}
+
+// customTime returns the Custom-Time of the GCS object of an S3 object last
+// modified at lastModified, the zero time for none.
+func (c *copier) customTime(lastModified *time.Time) time.Time {
+	if !c.options.customTime || lastModified == nil {
+		return time.Time{}
+	}
+	return *lastModified
+}
+
+// logCopied logs a sampled line about an object whose copy has completed.
+func (c *copier) logCopied(key string, bytes int64, copyStartTime time.Time) {
+	duration := time.Since(copyStartTime)
+	c.options.logSample.log(objectEvent{
+		Key:      key,
+		Action:   actionCopied,
+		Bytes:    bytes,
+		Duration: duration.Seconds(),
+		Message:  fmt.Sprintf("Object %s – copied %s in %s", key, formatBytes(bytes), formatDuration(duration)),
+	})
+}
+
+// logObject logs a sampled line about an S3 object.
+func (c *copier) logObject(s3Object *s3.Object, action string, format string, v ...any) {
+	c.options.logSample.log(objectEvent{
+		Key:     *s3Object.Key,
+		Action:  action,
+		Bytes:   *s3Object.Size,
+		Message: fmt.Sprintf(format, v...),
+	})
+}
+
+// replaceExisting applies -on-exists to an S3 object whose GCS object exists
+// and differs, and reports whether to copy the S3 object over it. modTime
+// returns when the GCS object was last modified in S3, or written if that
+// is unknown. With overwrite-if-newer, an S3 object is only copied if it was
+// modified later, so a GCS object written since is not replaced.
+func (c *copier) replaceExisting(s3Object *s3.Object, modTime func() time.Time) bool {
+	switch c.options.onExists {
+	case onExistsSkip:
+		c.skipObject(s3Object, reasonExistsDifferent, "Object %s – skipping, differs from the existing GCS object", *s3Object.Key)
+	case onExistsOverwriteIfNewer:
+		gcsModTime := modTime()
+		// Modification times are recorded to the second
+		if s3Object.LastModified.Truncate(time.Second).After(gcsModTime.Add(c.options.modifyWindow)) {
+			return true
+		}
+		c.skipObject(s3Object, reasonGCSNewer, "Object %s – skipping, the GCS object is as recent (S3: %s, GCS: %s)", *s3Object.Key,
+			s3Object.LastModified.UTC().Format(time.RFC3339), gcsModTime.UTC().Format(time.RFC3339))
+	case onExistsFail:
+		fatalObject(*s3Object.Key, errors.New("differs from the existing GCS object"), "Error copying object "+*s3Object.Key+" with -on-exists fail")
+	default:
+		return true
+	}
+	c.copyMutex.Lock()
+	c.filesKept++
+	c.copyMutex.Unlock()
+	return false
+}
+
+// copyObject compares an S3 object with its GCS counterpart and copies it
+// when needed. Copies may still be in progress when it returns; call wait to
+// wait for them, or give done, called once the object is handled, nil for
+// none.
+func (c *copier) copyObject(s3Object *s3.Object, done func()) {
+	inBackground := false
+	defer func() {
+		if !inBackground && done != nil {
+			done()
+		}
+	}()
+	// With -dry-run, the objects to copy are only added to the plan, with
+	// whether they exist in GCS and what changed
+	var exists bool
+	var change string
+	copyFile := func(gcsObject *storage.ObjectHandle, generation int64, storageClass string) {
+		if c.plan != nil {
+			sign := planCopy
+			if exists {
+				sign = planMismatch
+			}
+			c.plan.add(sign, *s3Object.Key, *s3Object.Size, change)
+			return
+		}
+		inBackground = c.copyFile(s3Object, gcsObject, generation, storageClass, done)
+	}
+
+	c.status.listed(*s3Object.Key)
+	if c.options.maxObjectSize > 0 && *s3Object.Size > c.options.maxObjectSize {
+		c.skipObject(s3Object, reasonTooLarge, "Object %s – skipping, size %s exceeds maximum object size %s",
+			*s3Object.Key, formatBytes(*s3Object.Size), formatBytes(c.options.maxObjectSize))
+		c.copyMutex.Lock()
+		c.filesTooLarge++
+		c.totalBytesTooLarge += *s3Object.Size
+		c.copyMutex.Unlock()
+		return
+	}
+
+	if c.skipBucketHandle != nil && c.existsElsewhere(s3Object) {
+		c.skipObject(s3Object, reasonExistsIdentical, "Object %s – skipping, already in %s", *s3Object.Key, c.options.skipIfExistsIn)
+		c.copyMutex.Lock()
+		c.filesExistingElsewhere++
+		c.copyMutex.Unlock()
+		return
+	}
+
+	gcsBucket, storageClass := c.destination(s3Object)
+	gcsBucketHandle := c.bucketHandles[gcsBucket]
+	name := c.gcsName(s3Object)
+
+	if c.options.splitSize > 0 && *s3Object.Size > c.options.splitSize {
+		manifest, err := readSplitManifest(c.ctx, gcsBucketHandle, name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var sourceKey string
+		if manifest != nil {
+			sourceKey = manifest.SourceKey
+		}
+		if c.collides(s3Object, gcsBucket, name, sourceKey) {
+			return
+		}
+		if manifest != nil && manifest.ETag == *s3Object.ETag && manifest.PartSize == c.options.splitSize && !c.options.force {
+			c.logObject(s3Object, actionMatch, "Object %s match (ETag: %s, %d parts)", *s3Object.Key, *s3Object.ETag, len(manifest.Parts))
+			c.markIdentical(*s3Object.Size)
+			c.recordObject(s3Object, actionMatch, reasonExistsIdentical, "")
+			return
+		}
+		// The manifest is written last, once the parts are in place
+		manifestModTime := func() time.Time {
+			attrs, err := gcsBucketHandle.Object(splitManifestName(name)).Attrs(c.ctx)
+			if err != nil {
+				log.Fatal(err)
+			}
+			return attrs.Created
+		}
+		if manifest == nil || c.options.force || c.replaceExisting(s3Object, manifestModTime) {
+			c.logObject(s3Object, actionCopy, "Object %s – copying in %d parts", *s3Object.Key, splitPartCount(*s3Object.Size, c.options.splitSize))
+			if c.plan != nil {
+				sign, change := planCopy, "new"
+				if manifest != nil {
+					sign, change = planMismatch, reasonETagChanged+": "+manifest.ETag+" -> "+*s3Object.ETag
+				}
+				c.plan.add(sign, *s3Object.Key, *s3Object.Size, change)
+				return
+			}
+			var manifestGeneration int64
+			if manifest != nil {
+				manifestGeneration = manifest.generation
+			}
+			c.copySplitFile(s3Object, gcsBucket, manifestGeneration, storageClass)
+		}
+		return
+	}
+
+	gcsObject := gcsBucketHandle.Object(name).Retryer(gcsRetryer, gcsRetryErrors, storage.WithPolicy(storage.RetryAlways))
+
+	var gcsObjectAttrs *storage.ObjectAttrs
+	var err error
+	if c.gcsListing != nil && gcsBucket == c.gcsBucket {
+		gcsObjectAttrs, err = c.gcsListing.attrs(name)
+	} else {
+		gcsObjectAttrs, err = gcsObject.Attrs(c.ctx)
+	}
+
+	exists = err == nil
+	var sourceKey string
+	if exists {
+		sourceKey = gcsObjectAttrs.Metadata[metadataKeySourceKey]
+	}
+	if c.collides(s3Object, gcsBucket, name, sourceKey) {
+		return
+	}
+	if err != storage.ErrObjectNotExist && c.options.force && c.plan == nil {
+		if c.versionEnabled {
+			if err := deleteAllVersions(c.ctx, gcsBucketHandle, name); err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			err := gcsObject.Delete(c.ctx)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	// The object is replaced only if it is still the generation compared
+	var generation int64
+	if err == nil && !c.options.force {
+		generation = gcsObjectAttrs.Generation
+	}
+
+	if err == storage.ErrObjectNotExist || c.options.force {
+		c.logObject(s3Object, actionCopy, "Object %s – copying", *s3Object.Key)
+		change = "new"
+		if exists {
+			change = "forced"
+		}
+		copyFile(gcsObject, generation, storageClass)
+	} else if err != nil {
+		log.Fatal(err)
+	} else if c.options.compare == compareSizeMtime {
+		if *s3Object.Size != sourceSize(gcsObjectAttrs) || !modTimeMatches(*s3Object.LastModified, gcsObjectAttrs, c.options.modifyWindow) {
+			if c.replaceExisting(s3Object, func() time.Time { return gcsObjectModTime(gcsObjectAttrs) }) {
+				c.logObject(s3Object, actionCopy, "Object %s – size or modification time changed, copying", *s3Object.Key)
+				change = fmt.Sprintf("size-mtime-changed: %d %s -> %d %s", sourceSize(gcsObjectAttrs), gcsObjectModTime(gcsObjectAttrs).UTC().Format(time.RFC3339),
+					*s3Object.Size, s3Object.LastModified.UTC().Format(time.RFC3339))
+				copyFile(gcsObject, generation, storageClass)
+			}
+		} else {
+			c.logObject(s3Object, actionMatch, "Object %s match (size: %d, last modified: %s)", *s3Object.Key, *s3Object.Size, s3Object.LastModified.UTC().Format(time.RFC3339))
+			c.markIdentical(*s3Object.Size)
+			c.recordObject(s3Object, actionMatch, reasonExistsIdentical, encodeCRC32C(gcsObjectAttrs.CRC32C))
+		}
+	} else {
+		// get ETag from metadata
+		if gcsMetadataEtag, ok := gcsObjectAttrs.Metadata[metadataKeyETag]; ok {
+			if *s3Object.ETag != gcsMetadataEtag {
+				logObject(objectEvent{Key: *s3Object.Key, Action: actionMismatch, Reason: reasonETagChanged, Bytes: *s3Object.Size,
+					Message: fmt.Sprintf("Mismatch detected:\n  S3 object: %s\n  GCS object %s\n  S3 ETag: %s\n  GCS Metadata ETag: %s\n",
+						*s3Object.Key, gcsObjectAttrs.Name, *s3Object.ETag, gcsMetadataEtag)})
+				change = reasonETagChanged + ": " + gcsMetadataEtag + " -> " + *s3Object.ETag
+				if c.replaceExisting(s3Object, func() time.Time { return gcsObjectModTime(gcsObjectAttrs) }) {
+					copyFile(gcsObject, generation, storageClass)
+				}
+			} else {
+				c.logObject(s3Object, actionMatch, "Object %s match (ETag: %s)", *s3Object.Key, *s3Object.ETag)
+				c.markIdentical(*s3Object.Size)
+				c.recordObject(s3Object, actionMatch, reasonExistsIdentical, encodeCRC32C(gcsObjectAttrs.CRC32C))
+			}
+		} else {
+			logObject(objectEvent{Key: *s3Object.Key, Action: actionMismatch, Reason: reasonETagMissing, Bytes: *s3Object.Size,
+				Message: fmt.Sprintf("GCS Object: %s\n  ETag not found in GCS object metadata – object may be corrupt, forcing copy.", gcsObjectAttrs.Name)})
+			change = reasonETagMissing
+			if c.replaceExisting(s3Object, func() time.Time { return gcsObjectModTime(gcsObjectAttrs) }) {
+				copyFile(gcsObject, generation, storageClass)
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// TestCopyOptionsValidateRejects runs validate in a child process for each
+// combination of flags, since it exits the program on invalid ones.
+func TestCopyOptionsValidateRejects(t *testing.T) {
+	if args := os.Getenv("S3_TO_GCS_VALIDATE_ARGS"); args != "" {
+		flags := flag.NewFlagSet("test", flag.ExitOnError)
+		var options copyOptions
+		addCopyFlags(flags, &options)
+		flags.Parse(strings.Split(args, " "))
+		options.validate()
+		return
+	}
+
+	tests := []struct {
+		args string
+		want string
+	}{
+		{args: "-delete-source -name-template {year}/{key}", want: "-delete-source cannot be used with -strip-prefix, -rename, -name-template or -add-prefix"},
+		{args: "-delete-source -add-prefix imported/", want: "-delete-source cannot be used with -strip-prefix, -rename, -name-template or -add-prefix"},
+		{args: "-delete-source -tier 30d=NEARLINE -tier 365d=gs://cold-bucket", want: "-delete-source cannot be used with a -tier copying to another bucket"},
+	}
+	for _, test := range tests {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestCopyOptionsValidateRejects$")
+		cmd.Env = append(os.Environ(), "S3_TO_GCS_VALIDATE_ARGS="+test.args)
+		output, err := cmd.CombinedOutput()
+		if err == nil {
+			t.Errorf("%s: validate accepted the options, want %q", test.args, test.want)
+		} else if !strings.Contains(string(output), test.want) {
+			t.Errorf("%s: validate failed with %q, want %q", test.args, output, test.want)
+		}
+	}
+
+	// Without -delete-source, or with tiers staying in the destination
+	// bucket, the options are valid
+	for _, args := range []string{"-name-template {year}/{key}", "-delete-source -tier 30d=NEARLINE"} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestCopyOptionsValidateRejects$")
+		cmd.Env = append(os.Environ(), "S3_TO_GCS_VALIDATE_ARGS="+args)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("validate rejected %s: %s", args, output)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// runCopyObject copies a single object, with the same comparisons and
+// checks as the copy of a bucket. It is meant to be run by event driven
+// runtimes, such as a Lambda function or a Cloud Run function receiving S3
+// event notifications, which only need to tell it the key. The exit status
+// tells whether the object is safely in GCS.
+func runCopyObject(args []string) {
+	flags := flag.NewFlagSet("copy-object", flag.ExitOnError)
+	var options copyOptions
+	addCopyFlags(flags, &options)
+	var s3Opts s3Options
+	addS3Flags(flags, &s3Opts)
+	var gcsOpts gcsOptions
+	addGCSFlags(flags, &gcsOpts)
+	addGCSKMSKeyFlag(flags, &gcsOpts)
+	deleteRemovedFlag := flags.Bool("delete-removed", false, "Delete the GCS object if the S3 object no longer exists")
+	yes := addConfirmFlags(flags)
+	addLogFlags(flags)
+	addTracingFlags(flags)
+	flags.Parse(args)
+	setupLogging()
+	setupTracing()
+	defer shutdownTracing()
+
+	if len(flags.Args()) != 3 {
+		log.Fatal("Usage: ./s3-to-gcs copy-object [-delete-removed] [-yes] [-trace] [copy flags] <S3 bucket> <GCS bucket> <object key>")
+	}
+
+	options.validate()
+	options.requireYes("copy-object", *yes, *deleteRemovedFlag)
+	// Objects removed from S3 have no LastModified time to find their name
+	// with
+	if *deleteRemovedFlag && options.nameTemplate.usesTime() {
+		log.Fatal("-delete-removed cannot be used with a -name-template using the modification time")
+	}
+
+	buckets, prefix := parseBucketArgs(flags.Args()[:2], "s3", "gs")
+	if prefix != "" {
+		log.Fatal("The buckets of copy-object cannot have a prefix, the object key is given in full")
+	}
+	s3Bucket, gcsBucket := buckets[0], buckets[1]
+	key := flags.Arg(2)
+
+	log.Printf("S3 bucket: %s", s3Bucket)
+	log.Printf("GCS bucket: %s", gcsBucket)
+	log.Printf("Object key: %s", key)
+	options.log()
+	s3Opts.log()
+	gcsOpts.log()
+
+	s3Client := newS3Client(s3Opts)
+	versionEnabled := s3VersioningEnabled(s3Client, s3Bucket, options.assumeVersioning)
+
+	ctx := context.Background()
+	client := newGCSClient(ctx, gcsOpts)
+	defer client.Close()
+
+	c := newCopier(ctx, options, s3Client, s3Bucket, client, gcsOpts, gcsBucket, versionEnabled)
+	defer c.close()
+
+	// Like in watch mode, the current state of the object is copied, since
+	// the event that triggered the run may be late
+	headOutput, err := s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(key),
+	})
+	switch {
+	case err == nil:
+		c.copyObject(&s3.Object{
+			Key:          aws.String(key),
+			Size:         headOutput.ContentLength,
+			ETag:         headOutput.ETag,
+			LastModified: headOutput.LastModified,
+		}, nil)
+		c.wait()
+		c.waitVerified()
+	case !isS3NotFound(err):
+		log.Fatal("Error getting object " + key + " from bucket " + s3Bucket + ": " + err.Error())
+	case *deleteRemovedFlag:
+		logObject(objectEvent{Key: key, Action: actionDelete, Message: "Object " + key + " – not in S3, deleting"})
+		if err := c.deleteObject(ctx, key); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Printf("Object %s – not in S3, nothing to copy", key)
+	}
+
+	c.reportSummary()
+
+	// The object is quarantined, but it was not copied
+	if c.filesQuarantined > 0 {
+		shutdownTracing()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"google.golang.org/api/googleapi"
+)
+
+// bucketCreation is how -create-bucket creates the GCS bucket when it does
+// not exist yet. Its settings are derived from the S3 bucket unless given.
+type bucketCreation struct {
+	enabled bool
+
+	// Project the bucket is created in
+	project string
+
+	// Location of the bucket, "" for the GCP region closest to the region
+	// of the S3 bucket
+	location string
+
+	// Default storage class of the bucket, "" for STANDARD
+	storageClass string
+
+	// versioning is on, off or auto for that of the S3 bucket
+	versioning string
+
+	// uniformAccess is on, off or auto for on unless -copy-acls needs
+	// fine-grained access control
+	uniformAccess string
+}
+
+// addCreateBucketFlags registers the flags creating the GCS bucket.
+func addCreateBucketFlags(flags *flag.FlagSet, options *bucketCreation) {
+	flags.BoolVar(&options.enabled, "create-bucket", false, "Create the GCS bucket if it does not exist, with settings derived from the S3 bucket")
+	flags.StringVar(&options.project, "create-bucket-project", "", "Google Cloud project -create-bucket creates the bucket in")
+	flags.StringVar(&options.location, "create-bucket-location", "", "Location of the bucket -create-bucket creates, e.g. europe-west1 or EU (default: the GCP region closest to the region of the S3 bucket)")
+	flags.StringVar(&options.storageClass, "create-bucket-storage-class", "", "Default storage class of the bucket -create-bucket creates: STANDARD, NEARLINE, COLDLINE or ARCHIVE (default: STANDARD)")
+	flags.StringVar(&options.versioning, "create-bucket-versioning", assumeVersioningAuto, "Whether -create-bucket enables object versioning on the bucket: on, off or auto for the same as the S3 bucket")
+	flags.StringVar(&options.uniformAccess, "create-bucket-uniform-access", assumeVersioningAuto, "Whether -create-bucket enables uniform bucket-level access on the bucket: on, off or auto for on unless -copy-acls is given")
+}
+
+func (o *bucketCreation) validate(copyACLs bool) {
+	if !o.enabled {
+		if o.project != "" || o.location != "" || o.storageClass != "" || o.versioning != assumeVersioningAuto || o.uniformAccess != assumeVersioningAuto {
+			log.Fatal("-create-bucket-project, -create-bucket-location, -create-bucket-storage-class, -create-bucket-versioning and -create-bucket-uniform-access require -create-bucket")
+		}
+		return
+	}
+	if o.project == "" {
+		log.Fatal("-create-bucket requires -create-bucket-project")
+	}
+	if o.storageClass != "" {
+		if !isGCSStorageClass(o.storageClass) {
+			log.Fatalf("Invalid -create-bucket-storage-class value %q, must be one of %s", o.storageClass, strings.Join(gcsStorageClasses, ", "))
+		}
+		o.storageClass = strings.ToUpper(o.storageClass)
+	}
+	for name, value := range map[string]string{"-create-bucket-versioning": o.versioning, "-create-bucket-uniform-access": o.uniformAccess} {
+		switch value {
+		case assumeVersioningOn, assumeVersioningOff, assumeVersioningAuto:
+		default:
+			log.Fatalf("Invalid %s value %q, must be %s, %s or %s", name, value, assumeVersioningOn, assumeVersioningOff, assumeVersioningAuto)
+		}
+	}
+	// Predefined object ACLs are rejected by buckets with uniform access
+	if copyACLs && o.uniformAccess == assumeVersioningOn {
+		log.Fatal("-create-bucket-uniform-access on cannot be used with -copy-acls")
+	}
+}
+
+func (o bucketCreation) log() {
+	if !o.enabled {
+		return
+	}
+	log.Printf("Create bucket: in project %s", o.project)
+	if o.location != "" {
+		log.Printf("Create bucket location: %s", o.location)
+	}
+	if o.storageClass != "" {
+		log.Printf("Create bucket storage class: %s", o.storageClass)
+	}
+	log.Printf("Create bucket versioning: %s", o.versioning)
+	log.Printf("Create bucket uniform access: %s", o.uniformAccess)
+}
+
+// ensureBucket creates the GCS bucket with -create-bucket, unless it exists.
+// versionEnabled is whether versioning is enabled on the S3 bucket. The
+// bucket is left as it is if it exists, whatever its settings.
+func (o bucketCreation) ensureBucket(ctx context.Context, s3Client *s3.S3, s3Bucket string, gcsBucket string, gcsBucketHandle *storage.BucketHandle, versionEnabled bool, copyACLs bool) {
+	if !o.enabled {
+		return
+	}
+	_, err := gcsBucketHandle.Attrs(ctx)
+	if err == nil {
+		log.Printf("GCS bucket %s already exists, not creating it", gcsBucket)
+		return
+	}
+	if !errors.Is(err, storage.ErrBucketNotExist) {
+		log.Fatalf("Error getting GCS bucket %s to create it: %v", gcsBucket, err)
+	}
+
+	attrs, err := o.bucketAttrs(ctx, s3Client, s3Bucket, versionEnabled, copyACLs)
+	if err != nil {
+		log.Fatalf("Error creating GCS bucket %s: %v", gcsBucket, err)
+	}
+	err = gcsBucketHandle.Create(ctx, o.project, attrs)
+	// Another run may have created the bucket since, else its name is
+	// taken by another project
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == 409 {
+		if _, attrsErr := gcsBucketHandle.Attrs(ctx); attrsErr == nil {
+			log.Printf("GCS bucket %s was created meanwhile, not creating it", gcsBucket)
+			return
+		}
+		log.Fatalf("Error creating GCS bucket %s, the name is already taken: %v", gcsBucket, err)
+	}
+	if err != nil {
+		log.Fatalf("Error creating GCS bucket %s: %v", gcsBucket, err)
+	}
+
+	storageClass := attrs.StorageClass
+	if storageClass == "" {
+		storageClass = "STANDARD"
+	}
+	log.Printf("Created GCS bucket %s in project %s – location %s, storage class %s, versioning %t, uniform bucket-level access %t",
+		gcsBucket, o.project, attrs.Location, storageClass, attrs.VersioningEnabled, attrs.UniformBucketLevelAccess.Enabled)
+}
+
+// bucketAttrs returns the settings of the bucket to create.
+func (o bucketCreation) bucketAttrs(ctx context.Context, s3Client *s3.S3, s3Bucket string, versionEnabled bool, copyACLs bool) (*storage.BucketAttrs, error) {
+	location := o.location
+	if location == "" {
+		region := s3BucketRegion(ctx, s3Client, s3Bucket)
+		location = nearestGCPRegion[region]
+		if location == "" {
+			return nil, fmt.Errorf("no GCP region is known to be close to region %q of S3 bucket %s, set -create-bucket-location", region, s3Bucket)
+		}
+	}
+
+	attrs := &storage.BucketAttrs{
+		Location:          location,
+		StorageClass:      o.storageClass,
+		VersioningEnabled: versionEnabled,
+	}
+	if o.versioning != assumeVersioningAuto {
+		attrs.VersioningEnabled = o.versioning == assumeVersioningOn
+	}
+	attrs.UniformBucketLevelAccess.Enabled = !copyACLs
+	if o.uniformAccess != assumeVersioningAuto {
+		attrs.UniformBucketLevelAccess.Enabled = o.uniformAccess == assumeVersioningOn
+	}
+	return attrs, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// verifyQueueSize is the number of copied objects waiting for their deep
+// verification, past which copies wait for the verifier to catch up.
+const verifyQueueSize = 10000
+
+// verifyTask is a copied object to read back from GCS, with the checksums of
+// what was read from S3.
+type verifyTask struct {
+	key        string
+	object     *storage.ObjectHandle
+	generation int64
+	size       int64
+	crc32c     uint32
+	md5        []byte // nil for composite objects, which have none
+
+	// verified is called once the object is verified, nil for none
+	verified func()
+
+	// mismatched is called with the error of an object that does not
+	// match, once deleted, nil to fail the run
+	mismatched func(err error, message string)
+}
+
+// verifier reads back every object copied with -deep-verify, with its own
+// pool of workers, so that slow verifications do not hold up the copies.
+type verifier struct {
+	ctx    context.Context
+	tasks  chan verifyTask
+	wg     sync.WaitGroup
+	status *statusBoard
+
+	startTime     time.Time
+	filesVerified atomic.Int64
+	bytesVerified atomic.Int64
+}
+
+func newVerifier(ctx context.Context, workers int, status *statusBoard) *verifier {
+	v := &verifier{
+		ctx:       ctx,
+		tasks:     make(chan verifyTask, verifyQueueSize),
+		status:    status,
+		startTime: time.Now(),
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for task := range v.tasks {
+				v.verify(task)
+				v.wg.Done()
+			}
+		}()
+	}
+	return v
+}
+
+// enqueue queues an object for verification, waiting if the queue is full.
+// A nil verifier calls task.verified right away.
+func (v *verifier) enqueue(task verifyTask) {
+	if v == nil {
+		if task.verified != nil {
+			task.verified()
+		}
+		return
+	}
+	v.wg.Add(1)
+	v.tasks <- task
+}
+
+// wait waits for the verification of every object queued so far. A nil
+// verifier returns right away.
+func (v *verifier) wait() {
+	if v == nil {
+		return
+	}
+	if queued := len(v.tasks); queued > 0 {
+		log.Printf("Waiting for the verification of %s queued files", printer.Sprintf("%d", queued))
+	}
+	v.wg.Wait()
+}
+
+// verify reads an object back from GCS and compares its checksums with those
+// of what was read from S3. A corrupt object is deleted, and handed to
+// task.mismatched, or the run exits.
+func (v *verifier) verify(task verifyTask) {
+	ctx, span := startObjectSpan(v.ctx, "verify object", task.key, task.size)
+	defer span.End()
+	transfer := v.status.start(stageVerifying, task.key, "", task.size)
+	defer v.status.finish(transfer)
+	object := task.object.Generation(task.generation)
+	mismatchFn := func(err error) {
+		if err := object.Delete(v.ctx); err != nil {
+			log.Printf("Error deleting corrupt object %s (generation %d): %v", object.ObjectName(), task.generation, err)
+		}
+		endSpan(span, err)
+		message := "Error verifying object " + task.key + " in bucket " + object.BucketName()
+		if task.mismatched == nil {
+			fatalObject(task.key, err, message)
+		}
+		task.mismatched(contentMismatch{err}, message)
+	}
+
+	// Decompressive transcoding would hash other bytes than those stored
+	reader, err := object.ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		endSpan(span, err)
+		fatalObject(task.key, err, "Error reading object "+task.key+" from bucket "+object.BucketName())
+	}
+	defer reader.Close()
+
+	crc32cHash := crc32.New(crc32cTable)
+	md5Hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(crc32cHash, md5Hash), transfer.reader(reader))
+	if err != nil {
+		endSpan(span, err)
+		fatalObject(task.key, err, "Error reading object "+task.key+" from bucket "+object.BucketName())
+	}
+
+	switch {
+	case size != task.size:
+		mismatchFn(fmt.Errorf("size mismatch:\n  Copied: %d\n  Read back: %d", task.size, size))
+		return
+	case crc32cHash.Sum32() != task.crc32c:
+		mismatchFn(fmt.Errorf("checksum mismatch:\n  Copied CRC32C: %s\n  Read back CRC32C: %s", encodeCRC32C(task.crc32c), encodeCRC32C(crc32cHash.Sum32())))
+		return
+	case task.md5 != nil && !bytes.Equal(md5Hash.Sum(nil), task.md5):
+		mismatchFn(fmt.Errorf("checksum mismatch:\n  Copied MD5: %s\n  Read back MD5: %s", base64.StdEncoding.EncodeToString(task.md5), base64.StdEncoding.EncodeToString(md5Hash.Sum(nil))))
+		return
+	}
+
+	v.filesVerified.Add(1)
+	v.bytesVerified.Add(size)
+	if task.verified != nil {
+		task.verified()
+	}
+}
+
+// logStats logs the rate objects have been verified at, and how many are
+// waiting. A nil verifier logs nothing.
+func (v *verifier) logStats() {
+	if v == nil {
+		return
+	}
+	duration := time.Since(v.startTime)
+	bytesVerified := v.bytesVerified.Load()
+	log.Printf("Verified %s files, total size: %s, MB/sec: %.2f, queued: %s",
+		printer.Sprintf("%d", v.filesVerified.Load()), formatBytes(bytesVerified),
+		float64(bytesVerified)/duration.Seconds()/(1024*1024), printer.Sprintf("%d", len(v.tasks)))
+}
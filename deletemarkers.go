@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"google.golang.org/api/iterator"
+)
+
+// Values of -delete-markers.
+const (
+	deleteMarkersSkip      = "skip"
+	deleteMarkersReplicate = "replicate"
+)
+
+// historyEntry is a version or a delete marker of an S3 object.
+type historyEntry struct {
+	version *s3.ObjectVersion
+	marker  *s3.DeleteMarkerEntry // Set instead of version for a delete marker
+}
+
+func (e historyEntry) isLatest() bool {
+	if e.marker != nil {
+		return aws.BoolValue(e.marker.IsLatest)
+	}
+	return aws.BoolValue(e.version.IsLatest)
+}
+
+func (e historyEntry) lastModified() time.Time {
+	if e.marker != nil {
+		return aws.TimeValue(e.marker.LastModified)
+	}
+	return aws.TimeValue(e.version.LastModified)
+}
+
+// objectHistory returns the versions and delete markers of an object sorted
+// from the oldest to the latest. S3 lists them latest first.
+func objectHistory(versions []*s3.ObjectVersion, markers []*s3.DeleteMarkerEntry) []historyEntry {
+	history := make([]historyEntry, 0, len(versions)+len(markers))
+	for _, version := range versions {
+		history = append(history, historyEntry{version: version})
+	}
+	for _, marker := range markers {
+		history = append(history, historyEntry{marker: marker})
+	}
+	sort.SliceStable(history, func(i, j int) bool {
+		if history[i].isLatest() != history[j].isLatest() {
+			return history[j].isLatest()
+		}
+		return history[i].lastModified().Before(history[j].lastModified())
+	})
+	return history
+}
+
+// copyHistory copies the versions of an object, oldest first, as successive
+// generations of gcsObject, so that the latest version ends up as the live
+// generation. A delete marker deletes the live generation, which Object
+// Versioning keeps as a noncurrent one, as S3 keeps the versions behind a
+// delete marker. Each generation is written only if the live generation is
+// still generation, then the one written before it.
+func (c *copier) copyHistory(key string, history []historyEntry, gcsObject *storage.ObjectHandle, generation int64, storageClass string) {
+	for _, entry := range history {
+		if entry.marker != nil {
+			c.deleteLiveGeneration(key, entry.marker, gcsObject)
+			generation = 0
+			continue
+		}
+		c.wg.Add(1)
+		c.copySlots.acquire()
+		generation = c.copyFileVersion(key, *entry.version.VersionId, aws.Int64Value(entry.version.Size), gcsObject, generation, storageClass)
+	}
+}
+
+// deleteLiveGeneration deletes the live generation of the GCS object of a
+// key that marker deleted in S3, if there is one.
+func (c *copier) deleteLiveGeneration(key string, marker *s3.DeleteMarkerEntry, gcsObject *storage.ObjectHandle) {
+	// The object of another key rewritten into the same name is left
+	other, err := c.otherSourceKey(c.ctx, gcsObject, key)
+	if err != nil {
+		fatalObject(key, err, "Error getting object "+key+" from bucket "+gcsObject.BucketName())
+	}
+	if other != "" {
+		log.Printf("Object %s – deleted in S3, GCS object %s is that of object %s, leaving it", key, gcsObject.ObjectName(), other)
+		return
+	}
+	err = gcsObject.Delete(c.ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return
+	}
+	if err != nil {
+		fatalObject(key, err, "Error deleting object "+key+" from bucket "+gcsObject.BucketName())
+	}
+	c.options.logSample.log(objectEvent{Key: key, Action: actionDelete, Reason: reasonDeleteMarker,
+		Message: fmt.Sprintf("Object %s – deleted in S3 (delete marker %s), deleting the live generation", key, aws.StringValue(marker.VersionId))})
+	c.copyMutex.Lock()
+	c.filesDeletedByMarker++
+	c.copyMutex.Unlock()
+	c.manifest.record(transferRecord{Key: key, VersionID: aws.StringValue(marker.VersionId), Action: actionDelete, Reason: reasonDeleteMarker})
+}
+
+// hasVersion reports whether a generation of the GCS object of key was
+// copied from the given S3 version.
+func hasVersion(ctx context.Context, bucketHandle *storage.BucketHandle, key string, versionID string) bool {
+	it := bucketHandle.Objects(ctx, &storage.Query{Prefix: key, Versions: true})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return false
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		// The prefix also matches sibling keys such as "foo.bak" for "foo"
+		if attrs.Name == key && attrs.Metadata[metadataKeyVersionID] == versionID {
+			return true
+		}
+	}
+}
+
+// replicateDeletedObject replicates an object whose latest version is a
+// delete marker: its versions are copied unless an earlier run did, and its
+// live GCS generation is deleted.
+func (c *copier) replicateDeletedObject(key string, history []historyEntry) {
+	// The latest version is the newest entry that is not a delete marker
+	var latest *s3.ObjectVersion
+	for _, entry := range history {
+		if entry.version != nil {
+			latest = entry.version
+		}
+	}
+	if latest == nil {
+		// Only delete markers, there is nothing to copy
+		name := c.gcsName(&s3.Object{Key: aws.String(key)})
+		for _, bucketHandle := range c.bucketHandles {
+			c.deleteLiveGeneration(key, history[len(history)-1].marker, bucketHandle.Object(name))
+		}
+		return
+	}
+
+	s3Object := &s3.Object{Key: aws.String(key), LastModified: latest.LastModified, Size: latest.Size, ETag: latest.ETag}
+	gcsBucket, storageClass := c.destination(s3Object)
+	name := c.gcsName(s3Object)
+	gcsBucketHandle := c.bucketHandles[gcsBucket]
+	other, err := c.otherSourceKey(c.ctx, gcsBucketHandle.Object(name), key)
+	if err != nil {
+		fatalObject(key, err, "Error getting object "+key+" from bucket "+gcsBucket)
+	}
+	if c.collides(s3Object, gcsBucket, name, other) {
+		return
+	}
+	if hasVersion(c.ctx, gcsBucketHandle, name, *latest.VersionId) {
+		c.deleteLiveGeneration(key, history[len(history)-1].marker, gcsBucketHandle.Object(name))
+		return
+	}
+	log.Printf("%s – deleted in S3, copying its %d versions and delete markers", key, len(history))
+	gcsObject := gcsBucketHandle.Object(name).Retryer(gcsRetryer, gcsRetryErrors, storage.WithPolicy(storage.RetryAlways))
+	c.copyHistory(key, history, gcsObject, c.liveGeneration(gcsObject), storageClass)
+}
+
+// keyHistory collects the versions and delete markers of a key across the
+// pages of a version listing.
+type keyHistory struct {
+	versions []*s3.ObjectVersion
+	markers  []*s3.DeleteMarkerEntry
+}
+
+// replicateDeleteMarkers finds the objects under prefix whose latest version
+// is a delete marker, which listings of the bucket leave out, and replicates
+// them with replicateDeletedObject. It stops early once stopCtx is done.
+func (c *copier) replicateDeleteMarkers(stopCtx context.Context, prefix string, objectShard *shard) {
+	log.Print("Listing object versions to find objects deleted in S3")
+
+	histories := make(map[string]*keyHistory)
+	historyOf := func(key string) *keyHistory {
+		h, ok := histories[key]
+		if !ok {
+			h = &keyHistory{}
+			histories[key] = h
+		}
+		return h
+	}
+
+	input := &s3.ListObjectVersionsInput{Bucket: aws.String(c.s3Bucket)}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+	err := c.s3Client.ListObjectVersionsPagesWithContext(c.ctx, input, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		var lastKey string
+		for _, version := range page.Versions {
+			h := historyOf(*version.Key)
+			h.versions = append(h.versions, version)
+			if *version.Key > lastKey {
+				lastKey = *version.Key
+			}
+		}
+		for _, marker := range page.DeleteMarkers {
+			h := historyOf(*marker.Key)
+			h.markers = append(h.markers, marker)
+			if *marker.Key > lastKey {
+				lastKey = *marker.Key
+			}
+		}
+
+		// Keys are listed in order, only the versions of the last key of
+		// the page may continue on the next one
+		for key, h := range histories {
+			if key == lastKey && !lastPage {
+				continue
+			}
+			delete(histories, key)
+			if isFolderKey(key) || !objectShard.contains(key) || stopCtx.Err() != nil {
+				continue
+			}
+			history := objectHistory(h.versions, h.markers)
+			if latest := history[len(history)-1]; latest.marker != nil && latest.isLatest() {
+				c.replicateDeletedObject(key, history)
+			}
+		}
+		return stopCtx.Err() == nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	c.wait()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/url"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Objects are enqueued as event notifications of enqueueRecordsPerMessage
+// records each, which keeps messages well below the 256 KiB SQS limit even
+// with long keys, and sent enqueueMessagesPerBatch at a time, the most
+// SendMessageBatch accepts.
+const (
+	enqueueRecordsPerMessage = 50
+	enqueueMessagesPerBatch  = 10
+)
+
+// enqueueEventName is the event name of the records sent by enqueue. Like
+// real notifications of new objects, it starts with "ObjectCreated:".
+const enqueueEventName = "ObjectCreated:Enqueue"
+
+// queueSender sends S3 event notifications about objects to an SQS queue,
+// grouping objects into messages and messages into batches.
+type queueSender struct {
+	ctx       context.Context
+	sqsClient *sqs.SQS
+	queueURL  string
+	s3Bucket  string
+
+	records  []s3EventRecord
+	entries  []*sqs.SendMessageBatchRequestEntry
+	objects  int64
+	messages int64
+}
+
+func (q *queueSender) add(key string) {
+	var record s3EventRecord
+	record.EventName = enqueueEventName
+	record.S3.Bucket.Name = q.s3Bucket
+	// Keys are URL encoded in event notifications
+	record.S3.Object.Key = url.QueryEscape(key)
+	q.records = append(q.records, record)
+	q.objects++
+
+	if len(q.records) == enqueueRecordsPerMessage {
+		q.endMessage()
+	}
+}
+
+func (q *queueSender) endMessage() {
+	if len(q.records) == 0 {
+		return
+	}
+	body, err := json.Marshal(s3EventMessage{Records: q.records})
+	if err != nil {
+		log.Fatal(err)
+	}
+	q.records = nil
+	q.entries = append(q.entries, &sqs.SendMessageBatchRequestEntry{
+		Id:          aws.String(strconv.Itoa(len(q.entries))),
+		MessageBody: aws.String(string(body)),
+	})
+
+	if len(q.entries) == enqueueMessagesPerBatch {
+		q.send()
+	}
+}
+
+func (q *queueSender) send() {
+	if len(q.entries) == 0 {
+		return
+	}
+	output, err := q.sqsClient.SendMessageBatchWithContext(q.ctx, &sqs.SendMessageBatchInput{
+		QueueUrl: aws.String(q.queueURL),
+		Entries:  q.entries,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Objects of a message that could not be sent would never be copied
+	for _, failed := range output.Failed {
+		log.Fatalf("Error sending message %s: %s", aws.StringValue(failed.Id), aws.StringValue(failed.Message))
+	}
+	q.messages += int64(len(q.entries))
+	q.entries = nil
+}
+
+// flush sends the objects added since the last batch was sent.
+func (q *queueSender) flush() {
+	q.endMessage()
+	q.send()
+}
+
+func runEnqueue(args []string) {
+	flags := flag.NewFlagSet("enqueue", flag.ExitOnError)
+	queueURL := flags.String("queue-url", "", "URL of the SQS queue the workers running watch receive from")
+	inventory := flags.String("inventory", "", "s3:// URI of the manifest.json of an S3 Inventory report (CSV format) to read the objects from, instead of listing the bucket")
+	var objectShard shard
+	flags.Var(&objectShard, "shard", "Only enqueue the i-th of N disjoint sets of keys, e.g. 2/4")
+	var s3Opts s3Options
+	addS3Flags(flags, &s3Opts)
+	addLogFlags(flags)
+	flags.Parse(args)
+	setupLogging()
+
+	if len(flags.Args()) < 1 || len(flags.Args()) > 2 || *queueURL == "" {
+		log.Fatal("Usage: ./s3-to-gcs enqueue -queue-url <SQS queue URL> [-inventory s3://<bucket>/<path>/manifest.json] [-shard <i>/<N>] <S3 bucket> [optional object key prefix]")
+	}
+
+	buckets, objectKeyPrefix := parseBucketArgs(flags.Args(), "s3")
+	s3Bucket := buckets[0]
+
+	log.Printf("Enqueueing to queue %s", *queueURL)
+	log.Printf("S3 bucket: %s", s3Bucket)
+	if objectKeyPrefix != "" {
+		log.Printf("Object key prefix: %s", objectKeyPrefix)
+	}
+	if objectShard.count > 1 {
+		log.Printf("Shard: %s", objectShard.String())
+	}
+	s3Opts.log()
+
+	ctx := context.Background()
+	s3Client := newS3Client(s3Opts)
+	listObjects := bucketLister(ctx, s3Client, s3Bucket, objectKeyPrefix)
+	if *inventory != "" {
+		listObjects = inventoryLister(ctx, s3Client, *inventory, s3Bucket, objectKeyPrefix)
+	}
+	listObjects = objectShard.filter(listObjects)
+
+	sender := &queueSender{
+		ctx:       ctx,
+		sqsClient: sqs.New(newAWSSession(s3Opts)),
+		queueURL:  *queueURL,
+		s3Bucket:  s3Bucket,
+	}
+
+	var totalBytes int64
+	err := listObjects(func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, s3Object := range page.Contents {
+			if isFolderKey(*s3Object.Key) {
+				continue
+			}
+			sender.add(*s3Object.Key)
+			totalBytes += *s3Object.Size
+		}
+		return true
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	sender.flush()
+
+	log.Printf("Enqueued %s objects, total size: %s, in %s messages", printer.Sprintf("%d", sender.objects),
+		formatBytes(totalBytes), printer.Sprintf("%d", sender.messages))
+}
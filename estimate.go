@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// gib is the unit data transfer and storage are priced in.
+const gib = 1 << 30
+
+// priceList is the prices in USD the estimate subcommand uses. Requests are
+// priced per thousand, data transfer and retrievals per GiB, and storage per
+// GiB per month. Prices by storage class are keyed by the S3 or GCS class.
+type priceList struct {
+	S3ListPer1000         float64            `json:"s3ListPer1000"`
+	S3GetPer1000          float64            `json:"s3GetPer1000"`
+	S3TransferOutPerGiB   float64            `json:"s3TransferOutPerGiB"`
+	S3RetrievalPerGiB     map[string]float64 `json:"s3RetrievalPerGiB"`
+	GCSClassAPer1000      map[string]float64 `json:"gcsClassAPer1000"`
+	GCSClassBPer1000      map[string]float64 `json:"gcsClassBPer1000"`
+	GCSStoragePerGiBMonth map[string]float64 `json:"gcsStoragePerGiBMonth"`
+}
+
+// defaultPrices returns the list prices of S3 in us-east-1, with transfer
+// out to the internet in the first tier, and of GCS in a US region.
+func defaultPrices() priceList {
+	return priceList{
+		S3ListPer1000:       0.005,
+		S3GetPer1000:        0.0004,
+		S3TransferOutPerGiB: 0.09,
+		S3RetrievalPerGiB: map[string]float64{
+			s3.ObjectStorageClassStandardIa: 0.01,
+			s3.ObjectStorageClassOnezoneIa:  0.01,
+			s3.ObjectStorageClassGlacierIr:  0.03,
+		},
+		GCSClassAPer1000:      map[string]float64{"STANDARD": 0.005, "NEARLINE": 0.01, "COLDLINE": 0.02, "ARCHIVE": 0.05},
+		GCSClassBPer1000:      map[string]float64{"STANDARD": 0.0004, "NEARLINE": 0.001, "COLDLINE": 0.01, "ARCHIVE": 0.05},
+		GCSStoragePerGiBMonth: map[string]float64{"STANDARD": 0.02, "NEARLINE": 0.01, "COLDLINE": 0.004, "ARCHIVE": 0.0012},
+	}
+}
+
+// loadPrices returns the default prices, with those of the JSON file at path
+// replacing them.
+func loadPrices(path string) (priceList, error) {
+	prices := defaultPrices()
+	if path == "" {
+		return prices, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return prices, err
+	}
+	if err := json.Unmarshal(data, &prices); err != nil {
+		return prices, fmt.Errorf("%s: %w", path, err)
+	}
+	return prices, nil
+}
+
+// costEstimate is a line of the estimate: a quantity of something priced.
+type costEstimate struct {
+	Item      string  `json:"item"`
+	Quantity  float64 `json:"quantity"`
+	Unit      string  `json:"unit"`
+	UnitPrice float64 `json:"unitPrice"`
+	Cost      float64 `json:"cost"`
+	Monthly   bool    `json:"monthly,omitempty"` // A monthly cost, not one of the migration
+}
+
+// estimateReport is the document written by the estimate subcommand.
+type estimateReport struct {
+	Bucket        string         `json:"bucket"`
+	Prefix        string         `json:"prefix,omitempty"`
+	Versions      bool           `json:"versions"`
+	Objects       int64          `json:"objects"`
+	Bytes         int64          `json:"bytes"`
+	Archived      int64          `json:"archivedObjects"`
+	ArchivedBytes int64          `json:"archivedBytes"`
+	Costs         []costEstimate `json:"costs"`
+	MigrationCost float64        `json:"migrationCost"`
+	MonthlyCost   float64        `json:"monthlyStorageCost"`
+}
+
+// classUsage counts objects and bytes by storage class.
+type classUsage map[string]*struct{ objects, bytes int64 }
+
+func (u classUsage) add(class string, size int64) {
+	usage, ok := u[class]
+	if !ok {
+		usage = &struct{ objects, bytes int64 }{}
+		u[class] = usage
+	}
+	usage.objects++
+	usage.bytes += size
+}
+
+// classes returns the storage classes of u, sorted.
+func (u classUsage) classes() []string {
+	classes := make([]string, 0, len(u))
+	for class := range u {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	return classes
+}
+
+// objectEstimator tallies what copying the objects listed costs.
+type objectEstimator struct {
+	report          *estimateReport
+	storageClassMap storageClassMap
+	defaultClass    string
+	listRequests    int64
+	s3Classes       classUsage // Objects read, by S3 storage class
+	gcsClasses      classUsage // Objects written, by GCS storage class
+}
+
+// add counts an object version of the given S3 storage class. Objects of the
+// archive classes are counted apart, since they are not copied until they are
+// restored.
+func (e *objectEstimator) add(key string, size int64, s3Class *string) {
+	if isFolderKey(key) {
+		return
+	}
+	switch aws.StringValue(s3Class) {
+	case s3.ObjectStorageClassGlacier, s3.ObjectStorageClassDeepArchive:
+		e.report.Archived++
+		e.report.ArchivedBytes += size
+		return
+	}
+	e.report.Objects++
+	e.report.Bytes += size
+
+	class := aws.StringValue(s3Class)
+	if class == "" {
+		class = s3.ObjectStorageClassStandard
+	}
+	e.s3Classes.add(class, size)
+	gcsClass := e.storageClassMap.gcsClass(s3Class)
+	if gcsClass == "" {
+		gcsClass = e.defaultClass
+	}
+	e.gcsClasses.add(gcsClass, size)
+}
+
+// costs returns the cost of the objects added with prices. Every object
+// version copied is read with a GET, checked in GCS with a Class B get, and
+// written with Class A operations: the upload and the metadata update.
+func (e *objectEstimator) costs(prices priceList) []costEstimate {
+	var costs []costEstimate
+	addCost := func(item string, quantity float64, unit string, unitPrice float64, monthly bool) {
+		if quantity > 0 {
+			costs = append(costs, costEstimate{Item: item, Quantity: quantity, Unit: unit, UnitPrice: unitPrice, Cost: quantity * unitPrice, Monthly: monthly})
+		}
+	}
+	thousands := func(requests int64) float64 { return float64(requests) / 1000 }
+
+	addCost("S3 LIST requests", thousands(e.listRequests), "1000 requests", prices.S3ListPer1000, false)
+	addCost("S3 GET requests", thousands(e.report.Objects), "1000 requests", prices.S3GetPer1000, false)
+	addCost("S3 data transfer out", float64(e.report.Bytes)/gib, "GiB", prices.S3TransferOutPerGiB, false)
+	for _, class := range e.s3Classes.classes() {
+		if price, ok := prices.S3RetrievalPerGiB[class]; ok {
+			addCost("S3 retrieval "+class, float64(e.s3Classes[class].bytes)/gib, "GiB", price, false)
+		}
+	}
+	for _, class := range e.gcsClasses.classes() {
+		usage := e.gcsClasses[class]
+		addCost("GCS Class A operations "+class, thousands(2*usage.objects), "1000 requests", prices.GCSClassAPer1000[class], false)
+		addCost("GCS Class B operations "+class, thousands(usage.objects), "1000 requests", prices.GCSClassBPer1000[class], false)
+	}
+	for _, class := range e.gcsClasses.classes() {
+		addCost("GCS storage "+class, float64(e.gcsClasses[class].bytes)/gib, "GiB-month", prices.GCSStoragePerGiBMonth[class], true)
+	}
+	return costs
+}
+
+// runEstimate lists the objects of an S3 bucket, or reads them from an S3
+// Inventory report, and estimates the cost of copying them: the S3 requests,
+// retrievals and data transfer out, the GCS operations, and the monthly
+// storage in GCS by storage class.
+func runEstimate(args []string) {
+	flags := flag.NewFlagSet("estimate", flag.ExitOnError)
+	reportPath := flags.String("report", "-", "Write the estimate to this file (default: standard output)")
+	outputFormat := addOutputFlag(flags)
+	versionsFlag := flags.Bool("versions", false, "Estimate the copy of every version of the objects, not only the current one")
+	inventoryFlag := flags.String("inventory", "", "s3:// URI of the manifest.json of an S3 Inventory report to read the objects from, instead of listing the bucket")
+	pricesPath := flags.String("prices", "", "JSON file of prices replacing the default list prices, see the README")
+	var storageClasses storageClassMap
+	flags.Var(&storageClasses, "storage-class-map", "GCS storage class of the objects of each S3 storage class, as for the copy, e.g. STANDARD_IA=NEARLINE, or default")
+	defaultClass := flags.String("gcs-storage-class", "STANDARD", "GCS storage class of the objects the -storage-class-map does not map, that of the GCS bucket")
+	var s3Opts s3Options
+	addS3Flags(flags, &s3Opts)
+	addLogFlags(flags)
+	flags.Parse(args)
+	setupLogging()
+	checkOutputFormat(*outputFormat)
+
+	if len(flags.Args()) < 1 || len(flags.Args()) > 2 {
+		log.Fatal("Usage: ./s3-to-gcs estimate [-report <file>] [-output json|csv|table] [-versions] [-inventory s3://<bucket>/<path>/manifest.json] [-storage-class-map <mapping>] [-gcs-storage-class <class>] [-prices <file>] <S3 bucket> [optional object key prefix]")
+	}
+	if *versionsFlag && *inventoryFlag != "" {
+		log.Fatal("-versions cannot be used with -inventory, which only lists the current versions")
+	}
+	if !isGCSStorageClass(*defaultClass) {
+		log.Fatalf("Invalid -gcs-storage-class value %q, expected one of %s", *defaultClass, strings.Join(gcsStorageClasses, ", "))
+	}
+	prices, err := loadPrices(*pricesPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	buckets, objectKeyPrefix := parseBucketArgs(flags.Args(), "s3")
+	s3Bucket := buckets[0]
+	s3Opts.log()
+	s3Client := newS3Client(s3Opts)
+	ctx := context.Background()
+
+	report := &estimateReport{Bucket: s3Bucket, Prefix: objectKeyPrefix, Versions: *versionsFlag}
+	estimator := &objectEstimator{
+		report:          report,
+		storageClassMap: storageClasses,
+		defaultClass:    strings.ToUpper(*defaultClass),
+		s3Classes:       make(classUsage),
+		gcsClasses:      make(classUsage),
+	}
+
+	log.Printf("Estimating the cost of copying S3 bucket %s", s3Bucket)
+	if *versionsFlag {
+		input := &s3.ListObjectVersionsInput{Bucket: aws.String(s3Bucket)}
+		if objectKeyPrefix != "" {
+			input.Prefix = aws.String(objectKeyPrefix)
+		}
+		keys := int64(0)
+		var lastKey string
+		err = s3Client.ListObjectVersionsPagesWithContext(ctx, input, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+			for _, version := range page.Versions {
+				if *version.Key != lastKey {
+					keys++
+					lastKey = *version.Key
+				}
+				estimator.add(*version.Key, aws.Int64Value(version.Size), version.StorageClass)
+			}
+			return true
+		})
+		// The copy lists the objects, a thousand per page, then the versions
+		// of every object
+		estimator.listRequests = (keys+999)/1000 + keys
+	} else {
+		listObjects := bucketLister(ctx, s3Client, s3Bucket, objectKeyPrefix)
+		if *inventoryFlag != "" {
+			listObjects = inventoryLister(ctx, s3Client, *inventoryFlag, s3Bucket, objectKeyPrefix)
+		}
+		err = listObjects(func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			if *inventoryFlag == "" {
+				estimator.listRequests++
+			}
+			for _, s3Object := range page.Contents {
+				estimator.add(*s3Object.Key, *s3Object.Size, s3Object.StorageClass)
+			}
+			return true
+		})
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	report.Costs = estimator.costs(prices)
+	for _, cost := range report.Costs {
+		if cost.Monthly {
+			report.MonthlyCost += cost.Cost
+		} else {
+			report.MigrationCost += cost.Cost
+		}
+	}
+	log.Printf("%s objects to copy, total size: %s, estimated migration cost: $%.2f, then $%.2f per month of GCS storage",
+		printer.Sprintf("%d", report.Objects), formatBytes(report.Bytes), report.MigrationCost, report.MonthlyCost)
+	if report.Archived > 0 {
+		log.Printf("%s objects (%s) are in archive storage classes, not included: they must be restored before they are copied",
+			printer.Sprintf("%d", report.Archived), formatBytes(report.ArchivedBytes))
+	}
+
+	var output io.Writer = os.Stdout
+	if *reportPath != "-" {
+		reportFile, err := os.Create(*reportPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer reportFile.Close()
+		output = reportFile
+	}
+
+	if *outputFormat != outputJSON {
+		formatFloat := func(value float64) string { return strconv.FormatFloat(value, 'f', -1, 64) }
+		table := newTableWriter(output, *outputFormat, "item", "quantity", "unit", "unitPrice", "cost")
+		for _, cost := range report.Costs {
+			table.write(cost.Item, strconv.FormatFloat(cost.Quantity, 'f', 3, 64), cost.Unit, formatFloat(cost.UnitPrice), strconv.FormatFloat(cost.Cost, 'f', 2, 64))
+		}
+		table.write("Migration total", "", "", "", strconv.FormatFloat(report.MigrationCost, 'f', 2, 64))
+		table.write("Monthly storage total", "", "", "", strconv.FormatFloat(report.MonthlyCost, 'f', 2, 64))
+		table.flush()
+		return
+	}
+
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fsObjectPath returns the path of the file storing the object key under
+// root, refusing keys that would end up outside of it.
+func fsObjectPath(root, key string) (string, error) {
+	path := filepath.FromSlash(key)
+	if !filepath.IsLocal(path) {
+		return "", fmt.Errorf("object key %q is not a valid relative path", key)
+	}
+	return filepath.Join(root, path), nil
+}
+
+func fsObjectInfo(key string, fileInfo fs.FileInfo) objectInfo {
+	return objectInfo{
+		Key:          key,
+		Size:         fileInfo.Size(),
+		LastModified: fileInfo.ModTime(),
+	}
+}
+
+// fsSource reads objects from the regular files under a local directory. The
+// key of an object is the slash separated path of its file relative to the
+// directory.
+type fsSource struct {
+	root string
+}
+
+func newFSSource(root string) *fsSource {
+	return &fsSource{root: root}
+}
+
+func (s *fsSource) String() string {
+	return "file://" + filepath.ToSlash(s.root)
+}
+
+func (s *fsSource) List(ctx context.Context, prefix string, fn func(objectInfo) error) error {
+	return filepath.WalkDir(s.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(relPath)
+
+		if entry.IsDir() {
+			// Only descend into directories that can hold keys with the prefix
+			if relPath != "." && !strings.HasPrefix(key+"/", prefix) && !strings.HasPrefix(prefix, key+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		return fn(fsObjectInfo(key, fileInfo))
+	})
+}
+
+func (s *fsSource) Open(ctx context.Context, info objectInfo) (io.ReadCloser, error) {
+	path, err := fsObjectPath(s.root, info.Key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// fsDestination writes objects to files under a local directory, creating
+// subdirectories as needed. Files are written under a temporary name and
+// renamed once complete, and keep the modification time of their source.
+type fsDestination struct {
+	root string
+}
+
+func newFSDestination(root string) *fsDestination {
+	return &fsDestination{root: root}
+}
+
+func (d *fsDestination) String() string {
+	return "file://" + filepath.ToSlash(d.root)
+}
+
+func (d *fsDestination) Stat(ctx context.Context, key string) (*objectInfo, error) {
+	path, err := fsObjectPath(d.root, key)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	info := fsObjectInfo(key, fileInfo)
+	return &info, nil
+}
+
+func (d *fsDestination) Write(ctx context.Context, info objectInfo, body io.Reader) (string, error) {
+	path, err := fsObjectPath(d.root, info.Key)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	// Removing the temporary file fails harmlessly once it has been renamed
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	crc32cHash := crc32.New(crc32cTable)
+	if _, err := io.Copy(io.MultiWriter(file, crc32cHash), body); err != nil {
+		return "", err
+	}
+	if err := file.Sync(); err != nil {
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+
+	crc32cSum := encodeCRC32C(crc32cHash.Sum32())
+	if info.CRC32C != "" && info.CRC32C != crc32cSum {
+		return "", fmt.Errorf("checksum mismatch:\n  Source CRC32C: %s\n  Read CRC32C: %s", info.CRC32C, crc32cSum)
+	}
+
+	if !info.LastModified.IsZero() {
+		if err := os.Chtimes(file.Name(), info.LastModified, info.LastModified); err != nil {
+			return "", err
+		}
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return "", err
+	}
+
+	return crc32cSum, nil
+}
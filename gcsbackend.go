@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// gcsSource reads objects from a GCS bucket. Objects that were split into
+// parts by -split-size are reassembled from their manifest.
+type gcsSource struct {
+	bucket       string
+	bucketHandle *storage.BucketHandle
+
+	manifestsMutex sync.Mutex
+	manifests      map[string]*splitManifest
+}
+
+func newGCSSource(bucketHandle *storage.BucketHandle, bucket string) *gcsSource {
+	return &gcsSource{
+		bucket:       bucket,
+		bucketHandle: bucketHandle,
+		manifests:    make(map[string]*splitManifest),
+	}
+}
+
+func (s *gcsSource) String() string {
+	return "gs://" + s.bucket
+}
+
+func gcsObjectInfo(attrs *storage.ObjectAttrs) objectInfo {
+	info := objectInfo{
+		Key:          attrs.Name,
+		Size:         attrs.Size,
+		LastModified: attrs.Updated,
+		ContentType:  attrs.ContentType,
+		CRC32C:       encodeCRC32C(attrs.CRC32C),
+		Metadata:     originalMetadata(attrs.Metadata),
+	}
+	return info
+}
+
+func (s *gcsSource) List(ctx context.Context, prefix string, fn func(objectInfo) error) error {
+	// Names of the parts of split objects, which are read through their
+	// manifest. A manifest sorts before its parts.
+	partNames := make(map[string]struct{})
+
+	it := s.bucketHandle.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if isFolderKey(attrs.Name) {
+			continue
+		}
+		if _, ok := partNames[attrs.Name]; ok {
+			delete(partNames, attrs.Name)
+			continue
+		}
+
+		if key := strings.TrimSuffix(attrs.Name, splitManifestSuffix); key != attrs.Name {
+			manifest, err := readSplitManifest(ctx, s.bucketHandle, key)
+			if err == nil && manifest != nil && manifest.Key == key {
+				for _, part := range manifest.Parts {
+					partNames[part.Name] = struct{}{}
+				}
+				s.manifestsMutex.Lock()
+				s.manifests[key] = manifest
+				s.manifestsMutex.Unlock()
+
+				info := gcsObjectInfo(attrs)
+				info.Key = key
+				info.Size = manifest.Size
+				info.ContentType = ""
+				info.CRC32C = ""
+				if err := fn(info); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		if err := fn(gcsObjectInfo(attrs)); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *gcsSource) Open(ctx context.Context, info objectInfo) (io.ReadCloser, error) {
+	s.manifestsMutex.Lock()
+	manifest := s.manifests[info.Key]
+	s.manifestsMutex.Unlock()
+
+	if manifest == nil {
+		return s.bucketHandle.Object(info.Key).NewReader(ctx)
+	}
+
+	readers := make([]io.Reader, len(manifest.Parts))
+	for i, part := range manifest.Parts {
+		readers[i] = &splitPartReader{ctx: ctx, object: s.bucketHandle.Object(part.Name), part: part}
+	}
+	return io.NopCloser(io.MultiReader(readers...)), nil
+}
+
+// splitPartReader reads a part of a split object, opening it lazily so only
+// one part is open at a time, and checks it against its manifest entry.
+type splitPartReader struct {
+	ctx    context.Context
+	object *storage.ObjectHandle
+	part   splitPart
+	reader *storage.Reader
+	hash   hash.Hash32
+	read   int64
+}
+
+func (r *splitPartReader) Read(p []byte) (int, error) {
+	if r.reader == nil {
+		reader, err := r.object.NewReader(r.ctx)
+		if err != nil {
+			return 0, err
+		}
+		r.reader = reader
+		r.hash = crc32.New(crc32cTable)
+	}
+
+	n, err := r.reader.Read(p)
+	r.hash.Write(p[:n])
+	r.read += int64(n)
+	if errors.Is(err, io.EOF) {
+		r.reader.Close()
+		if r.read != r.part.Size || encodeCRC32C(r.hash.Sum32()) != r.part.CRC32C {
+			return n, fmt.Errorf("part %s does not match its manifest", r.part.Name)
+		}
+	}
+	return n, err
+}
+
+// gcsDestination writes objects to a GCS bucket.
+type gcsDestination struct {
+	bucket       string
+	bucketHandle *storage.BucketHandle
+	kmsKey       string // "" for the default of the bucket
+}
+
+func newGCSDestination(bucketHandle *storage.BucketHandle, bucket string, kmsKey string) *gcsDestination {
+	return &gcsDestination{
+		bucket:       bucket,
+		bucketHandle: bucketHandle,
+		kmsKey:       kmsKey,
+	}
+}
+
+func (d *gcsDestination) String() string {
+	return "gs://" + d.bucket
+}
+
+func (d *gcsDestination) Stat(ctx context.Context, key string) (*objectInfo, error) {
+	attrs, err := d.bucketHandle.Object(key).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	info := gcsObjectInfo(attrs)
+	return &info, nil
+}
+
+func (d *gcsDestination) Write(ctx context.Context, info objectInfo, body io.Reader) (string, error) {
+	metadata := make(map[string]string, len(info.Metadata))
+	for key, value := range info.Metadata {
+		addUserMetadata(metadata, key, value)
+	}
+	result, err := uploadToGCS(ctx, d.bucketHandle.Object(info.Key), nil, body, func(writer *storage.Writer) {
+		writer.ContentType = info.ContentType
+		writer.Metadata = metadata
+		writer.KMSKeyName = d.kmsKey
+
+		// GCS rejects the upload if the content does not match
+		if crc32cSum, ok := decodeCRC32C(info.CRC32C); ok {
+			writer.CRC32C = crc32cSum
+			writer.SendCRC32C = true
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	return encodeCRC32C(result.crc32c), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// gcsListing walks the objects of a GCS bucket in name order, alongside the
+// S3 listing, which lists keys in the same order, so that the GCS object of
+// each S3 key is found without a request of its own. Only the current page of
+// the GCS listing is held in memory, however large the bucket.
+type gcsListing struct {
+	ctx    context.Context
+	bucket *storage.BucketHandle
+	mutex  sync.Mutex
+
+	it      *storage.ObjectIterator
+	current *storage.ObjectAttrs // The first object not before the last key, nil at the end
+	last    string               // The last key looked up
+	started bool
+}
+
+func newGCSListing(ctx context.Context, bucket *storage.BucketHandle) *gcsListing {
+	return &gcsListing{ctx: ctx, bucket: bucket}
+}
+
+// seek starts listing again from key.
+func (l *gcsListing) seek(key string) error {
+	l.it = l.bucket.Objects(l.ctx, &storage.Query{StartOffset: key})
+	l.started = true
+	return l.advance()
+}
+
+// advance moves to the next object of the listing.
+func (l *gcsListing) advance() error {
+	attrs, err := l.it.Next()
+	if errors.Is(err, iterator.Done) {
+		l.current = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	l.current = attrs
+	return nil
+}
+
+// attrs returns the attributes of the live generation of the GCS object of
+// key, as ObjectHandle.Attrs would, storage.ErrObjectNotExist if there is
+// none. Keys are expected in increasing order: one before the last key
+// looked up, as when the next prefix is listed, starts listing again from it.
+func (l *gcsListing) attrs(key string) (*storage.ObjectAttrs, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.started || key < l.last {
+		if err := l.seek(key); err != nil {
+			return nil, err
+		}
+	}
+	l.last = key
+	for l.current != nil && l.current.Name < key {
+		if err := l.advance(); err != nil {
+			return nil, err
+		}
+	}
+	if l.current != nil && l.current.Name == key {
+		return l.current, nil
+	}
+	return nil, storage.ErrObjectNotExist
+}
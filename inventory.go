@@ -0,0 +1,180 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// inventoryManifest is the manifest.json of an S3 Inventory report, listing
+// the data files of the report.
+type inventoryManifest struct {
+	SourceBucket      string `json:"sourceBucket"`
+	DestinationBucket string `json:"destinationBucket"`
+	FileFormat        string `json:"fileFormat"`
+	FileSchema        string `json:"fileSchema"`
+	CreationTimestamp string `json:"creationTimestamp"` // Milliseconds since the epoch
+	Files             []struct {
+		Key  string `json:"key"`
+		Size int64  `json:"size"`
+	} `json:"files"`
+}
+
+// Fields of the inventory a copy needs.
+var requiredInventoryFields = []string{"Key", "Size", "LastModifiedDate", "ETag"}
+
+// inventoryLister returns an objectLister reading the objects of the S3
+// Inventory report whose manifest.json is at manifestURI, instead of listing
+// the bucket. Only the CSV format is supported. The manifest is read and
+// checked right away.
+func inventoryLister(ctx context.Context, s3Client *s3.S3, manifestURI string, s3Bucket string, prefix string) objectLister {
+	manifestLocation, err := parseLocation(manifestURI)
+	if err != nil || manifestLocation.scheme != "s3" || manifestLocation.prefix == "" {
+		log.Fatalf("Invalid -inventory value %q, must be the s3:// URI of a manifest.json", manifestURI)
+	}
+
+	output, err := s3Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(manifestLocation.bucket),
+		Key:    aws.String(manifestLocation.prefix),
+	})
+	if err != nil {
+		log.Fatalf("Error reading inventory manifest %s: %v", manifestURI, err)
+	}
+	var manifest inventoryManifest
+	err = json.NewDecoder(output.Body).Decode(&manifest)
+	output.Body.Close()
+	if err != nil {
+		log.Fatalf("Error reading inventory manifest %s: %v", manifestURI, err)
+	}
+
+	if manifest.SourceBucket != s3Bucket && !isS3AccessPoint(s3Bucket) {
+		log.Fatalf("Inventory %s is of bucket %s, not %s", manifestURI, manifest.SourceBucket, s3Bucket)
+	}
+	if manifest.FileFormat != "CSV" {
+		log.Fatalf("Inventory %s is in %s format, only CSV is supported", manifestURI, manifest.FileFormat)
+	}
+
+	columns := make(map[string]int)
+	for i, field := range strings.Split(manifest.FileSchema, ",") {
+		columns[strings.TrimSpace(field)] = i
+	}
+	for _, field := range requiredInventoryFields {
+		if _, ok := columns[field]; !ok {
+			log.Fatalf("Inventory %s has no %s field, it must include %s", manifestURI, field, strings.Join(requiredInventoryFields, ", "))
+		}
+	}
+
+	// Reports are written to another bucket, named by its ARN
+	destinationBucket := strings.TrimPrefix(manifest.DestinationBucket, "arn:aws:s3:::")
+	if created, err := strconv.ParseInt(manifest.CreationTimestamp, 10, 64); err == nil {
+		log.Printf("Inventory: %s, %d files, created %s", manifestURI, len(manifest.Files), time.UnixMilli(created).UTC().Format(time.RFC3339))
+	} else {
+		log.Printf("Inventory: %s, %d files", manifestURI, len(manifest.Files))
+	}
+
+	return func(fn func(page *s3.ListObjectsV2Output, lastPage bool) bool) error {
+		page := &s3.ListObjectsV2Output{}
+		for _, file := range manifest.Files {
+			more, err := readInventoryFile(ctx, s3Client, destinationBucket, file.Key, columns, prefix, func(s3Object *s3.Object) bool {
+				page.Contents = append(page.Contents, s3Object)
+				if len(page.Contents) < 1000 {
+					return true
+				}
+				more := fn(page, false)
+				page = &s3.ListObjectsV2Output{}
+				return more
+			})
+			if err != nil {
+				return err
+			}
+			if !more {
+				return nil
+			}
+		}
+		fn(page, true)
+		return nil
+	}
+}
+
+// readInventoryFile calls fn with the current version of every object under
+// prefix in a gzipped CSV file of an inventory report, until fn returns false.
+// It returns whether fn always returned true.
+func readInventoryFile(ctx context.Context, s3Client *s3.S3, bucket string, key string, columns map[string]int, prefix string, fn func(s3Object *s3.Object) bool) (bool, error) {
+	output, err := s3Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return false, fmt.Errorf("reading inventory file %s: %w", key, err)
+	}
+	defer output.Body.Close()
+
+	gzipReader, err := gzip.NewReader(output.Body)
+	if err != nil {
+		return false, fmt.Errorf("reading inventory file %s: %w", key, err)
+	}
+	reader := csv.NewReader(gzipReader)
+	reader.FieldsPerRecord = -1
+
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return true, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("reading inventory file %s: %w", key, err)
+		}
+
+		// Inventories of versioned buckets list every version, the other
+		// versions are found like when listing the bucket
+		if field(record, "IsLatest") == "false" || field(record, "IsDeleteMarker") == "true" {
+			continue
+		}
+
+		// Keys are URL encoded in inventory reports
+		objectKey, err := url.QueryUnescape(field(record, "Key"))
+		if err != nil {
+			return false, fmt.Errorf("invalid key %q in inventory file %s: %w", field(record, "Key"), key, err)
+		}
+		if !strings.HasPrefix(objectKey, prefix) {
+			continue
+		}
+		size, err := strconv.ParseInt(field(record, "Size"), 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("invalid size of %s in inventory file %s: %w", objectKey, key, err)
+		}
+		lastModified, err := time.Parse(time.RFC3339, field(record, "LastModifiedDate"))
+		if err != nil {
+			return false, fmt.Errorf("invalid last modified date of %s in inventory file %s: %w", objectKey, key, err)
+		}
+
+		// ETags are quoted when listing the bucket, and in GCS metadata
+		if !fn(&s3.Object{
+			Key:          aws.String(objectKey),
+			Size:         aws.Int64(size),
+			ETag:         aws.String(`"` + field(record, "ETag") + `"`),
+			LastModified: aws.Time(lastModified),
+		}) {
+			return false, nil
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// kmsKeyUsage counts the objects encrypted in a given way.
+type kmsKeyUsage struct {
+	ServerSideEncryption string `json:"serverSideEncryption"`
+	KMSKeyID             string `json:"kmsKeyId,omitempty"`
+	Objects              int64  `json:"objects"`
+	Bytes                int64  `json:"bytes"`
+}
+
+// kmsReport is the document written by the kms-report subcommand.
+type kmsReport struct {
+	Bucket     string         `json:"bucket"`
+	Prefix     string         `json:"prefix,omitempty"`
+	Versions   bool           `json:"versions"`
+	Objects    int64          `json:"objects"`
+	Bytes      int64          `json:"bytes"`
+	Encryption []*kmsKeyUsage `json:"encryption"`
+}
+
+// encryptionKeys tallies the server side encryption of S3 objects.
+type encryptionKeys struct {
+	mutex sync.Mutex
+	usage map[kmsKeyUsage]*kmsKeyUsage
+}
+
+func newEncryptionKeys() *encryptionKeys {
+	return &encryptionKeys{usage: make(map[kmsKeyUsage]*kmsKeyUsage)}
+}
+
+func (k *encryptionKeys) add(serverSideEncryption, kmsKeyID *string, size int64) {
+	key := kmsKeyUsage{
+		ServerSideEncryption: aws.StringValue(serverSideEncryption),
+		KMSKeyID:             aws.StringValue(kmsKeyID),
+	}
+	if key.ServerSideEncryption == "" {
+		key.ServerSideEncryption = "none"
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	usage, ok := k.usage[key]
+	if !ok {
+		usage = &kmsKeyUsage{ServerSideEncryption: key.ServerSideEncryption, KMSKeyID: key.KMSKeyID}
+		k.usage[key] = usage
+	}
+	usage.Objects++
+	usage.Bytes += size
+}
+
+// summary returns the usage of every key, most used first.
+func (k *encryptionKeys) summary() []*kmsKeyUsage {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	summary := make([]*kmsKeyUsage, 0, len(k.usage))
+	for _, usage := range k.usage {
+		summary = append(summary, usage)
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		if summary[i].Objects != summary[j].Objects {
+			return summary[i].Objects > summary[j].Objects
+		}
+		return summary[i].KMSKeyID < summary[j].KMSKeyID
+	})
+	return summary
+}
+
+func (k *encryptionKeys) log() {
+	for _, usage := range k.summary() {
+		if usage.KMSKeyID != "" {
+			log.Printf("Encryption %s, key %s: %s objects, %s", usage.ServerSideEncryption, usage.KMSKeyID,
+				printer.Sprintf("%d", usage.Objects), formatBytes(usage.Bytes))
+		} else {
+			log.Printf("Encryption %s: %s objects, %s", usage.ServerSideEncryption,
+				printer.Sprintf("%d", usage.Objects), formatBytes(usage.Bytes))
+		}
+	}
+}
+
+func runKMSReport(args []string) {
+	flags := flag.NewFlagSet("kms-report", flag.ExitOnError)
+	reportPath := flags.String("report", "-", "Write the report to this file (default: standard output)")
+	outputFormat := addOutputFlag(flags)
+	versionsFlag := flags.Bool("versions", false, "Include every version of the objects, not only the current one")
+	concurrency := flags.Int("concurrency", runtime.NumCPU(), "Number of HeadObject calls made concurrently")
+	var s3Opts s3Options
+	addS3Flags(flags, &s3Opts)
+	addLogFlags(flags)
+	flags.Parse(args)
+	setupLogging()
+	checkOutputFormat(*outputFormat)
+
+	if len(flags.Args()) < 1 || len(flags.Args()) > 2 {
+		log.Fatal("Usage: ./s3-to-gcs kms-report [-report <file>] [-output json|csv|table] [-versions] [-concurrency <n>] <S3 bucket> [optional object key prefix]")
+	}
+
+	buckets, objectKeyPrefix := parseBucketArgs(flags.Args(), "s3")
+	s3Bucket := buckets[0]
+
+	s3Opts.log()
+	s3Client := newS3Client(s3Opts)
+	ctx := context.Background()
+	keys := newEncryptionKeys()
+
+	report := &kmsReport{
+		Bucket:   s3Bucket,
+		Prefix:   objectKeyPrefix,
+		Versions: *versionsFlag,
+	}
+
+	wg := sync.WaitGroup{}
+	headSemaphore := make(chan struct{}, *concurrency)
+
+	headObjectFn := func(key, versionID *string, size int64) {
+		report.Objects++
+		report.Bytes += size
+
+		wg.Add(1)
+		headSemaphore <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-headSemaphore }()
+
+			output, err := s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+				Bucket:    aws.String(s3Bucket),
+				Key:       key,
+				VersionId: versionID,
+			})
+			if err != nil {
+				log.Fatal("Error getting object " + *key + " from bucket " + s3Bucket + ": " + err.Error())
+			}
+			keys.add(output.ServerSideEncryption, output.SSEKMSKeyId, size)
+		}()
+	}
+
+	var prefix *string
+	if objectKeyPrefix != "" {
+		prefix = aws.String(objectKeyPrefix)
+	}
+
+	var err error
+	if *versionsFlag {
+		err = s3Client.ListObjectVersionsPagesWithContext(ctx, &s3.ListObjectVersionsInput{
+			Bucket: aws.String(s3Bucket),
+			Prefix: prefix,
+		}, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+			for _, version := range page.Versions {
+				if !isFolderKey(*version.Key) {
+					headObjectFn(version.Key, version.VersionId, *version.Size)
+				}
+			}
+			return true
+		})
+	} else {
+		err = s3Client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket: aws.String(s3Bucket),
+			Prefix: prefix,
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, object := range page.Contents {
+				if !isFolderKey(*object.Key) {
+					headObjectFn(object.Key, nil, *object.Size)
+				}
+			}
+			return true
+		})
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	wg.Wait()
+
+	report.Encryption = keys.summary()
+	keys.log()
+
+	var output io.Writer = os.Stdout
+	if *reportPath != "-" {
+		reportFile, err := os.Create(*reportPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer reportFile.Close()
+		output = reportFile
+	}
+
+	if *outputFormat != outputJSON {
+		table := newTableWriter(output, *outputFormat, "serverSideEncryption", "kmsKeyId", "objects", "bytes")
+		for _, usage := range report.Encryption {
+			table.write(usage.ServerSideEncryption, usage.KMSKeyID, strconv.FormatInt(usage.Objects, 10), strconv.FormatInt(usage.Bytes, 10))
+		}
+		table.flush()
+		return
+	}
+
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.Fatal(err)
+	}
+}
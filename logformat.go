@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values of -log-format.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// Levels of object events. Other lines, such as the options, statistics and
+// fatal errors, are always logged.
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+var (
+	logFormat    = logFormatText
+	logLevelName = "info"
+	quietLogging bool
+
+	// minLogLevel is the index in logLevels of -log-level
+	minLogLevel = 1
+)
+
+// addLogFlags registers the flags controlling the log output, shared by all
+// commands.
+func addLogFlags(flags *flag.FlagSet) {
+	flags.StringVar(&logFormat, "log-format", logFormatText, "Log format: text, or json for one JSON object per line")
+	flags.StringVar(&logLevelName, "log-level", logLevelName, "Minimum level of the lines logged about objects: debug (objects already up to date), info (objects copied, skipped or deleted), warn (mismatches) or error")
+	flags.BoolVar(&quietLogging, "quiet", false, "Same as -log-level warn, and no periodic statistics")
+}
+
+// setupLogging applies the log flags once they have been parsed.
+func setupLogging() {
+	minLogLevel = -1
+	for i, name := range logLevels {
+		if name == logLevelName {
+			minLogLevel = i
+		}
+	}
+	if minLogLevel == -1 {
+		log.Fatalf("Invalid -log-level value %q, must be one of %s", logLevelName, strings.Join(logLevels, ", "))
+	}
+	if quietLogging && minLogLevel < 2 {
+		minLogLevel = 2
+	}
+
+	switch logFormat {
+	case logFormatText:
+	case logFormatJSON:
+		log.SetFlags(0)
+		log.SetOutput(&jsonLogWriter{})
+	default:
+		log.Fatalf("Invalid -log-format value %q, must be %s or %s", logFormat, logFormatText, logFormatJSON)
+	}
+}
+
+// Actions of object events.
+const (
+	actionCopy     = "copy"
+	actionCopied   = "copied"
+	actionMatch    = "match"
+	actionSkip     = "skip"
+	actionDelete   = "delete"
+	actionMismatch = "mismatch"
+	actionError    = "error"
+)
+
+// Reasons of objects not copied, recorded with their events and in the
+// transfer manifest, so that why an object was not copied can be queried.
+const (
+	reasonExistsIdentical = "exists-identical" // An identical object is in GCS, or in -skip-if-exists-in
+	reasonTooLarge        = "too-large"        // Larger than -max-object-size
+	reasonArchivedClass   = "archived-class"   // In an archive storage class, and not restored
+	reasonFolderMarker    = "folder-marker"    // A folder placeholder
+	reasonDeleteMarker    = "delete-marker"    // Deleted in S3, its latest version is a delete marker
+	reasonExistsDifferent = "exists-different" // A different object is in GCS, kept by -on-exists skip
+	reasonGCSNewer        = "gcs-newer"        // A different object at least as recent is in GCS, kept by -on-exists overwrite-if-newer
+	reasonGCSChanged      = "gcs-changed"      // Written to GCS by another writer during the copy
+	reasonNameCollision   = "name-collision"   // Rewritten into the GCS name of another key, skipped by -on-collision skip
+)
+
+// Reasons of mismatches, counted by reason in the summary of the run.
+const (
+	reasonETagChanged = "etag-changed" // The ETag recorded in GCS is not that of the S3 object
+	reasonETagMissing = "etag-missing" // No ETag is recorded in GCS
+	reasonACLUnmapped = "acl-unmapped" // The S3 ACL has no GCS equivalent
+	reasonGCSMissing  = "gcs-missing"  // Not in GCS after a Storage Transfer Service transfer
+
+	reasonContentMismatch = "content-mismatch" // The content copied does not match what was read from S3
+)
+
+// objectEventLevel returns the index in logLevels of the events of action.
+func objectEventLevel(action string) int {
+	switch action {
+	case actionMatch:
+		return 0
+	case actionMismatch:
+		return 2
+	case actionError:
+		return 3
+	}
+	return 1
+}
+
+// objectEvent is a log line about a single object. In JSON logs, its fields
+// can be queried once the logs are ingested into Cloud Logging or ELK.
+type objectEvent struct {
+	Time     time.Time `json:"time"`
+	Level    string    `json:"level"`
+	Key      string    `json:"key"`
+	Action   string    `json:"action"`
+	Reason   string    `json:"reason,omitempty"`
+	Bytes    int64     `json:"bytes,omitempty"`
+	Duration float64   `json:"durationSeconds,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Message  string    `json:"message"`
+}
+
+var jsonLogMutex sync.Mutex
+
+func writeJSONLog(value any) {
+	jsonLogMutex.Lock()
+	defer jsonLogMutex.Unlock()
+	if err := json.NewEncoder(os.Stderr).Encode(value); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// logObject logs an object event, as JSON or as its message, unless its level
+// is below -log-level.
+func logObject(event objectEvent) {
+	level := objectEventLevel(event.Action)
+	if level >= 2 {
+		recordRecentError("object "+event.Key, event.Message)
+	}
+	if event.Action == actionMismatch {
+		countMismatch(event.Reason)
+	}
+	if level < minLogLevel {
+		return
+	}
+	if logFormat != logFormatJSON {
+		log.Print(event.Message)
+		return
+	}
+	event.Time = time.Now()
+	event.Level = logLevels[level]
+	writeJSONLog(event)
+}
+
+// fatalObject logs an error copying an object, reports the summary of the
+// run and exits.
+func fatalObject(key string, err error, message string) {
+	logObject(objectEvent{Key: key, Action: actionError, Error: err.Error(), Message: message + ": " + err.Error()})
+	countFailure(err)
+	if failureSummary != nil {
+		failureSummary()
+	}
+	shutdownTracing()
+	os.Exit(1)
+}
+
+// jsonLogWriter turns the lines of the standard logger into JSON objects.
+type jsonLogWriter struct{}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	writeJSONLog(struct {
+		Time    time.Time `json:"time"`
+		Message string    `json:"message"`
+	}{time.Now(), strings.TrimSuffix(string(p), "\n")})
+	return len(p), nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// logSampler logs only one in every of the per-object lines it is given, to
+// keep the logs of runs over millions of objects manageable. It is a
+// flag.Value parsed from "1/<every>"; the zero value logs every line.
+type logSampler struct {
+	every int64
+	count atomic.Int64
+}
+
+func (s *logSampler) String() string {
+	if s == nil || s.every <= 1 {
+		return "1/1"
+	}
+	return fmt.Sprintf("1/%d", s.every)
+}
+
+func (s *logSampler) Set(value string) error {
+	denominator, ok := strings.CutPrefix(strings.TrimSpace(value), "1/")
+	if !ok {
+		return fmt.Errorf("invalid sample rate %q, expected 1/<n>", value)
+	}
+	every, err := strconv.ParseInt(denominator, 10, 64)
+	if err != nil || every < 1 {
+		return fmt.Errorf("invalid sample rate %q, expected 1/<n>", value)
+	}
+	s.every = every
+	return nil
+}
+
+// log logs the first event and then every s.every-th event. A nil sampler
+// logs every event.
+func (s *logSampler) log(event objectEvent) {
+	if s != nil && s.every > 1 && (s.count.Add(1)-1)%s.every != 0 {
+		return
+	}
+	logObject(event)
+}
@@ -1,23 +1,39 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
 	"os"
-	"runtime"
+	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/googleapis/gax-go/v2"
+	"google.golang.org/api/impersonate"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 
 	"golang.org/x/text/language"
 	"golang.org/x/text/message"
@@ -25,6 +41,54 @@ import (
 
 var printer = message.NewPrinter(language.English)
 
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// encodeCRC32C returns the base64 encoding of a big-endian CRC32C checksum,
+// which is the representation used by both S3 and GCS.
+func encodeCRC32C(sum uint32) string {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], sum)
+	return base64.StdEncoding.EncodeToString(buf[:])
+}
+
+// decodeCRC32C is the inverse of encodeCRC32C. It reports false if encoded is
+// empty or not a valid checksum.
+func decodeCRC32C(encoded string) (uint32, bool) {
+	sum, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sum) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(sum), true
+}
+
+// s3ContentMD5 returns the MD5 digest of an S3 object when its ETag is known
+// to be one. Multipart uploads and SSE-KMS/SSE-C encrypted objects have ETags
+// that are not a digest of the content, in which case nil is returned.
+func s3ContentMD5(etag, serverSideEncryption, sseCustomerAlgorithm *string) []byte {
+	if etag == nil || sseCustomerAlgorithm != nil {
+		return nil
+	}
+	if serverSideEncryption != nil && *serverSideEncryption == s3.ServerSideEncryptionAwsKms {
+		return nil
+	}
+	sum, err := hex.DecodeString(strings.Trim(*etag, `"`))
+	if err != nil || len(sum) != md5.Size {
+		return nil
+	}
+	return sum
+}
+
+func s3ObjectMD5(output *s3.GetObjectOutput) []byte {
+	return s3ContentMD5(output.ETag, output.ServerSideEncryption, output.SSECustomerAlgorithm)
+}
+
+// s3ObjectCRC32C returns the CRC32C checksum S3 stored for an object, if any.
+// Checksums of multipart uploads are checksums of the part checksums and are
+// not usable for the object content.
+func s3ObjectCRC32C(output *s3.GetObjectOutput) (uint32, bool) {
+	return decodeCRC32C(aws.StringValue(output.ChecksumCRC32C))
+}
+
 func formatBytes(bytes int64) string {
 	const unit = 1024
 	if bytes < unit {
@@ -38,6 +102,91 @@ func formatBytes(bytes int64) string {
 	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
 
+var byteSizeUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kb":  1000,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mb":  1000 * 1000,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gb":  1000 * 1000 * 1000,
+	"gib": 1 << 30,
+	"t":   1 << 40,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"tib": 1 << 40,
+	"p":   1 << 50,
+	"pb":  1000 * 1000 * 1000 * 1000 * 1000,
+	"pib": 1 << 50,
+}
+
+// parseBytes parses a human readable size such as "512", "1.5GiB" or "5TB".
+// Decimal (KB, MB, ...) and binary (KiB, MiB, ...) units are supported, and
+// single letter units are treated as binary.
+func parseBytes(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	i := strings.IndexFunc(value, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i == -1 {
+		i = len(value)
+	}
+	number, err := strconv.ParseFloat(value[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	unit, ok := byteSizeUnits[strings.ToLower(strings.TrimSpace(value[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit in %q", value)
+	}
+	return int64(number * unit), nil
+}
+
+// byteSize is a flag.Value holding a size parsed by parseBytes.
+type byteSize int64
+
+func (b *byteSize) String() string {
+	if *b == 0 {
+		return ""
+	}
+	return formatBytes(int64(*b))
+}
+
+func (b *byteSize) Set(value string) error {
+	size, err := parseBytes(value)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(size)
+	return nil
+}
+
+// bandwidth is a flag.Value holding a transfer rate in bytes per second, such
+// as "200MiB/s", parsed by parseBytes.
+type bandwidth int64
+
+func (b *bandwidth) String() string {
+	if *b == 0 {
+		return ""
+	}
+	return formatBytes(int64(*b)) + "/s"
+}
+
+func (b *bandwidth) Set(value string) error {
+	value = strings.TrimSpace(value)
+	if strings.HasSuffix(strings.ToLower(value), "/s") {
+		value = value[:len(value)-2]
+	}
+	rate, err := parseBytes(value)
+	if err != nil {
+		return err
+	}
+	*b = bandwidth(rate)
+	return nil
+}
+
 func formatDuration(d time.Duration) string {
 	days := int(d.Hours() / 24)
 	hours := int(d.Hours()) % 24
@@ -73,6 +222,11 @@ func deleteAllVersions(ctx context.Context, bucket *storage.BucketHandle, object
 			return err
 		}
 
+		// The prefix also matches sibling keys such as "foo.bak" for "foo"
+		if attrs.Name != objectKey {
+			continue
+		}
+
 		// Delete the specific version of the object
 		object := bucket.Object(attrs.Name).Generation(attrs.Generation)
 		if err := object.Delete(ctx); err != nil {
@@ -83,264 +237,1145 @@ func deleteAllVersions(ctx context.Context, bucket *storage.BucketHandle, object
 	return nil
 }
 
-func main() {
-	forceFlag := flag.Bool("force", false, "Force copying objects, skipping checksum comparison")
-	flag.Parse()
+// uploadResult describes the content written by uploadToGCS.
+type uploadResult struct {
+	bytes      int64
+	crc32c     uint32
+	md5        []byte
+	generation int64
+}
 
-	if len(flag.Args()) < 2 || len(flag.Args()) > 3 {
-		log.Fatal("Usage: ./s3-to-gcs [-force] <S3 bucket> <GCS bucket> [optional object key prefix]")
+// sourceReadError is an error reading the content of an upload, as opposed
+// to writing it to GCS.
+type sourceReadError struct {
+	err error
+}
+
+func (e *sourceReadError) Error() string { return e.err.Error() }
+func (e *sourceReadError) Unwrap() error { return e.err }
+
+// sourceReader returns the errors of reader as sourceReadErrors.
+type sourceReader struct {
+	reader io.Reader
+}
+
+func (r sourceReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = &sourceReadError{err: err}
 	}
+	return n, err
+}
 
-	s3Bucket := flag.Arg(0)
-	gcsBucket := flag.Arg(1)
+// uploadErrorMessage returns the message of an error of uploadToGCS, telling
+// whether reading the source or writing to GCS failed.
+func uploadErrorMessage(err error, source string, destination string) string {
+	var readErr *sourceReadError
+	if errors.As(err, &readErr) {
+		return "Error reading " + source
+	}
+	return "Error writing " + destination
+}
 
-	var objectKeyPrefix string
-	if len(flag.Args()) == 3 {
-		objectKeyPrefix = flag.Arg(2)
+// uploadToGCS streams body into a new generation of the GCS object, computing
+// the CRC32C and MD5 checksums of the content on the way through, and compares
+// them with the checksums GCS reports for what it stored. A corrupt upload is
+// deleted again, with a contentMismatch error. configure, if not nil, is
+// called to set up the writer before anything is written. Errors reading body
+// are sourceReadErrors. The write is conditioned on conditions, if not nil.
+func uploadToGCS(ctx context.Context, gcsObject *storage.ObjectHandle, conditions *storage.Conditions, body io.Reader, configure func(*storage.Writer)) (uploadResult, error) {
+	// Cancelling the upload abandons it, closing the writer would instead
+	// commit what was written so far
+	writeCtx, cancelWrite := context.WithCancel(ctx)
+	defer cancelWrite()
+	writeObject := gcsObject
+	if conditions != nil {
+		writeObject = gcsObject.If(*conditions)
 	}
+	gcsObjectWriter := writeObject.NewWriter(writeCtx)
+	defer gcsObjectWriter.Close()
 
-	log.Printf("S3 bucket: %s", s3Bucket)
-	log.Printf("GCS bucket: %s", gcsBucket)
-	if objectKeyPrefix != "" {
-		log.Printf("Object key prefix: %s", objectKeyPrefix)
+	if configure != nil {
+		configure(gcsObjectWriter)
+	}
+
+	crc32cHash := crc32.New(crc32cTable)
+	md5Hash := md5.New()
+	bytesCopied, err := io.Copy(io.MultiWriter(gcsObjectWriter, crc32cHash, md5Hash), sourceReader{reader: body})
+	if err != nil {
+		cancelWrite()
+		return uploadResult{}, err
+	}
+
+	if err := gcsObjectWriter.Close(); err != nil {
+		return uploadResult{}, err
+	}
+
+	writtenAttrs := gcsObjectWriter.Attrs()
+	result := uploadResult{
+		bytes:      bytesCopied,
+		crc32c:     crc32cHash.Sum32(),
+		md5:        md5Hash.Sum(nil),
+		generation: writtenAttrs.Generation,
+	}
+
+	// An object encrypted with another key, such as the default key of the
+	// bucket, would not meet the requirement the key was given for
+	if key := gcsObjectWriter.KMSKeyName; key != "" && !strings.HasPrefix(writtenAttrs.KMSKeyName, key+"/") {
+		if err := gcsObject.Generation(writtenAttrs.Generation).Delete(ctx); err != nil {
+			log.Printf("Error deleting object %s (generation %d) encrypted with the wrong key: %v", writtenAttrs.Name, writtenAttrs.Generation, err)
+		}
+		return uploadResult{}, fmt.Errorf("encryption key mismatch:\n  Requested KMS key: %s\n  GCS KMS key: %s", key, writtenAttrs.KMSKeyName)
+	}
+
+	// Compare what we read with what GCS says it stored
+	if writtenAttrs.CRC32C != result.crc32c || (len(writtenAttrs.MD5) > 0 && !bytes.Equal(writtenAttrs.MD5, result.md5)) {
+		if err := gcsObject.Generation(writtenAttrs.Generation).Delete(ctx); err != nil {
+			log.Printf("Error deleting corrupt object %s (generation %d): %v", writtenAttrs.Name, writtenAttrs.Generation, err)
+		}
+		return uploadResult{}, contentMismatch{fmt.Errorf("checksum mismatch:\n  Read CRC32C: %s\n  GCS CRC32C: %s\n  Read MD5: %s\n  GCS MD5: %s",
+			encodeCRC32C(result.crc32c), encodeCRC32C(writtenAttrs.CRC32C),
+			base64.StdEncoding.EncodeToString(result.md5), base64.StdEncoding.EncodeToString(writtenAttrs.MD5))}
+	}
+
+	return result, nil
+}
+
+// defaultTagPrefix is prepended to the names of S3 tags to name the GCS
+// metadata entries they are copied to.
+const defaultTagPrefix = "x-s3-tag-"
+
+// Metadata entries added to every GCS object on top of the S3 user metadata.
+const (
+	metadataKeyETag         = "ETag"
+	metadataKeyCRC32C       = "CRC32C"
+	metadataKeyMD5          = "MD5"
+	metadataKeyLastModified = "LastModified"
+	metadataKeyVersionID    = "VersionId"
+
+	// The modification time of the file, in seconds since the epoch, as
+	// gcloud storage and gsutil record and restore it
+	metadataKeyFileMtime = "goog-reserved-file-mtime"
+)
+
+func isToolMetadataKey(key string) bool {
+	switch key {
+	case metadataKeyETag, metadataKeyCRC32C, metadataKeyMD5, metadataKeyLastModified, metadataKeyVersionID, metadataKeyFileMtime, metadataKeyPartCount, metadataKeyPartSizes,
+		metadataKeyTranscoded, metadataKeySourceSize:
+		return true
+	}
+	return strings.HasPrefix(key, metadataKeyOriginalPrefix)
+}
+
+// Ways of deciding whether an existing GCS object is up to date.
+const (
+	compareETag      = "etag"
+	compareSizeMtime = "size-mtime"
+)
+
+// What is done with an existing GCS object that differs from its S3 object,
+// the values of -on-exists.
+const (
+	onExistsOverwrite        = "overwrite"
+	onExistsSkip             = "skip"
+	onExistsOverwriteIfNewer = "overwrite-if-newer"
+	onExistsFail             = "fail"
+)
+
+// gcsObjectModTime returns when the S3 object a GCS object was copied from
+// was last modified, or when the GCS object was created if it was not
+// recorded.
+func gcsObjectModTime(gcsObjectAttrs *storage.ObjectAttrs) time.Time {
+	if recorded, ok := gcsObjectAttrs.Metadata[metadataKeyLastModified]; ok {
+		if recordedTime, err := time.Parse(time.RFC3339, recorded); err == nil {
+			return recordedTime
+		}
 	}
-	log.Printf("Force copy: %t", *forceFlag)
+	return gcsObjectAttrs.Created
+}
+
+// modTimeMatches reports whether a GCS object was copied from the S3 object
+// version last modified at lastModified, give or take window. Objects copied
+// before the tool recorded modification times count as matching if they were
+// written after the S3 object last changed.
+func modTimeMatches(lastModified time.Time, gcsObjectAttrs *storage.ObjectAttrs, window time.Duration) bool {
+	if recorded, ok := gcsObjectAttrs.Metadata[metadataKeyLastModified]; ok {
+		recordedTime, err := time.Parse(time.RFC3339, recorded)
+		if err != nil {
+			return false
+		}
+		skew := recordedTime.Sub(lastModified.Truncate(time.Second))
+		return skew <= window && skew >= -window
+	}
+	return !gcsObjectAttrs.Created.Before(lastModified.Add(-window))
+}
 
-	awsRegion := os.Getenv("AWS_REGION")
+var gcsRetryer = storage.WithBackoff(gax.Backoff{
+	// Set the initial retry delay to a maximum of 2 seconds. The length of
+	// pauses between retries is subject to random jitter.
+	Initial: 2 * time.Second,
+	// Set the maximum retry delay to 60 seconds.
+	Max: 60 * time.Second,
+	// Set the backoff multiplier to 3.0.
+	Multiplier: 3,
+})
 
-	if awsRegion == "" {
-		log.Fatal("AWS_REGION environment variable must be set")
+// defaultS3MaxRetries is how many times S3 requests are retried by default,
+// more than the 3 of the SDK, as copies run for hours.
+const defaultS3MaxRetries = 10
+
+// s3Retryer retries S3 requests with exponential backoff, like gcsRetryer,
+// and waits longer after S3 asked to slow down.
+func s3Retryer(maxRetries int) client.DefaultRetryer {
+	return client.DefaultRetryer{
+		NumMaxRetries: maxRetries,
+		// The delay doubles from 1 second, with random jitter, up to 60
+		// seconds
+		MinRetryDelay: time.Second,
+		MaxRetryDelay: 60 * time.Second,
+		// Throttled requests start over from 2 seconds
+		MinThrottleDelay: 2 * time.Second,
+		MaxThrottleDelay: 60 * time.Second,
 	}
+}
 
-	sess, err := session.NewSession(&aws.Config{
-		Region: &awsRegion,
+// newAWSSession returns a session with the credentials and region of the
+// environment, or of the shared AWS configuration and credentials files,
+// including SSO sessions started with "aws sso login".
+func newAWSSession(options s3Options) *session.Session {
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Profile:           options.profile,
+		SharedConfigState: session.SharedConfigEnable,
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	s3Client := s3.New(sess)
+	if aws.StringValue(sess.Config.Region) == "" {
+		log.Fatal("AWS_REGION environment variable or the region of the AWS profile must be set")
+	}
 
-	versioningInput := &s3.GetBucketVersioningInput{
-		Bucket: aws.String(s3Bucket),
+	return sess
+}
+
+// s3Options select the S3 compatible store the S3 buckets are in.
+type s3Options struct {
+	// Profile of the shared AWS configuration, AWS_PROFILE or the default
+	// one if empty
+	profile string
+
+	// Role S3 requests are sent with, typically in the account of the
+	// bucket, and the external ID its trust policy requires
+	roleARN    string
+	externalID string
+
+	// "requester" to read requester pays buckets, billed to the account of
+	// the credentials
+	requestPayer string
+
+	// Customer-provided keys of SSE-C encrypted objects, a base64 key for
+	// every object read or a file of keys by prefix
+	sseCKey     string
+	sseCKeyFile string
+
+	endpoint       string
+	forcePathStyle bool
+	disableSSL     bool
+
+	// maxRetries is how many times failed S3 requests are retried
+	maxRetries int
+}
+
+// addS3Flags registers the flags selecting the S3 compatible store.
+func addS3Flags(flags *flag.FlagSet, options *s3Options) {
+	flags.StringVar(&options.profile, "aws-profile", "", "Profile of the AWS configuration and credentials files to use (default: AWS_PROFILE or the default profile)")
+	flags.StringVar(&options.roleARN, "aws-role-arn", "", "ARN of an IAM role to assume for S3 requests, e.g. to read a bucket in another account")
+	flags.StringVar(&options.externalID, "aws-external-id", "", "External ID to assume -aws-role-arn with, if its trust policy requires one")
+	flags.StringVar(&options.requestPayer, "s3-request-payer", "", "Set to requester to access requester pays S3 buckets, billing the requests and transfer to your AWS account")
+	flags.StringVar(&options.sseCKey, "s3-sse-c-key", "", "Base64 encoded 256 bit key to read SSE-C encrypted objects with, sent for every object read")
+	flags.StringVar(&options.sseCKeyFile, "s3-sse-c-key-file", "", "File of the keys of SSE-C encrypted objects, one \"s3://<bucket>/<prefix> <base64 key>\" per line, the longest prefix winning")
+	flags.StringVar(&options.endpoint, "s3-endpoint", "", "URL of an S3 compatible endpoint, such as MinIO, Cloudflare R2, Wasabi or Ceph (default: AWS)")
+	flags.BoolVar(&options.forcePathStyle, "s3-force-path-style", false, "Address buckets in the URL path instead of as a subdomain of the endpoint")
+	flags.BoolVar(&options.disableSSL, "s3-disable-ssl", false, "Connect to the S3 endpoint over plain HTTP")
+	flags.IntVar(&options.maxRetries, "s3-max-retries", defaultS3MaxRetries, "Number of times an S3 request that failed with a throttling, server or network error is retried, with exponential backoff")
+}
+
+// config returns the AWS configuration of S3 clients.
+func (o s3Options) config() *aws.Config {
+	config := aws.NewConfig().
+		WithS3UseARNRegion(true).
+		WithS3ForcePathStyle(o.forcePathStyle).
+		WithDisableSSL(o.disableSSL)
+	if o.endpoint != "" {
+		config = config.WithEndpoint(o.endpoint)
 	}
-	versioningOutput, err := s3Client.GetBucketVersioning(versioningInput)
+	return config
+}
+
+func (o s3Options) log() {
+	if o.profile != "" {
+		log.Printf("AWS profile: %s", o.profile)
+	}
+	if o.roleARN != "" {
+		log.Printf("AWS role: %s", o.roleARN)
+	}
+	if o.externalID != "" {
+		log.Print("AWS external ID: set")
+	}
+	if o.requestPayer != "" {
+		log.Printf("S3 request payer: %s", o.requestPayer)
+	}
+	if o.sseCKey != "" {
+		log.Print("S3 SSE-C key: set")
+	}
+	if o.sseCKeyFile != "" {
+		log.Printf("S3 SSE-C key file: %s", o.sseCKeyFile)
+	}
+	if o.endpoint != "" {
+		log.Printf("S3 endpoint: %s", o.endpoint)
+	}
+	if o.forcePathStyle {
+		log.Print("S3 path style addressing: true")
+	}
+	if o.disableSSL {
+		log.Print("S3 SSL disabled: true")
+	}
+	if o.maxRetries != defaultS3MaxRetries {
+		log.Printf("S3 max retries: %d", o.maxRetries)
+	}
+}
+
+// newS3Client returns an S3 client, sending requests with the credentials of
+// -aws-role-arn if given. The role is assumed again before its temporary
+// credentials expire.
+func newS3Client(options s3Options) *s3.S3 {
+	if options.externalID != "" && options.roleARN == "" {
+		log.Fatal("-aws-external-id requires -aws-role-arn")
+	}
+	if options.requestPayer != "" && options.requestPayer != s3.RequestPayerRequester {
+		log.Fatalf("Invalid -s3-request-payer value %q, must be %s", options.requestPayer, s3.RequestPayerRequester)
+	}
+	if options.maxRetries < 0 {
+		log.Fatalf("Invalid -s3-max-retries value %d, must not be negative", options.maxRetries)
+	}
+	sseCKeys, err := loadSSECKeys(options.sseCKey, options.sseCKeyFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	versionEnabled := false
+	sess := newAWSSession(options)
+	config := request.WithRetryer(options.config(), s3Retryer(options.maxRetries))
+	if options.roleARN != "" {
+		config = config.WithCredentials(stscreds.NewCredentials(sess, options.roleARN, func(provider *stscreds.AssumeRoleProvider) {
+			provider.RoleSessionName = "s3-to-gcs"
+			if options.externalID != "" {
+				provider.ExternalID = aws.String(options.externalID)
+			}
+		}))
+	}
+	s3Client := s3.New(sess, config)
 
-	if versioningOutput.Status != nil {
-		versionEnabled = *versioningOutput.Status == "Enabled"
+	// Every request, whatever its operation, acknowledges the charges
+	if options.requestPayer != "" {
+		s3Client.Handlers.Build.PushBack(func(r *request.Request) {
+			r.HTTPRequest.Header.Set("x-amz-request-payer", options.requestPayer)
+		})
+	}
+	if len(sseCKeys) > 0 {
+		useSSECKeys(s3Client, sseCKeys)
 	}
+	// Objects are stored in GCS with their S3 Content-Encoding, so their
+	// content must not be decompressed on the way. The handlers are only
+	// added once per client, which the copiers of copy-buckets share
+	requireIdentityEncoding(s3Client)
+	recordS3Retries(s3Client)
+	return s3Client
+}
 
-	log.Printf("S3 bucket – Versioning enabled: %t", versionEnabled)
+// gcsOptions select the identity GCS requests are sent with.
+type gcsOptions struct {
+	// Service account key or other credentials file, instead of Application
+	// Default Credentials
+	credentialsFile string
 
-	gcsRetryer := storage.WithBackoff(gax.Backoff{
-		// Set the initial retry delay to a maximum of 2 seconds. The length of
-		// pauses between retries is subject to random jitter.
-		Initial: 2 * time.Second,
-		// Set the maximum retry delay to 60 seconds.
-		Max: 60 * time.Second,
-		// Set the backoff multiplier to 3.0.
-		Multiplier: 3,
+	// Service account impersonated with the credentials
+	impersonateServiceAccount string
+
+	// Project billed for requests to requester pays buckets
+	userProject string
+
+	// Cloud KMS key the objects written are encrypted with, registered by
+	// addGCSKMSKeyFlag
+	kmsKey string
+}
+
+// addGCSFlags registers the flags selecting the GCS identity.
+func addGCSFlags(flags *flag.FlagSet, options *gcsOptions) {
+	flags.StringVar(&options.credentialsFile, "gcs-credentials-file", "", "Credentials file, such as a service account key, to send GCS requests with (default: Application Default Credentials)")
+	flags.StringVar(&options.userProject, "gcs-user-project", "", "Project billed for the requests, required by requester pays GCS buckets")
+	flags.StringVar(&options.impersonateServiceAccount, "gcs-impersonate-service-account", "", "Email of a service account to impersonate for GCS requests, which the credentials must be allowed to create tokens for")
+}
+
+// addGCSKMSKeyFlag registers -gcs-kms-key for the commands writing to GCS.
+func addGCSKMSKeyFlag(flags *flag.FlagSet, options *gcsOptions) {
+	flags.Func("gcs-kms-key", "Cloud KMS key to encrypt every GCS object written with, as projects/<project>/locations/<location>/keyRings/<key ring>/cryptoKeys/<key> (default: the default key of the bucket, if any)", func(value string) error {
+		if !isKMSKeyName(value) {
+			return fmt.Errorf("invalid key %q, expected projects/<project>/locations/<location>/keyRings/<key ring>/cryptoKeys/<key>", value)
+		}
+		options.kmsKey = value
+		return nil
 	})
+}
 
-	ctx := context.Background()
-	client, err := storage.NewClient(ctx)
+// isKMSKeyName reports whether name is the resource name of a Cloud KMS key,
+// without a key version.
+func isKMSKeyName(name string) bool {
+	parts := strings.Split(name, "/")
+	if len(parts) != 8 {
+		return false
+	}
+	for i, collection := range []string{"projects", "locations", "keyRings", "cryptoKeys"} {
+		if parts[2*i] != collection || parts[2*i+1] == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func (o gcsOptions) log() {
+	if o.credentialsFile != "" {
+		log.Printf("GCS credentials file: %s", o.credentialsFile)
+	}
+	if o.impersonateServiceAccount != "" {
+		log.Printf("GCS service account: %s", o.impersonateServiceAccount)
+	}
+	if o.userProject != "" {
+		log.Printf("GCS user project: %s", o.userProject)
+	}
+	if o.kmsKey != "" {
+		log.Printf("GCS KMS key: %s", o.kmsKey)
+	}
+}
+
+// bucket returns the handle of a GCS bucket, billing requests to the user
+// project if any.
+func (o gcsOptions) bucket(client *storage.Client, name string) *storage.BucketHandle {
+	handle := client.Bucket(name).Retryer(gcsRetryer, gcsRetryErrors)
+	if o.userProject != "" {
+		handle = handle.UserProject(o.userProject)
+	}
+	return handle
+}
+
+// newGCSClient returns a GCS client sending requests with the identity
+// selected by options.
+func newGCSClient(ctx context.Context, options gcsOptions) *storage.Client {
+	client, err := storage.NewClient(ctx, gcsClientOptions(ctx, options, storage.ScopeFullControl)...)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer client.Close()
+	return client
+}
 
-	var filesCopied int64
-	var totalBytesCopied int64
-	var copyStartTime time.Time
-	var copyMutex sync.Mutex
-
-	wg := sync.WaitGroup{}
-
-	reportStatsFn := func() {
-		copyMutex.Lock()
-		defer copyMutex.Unlock()
-		copyDuration := time.Since(copyStartTime)
-		mbPerSec := float64(totalBytesCopied) / copyDuration.Seconds() / (1024 * 1024)
-		formattedBytes := formatBytes(totalBytesCopied)
-		formattedFiles := printer.Sprintf("%d", filesCopied)
-		formattedDuration := formatDuration(copyDuration)
-		log.Printf("Copied %s files, total size: %s, time taken: %s, MB/sec: %.2f", formattedFiles, formattedBytes, formattedDuration, mbPerSec)
-	}
-
-	ticker := time.NewTicker(5 * time.Second)
-	quit := make(chan struct{})
-
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				reportStatsFn()
-			case <-quit:
-				ticker.Stop()
-				return
-			}
+// gcsClientOptions returns the options of the clients of Google Cloud APIs,
+// with the credentials the GCS flags give, impersonating a service account
+// for the given scope.
+func gcsClientOptions(ctx context.Context, options gcsOptions, scope string) []option.ClientOption {
+	var opts []option.ClientOption
+	if options.credentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(options.credentialsFile))
+	}
+	if options.impersonateServiceAccount != "" {
+		tokenSource, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: options.impersonateServiceAccount,
+			Scopes:          []string{scope},
+		}, opts...)
+		if err != nil {
+			log.Fatal(err)
 		}
-	}()
-
-	// Create a buffered channel to control the number of concurrent copy operations
-	numCores := runtime.NumCPU()
-	bufferSize := numCores / 2
-	if bufferSize < 1 {
-		bufferSize = 1
+		opts = []option.ClientOption{option.WithTokenSource(tokenSource)}
 	}
-	copySemaphore := make(chan struct{}, bufferSize)
+	return opts
+}
 
-	copyFileVersionFn := func(awsKey string, awsVersion string, gcsObject *storage.ObjectHandle) {
-		defer wg.Done()
-		defer func() { <-copySemaphore }() // Release the semaphore when the function exits
+// parseGCSURI splits a gs://bucket/prefix URI into its bucket and prefix.
+func parseGCSURI(uri string) (bucket, prefix string, err error) {
+	if !strings.HasPrefix(uri, "gs://") {
+		return "", "", fmt.Errorf("%q is not a gs:// URI", uri)
+	}
+	bucket, prefix, _ = strings.Cut(strings.TrimPrefix(uri, "gs://"), "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("%q has no bucket name", uri)
+	}
+	return bucket, prefix, nil
+}
 
-		s3ObjectOutput, err := s3Client.GetObject(&s3.GetObjectInput{
-			Bucket:    aws.String(s3Bucket),
-			Key:       aws.String(awsKey),
-			VersionId: aws.String(awsVersion),
-		})
+// parseBucketArgs parses the positional arguments of a command: one bucket
+// per scheme, followed by an optional object key prefix. Buckets can be given
+// as names or as s3://bucket/prefix and gs://bucket/prefix URIs. A prefix can
+// be given in the URIs or as the last argument, but all the prefixes given
+// must be the same, as objects keep their key.
+func parseBucketArgs(args []string, schemes ...string) (buckets []string, prefix string) {
+	var prefixes []string
+	if len(args) > len(schemes) {
+		prefixes = append(prefixes, args[len(schemes)])
+	}
 
-		if err != nil {
-			log.Fatal("Error getting object " + awsKey + " from bucket " + s3Bucket + ": " + err.Error())
+	for i, scheme := range schemes {
+		bucket := args[i]
+		if strings.Contains(bucket, "://") {
+			l, err := parseLocation(bucket)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if l.scheme != scheme {
+				log.Fatalf("Expected a bucket name or %s:// URI, got %q", scheme, bucket)
+			}
+			bucket = l.bucket
+			if l.prefix != "" {
+				prefixes = append(prefixes, l.prefix)
+			}
+		}
+		if scheme == "s3" {
+			checkS3Bucket(bucket)
 		}
+		buckets = append(buckets, bucket)
+	}
 
-		gcsObjectWriter := gcsObject.NewWriter(ctx)
-		defer gcsObjectWriter.Close()
+	for _, p := range prefixes {
+		if prefix != "" && p != prefix {
+			log.Fatalf("Different object key prefixes %q and %q given, objects are copied under the same key", prefix, p)
+		}
+		prefix = p
+	}
+	return buckets, prefix
+}
 
-		// write to gcsObjectWriter
-		bytesCopied, err := io.Copy(gcsObjectWriter, s3ObjectOutput.Body)
+// checkS3Bucket exits if an S3 bucket argument cannot be used. Besides bucket
+// names, access point aliases and the ARNs of access points are accepted; the
+// SDK sends requests for an access point ARN to the access point endpoint of
+// the ARN's region. Multi-Region Access Points need requests signed with
+// SigV4A, which the SDK does not implement.
+func checkS3Bucket(bucket string) {
+	isMultiRegion := strings.HasSuffix(bucket, ".mrap")
+	if arn.IsARN(bucket) {
+		parsed, err := arn.Parse(bucket)
 		if err != nil {
-			log.Fatal("Error copying object " + awsKey + " from bucket " + s3Bucket + ": " + err.Error())
+			log.Fatalf("Invalid S3 access point ARN %q: %v", bucket, err)
+		}
+		if !strings.HasPrefix(parsed.Resource, "accesspoint/") && !strings.HasPrefix(parsed.Resource, "accesspoint:") {
+			log.Fatalf("S3 ARN %q is not the ARN of an access point", bucket)
 		}
+		isMultiRegion = parsed.Region == ""
+	}
+	if isMultiRegion {
+		log.Fatalf("S3 Multi-Region Access Point %q is not supported, use the ARN of a regional access point or the bucket name", bucket)
+	}
+}
 
-		gcsObjectWriter.Close()
+// isS3AccessPoint reports whether an S3 bucket argument is the ARN of an
+// access point rather than a bucket name.
+func isS3AccessPoint(bucket string) bool {
+	return arn.IsARN(bucket)
+}
 
-		copyMutex.Lock()
-		totalBytesCopied += bytesCopied
-		filesCopied++
-		copyMutex.Unlock()
+// Values of -assume-versioning.
+const (
+	assumeVersioningOn   = "on"
+	assumeVersioningOff  = "off"
+	assumeVersioningAuto = "auto"
+)
 
-		// Copy metadata from S3 object to GCS object
-		gcsObjectAttrs := &storage.ObjectAttrsToUpdate{
-			Metadata: make(map[string]string),
-		}
+// s3VersioningEnabled reports whether versioning is enabled on an S3 bucket.
+// Unless assume is auto, S3 is not asked, so that credentials without the
+// s3:GetBucketVersioning permission can be used.
+func s3VersioningEnabled(s3Client *s3.S3, s3Bucket string, assume string) bool {
+	if assume != assumeVersioningAuto {
+		versionEnabled := assume == assumeVersioningOn
+		log.Printf("S3 bucket – Versioning enabled: %t (assumed)", versionEnabled)
+		return versionEnabled
+	}
 
-		for key, value := range s3ObjectOutput.Metadata {
-			gcsObjectAttrs.Metadata[key] = *value
-		}
+	versioningInput := &s3.GetBucketVersioningInput{
+		Bucket: aws.String(s3Bucket),
+	}
+	versioningOutput, err := s3Client.GetBucketVersioning(versioningInput)
+	if err != nil {
+		log.Fatal("Error getting versioning of bucket " + s3Bucket + " (use -assume-versioning on or off to skip): " + err.Error())
+	}
 
-		// add ETag to metadata
-		gcsObjectAttrs.Metadata["ETag"] = *s3ObjectOutput.ETag
+	versionEnabled := false
 
-		_, err = gcsObject.Update(ctx, *gcsObjectAttrs)
-		if err != nil {
-			log.Fatal("Error updating object " + awsKey + " in bucket " + gcsBucket + ": " + err.Error())
-		}
+	if versioningOutput.Status != nil {
+		versionEnabled = *versioningOutput.Status == "Enabled"
 	}
 
-	copyFileFn := func(s3Object *s3.Object, gcsObject *storage.ObjectHandle) {
-		s3VersionsOutput, err := s3Client.ListObjectVersions(&s3.ListObjectVersionsInput{
-			Bucket: aws.String(s3Bucket),
-			Prefix: s3Object.Key,
-		})
-		if err != nil {
-			log.Fatal(err)
-		}
+	log.Printf("S3 bucket – Versioning enabled: %t", versionEnabled)
 
-		if len(s3VersionsOutput.Versions) == 1 {
-			wg.Add(1)
-			copySemaphore <- struct{}{} // Acquire the semaphore
-			go copyFileVersionFn(*s3Object.Key, *s3VersionsOutput.Versions[0].VersionId, gcsObject)
-		} else {
-			log.Printf("%s – %d versions detected", *s3Object.Key, len(s3VersionsOutput.Versions))
-			for _, s3Version := range s3VersionsOutput.Versions {
-				wg.Add(1)
-				copySemaphore <- struct{}{} // Acquire the semaphore
-				copyFileVersionFn(*s3Object.Key, *s3Version.VersionId, gcsObject)
-			}
+	return versionEnabled
+}
+
+// stopContext returns a context that is done once the process receives SIGINT
+// or SIGTERM, or once timeout has elapsed if not zero. Runs stop starting new
+// copies when it is done, and let the copies in progress complete.
+func stopContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	if timeout <= 0 {
+		return ctx, stop
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// enforceRunDeadline exits once deadline has elapsed, if not zero, abandoning
+// the copies in progress after reporting the summary and metrics of the run.
+// GCS objects are written whole or not at all, so the next run copies the
+// objects that were in progress again. Call the returned function once the
+// run is done.
+func (c *copier) enforceRunDeadline(deadline time.Duration, summaryPath string, metricsPath string) (stop func()) {
+	if deadline <= 0 {
+		return func() {}
+	}
+	timer := time.AfterFunc(deadline, func() {
+		inUse, _ := c.copySlots.usage()
+		log.Printf("Run deadline of %s reached, abandoning %d copies in progress", deadline, inUse)
+		c.reportSummary()
+		c.writeMetrics(metricsPath, false)
+		c.finishSummary(summaryPath, runStopped)
+		shutdownTracing()
+		os.Exit(1)
+	})
+	return func() { timer.Stop() }
+}
+
+// checkRunDeadline exits if -run-timeout would not stop a run before
+// -run-deadline ends it.
+func checkRunDeadline(timeout time.Duration, deadline time.Duration) {
+	if deadline < 0 {
+		log.Fatalf("Invalid -run-deadline value %s, must not be negative", deadline)
+	}
+	if deadline > 0 && timeout >= deadline {
+		log.Fatalf("-run-timeout %s must be shorter than -run-deadline %s", timeout, deadline)
+	}
+}
+
+// logStopReason logs why a run stopped early, once stopCtx from stopContext
+// is done.
+func logStopReason(stopCtx context.Context, timeout time.Duration) {
+	if errors.Is(stopCtx.Err(), context.DeadlineExceeded) {
+		log.Printf("Run timeout of %s reached", timeout)
+	} else {
+		log.Print("Interrupted")
+	}
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify":
+			runVerify(os.Args[2:])
+			return
+		case "estimate":
+			runEstimate(os.Args[2:])
+			return
+		case "kms-report":
+			runKMSReport(os.Args[2:])
+			return
+		case "watch":
+			runWatch(os.Args[2:])
+			return
+		case "copy-object":
+			runCopyObject(os.Args[2:])
+			return
+		case "gcs-to-s3":
+			runGCSToS3(os.Args[2:])
+			return
+		case "purge-source":
+			runPurgeSource(os.Args[2:])
+			return
+		case "sync":
+			runSync(os.Args[2:])
+			return
+		case "report":
+			runReport(os.Args[2:])
+			return
+		case "reconcile":
+			runReconcile(os.Args[2:])
+			return
+		case "abort-multipart-uploads":
+			runAbortMultipartUploads(os.Args[2:])
+			return
+		case "waves":
+			runWaves(os.Args[2:])
+			return
+		case "enqueue":
+			runEnqueue(os.Args[2:])
+			return
+		case "notifications":
+			runNotifications(os.Args[2:])
+			return
+		case "bucket-config":
+			runBucketConfig(os.Args[2:])
+			return
+		case "selftest":
+			runSelftest(os.Args[2:])
+			return
+		case "transfer-service":
+			runTransferService(os.Args[2:])
+			return
+		case "copy-buckets":
+			runCopyBuckets(os.Args[2:])
+			return
 		}
 	}
 
-	gcsBucketHandle := client.Bucket(gcsBucket).Retryer(gcsRetryer)
+	var options copyOptions
+	addCopyFlags(flag.CommandLine, &options)
+	var s3Opts s3Options
+	addS3Flags(flag.CommandLine, &s3Opts)
+	var gcsOpts gcsOptions
+	addGCSFlags(flag.CommandLine, &gcsOpts)
+	addGCSKMSKeyFlag(flag.CommandLine, &gcsOpts)
+	var creation bucketCreation
+	addCreateBucketFlags(flag.CommandLine, &creation)
+	deleteExtraFlag := flag.Bool("delete-extra", false, "Delete objects from the GCS bucket that do not exist in the S3 bucket")
+	dryRunFlag := flag.Bool("dry-run", false, "Compare the objects without copying or deleting any, and print a line per key: + to copy, = up to date or skipped, ! to copy over a mismatch, - extra to delete")
+	itemizeFlag := flag.Bool("itemize", false, "With -dry-run, follow each key with its size and the reason of its line")
+	yesFlag := addConfirmFlags(flag.CommandLine)
+	requireQuiescentFlag := flag.Duration("require-quiescent", 0, "List the S3 bucket twice, this long apart, and exit without copying if any object changed in between, e.g. 5m (default: no check)")
+	runTimeout := flag.Duration("run-timeout", 0, "Stop starting new copies after this long, e.g. 5h45m, letting the copies in progress complete (default: no limit)")
+	runDeadline := flag.Duration("run-deadline", 0, "Exit after this long, e.g. 6h, abandoning the copies still in progress, even those of -run-timeout (default: no limit)")
+	var objectShard shard
+	flag.Var(&objectShard, "shard", "Only copy the i-th of N disjoint sets of keys, e.g. 2/4, to share the bucket between N instances")
+	controlAddr := addControlFlags(flag.CommandLine)
+	metricsFile := addMetricsFlags(flag.CommandLine)
+	summaryFile := addSummaryFlags(flag.CommandLine)
+	inventoryFlag := flag.String("inventory", "", "s3:// URI of the manifest.json of an S3 Inventory report (CSV format) to read the objects to copy from, instead of listing the bucket")
+	retryFromFlag := flag.String("retry-from", "", "Copy only the objects recorded in this -quarantine file by an earlier run, instead of listing the bucket")
+	enumerateFlag := flag.Bool("enumerate", false, "List the S3 bucket first to report the percentage of objects copied and an ETA")
+	wavePlanFlag := flag.String("wave-plan", "", "JSON file assigning prefixes of the S3 bucket to named migration waves, see -wave")
+	waveFlag := flag.String("wave", "", "Copy the prefixes of this wave of -wave-plan, once the waves it runs after are signed off, and sign it off")
+	skipPlacementCheckFlag := flag.Bool("skip-placement-check", false, "Do not compare the regions of the buckets and of the runner before copying")
+	listWorkersFlag := flag.Int("list-workers", 1, "Number of prefixes of the S3 bucket listed concurrently, found by listing it with the / delimiter")
+	compareWorkersFlag := flag.Int("compare-workers", defaultCompareWorkers, "Number of objects compared with GCS concurrently, ahead of the copies")
+	listGCSFlag := flag.Bool("list-gcs", false, "Find the GCS objects of the S3 objects by listing the GCS bucket alongside S3, one request per 1000 objects, instead of getting each one")
+	maxPendingFlag := flag.Int("max-pending", defaultMaxPending, "Maximum number of objects listed ahead of the copies, bounding the memory used when listing is faster than copying")
+	addLogFlags(flag.CommandLine)
+	addTracingFlags(flag.CommandLine)
+	flag.Parse()
+	setupLogging()
+	setupTracing()
+	defer shutdownTracing()
 
-	copyStartTime = time.Now()
+	if len(flag.Args()) < 2 || len(flag.Args()) > 3 {
+		log.Fatal("Usage: ./s3-to-gcs [-force] [-on-exists overwrite|skip|overwrite-if-newer|fail] [-on-mismatch fail|recopy|report] [-mismatch-report <file>] [-quarantine <file>] [-compare etag|size-mtime] [-modify-window <duration>] [-log-format text|json] [-log-level debug|info|warn|error] [-quiet] [-trace] [-delete-extra] [-dry-run [-itemize]] [-yes] [-inventory s3://<bucket>/<path>/manifest.json] [-retry-from <file>] [-shard <i>/<N>] [-enumerate] [-wave-plan <file> -wave <name>] [-max-pending <n>] [-list-workers <n>] [-compare-workers <n>] [-list-gcs] [-skip-placement-check] [-require-quiescent <duration>] [-run-timeout <duration>] [-run-deadline <duration>] [-object-timeout <duration>] [-control-addr <host:port>] [-metrics-file <file>] [-summary-file <file>] [-delete-source] [-deletion-list <file>] [-max-object-size <size>] [-split-size <size>] [-log-sample 1/<n>] [-bandwidth-limit <rate>] [-parallel-download-threshold <size>] [-parallel-download-ranges <n>] [-composite-threshold <size>] [-composite-parts <n>] [-circuit-breaker-errors <n>] [-circuit-breaker-window <duration>] [-circuit-breaker-pause <duration>] [-assume-versioning on|off|auto] [-latest-only] [-delete-markers skip|replicate] [-skip-if-exists-in gs://<bucket>/<prefix>] [-tier <age>=<destination>] [-storage-class-map <mapping>] [-copy-acls] [-acl-report <file>] [-copy-tags] [-tag-prefix <prefix>] [-custom-time] [-record-parts] [-gzip | -gunzip] [-gzip-extensions <list>] [-gzip-content-types <list>] [-strip-prefix <prefix>] [-rename s#<regexp>#<replacement>#] [-name-template <template>] [-add-prefix <prefix>] [-on-collision fail|skip] [-byte-exact] [-deep-verify] [-verify-workers <n>] [-transfer-manifest <file>] [-transfer-manifest-format json|csv] [-aws-profile <name>] [-aws-role-arn <ARN>] [-aws-external-id <ID>] [-gcs-credentials-file <file>] [-gcs-impersonate-service-account <email>] [-gcs-user-project <project>] [-gcs-kms-key <key>] [-create-bucket -create-bucket-project <project>] [-create-bucket-location <location>] [-create-bucket-storage-class <class>] [-create-bucket-versioning on|off|auto] [-create-bucket-uniform-access on|off|auto] [-s3-request-payer requester] [-s3-sse-c-key <key>] [-s3-sse-c-key-file <file>] [-s3-endpoint <URL>] [-s3-force-path-style] [-s3-disable-ssl] [-s3-max-retries <n>] <S3 bucket> <GCS bucket> [optional object key prefix]")
+	}
 
-	handleS3ObjectsPageFn := func(page *s3.ListObjectsV2Output, lastPage bool) bool {
-		if err != nil {
+	options.validate()
+	creation.validate(options.copyACLs)
+	checkRunDeadline(*runTimeout, *runDeadline)
+	if *maxPendingFlag < 1 {
+		log.Fatalf("Invalid -max-pending value %d, must be at least 1", *maxPendingFlag)
+	}
+
+	// The prefixes of a wave replace the prefix argument
+	var plan *wavePlan
+	var currentWave *wave
+	if (*wavePlanFlag == "") != (*waveFlag == "") {
+		log.Fatal("-wave-plan and -wave must be used together")
+	}
+	if *waveFlag != "" {
+		if len(flag.Args()) > 2 {
+			log.Fatal("-wave cannot be used with an object key prefix, the wave plan gives the prefixes to copy")
+		}
+		var err error
+		if plan, err = loadWavePlan(*wavePlanFlag); err != nil {
+			log.Fatal(err)
+		}
+		if currentWave, err = plan.wave(*waveFlag); err != nil {
 			log.Fatal(err)
 		}
+	}
 
-		for _, s3Object := range page.Contents {
-			if *s3Object.Key == "" || (*s3Object.Key)[len(*s3Object.Key)-1:] == "/" {
-				continue
-			}
+	if *itemizeFlag && !*dryRunFlag {
+		log.Fatal("-itemize requires -dry-run")
+	}
+	// Nothing is copied to delete from S3, nor deleted in GCS
+	if *dryRunFlag && options.deleteSource {
+		log.Fatal("-dry-run cannot be used with -delete-source")
+	}
+	if *dryRunFlag && options.deleteMarkers == deleteMarkersReplicate {
+		log.Fatal("-dry-run cannot be used with -delete-markers replicate")
+	}
 
-			gcsObject := gcsBucketHandle.Object(*s3Object.Key).Retryer(gcsRetryer, storage.WithPolicy(storage.RetryAlways))
+	// Objects created since the inventory would look extraneous
+	if *inventoryFlag != "" && *deleteExtraFlag {
+		log.Fatal("-delete-extra cannot be used with -inventory, which may not list the latest objects")
+	}
+	// Every object but the failed ones would look extraneous
+	if *retryFromFlag != "" && *deleteExtraFlag {
+		log.Fatal("-delete-extra cannot be used with -retry-from, which only lists the objects that failed")
+	}
+	if *retryFromFlag != "" && *inventoryFlag != "" {
+		log.Fatal("-retry-from cannot be used with -inventory")
+	}
+	// The -quarantine file is emptied as the run starts, so a run stopped or
+	// failing before its end would lose the objects left to retry
+	if *retryFromFlag != "" && options.quarantine != "" && sameFile(*retryFromFlag, options.quarantine) {
+		log.Fatal("-quarantine cannot be the -retry-from file, which it would empty before its objects are retried")
+	}
 
-			_, err := gcsObject.Attrs(ctx)
+	// GCS objects renamed would look extraneous, and be listed in another
+	// order than their keys
+	if options.rewritesKeys() && *deleteExtraFlag {
+		log.Fatal("-delete-extra cannot be used with -strip-prefix, -rename or -add-prefix")
+	}
+	if options.rewritesKeys() && *listGCSFlag {
+		log.Fatal("-list-gcs cannot be used with -strip-prefix, -rename or -add-prefix")
+	}
 
-			if err != storage.ErrObjectNotExist && *forceFlag {
-				if versionEnabled {
-					if err := deleteAllVersions(ctx, gcsBucketHandle, *s3Object.Key); err != nil {
-						log.Fatal(err)
+	if *compareWorkersFlag < 1 {
+		log.Fatalf("Invalid -compare-workers value %d, must be at least 1", *compareWorkersFlag)
+	}
+	if *listWorkersFlag < 1 {
+		log.Fatalf("Invalid -list-workers value %d, must be at least 1", *listWorkersFlag)
+	}
+	// Listings of several prefixes are not in key order as a whole
+	if *listWorkersFlag > 1 && *listGCSFlag {
+		log.Fatal("-list-gcs cannot be used with -list-workers")
+	}
+	if *listWorkersFlag > 1 && (*inventoryFlag != "" || *retryFromFlag != "") {
+		log.Fatal("-list-workers cannot be used with -inventory or -retry-from, which list nothing")
+	}
+	compareWorkers := *compareWorkersFlag
+	// The GCS listing is read in key order
+	if *listGCSFlag {
+		compareWorkers = 1
+	}
+
+	// Inventory reports are not in key order, every key would list again
+	if *inventoryFlag != "" && *listGCSFlag {
+		log.Fatal("-list-gcs cannot be used with -inventory, whose objects are not listed in key order")
+	}
+
+	buckets, objectKeyPrefix := parseBucketArgs(flag.Args(), "s3", "gs")
+	s3Bucket, gcsBucket := buckets[0], buckets[1]
+
+	log.Printf("S3 bucket: %s", s3Bucket)
+	log.Printf("GCS bucket: %s", gcsBucket)
+	if objectKeyPrefix != "" {
+		log.Printf("Object key prefix: %s", objectKeyPrefix)
+	}
+	prefixes := []string{objectKeyPrefix}
+	if currentWave != nil {
+		log.Printf("Wave: %s, prefixes: %s", currentWave.Name, strings.Join(currentWave.Prefixes, ", "))
+		plan.checkOrder(currentWave, s3Bucket, gcsBucket)
+		prefixes = currentWave.Prefixes
+	}
+	options.log()
+	creation.log()
+	s3Opts.log()
+	gcsOpts.log()
+	log.Printf("Delete extra objects: %t", *deleteExtraFlag)
+	if *dryRunFlag {
+		log.Print("Dry run: nothing is copied or deleted")
+	}
+	log.Printf("Max pending objects: %s", printer.Sprintf("%d", *maxPendingFlag))
+	if *listWorkersFlag > 1 {
+		log.Printf("List workers: %d", *listWorkersFlag)
+	}
+	log.Printf("Compare workers: %d", compareWorkers)
+	log.Printf("List GCS bucket: %t", *listGCSFlag)
+	if objectShard.count > 1 {
+		log.Printf("Shard: %s", objectShard.String())
+	}
+	if *requireQuiescentFlag > 0 {
+		log.Printf("Require quiescent: %s", *requireQuiescentFlag)
+	}
+	if *runTimeout > 0 {
+		log.Printf("Run timeout: %s", *runTimeout)
+	}
+	if *runDeadline > 0 {
+		log.Printf("Run deadline: %s", *runDeadline)
+	}
+
+	s3Client := newS3Client(s3Opts)
+
+	versionEnabled := s3VersioningEnabled(s3Client, s3Bucket, options.assumeVersioning)
+
+	var retryKeys []string
+	if *retryFromFlag != "" {
+		retryKeys = readQuarantine(*retryFromFlag, s3Bucket)
+	}
+
+	// Like in watch mode, a signal or the run timeout only stops listing
+	// objects, so every object is either copied entirely or left for the
+	// next run
+	ctx := context.Background()
+	stopCtx, stop := stopContext(ctx, *runTimeout)
+	defer stop()
+
+	client := newGCSClient(ctx, gcsOpts)
+	defer client.Close()
+
+	newBucketLister := func(ctx context.Context, prefix string) objectLister {
+		if *listWorkersFlag > 1 {
+			return parallelBucketLister(ctx, s3Client, s3Bucket, prefix, *listWorkersFlag)
+		}
+		return bucketLister(ctx, s3Client, s3Bucket, prefix)
+	}
+	listObjects := objectShard.filter(prefixesLister(prefixes, func(prefix string) objectLister {
+		if *inventoryFlag != "" {
+			return inventoryLister(ctx, s3Client, *inventoryFlag, s3Bucket, prefix)
+		}
+		if *retryFromFlag != "" {
+			return retryLister(ctx, s3Client, s3Bucket, retryKeys, prefix)
+		}
+		return newBucketLister(ctx, prefix)
+	}))
+
+	// copyAll lists the objects and hands them to c, which copies them, or
+	// adds them to its plan, then deletes the extra GCS objects with
+	// -delete-extra. It returns the number of files deleted, and whether
+	// the run was stopped before all of S3 was listed.
+	copyAll := func(c *copier) (filesDeleted int64, stopped bool) {
+		// Keys seen in S3, used to find extraneous GCS objects with -delete-extra
+		s3Keys := make(map[string]struct{})
+
+		// Objects flow from the listing to the workers comparing them with GCS,
+		// who hand those to copy over to copies in the background, so that
+		// listing, comparing and copying go on at once and a slow object only
+		// holds up its own worker
+		type queuedObject struct {
+			s3Object *s3.Object
+			done     func()
+		}
+		compareQueue := make(chan queuedObject)
+		var objectsWg sync.WaitGroup
+		for i := 0; i < compareWorkers; i++ {
+			go func() {
+				for object := range compareQueue {
+					// Objects listed before a stop are left for the next run
+					if stopCtx.Err() != nil {
+						object.done()
+						continue
 					}
-				} else {
-					err := gcsObject.Delete(ctx)
-					if err != nil {
-						log.Fatal(err)
+					s3Object := object.s3Object
+					c.copyObject(s3Object, func() {
+						c.markProcessed(1, *s3Object.Size)
+						object.done()
+					})
+				}
+			}()
+		}
+
+		handleS3ObjectsPageFn := func(page *s3.ListObjectsV2Output, lastPage bool, pageDone func()) bool {
+			// The page is done once all its objects are, and it is handed out
+			var objectsLeft atomic.Int64
+			objectsLeft.Store(1)
+			objectDone := func() {
+				if objectsLeft.Add(-1) == 0 {
+					pageDone()
+				}
+			}
+			for _, s3Object := range page.Contents {
+				if stopCtx.Err() != nil {
+					break
+				}
+				if isFolderKey(*s3Object.Key) {
+					c.skipObject(s3Object, reasonFolderMarker, "Object %s – skipping, folder marker", *s3Object.Key)
+					continue
+				}
+
+				if *deleteExtraFlag {
+					s3Keys[*s3Object.Key] = struct{}{}
+					if options.splitSize > 0 && *s3Object.Size > options.splitSize {
+						for _, name := range splitObjectNames(*s3Object.Key, *s3Object.Size, options.splitSize) {
+							s3Keys[name] = struct{}{}
+						}
 					}
 				}
+
+				objectsLeft.Add(1)
+				objectsWg.Add(1)
+				compareQueue <- queuedObject{s3Object: s3Object, done: func() {
+					objectDone()
+					objectsWg.Done()
+				}}
 			}
+			objectDone()
 
-			if err == storage.ErrObjectNotExist || *forceFlag {
-				log.Printf("Object %s – copying", *s3Object.Key)
-				copyFileFn(s3Object, gcsObject)
+			return stopCtx.Err() == nil
+		}
+
+		// The next pages are listed while the objects of a page are compared
+		// and copied
+		if err := c.pending.prefetch(listObjects, handleS3ObjectsPageFn); err != nil {
+			log.Fatal(err)
+		}
+		close(compareQueue)
+		objectsWg.Wait()
+		c.wait()
+
+		// Objects deleted in S3 are not listed, only their versions are. A
+		// plan leaves them out, as -dry-run does.
+		if options.deleteMarkers == deleteMarkersReplicate && stopCtx.Err() == nil && c.plan == nil {
+			if versionEnabled {
+				for _, prefix := range prefixes {
+					c.replicateDeleteMarkers(stopCtx, prefix, &objectShard)
+				}
 			} else {
-				gcsObjectAttrs, err := gcsObject.Attrs(ctx)
+				log.Print("S3 bucket versioning is not enabled, there are no delete markers to replicate")
+			}
+		}
 
+		// GCS objects can only be told extraneous once all of S3 is listed
+		stopped = stopCtx.Err() != nil
+		c.waitVerified()
+		if !*deleteExtraFlag || stopped {
+			return 0, stopped
+		}
+		for _, prefix := range prefixes {
+			it := c.gcsBucketHandle.Objects(ctx, &storage.Query{Prefix: prefix})
+			for {
+				gcsObjectAttrs, err := it.Next()
+				if errors.Is(err, iterator.Done) {
+					break
+				}
 				if err != nil {
 					log.Fatal(err)
 				}
 
-				// get ETag from metadata
-				if gcsMetadataEtag, ok := gcsObjectAttrs.Metadata["ETag"]; ok {
-					if *s3Object.ETag != gcsObjectAttrs.Metadata["ETag"] {
-						log.Printf("Mismatch detected:\n  S3 object: %s\n  GCS object %s\n  S3 ETag: %s\n  GCS Metadata ETag: %s\n",
-							*s3Object.Key, gcsObjectAttrs.Name, *s3Object.ETag, gcsMetadataEtag)
-						copyFileFn(s3Object, gcsObject)
-					} else {
-						log.Printf("Object %s match (ETag: %s)", *s3Object.Key, *s3Object.ETag)
-					}
+				// Other instances delete the extra objects of their shards
+				if _, ok := s3Keys[gcsObjectAttrs.Name]; ok || isFolderKey(gcsObjectAttrs.Name) || !objectShard.contains(gcsObjectAttrs.Name) {
+					continue
+				}
+
+				if c.plan != nil {
+					c.plan.add(planExtra, gcsObjectAttrs.Name, gcsObjectAttrs.Size, "not-in-s3")
+					continue
+				}
+				logObject(objectEvent{Key: gcsObjectAttrs.Name, Action: actionDelete, Message: "Object " + gcsObjectAttrs.Name + " – not in S3, deleting"})
+				if versionEnabled {
+					err = deleteAllVersions(ctx, c.gcsBucketHandle, gcsObjectAttrs.Name)
 				} else {
-					log.Printf("GCS Object: %s\n  ETag not found in GCS object metadata – object may be corrupt, forcing copy.", gcsObjectAttrs.Name)
-					copyFileFn(s3Object, gcsObject)
+					err = c.gcsBucketHandle.Object(gcsObjectAttrs.Name).Delete(ctx)
+				}
+				if err != nil {
+					log.Fatal(err)
 				}
+				filesDeleted++
 			}
 		}
+		return filesDeleted, false
+	}
+
+	// Nothing is deleted before the run is confirmed, nor by a dry run. The
+	// objects are compared first, as with -dry-run, to show how many the run
+	// deletes.
+	if !*yesFlag && !*dryRunFlag && (options.force || *deleteExtraFlag || options.deleteSource) {
+		log.Print("Planning the run, to confirm what it deletes")
+		planner := newPlanner(ctx, options, s3Client, s3Bucket, client, gcsOpts, gcsBucket, versionEnabled)
+		planner.pending = newPendingQueue(*maxPendingFlag)
+		if *listGCSFlag {
+			planner.gcsListing = newGCSListing(ctx, planner.gcsBucketHandle)
+		}
+		var stopped bool
+		planQuietly(func() {
+			_, stopped = copyAll(planner)
+		})
+		planner.close()
+		if stopped {
+			logStopReason(stopCtx, *runTimeout)
+			log.Fatal("Stopped before the run was planned, nothing was changed")
+		}
+		locations := make([]string, len(prefixes))
+		for i, prefix := range prefixes {
+			locations[i] = "gs://" + gcsBucket + "/" + prefix
+		}
+		confirmDeletions(options.deletions(s3Bucket, locations, planner.plan, versionEnabled), gcsBucket)
+	}
 
-		wg.Wait()
+	// A dry run plans the copy of every object to a bucket to create
+	if !*dryRunFlag {
+		creation.ensureBucket(ctx, s3Client, s3Bucket, gcsBucket, gcsOpts.bucket(client, gcsBucket), versionEnabled, options.copyACLs)
+	}
 
-		return true
+	c := newCopier(ctx, options, s3Client, s3Bucket, client, gcsOpts, gcsBucket, versionEnabled)
+	defer c.close()
+	c.summarizeFailures(*summaryFile)
+	stopDeadline := c.enforceRunDeadline(*runDeadline, *summaryFile, *metricsFile)
+	gcsBucketHandle := c.gcsBucketHandle
+	c.pending = newPendingQueue(*maxPendingFlag)
+	if *dryRunFlag {
+		c.plan = newDryRunPlan(*itemizeFlag)
+	}
+	if *listGCSFlag {
+		c.gcsListing = newGCSListing(ctx, gcsBucketHandle)
+	}
+	serveControl(*controlAddr, c)
+	// The regions of other S3 compatible services mean nothing to AWS or GCP
+	if !*skipPlacementCheckFlag && s3Opts.endpoint == "" {
+		checkPlacement(ctx, s3Client, s3Bucket, gcsBucket, gcsBucketHandle)
 	}
 
-	s3ObjectsInput := &s3.ListObjectsV2Input{
-		Bucket: aws.String(s3Bucket),
+	// The bucket itself is listed, whatever the objects are read from
+	if *requireQuiescentFlag > 0 {
+		requireQuiescent(stopCtx, objectShard.filter(prefixesLister(prefixes, func(prefix string) objectLister {
+			return newBucketLister(stopCtx, prefix)
+		})), *requireQuiescentFlag)
 	}
 
-	if objectKeyPrefix != "" {
-		s3ObjectsInput.Prefix = aws.String(objectKeyPrefix)
+	if *enumerateFlag {
+		c.enumerate(prefixes, listObjects)
 	}
 
-	if err := s3Client.ListObjectsV2PagesWithContext(ctx, s3ObjectsInput, handleS3ObjectsPageFn); err != nil {
-		log.Fatal(err)
+	stopReporting := c.reportStatsPeriodically()
+	filesDeleted, stopped := copyAll(c)
+	if stopped {
+		logStopReason(stopCtx, *runTimeout)
+		log.Print("Stopped before copying every object, run again to copy the rest")
 	}
 
-	close(quit)
+	stopDeadline()
+	stopReporting()
 
-	reportStatsFn()
+	c.reportSummary()
+	c.writeMetrics(*metricsFile, !stopped)
+	if stopped {
+		c.finishSummary(*summaryFile, runStopped)
+	} else {
+		c.finishSummary(*summaryFile, runCompleted)
+	}
+
+	if *deleteExtraFlag && !stopped && c.plan == nil {
+		log.Printf("Deleted %s extra files", printer.Sprintf("%d", filesDeleted))
+	}
+	if c.plan != nil {
+		c.plan.print(os.Stdout)
+		c.plan.log()
+	}
+
+	// Only a wave whose objects were all copied is signed off
+	if currentWave != nil {
+		if c.plan != nil {
+			log.Printf("Wave %s is not signed off by a dry run", currentWave.Name)
+		} else if stopped {
+			log.Printf("Wave %s is not signed off, run it again to copy the rest", currentWave.Name)
+		} else if c.filesQuarantined > 0 {
+			log.Printf("Wave %s is not signed off, copy the objects quarantined again to complete it", currentWave.Name)
+		} else {
+			c.signOffWave(plan, currentWave, &objectShard, filesDeleted)
+		}
+	}
+
+	// The run is incomplete. Run again, it skips the objects already copied
+	// since they are up to date.
+	if stopped || c.filesQuarantined > 0 {
+		shutdownTracing()
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// metadataKeyOriginalPrefix is prepended to the name of an S3 user metadata
+// entry to name the GCS metadata entry holding its original value, base64
+// encoded, when the value had to be escaped.
+const metadataKeyOriginalPrefix = "x-s3-original-"
+
+// sanitizeMetadataValue escapes the bytes of a metadata value that are not
+// valid UTF-8 and its control characters, which GCS metadata cannot hold,
+// as \xNN (or \uNNNN). It returns the escaped value and whether anything was
+// escaped. Backslashes are left as is, the original value is kept anyway.
+func sanitizeMetadataValue(value string) (string, bool) {
+	if utf8.ValidString(value) && strings.IndexFunc(value, unicode.IsControl) < 0 {
+		return value, false
+	}
+
+	var escaped strings.Builder
+	for i := 0; i < len(value); {
+		r, width := utf8.DecodeRuneInString(value[i:])
+		switch {
+		case r == utf8.RuneError && width <= 1:
+			fmt.Fprintf(&escaped, `\x%02x`, value[i])
+		case unicode.IsControl(r) && r < 0x100:
+			fmt.Fprintf(&escaped, `\x%02x`, r)
+		case unicode.IsControl(r):
+			fmt.Fprintf(&escaped, `\u%04x`, r)
+		default:
+			escaped.WriteString(value[i : i+width])
+		}
+		i += width
+	}
+	return escaped.String(), true
+}
+
+// addUserMetadata adds an S3 user metadata entry to GCS metadata, escaped if
+// needed, with its original value under metadataKeyOriginalPrefix. It returns
+// whether the value was escaped.
+func addUserMetadata(metadata map[string]string, key string, value string) bool {
+	sanitized, escaped := sanitizeMetadataValue(value)
+	metadata[key] = sanitized
+	if escaped {
+		metadata[metadataKeyOriginalPrefix+key] = base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	return escaped
+}
+
+// originalMetadata returns the user metadata of a GCS object written by
+// addUserMetadata, with the original values of the entries that were
+// escaped, leaving out the entries of the tool.
+func originalMetadata(metadata map[string]string) map[string]string {
+	original := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		if !isToolMetadataKey(key) {
+			original[key] = value
+		}
+	}
+	for key, value := range metadata {
+		name, ok := strings.CutPrefix(key, metadataKeyOriginalPrefix)
+		if !ok {
+			continue
+		}
+		// An entry that cannot be decoded was not written by the tool
+		if decoded, err := base64.StdEncoding.DecodeString(value); err == nil {
+			original[name] = string(decoded)
+		} else {
+			original[key] = value
+		}
+	}
+	return original
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func addMetricsFlags(flags *flag.FlagSet) *string {
+	return flags.String("metrics-file", "", "Write the final statistics to this file in the OpenMetrics text format, e.g. for the textfile collector of the node exporter")
+}
+
+// metricsWriter builds a metrics snapshot in the OpenMetrics text format,
+// which the textfile collector of the Prometheus node exporter reads.
+type metricsWriter struct {
+	b strings.Builder
+}
+
+// add adds a gauge with a single sample. Every run replaces the values of the
+// previous one, so even the numbers of objects are gauges rather than
+// counters, which also keeps the file valid for parsers of the older
+// Prometheus text format.
+func (m *metricsWriter) add(name string, help string, value float64) {
+	fmt.Fprintf(&m.b, "# TYPE %s gauge\n", name)
+	fmt.Fprintf(&m.b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(&m.b, "%s %s\n", name, strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+// write replaces the file at path with the snapshot. It is written under a
+// temporary name first, so that collectors never read a partial file.
+func (m *metricsWriter) write(path string) {
+	m.b.WriteString("# EOF\n")
+
+	temp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := temp.WriteString(m.b.String()); err != nil {
+		log.Fatal(err)
+	}
+	if err := temp.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Chmod(temp.Name(), 0o644); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Wrote metrics to %s", path)
+}
+
+// writeMetrics writes the final statistics of the copy to path, if not empty.
+// completed tells whether every object was handled, or the run stopped early.
+func (c *copier) writeMetrics(path string, completed bool) {
+	if path == "" {
+		return
+	}
+
+	c.copyMutex.Lock()
+	defer c.copyMutex.Unlock()
+
+	var m metricsWriter
+	m.add("s3_to_gcs_last_run_objects_copied", "Objects copied and verified.", float64(c.filesCopied))
+	m.add("s3_to_gcs_last_run_bytes_copied", "Bytes of the objects copied and verified.", float64(c.totalBytesCopied))
+	m.add("s3_to_gcs_last_run_bytes_read", "Bytes read from S3, including retries and copies that did not complete.", float64(c.bytesRead.Load()))
+	m.add("s3_to_gcs_last_run_objects_up_to_date", "Objects already up to date in GCS.", float64(c.filesIdentical))
+	m.add("s3_to_gcs_last_run_bytes_up_to_date", "Bytes of the objects already up to date in GCS.", float64(c.totalBytesIdentical))
+	m.add("s3_to_gcs_last_run_objects_too_large", "Objects skipped for exceeding -max-object-size.", float64(c.filesTooLarge))
+	m.add("s3_to_gcs_last_run_objects_existing_elsewhere", "Objects skipped for existing in the -skip-if-exists-in location.", float64(c.filesExistingElsewhere))
+	m.add("s3_to_gcs_last_run_objects_kept", "Objects that differ from the GCS object kept by -on-exists.", float64(c.filesKept))
+	m.add("s3_to_gcs_last_run_objects_deleted_by_marker", "Objects deleted in S3 whose live GCS generation was deleted with -delete-markers replicate.", float64(c.filesDeletedByMarker))
+	m.add("s3_to_gcs_last_run_object_versions_archived", "Object versions skipped for being archived and not restored.", float64(c.filesArchived))
+	if c.verifier != nil {
+		m.add("s3_to_gcs_last_run_objects_deep_verified", "Objects read back from GCS with -deep-verify.", float64(c.verifier.filesVerified.Load()))
+	}
+	m.add("s3_to_gcs_last_run_duration_seconds", "Duration of the run.", time.Since(c.copyStartTime).Seconds())
+	completedValue := 0.0
+	if completed {
+		completedValue = 1
+	}
+	m.add("s3_to_gcs_last_run_completed", "Whether the run handled every object (1), or stopped early (0).", completedValue)
+	m.add("s3_to_gcs_last_run_timestamp_seconds", "Time the run ended at.", float64(time.Now().Unix()))
+	m.write(path)
+}
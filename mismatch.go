@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values of -on-mismatch.
+const (
+	onMismatchFail   = "fail"   // Fail the run
+	onMismatchRecopy = "recopy" // Copy the object again, up to mismatchRecopies times
+	onMismatchReport = "report" // Record the object in -mismatch-report and go on
+)
+
+// mismatchRecopies is how many more times -on-mismatch recopy copies an
+// object whose copy does not match before failing the run.
+const mismatchRecopies = 3
+
+// contentMismatch is the error of a copy whose content, as stored by GCS or
+// read back from it, does not match what was read from S3 or the checksums
+// of S3.
+type contentMismatch struct {
+	error
+}
+
+func (e contentMismatch) Unwrap() error {
+	return e.error
+}
+
+// isContentMismatch reports whether err is the error of a copy whose content
+// does not match.
+func isContentMismatch(err error) bool {
+	var mismatch contentMismatch
+	return errors.As(err, &mismatch)
+}
+
+// mismatchReportEntry is the line of the mismatch report about a copy whose
+// content does not match.
+type mismatchReportEntry struct {
+	Key       string    `json:"key"`
+	VersionID string    `json:"versionId,omitempty"`
+	Error     string    `json:"error"`
+	Time      time.Time `json:"time"`
+}
+
+// mismatchReport records the copies whose content does not match with
+// -on-mismatch report, as JSON lines. A nil report only counts them.
+type mismatchReport struct {
+	path    string
+	file    *os.File
+	mutex   sync.Mutex
+	encoder *json.Encoder
+}
+
+func createMismatchReport(path string) *mismatchReport {
+	file, err := os.Create(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &mismatchReport{path: path, file: file, encoder: json.NewEncoder(file)}
+}
+
+func (r *mismatchReport) record(entry mismatchReportEntry) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.encoder.Encode(entry); err != nil {
+		log.Fatal("Error writing mismatch report " + r.path + ": " + err.Error())
+	}
+}
+
+func (r *mismatchReport) close() {
+	if r == nil {
+		return
+	}
+	if err := r.file.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// mismatched applies -on-mismatch to a copy of an object version whose
+// content does not match, once its corrupt generation is deleted, and
+// reports whether to copy the version again. attempt is the number of
+// copies of the version so far, 0 if it cannot be copied again, as once
+// later generations may have been written. A run that fails exits.
+func (c *copier) mismatched(awsKey string, awsVersion string, attempt int, err error, message string) bool {
+	summary, _, _ := strings.Cut(err.Error(), "\n")
+	c.options.logSample.log(objectEvent{Key: awsKey, Action: actionMismatch, Reason: reasonContentMismatch, Error: err.Error(),
+		Message: "Object " + awsKey + " – " + summary + ", the corrupt copy was deleted"})
+
+	switch c.options.onMismatch {
+	case onMismatchRecopy:
+		if attempt > 0 && attempt <= mismatchRecopies {
+			log.Printf("Object %s – copying again, attempt %d of %d", awsKey, attempt+1, mismatchRecopies+1)
+			c.copyMutex.Lock()
+			c.filesRecopied++
+			c.copyMutex.Unlock()
+			return true
+		}
+	case onMismatchReport:
+		c.mismatchReport.record(mismatchReportEntry{Key: awsKey, VersionID: awsVersion, Error: err.Error(), Time: time.Now().UTC()})
+		c.copyMutex.Lock()
+		c.filesMismatchReported++
+		c.copyMutex.Unlock()
+		return false
+	}
+	fatalObject(awsKey, err, message)
+	return false
+}
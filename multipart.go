@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Uploads to S3 (gcs-to-s3, sync) use multipart uploads for large objects.
+// The uploader aborts them when a copy fails, but the parts of a run that
+// crashed or was killed stay in the bucket, and are billed, until aborted.
+
+func runAbortMultipartUploads(args []string) {
+	flags := flag.NewFlagSet("abort-multipart-uploads", flag.ExitOnError)
+	olderThan := flags.Duration("older-than", 24*time.Hour, "Only abort uploads started longer ago than this, to leave uploads in progress alone")
+	dryRun := flags.Bool("dry-run", false, "List the incomplete uploads but do not abort them")
+	var s3Opts s3Options
+	addS3Flags(flags, &s3Opts)
+	addLogFlags(flags)
+	flags.Parse(args)
+	setupLogging()
+
+	if len(flags.Args()) < 1 || len(flags.Args()) > 2 {
+		log.Fatal("Usage: ./s3-to-gcs abort-multipart-uploads [-older-than <duration>] [-dry-run] <S3 bucket> [optional object key prefix]")
+	}
+
+	buckets, objectKeyPrefix := parseBucketArgs(flags.Args(), "s3")
+	s3Bucket := buckets[0]
+
+	log.Printf("S3 bucket: %s", s3Bucket)
+	if objectKeyPrefix != "" {
+		log.Printf("Object key prefix: %s", objectKeyPrefix)
+	}
+	log.Printf("Older than: %s", *olderThan)
+	s3Opts.log()
+
+	s3Client := newS3Client(s3Opts)
+
+	cutoff := time.Now().Add(-*olderThan)
+	var aborted, skipped int64
+	err := s3Client.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s3Bucket),
+		Prefix: aws.String(objectKeyPrefix),
+	}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, upload := range page.Uploads {
+			if upload.Initiated != nil && upload.Initiated.After(cutoff) {
+				skipped++
+				continue
+			}
+
+			log.Printf("Upload %s of object %s – started %s, aborting", aws.StringValue(upload.UploadId),
+				aws.StringValue(upload.Key), aws.TimeValue(upload.Initiated).UTC().Format(time.RFC3339))
+			if !*dryRun {
+				_, err := s3Client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+					Bucket:   aws.String(s3Bucket),
+					Key:      upload.Key,
+					UploadId: upload.UploadId,
+				})
+				if err != nil && !isS3NotFound(err) {
+					log.Fatal("Error aborting upload " + aws.StringValue(upload.UploadId) + " of object " + aws.StringValue(upload.Key) + ": " + err.Error())
+				}
+			}
+			aborted++
+		}
+		return true
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *dryRun {
+		log.Printf("Dry run, would have aborted %s incomplete uploads", printer.Sprintf("%d", aborted))
+	} else {
+		log.Printf("Aborted %s incomplete uploads", printer.Sprintf("%d", aborted))
+	}
+	if skipped > 0 {
+		log.Printf("Left %s uploads started less than %s ago", printer.Sprintf("%d", skipped), *olderThan)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// gcsEventTypes returns the GCS Pub/Sub notification event types closest to
+// an S3 event, none if GCS has no equivalent. Wildcards such as
+// "s3:ObjectCreated:*" are matched by their prefix.
+func gcsEventTypes(s3Event string) []string {
+	switch {
+	case strings.HasPrefix(s3Event, "s3:ObjectCreated:"):
+		return []string{"OBJECT_FINALIZE"}
+	case s3Event == "s3:ObjectRemoved:DeleteMarkerCreated":
+		// Deleting the live version of an object in a versioned bucket
+		return []string{"OBJECT_ARCHIVE"}
+	case s3Event == "s3:ObjectRemoved:*":
+		return []string{"OBJECT_DELETE", "OBJECT_ARCHIVE"}
+	case strings.HasPrefix(s3Event, "s3:ObjectRemoved:"), strings.HasPrefix(s3Event, "s3:LifecycleExpiration:"):
+		return []string{"OBJECT_DELETE"}
+	case strings.HasPrefix(s3Event, "s3:ObjectTagging:"), strings.HasPrefix(s3Event, "s3:ObjectAcl:"):
+		return []string{"OBJECT_METADATA_UPDATE"}
+	}
+	return nil
+}
+
+// s3Notification is a notification configuration of a bucket, whatever its
+// destination.
+type s3Notification struct {
+	id          string
+	kind        string // SNS topic, SQS queue or Lambda function
+	destination string // ARN
+	events      []*string
+	filter      *s3.NotificationConfigurationFilter
+}
+
+// suggestGCSNotification returns the gcloud command creating the GCS
+// notification closest to n, preceded by comments about what differs.
+func suggestGCSNotification(n s3Notification, gcsBucket string) string {
+	var comments []string
+	comments = append(comments, fmt.Sprintf("%s %s (%s)", n.kind, n.destination, n.id))
+
+	var eventTypes []string
+	seen := make(map[string]bool)
+	for _, event := range aws.StringValueSlice(n.events) {
+		types := gcsEventTypes(event)
+		if len(types) == 0 {
+			comments = append(comments, "No GCS equivalent of "+event+", left out")
+		}
+		if strings.HasPrefix(event, "s3:ObjectCreated:") && event != "s3:ObjectCreated:*" {
+			comments = append(comments, "GCS does not tell "+event+" from other ways of creating objects")
+		}
+		for _, eventType := range types {
+			if !seen[eventType] {
+				seen[eventType] = true
+				eventTypes = append(eventTypes, eventType)
+			}
+		}
+	}
+	sort.Strings(eventTypes)
+
+	var prefix string
+	if n.filter != nil && n.filter.Key != nil {
+		for _, rule := range n.filter.Key.FilterRules {
+			switch strings.ToLower(aws.StringValue(rule.Name)) {
+			case "prefix":
+				prefix = aws.StringValue(rule.Value)
+			case "suffix":
+				comments = append(comments, "GCS notifications cannot filter on the suffix "+aws.StringValue(rule.Value)+", the subscriber has to")
+			}
+		}
+	}
+
+	// The topic is named after the resource of the destination ARN
+	topic := n.destination
+	if parsed, err := arn.Parse(n.destination); err == nil {
+		topic = parsed.Resource[strings.LastIndex(parsed.Resource, ":")+1:]
+	}
+	switch n.kind {
+	case "SQS queue":
+		comments = append(comments, "Create a pull subscription to the topic for the consumers of the queue")
+	case "Lambda function":
+		comments = append(comments, "Trigger a Cloud Run function from the topic, for example with Eventarc")
+	}
+
+	var b strings.Builder
+	for _, comment := range comments {
+		b.WriteString("# " + comment + "\n")
+	}
+	if len(eventTypes) == 0 {
+		b.WriteString("# No notification to create\n")
+		return b.String()
+	}
+	fmt.Fprintf(&b, "gcloud storage buckets notifications create gs://%s --topic=%s --event-types=%s", gcsBucket, topic, strings.Join(eventTypes, ","))
+	if prefix != "" {
+		fmt.Fprintf(&b, " --object-prefix=%s", prefix)
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+func runNotifications(args []string) {
+	flags := flag.NewFlagSet("notifications", flag.ExitOnError)
+	var s3Opts s3Options
+	addS3Flags(flags, &s3Opts)
+	addLogFlags(flags)
+	flags.Parse(args)
+	setupLogging()
+
+	if len(flags.Args()) != 2 {
+		log.Fatal("Usage: ./s3-to-gcs notifications <S3 bucket> <GCS bucket>")
+	}
+
+	buckets, _ := parseBucketArgs(flags.Args(), "s3", "gs")
+	s3Bucket, gcsBucket := buckets[0], buckets[1]
+
+	log.Printf("S3 bucket: %s", s3Bucket)
+	log.Printf("GCS bucket: %s", gcsBucket)
+	s3Opts.log()
+
+	s3Client := newS3Client(s3Opts)
+	config, err := s3Client.GetBucketNotificationConfiguration(&s3.GetBucketNotificationConfigurationRequest{
+		Bucket: aws.String(s3Bucket),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var notifications []s3Notification
+	for _, topic := range config.TopicConfigurations {
+		notifications = append(notifications, s3Notification{aws.StringValue(topic.Id), "SNS topic", aws.StringValue(topic.TopicArn), topic.Events, topic.Filter})
+	}
+	for _, queue := range config.QueueConfigurations {
+		notifications = append(notifications, s3Notification{aws.StringValue(queue.Id), "SQS queue", aws.StringValue(queue.QueueArn), queue.Events, queue.Filter})
+	}
+	for _, function := range config.LambdaFunctionConfigurations {
+		notifications = append(notifications, s3Notification{aws.StringValue(function.Id), "Lambda function", aws.StringValue(function.LambdaFunctionArn), function.Events, function.Filter})
+	}
+
+	log.Printf("Found %d notification configurations", len(notifications))
+	if config.EventBridgeConfiguration != nil {
+		log.Print("EventBridge delivery is enabled, its rules have to be migrated separately, for example to Eventarc")
+	}
+
+	fmt.Println("# Suggested GCS notifications for the S3 event notifications of " + s3Bucket)
+	fmt.Println("# Every topic must exist and allow the Cloud Storage service agent to publish to it")
+	for _, n := range notifications {
+		fmt.Println()
+		fmt.Print(suggestGCSNotification(n, gcsBucket))
+	}
+}
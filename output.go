@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Values of -output.
+const (
+	outputJSON  = "json"
+	outputCSV   = "csv"
+	outputTable = "table"
+)
+
+// addOutputFlag registers the -output flag of the commands writing a report.
+func addOutputFlag(flags *flag.FlagSet) *string {
+	return flags.String("output", outputJSON, "Format of the report: json, csv, or table for aligned columns")
+}
+
+// checkOutputFormat exits if format is not a valid -output value.
+func checkOutputFormat(format string) {
+	switch format {
+	case outputJSON, outputCSV, outputTable:
+	default:
+		log.Fatalf("Invalid -output value %q, must be %s, %s or %s", format, outputJSON, outputCSV, outputTable)
+	}
+}
+
+// tableWriter writes the rows of a report as CSV or as an aligned table, both
+// starting with a header of the column names. Tables are aligned, and so
+// written, once flushed.
+type tableWriter struct {
+	csv *csv.Writer
+	tab *tabwriter.Writer
+}
+
+func newTableWriter(w io.Writer, format string, columns ...string) *tableWriter {
+	t := &tableWriter{}
+	if format == outputCSV {
+		t.csv = csv.NewWriter(w)
+	} else {
+		t.tab = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	}
+	t.write(columns...)
+	return t
+}
+
+func (t *tableWriter) write(row ...string) {
+	if t.csv != nil {
+		if err := t.csv.Write(row); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// Cells are separated by tabs, which values cannot contain
+	for i, cell := range row {
+		row[i] = strings.ReplaceAll(cell, "\t", " ")
+	}
+	if _, err := io.WriteString(t.tab, strings.Join(row, "\t")+"\n"); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (t *tableWriter) flush() {
+	var err error
+	if t.csv != nil {
+		t.csv.Flush()
+		err = t.csv.Error()
+	} else {
+		err = t.tab.Flush()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// formatOptionalInt formats an optional number as a table cell, empty if nil.
+func formatOptionalInt(value *int64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatInt(*value, 10)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// maxPrefixDepth is how many levels of "/" separated prefixes
+// parallelBucketLister goes down at most to find enough prefixes.
+const maxPrefixDepth = 4
+
+// parallelBucketLister returns an objectLister listing the objects under
+// prefix in an S3 bucket with up to workers listings at once. The prefixes
+// to list are found level by level with the "/" delimiter, until a level has
+// at least as many prefixes as workers, listing the objects directly under
+// the levels above on the way. The pages of different prefixes are
+// interleaved, and none is the last page.
+func parallelBucketLister(ctx context.Context, s3Client *s3.S3, s3Bucket string, prefix string, workers int) objectLister {
+	return func(fn func(page *s3.ListObjectsV2Output, lastPage bool) bool) error {
+		// Pages are handed to fn one at a time, and none once it returned
+		// false
+		var mutex sync.Mutex
+		stopped := false
+		handle := func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if stopped {
+				return false
+			}
+			if len(page.Contents) > 0 && !fn(page, false) {
+				stopped = true
+			}
+			return !stopped
+		}
+		isStopped := func() bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return stopped
+		}
+
+		level := []string{prefix}
+		for depth := 0; depth < maxPrefixDepth && len(level) < workers; depth++ {
+			var nextMutex sync.Mutex
+			var next []string
+			err := forEachPrefix(level, workers, func(levelPrefix string) error {
+				return s3Client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+					Bucket:    aws.String(s3Bucket),
+					Prefix:    aws.String(levelPrefix),
+					Delimiter: aws.String("/"),
+				}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+					nextMutex.Lock()
+					for _, commonPrefix := range page.CommonPrefixes {
+						next = append(next, aws.StringValue(commonPrefix.Prefix))
+					}
+					nextMutex.Unlock()
+					return handle(page, lastPage)
+				})
+			})
+			if err != nil || isStopped() {
+				return err
+			}
+			sort.Strings(next)
+			level = next
+		}
+
+		return forEachPrefix(level, workers, func(levelPrefix string) error {
+			if isStopped() {
+				return nil
+			}
+			return bucketLister(ctx, s3Client, s3Bucket, levelPrefix)(handle)
+		})
+	}
+}
+
+// forEachPrefix calls fn for each of prefixes, with up to workers calls at
+// once, and returns the first error.
+func forEachPrefix(prefixes []string, workers int, fn func(prefix string) error) error {
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	semaphore := make(chan struct{}, workers)
+	for _, prefix := range prefixes {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(prefix string) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			if err := fn(prefix); err != nil {
+				errOnce.Do(func() { firstErr = err })
+			}
+		}(prefix)
+	}
+	wg.Wait()
+	return firstErr
+}
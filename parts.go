@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Metadata entries recording, with -record-parts, the layout of the
+// multipart upload of an S3 object, from which the same upload and so the
+// same ETag can be made again.
+const (
+	metadataKeyPartCount = "PartCount"
+	metadataKeyPartSizes = "PartSizes"
+)
+
+// maxPartSizesLength keeps the part sizes well within the 8 KiB GCS allows
+// for all the custom metadata of an object.
+const maxPartSizesLength = 4096
+
+// s3ObjectPartSizes returns the sizes of the parts of the multipart upload of
+// an object version, in part order. GetObjectAttributes only lists the parts
+// of uploads made with checksums, the size of the other parts is asked with
+// a HeadObject request per part.
+func s3ObjectPartSizes(ctx context.Context, s3Client *s3.S3, s3Bucket, key, version string) ([]int64, error) {
+	input := &s3.GetObjectAttributesInput{
+		Bucket:           aws.String(s3Bucket),
+		Key:              aws.String(key),
+		ObjectAttributes: aws.StringSlice([]string{s3.ObjectAttributesObjectParts}),
+		MaxParts:         aws.Int64(1000),
+	}
+	if version != "" {
+		input.VersionId = aws.String(version)
+	}
+
+	var sizes []int64
+	var partCount int64
+	for {
+		output, err := s3Client.GetObjectAttributesWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		if output.ObjectParts == nil {
+			return nil, nil
+		}
+		partCount = aws.Int64Value(output.ObjectParts.TotalPartsCount)
+		for _, part := range output.ObjectParts.Parts {
+			sizes = append(sizes, aws.Int64Value(part.Size))
+		}
+		if !aws.BoolValue(output.ObjectParts.IsTruncated) {
+			break
+		}
+		input.PartNumberMarker = output.ObjectParts.NextPartNumberMarker
+	}
+	if int64(len(sizes)) == partCount {
+		return sizes, nil
+	}
+
+	sizes = sizes[:0]
+	for partNumber := int64(1); partNumber <= partCount; partNumber++ {
+		headInput := &s3.HeadObjectInput{
+			Bucket:     aws.String(s3Bucket),
+			Key:        aws.String(key),
+			PartNumber: aws.Int64(partNumber),
+		}
+		if version != "" {
+			headInput.VersionId = aws.String(version)
+		}
+		output, err := s3Client.HeadObjectWithContext(ctx, headInput)
+		if err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, aws.Int64Value(output.ContentLength))
+	}
+	return sizes, nil
+}
+
+// formatPartSizes encodes part sizes as runs of parts of the same size, such
+// as "8388608x99,1048576x1" for 99 parts of 8 MiB followed by one of 1 MiB.
+func formatPartSizes(sizes []int64) string {
+	var runs []string
+	for i := 0; i < len(sizes); {
+		j := i + 1
+		for j < len(sizes) && sizes[j] == sizes[i] {
+			j++
+		}
+		runs = append(runs, fmt.Sprintf("%dx%d", sizes[i], j-i))
+		i = j
+	}
+	return strings.Join(runs, ",")
+}
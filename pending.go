@@ -0,0 +1,167 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// defaultMaxPending is the default of -max-pending, ten pages of a bucket
+// listing.
+const defaultMaxPending = 10000
+
+// defaultCompareWorkers is the default of -compare-workers, enough to keep
+// the copies busy while each comparison waits for a round trip to GCS.
+const defaultCompareWorkers = 16
+
+// listedPage is a page of a listing waiting to be copied.
+type listedPage struct {
+	page     *s3.ListObjectsV2Output
+	lastPage bool
+}
+
+// pendingQueue lists pages of objects ahead of the copies, so the next page
+// is ready when the copies of a page complete, while bounding the number of
+// objects listed and not copied yet so that listing a huge bucket faster
+// than it is copied does not hold it in memory.
+type pendingQueue struct {
+	mutex   sync.Mutex
+	changed *sync.Cond
+	limit   int
+	pending int // Objects of the pages queued or being copied
+	pages   []listedPage
+	listed  bool  // The listing has returned
+	err     error // The error the listing returned
+	stopped bool  // The copies stopped before the end of the listing
+}
+
+func newPendingQueue(limit int) *pendingQueue {
+	q := &pendingQueue{limit: limit}
+	q.changed = sync.NewCond(&q.mutex)
+	return q
+}
+
+// pageObjects is the number of objects a page counts for. Pages left empty
+// by -shard count for one, so they are bounded too.
+func pageObjects(page *s3.ListObjectsV2Output) int {
+	if len(page.Contents) == 0 {
+		return 1
+	}
+	return len(page.Contents)
+}
+
+// push waits for room for page in the queue, then queues it. A page larger
+// than the limit is queued once the queue is empty. It returns false once
+// the copies stopped.
+func (q *pendingQueue) push(page *s3.ListObjectsV2Output, lastPage bool) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	objects := pageObjects(page)
+	for !q.stopped && q.pending > 0 && q.pending+objects > q.limit {
+		q.changed.Wait()
+	}
+	if q.stopped {
+		return false
+	}
+	q.pending += objects
+	q.pages = append(q.pages, listedPage{page: page, lastPage: lastPage})
+	q.changed.Broadcast()
+	return true
+}
+
+// pop waits for the next page of the queue. It returns false at the end of
+// the listing.
+func (q *pendingQueue) pop() (listedPage, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for len(q.pages) == 0 && !q.listed {
+		q.changed.Wait()
+	}
+	if len(q.pages) == 0 {
+		return listedPage{}, false
+	}
+	next := q.pages[0]
+	q.pages[0] = listedPage{}
+	q.pages = q.pages[1:]
+	return next, true
+}
+
+// done records that the objects of a page popped from the queue have been
+// copied, making room for more.
+func (q *pendingQueue) done(page *s3.ListObjectsV2Output) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.pending -= pageObjects(page)
+	q.changed.Broadcast()
+}
+
+// finish records the end of the listing, with its error.
+func (q *pendingQueue) finish(err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.listed = true
+	q.err = err
+	q.changed.Broadcast()
+}
+
+// stop stops the listing before its end.
+func (q *pendingQueue) stop() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.stopped = true
+	q.changed.Broadcast()
+}
+
+// depth returns the number of objects listed and not copied yet, and the
+// limit.
+func (q *pendingQueue) depth() (pending int, limit int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.pending, q.limit
+}
+
+func (q *pendingQueue) logStats() {
+	if q == nil {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.listed && q.pending == 0 {
+		return
+	}
+	log.Printf("Pending: %s objects listed and not copied yet, max: %s",
+		printer.Sprintf("%d", q.pending), printer.Sprintf("%d", q.limit))
+}
+
+// prefetch runs list in the background, up to the limit of the queue ahead
+// of fn, and calls fn with each page in turn. A page stays pending until fn
+// calls its done, which fn may leave to the copies of the page, to go on
+// with the next page while they run. It returns the error of the listing.
+func (q *pendingQueue) prefetch(list objectLister, fn func(page *s3.ListObjectsV2Output, lastPage bool, done func()) bool) error {
+	go func() {
+		q.finish(list(q.push))
+	}()
+
+	for {
+		next, ok := q.pop()
+		if !ok {
+			break
+		}
+		more := fn(next.page, next.lastPage, func() {
+			q.done(next.page)
+		})
+		if !more {
+			q.stop()
+			break
+		}
+	}
+
+	// Wait for the listing to return, its error is that of the run
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for !q.listed {
+		q.changed.Wait()
+	}
+	return q.err
+}
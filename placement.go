@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// farRoundTrip is the round trip above which a bucket is far from the
+// runner, farther than the same or a neighbouring region.
+const farRoundTrip = 25 * time.Millisecond
+
+// tcpWindow is the typical largest TCP receive window of Linux, which bounds
+// the throughput of a connection to one window per round trip.
+const tcpWindow = 6 << 20
+
+// nearestGCPRegion maps AWS regions to the GCP region in the same or the
+// closest metropolitan area.
+var nearestGCPRegion = map[string]string{
+	"us-east-1":      "us-east4",
+	"us-east-2":      "us-east5",
+	"us-west-1":      "us-west2",
+	"us-west-2":      "us-west1",
+	"ca-central-1":   "northamerica-northeast1",
+	"sa-east-1":      "southamerica-east1",
+	"eu-west-1":      "europe-west2",
+	"eu-west-2":      "europe-west2",
+	"eu-west-3":      "europe-west9",
+	"eu-central-1":   "europe-west3",
+	"eu-central-2":   "europe-west6",
+	"eu-north-1":     "europe-north1",
+	"eu-south-1":     "europe-west8",
+	"eu-south-2":     "europe-southwest1",
+	"me-central-1":   "me-central1",
+	"me-south-1":     "me-central1",
+	"il-central-1":   "me-west1",
+	"af-south-1":     "africa-south1",
+	"ap-east-1":      "asia-east2",
+	"ap-south-1":     "asia-south1",
+	"ap-south-2":     "asia-south2",
+	"ap-northeast-1": "asia-northeast1",
+	"ap-northeast-2": "asia-northeast3",
+	"ap-northeast-3": "asia-northeast2",
+	"ap-southeast-1": "asia-southeast1",
+	"ap-southeast-2": "australia-southeast1",
+	"ap-southeast-3": "asia-southeast2",
+	"ap-southeast-4": "australia-southeast2",
+}
+
+// gcsLocationRegions maps the GCS multi-regions and predefined dual-regions
+// to the prefixes of the regions they store data in.
+var gcsLocationRegions = map[string][]string{
+	"US":    {"us-"},
+	"EU":    {"europe-"},
+	"ASIA":  {"asia-"},
+	"NAM4":  {"us-central1", "us-east1"},
+	"EUR4":  {"europe-north1", "europe-west4"},
+	"ASIA1": {"asia-northeast1", "asia-northeast2"},
+}
+
+// gcsLocationContains reports whether a GCS bucket location, with the data
+// locations of a configurable dual-region, stores data in a GCP region.
+func gcsLocationContains(location string, dataLocations []string, region string) bool {
+	location = strings.ToLower(location)
+	if location == region {
+		return true
+	}
+	for _, dataLocation := range dataLocations {
+		if strings.EqualFold(dataLocation, region) {
+			return true
+		}
+	}
+	if len(dataLocations) > 0 {
+		return false
+	}
+	for _, prefix := range gcsLocationRegions[strings.ToUpper(location)] {
+		if strings.HasPrefix(region, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// runnerLocation is where the program runs: on GCE, on EC2, or elsewhere
+// when both are empty.
+type runnerLocation struct {
+	gcpRegion string
+	gcpZone   string
+	awsRegion string
+}
+
+// findRunner asks the metadata servers of GCE and EC2 where the program
+// runs, waiting a second at most for an answer.
+func findRunner() runnerLocation {
+	var runner runnerLocation
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if !metadata.OnGCE() {
+			return
+		}
+		if zone, err := metadata.Zone(); err == nil {
+			runner.gcpZone = zone
+			// Zones are named after their region, e.g. us-central1-a
+			runner.gcpRegion = zone[:strings.LastIndex(zone, "-")]
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		sess, err := session.NewSession()
+		if err != nil {
+			return
+		}
+		client := ec2metadata.New(sess, aws.NewConfig().WithHTTPClient(&http.Client{Timeout: time.Second}).WithMaxRetries(0))
+		if region, err := client.Region(); err == nil {
+			runner.awsRegion = region
+		}
+	}()
+	wg.Wait()
+	return runner
+}
+
+func (r runnerLocation) String() string {
+	switch {
+	case r.gcpZone != "":
+		return "on GCE in " + r.gcpRegion + " (zone " + r.gcpZone + ")"
+	case r.awsRegion != "":
+		return "on EC2 in " + r.awsRegion
+	}
+	return "outside GCE and EC2"
+}
+
+// roundTrip returns the shortest of three calls of fn, the round trip of a
+// request once the connection is open, false if they all failed.
+func roundTrip(fn func() error) (time.Duration, bool) {
+	fastest := time.Duration(0)
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		if err := fn(); err != nil {
+			continue
+		}
+		if duration := time.Since(start); fastest == 0 || duration < fastest {
+			fastest = duration
+		}
+	}
+	return fastest, fastest > 0
+}
+
+// s3BucketRegion returns the region of an S3 bucket, or of the access point
+// of an ARN, "" if it cannot be found.
+func s3BucketRegion(ctx context.Context, s3Client *s3.S3, bucket string) string {
+	if arn.IsARN(bucket) {
+		if parsed, err := arn.Parse(bucket); err == nil {
+			return parsed.Region
+		}
+		return ""
+	}
+	region, err := s3manager.GetBucketRegionWithClient(ctx, s3Client, bucket)
+	if err != nil {
+		log.Printf("Placement: cannot find the region of S3 bucket %s: %v", bucket, err)
+		return ""
+	}
+	return region
+}
+
+// connectionThroughput returns the most a single connection can transfer in
+// a second with the given round trip.
+func connectionThroughput(rtt time.Duration) string {
+	return formatBytes(int64(float64(tcpWindow)/rtt.Seconds())) + "/s"
+}
+
+// checkPlacement compares the regions of the S3 bucket, of the GCS bucket
+// and of the runner, and the round trips to both buckets, and warns when the
+// runner is far from either bucket, which makes every copy slower, and when
+// its placement adds inter-region transfer costs. It suggests where to run
+// instead. Nothing it cannot find is reported.
+func checkPlacement(ctx context.Context, s3Client *s3.S3, s3Bucket string, gcsBucket string, gcsBucketHandle *storage.BucketHandle) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	runner := findRunner()
+	s3Region := s3BucketRegion(ctx, s3Client, s3Bucket)
+	var gcsLocation string
+	var dataLocations []string
+	attrs, err := gcsBucketHandle.Attrs(ctx)
+	if err == nil {
+		gcsLocation = attrs.Location
+		if attrs.CustomPlacementConfig != nil {
+			dataLocations = attrs.CustomPlacementConfig.DataLocations
+		}
+	} else {
+		// Reading the bucket needs storage.buckets.get, which copying does not
+		log.Printf("Placement: cannot find the location of GCS bucket %s: %v", gcsBucket, err)
+	}
+
+	s3RTT, s3OK := roundTrip(func() error {
+		_, err := s3Client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(s3Bucket)})
+		return err
+	})
+	// An object that does not exist answers as fast as one that does
+	gcsRTT, gcsOK := roundTrip(func() error {
+		_, err := gcsBucketHandle.Object(".s3-to-gcs-placement-check").Attrs(ctx)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil
+		}
+		return err
+	})
+
+	describe := func(location string, rtt time.Duration, ok bool) string {
+		if location == "" {
+			location = "unknown location"
+		}
+		if !ok {
+			return location
+		}
+		return fmt.Sprintf("%s, round trip %d ms", location, rtt.Milliseconds())
+	}
+	log.Printf("Placement: S3 bucket in %s, GCS bucket in %s, runner %s",
+		describe(s3Region, s3RTT, s3OK), describe(gcsLocation, gcsRTT, gcsOK), runner)
+
+	suggested := nearestGCPRegion[s3Region]
+	if s3Region != "" && gcsLocation != "" && suggested != "" && !gcsLocationContains(gcsLocation, dataLocations, suggested) {
+		log.Printf("Placement: the GCS bucket is not in %s, the GCP region closest to S3 bucket region %s, so data crosses regions wherever the migration runs", suggested, s3Region)
+	}
+
+	farFromS3 := s3OK && s3RTT > farRoundTrip
+	farFromGCS := gcsOK && gcsRTT > farRoundTrip
+	if runner.awsRegion != "" && s3Region != "" && runner.awsRegion != s3Region {
+		farFromS3 = true
+		log.Printf("Placement: the runner is in AWS region %s, not %s, reading from S3 adds about $0.02/GiB of inter-region transfer", runner.awsRegion, s3Region)
+	}
+	if runner.gcpRegion != "" && gcsLocation != "" && !gcsLocationContains(gcsLocation, dataLocations, runner.gcpRegion) {
+		farFromGCS = true
+		log.Printf("Placement: the runner is in GCP region %s, outside %s, writing to GCS is billed as inter-region egress, about $0.01 to $0.08/GiB", runner.gcpRegion, gcsLocation)
+	}
+	if !farFromS3 && !farFromGCS {
+		return
+	}
+
+	var far []string
+	var rtt time.Duration
+	if farFromS3 {
+		far = append(far, "the S3 bucket")
+		rtt = s3RTT
+	}
+	if farFromGCS {
+		far = append(far, "the GCS bucket")
+		if gcsRTT > rtt {
+			rtt = gcsRTT
+		}
+	}
+	message := "Placement: the runner is far from " + strings.Join(far, " and ")
+	if rtt > 0 {
+		message += fmt.Sprintf(", with a %d ms round trip each copy is limited to about %s", rtt.Milliseconds(), connectionThroughput(rtt))
+	}
+	switch {
+	case suggested != "":
+		message += ", run the migration on a GCE VM in " + suggested + " for the shortest round trips"
+	case s3Region != "":
+		message += ", run the migration close to S3 region " + s3Region
+	}
+	log.Print(message)
+}
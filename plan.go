@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Signs of the lines of a -dry-run plan, one per key, like the itemized
+// changes of rsync.
+const (
+	planCopy     = "+" // Not in GCS, copied
+	planSkip     = "=" // Up to date or skipped, left as it is
+	planMismatch = "!" // Differs from its GCS object, copied over it
+	planExtra    = "-" // Only in GCS, deleted with -delete-extra
+)
+
+type planLine struct {
+	sign   string
+	key    string
+	size   int64
+	detail string
+}
+
+// dryRunPlan collects what a run would do with -dry-run. The lines are only
+// printed once the run is done, sorted by key, since the objects are
+// compared concurrently, so that the plans of two runs can be diffed.
+type dryRunPlan struct {
+	// itemize adds the size and the reason of each line
+	itemize bool
+
+	mutex  sync.Mutex
+	lines  []planLine
+	counts map[string]int64
+	bytes  map[string]int64
+}
+
+func newDryRunPlan(itemize bool) *dryRunPlan {
+	return &dryRunPlan{itemize: itemize, counts: make(map[string]int64), bytes: make(map[string]int64)}
+}
+
+func (p *dryRunPlan) add(sign string, key string, size int64, detail string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.lines = append(p.lines, planLine{sign: sign, key: key, size: size, detail: detail})
+	p.counts[sign]++
+	p.bytes[sign] += size
+}
+
+// print writes the plan to w, a "<sign> <key>" line per key, followed by
+// its size and reason, tab separated, with -itemize.
+func (p *dryRunPlan) print(w io.Writer) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	sort.SliceStable(p.lines, func(i, j int) bool {
+		return p.lines[i].key < p.lines[j].key
+	})
+	for _, line := range p.lines {
+		var err error
+		if p.itemize {
+			_, err = fmt.Fprintf(w, "%s %s\t%d\t%s\n", line.sign, line.key, line.size, line.detail)
+		} else {
+			_, err = fmt.Fprintf(w, "%s %s\n", line.sign, line.key)
+		}
+		if err != nil {
+			log.Fatal("Error writing plan: " + err.Error())
+		}
+	}
+}
+
+func (p *dryRunPlan) log() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	log.Printf("Dry run: %s files to copy (%s), %s files to copy over a mismatch (%s), %s files up to date or skipped, %s extra files to delete (%s)",
+		printer.Sprintf("%d", p.counts[planCopy]), formatBytes(p.bytes[planCopy]),
+		printer.Sprintf("%d", p.counts[planMismatch]), formatBytes(p.bytes[planMismatch]),
+		printer.Sprintf("%d", p.counts[planSkip]),
+		printer.Sprintf("%d", p.counts[planExtra]), formatBytes(p.bytes[planExtra]))
+}
+
+// total returns the number of lines with one of signs, and their size.
+func (p *dryRunPlan) total(signs ...string) (files int64, bytes int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, sign := range signs {
+		files += p.counts[sign]
+		bytes += p.bytes[sign]
+	}
+	return files, bytes
+}
+
+// newPlanner returns a copier adding the objects to a plan, like with
+// -dry-run, to show what a run deletes before it is confirmed. It writes
+// none of the output files of options.
+func newPlanner(ctx context.Context, options copyOptions, s3Client *s3.S3, s3Bucket string, client *storage.Client, gcsOpts gcsOptions, gcsBucket string, versionEnabled bool) *copier {
+	options.transferManifest = ""
+	options.aclReport = ""
+	options.mismatchReport = ""
+	options.quarantine = ""
+	options.deleteSource = false
+	options.deepVerify = false
+	c := newCopier(ctx, options, s3Client, s3Bucket, client, gcsOpts, gcsBucket, versionEnabled)
+	c.plan = newDryRunPlan(false)
+	return c
+}
+
+// planQuietly runs plan logging only the errors about objects, and forgets
+// the errors counted meanwhile: the run confirmed compares the objects
+// again, and logs and counts what it finds itself.
+func planQuietly(plan func()) {
+	level := minLogLevel
+	if minLogLevel < 3 {
+		minLogLevel = 3
+	}
+	plan()
+	minLogLevel = level
+	resetRunErrors()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// The writes of a copy are conditioned on the GCS object being at the
+// generation it was compared at, or not existing, so that another instance
+// or another producer writing the object in between is not overwritten.
+
+// writeConditions returns the preconditions of a write replacing the live
+// generation of a GCS object, 0 if there is none.
+func writeConditions(generation int64) *storage.Conditions {
+	if generation == 0 {
+		return &storage.Conditions{DoesNotExist: true}
+	}
+	return &storage.Conditions{GenerationMatch: generation}
+}
+
+// liveGeneration returns the live generation of a GCS object, 0 if there is
+// none.
+func (c *copier) liveGeneration(gcsObject *storage.ObjectHandle) int64 {
+	attrs, err := gcsObject.Attrs(c.ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return 0
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return attrs.Generation
+}
+
+// isPreconditionFailed reports whether a GCS request failed for its
+// preconditions.
+func isPreconditionFailed(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed
+}
+
+// writeConflict leaves an object version written to GCS by another writer
+// since it was compared, for the next run to compare again.
+func (c *copier) writeConflict(key string, versionID string, size int64) {
+	c.options.logSample.log(objectEvent{Key: key, Action: actionSkip, Reason: reasonGCSChanged, Bytes: size,
+		Message: fmt.Sprintf("Object %s – written to GCS by another writer during the copy, leaving it", key)})
+	c.copyMutex.Lock()
+	c.filesConflicted++
+	c.copyMutex.Unlock()
+	c.manifest.record(transferRecord{Key: key, Size: size, VersionID: versionID, Action: actionSkip, Reason: reasonGCSChanged})
+}
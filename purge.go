@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Deleting S3 objects is a two-phase process. Copies with -delete-source only
+// append the object versions they copied and verified to a deletion list.
+// The purge-source subcommand then verifies the whole prefix again, checks
+// that none of the listed versions changed, and only then deletes them.
+
+const defaultDeletionList = "deletion-list.jsonl"
+
+// deletionEntry is a line of the deletion list.
+type deletionEntry struct {
+	Key       string `json:"key"`
+	VersionID string `json:"versionId,omitempty"`
+	ETag      string `json:"etag"`
+}
+
+// readDeletionList reads the entries of a deletion list whose key starts
+// with prefix. Versions listed more than once are only returned once.
+func readDeletionList(path, prefix string) []deletionEntry {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	var entries []deletionEntry
+	seen := make(map[deletionEntry]struct{})
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		entry := deletionEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Fatalf("Invalid deletion list %s: %v", path, err)
+		}
+		if _, ok := seen[entry]; ok || !strings.HasPrefix(entry.Key, prefix) {
+			continue
+		}
+		seen[entry] = struct{}{}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return entries
+}
+
+func runPurgeSource(args []string) {
+	flags := flag.NewFlagSet("purge-source", flag.ExitOnError)
+	deletionList := flags.String("deletion-list", defaultDeletionList, "Deletion list written by copies with -delete-source")
+	dryRun := flags.Bool("dry-run", false, "Run the verification and the delta pass but do not delete anything")
+	var options verifyOptions
+	flags.BoolVar(&options.skipMetadata, "skip-metadata", false, "Only compare size and checksums during verification, skipping the per-object S3 HeadObject call")
+	flags.StringVar(&options.tagPrefix, "tag-prefix", defaultTagPrefix, "Ignore the GCS metadata entries starting with this prefix during verification, the S3 tags copied with -copy-tags")
+	flags.IntVar(&options.concurrency, "concurrency", runtime.NumCPU(), "Number of objects compared concurrently")
+	flags.Var((*byteSize)(&options.splitSize), "split-size", "Expect objects larger than this size to have been split into parts (see copy -split-size)")
+	var s3Opts s3Options
+	addS3Flags(flags, &s3Opts)
+	var gcsOpts gcsOptions
+	addGCSFlags(flags, &gcsOpts)
+	addLogFlags(flags)
+	flags.Parse(args)
+	setupLogging()
+
+	if len(flags.Args()) < 2 || len(flags.Args()) > 3 {
+		log.Fatal("Usage: ./s3-to-gcs purge-source [-deletion-list <file>] [-dry-run] [-skip-metadata] [-tag-prefix <prefix>] [-concurrency <n>] [-split-size <size>] <S3 bucket> <GCS bucket> [optional object key prefix]")
+	}
+
+	buckets, objectKeyPrefix := parseBucketArgs(flags.Args(), "s3", "gs")
+	s3Bucket, gcsBucket := buckets[0], buckets[1]
+
+	entries := readDeletionList(*deletionList, objectKeyPrefix)
+	log.Printf("Deletion list %s: %s object versions under prefix %q", *deletionList, printer.Sprintf("%d", len(entries)), objectKeyPrefix)
+
+	s3Opts.log()
+	gcsOpts.log()
+	s3Client := newS3Client(s3Opts)
+
+	ctx := context.Background()
+	client := newGCSClient(ctx, gcsOpts)
+	defer client.Close()
+
+	gcsBucketHandle := gcsOpts.bucket(client, gcsBucket)
+
+	// Phase one: the whole prefix must verify, extra GCS objects aside
+	log.Printf("Verifying S3 bucket %s against GCS bucket %s", s3Bucket, gcsBucket)
+	var countsMutex sync.Mutex
+	counts := make(verifyCounts)
+	verifyBuckets(ctx, s3Client, s3Bucket, gcsBucketHandle, objectKeyPrefix, options, func(result verifyResult) {
+		countsMutex.Lock()
+		defer countsMutex.Unlock()
+		counts[result.Status]++
+		if result.Status == verifyStatusMismatch || result.Status == verifyStatusMissingInGCS {
+			log.Printf("Object %s – %s %s %s", result.Key, result.Status, strings.Join(result.Reasons, ","), result.Error)
+		}
+	})
+	counts.log()
+	if counts[verifyStatusMismatch] > 0 || counts[verifyStatusMissingInGCS] > 0 {
+		log.Fatal("Verification failed, nothing deleted")
+	}
+
+	// Phase two: none of the listed versions may have changed since they
+	// were copied
+	var toDelete []*s3.ObjectIdentifier
+	var alreadyDeleted int64
+	for _, entry := range entries {
+		input := &s3.HeadObjectInput{
+			Bucket: aws.String(s3Bucket),
+			Key:    aws.String(entry.Key),
+		}
+		if entry.VersionID != "" {
+			input.VersionId = aws.String(entry.VersionID)
+		}
+		headOutput, err := s3Client.HeadObjectWithContext(ctx, input)
+		if isS3NotFound(err) {
+			alreadyDeleted++
+			continue
+		}
+		if err != nil {
+			log.Fatal("Error getting object " + entry.Key + " from bucket " + s3Bucket + ": " + err.Error())
+		}
+		if aws.StringValue(headOutput.ETag) != entry.ETag {
+			log.Fatalf("Object %s (version %s) changed since it was copied: ETag %s, copied %s – nothing deleted",
+				entry.Key, entry.VersionID, aws.StringValue(headOutput.ETag), entry.ETag)
+		}
+		toDelete = append(toDelete, &s3.ObjectIdentifier{Key: input.Key, VersionId: input.VersionId})
+	}
+	log.Printf("Delta pass clean: %s object versions to delete, %s already deleted",
+		printer.Sprintf("%d", len(toDelete)), printer.Sprintf("%d", alreadyDeleted))
+
+	if *dryRun {
+		log.Print("Dry run, nothing deleted")
+		return
+	}
+
+	// DeleteObjects accepts up to 1000 keys per request
+	var deleted int64
+	for start := 0; start < len(toDelete); start += 1000 {
+		end := start + 1000
+		if end > len(toDelete) {
+			end = len(toDelete)
+		}
+		output, err := s3Client.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s3Bucket),
+			Delete: &s3.Delete{
+				Objects: toDelete[start:end],
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, deleteError := range output.Errors {
+			log.Printf("Error deleting object %s (version %s): %s", aws.StringValue(deleteError.Key),
+				aws.StringValue(deleteError.VersionId), aws.StringValue(deleteError.Message))
+		}
+		deleted += int64(end-start) - int64(len(output.Errors))
+	}
+
+	log.Printf("Deleted %s source object versions", printer.Sprintf("%d", deleted))
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// quarantineEntry is the line of the -quarantine file about an object whose
+// copy failed once its requests exhausted their retries.
+type quarantineEntry struct {
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	VersionID string    `json:"versionId,omitempty"`
+	Size      int64     `json:"size"`
+	Error     string    `json:"error"`
+	Time      time.Time `json:"time"`
+}
+
+// quarantine records the objects whose copy failed with -quarantine, as JSON
+// lines. A nil quarantine fails the run instead.
+type quarantine struct {
+	path    string
+	file    *os.File
+	mutex   sync.Mutex
+	encoder *json.Encoder
+}
+
+func createQuarantine(path string) *quarantine {
+	file, err := os.Create(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &quarantine{path: path, file: file, encoder: json.NewEncoder(file)}
+}
+
+func (q *quarantine) record(entry quarantineEntry) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if err := q.encoder.Encode(entry); err != nil {
+		log.Fatal("Error writing quarantine file " + q.path + ": " + err.Error())
+	}
+}
+
+func (q *quarantine) close() {
+	if q == nil {
+		return
+	}
+	if err := q.file.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// sameFile reports whether two paths name the same file, which does not
+// need to exist yet.
+func sameFile(a string, b string) bool {
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+	aInfo, aErr := os.Stat(a)
+	bInfo, bErr := os.Stat(b)
+	return aErr == nil && bErr == nil && os.SameFile(aInfo, bInfo)
+}
+
+// failed handles a copy of an object version that failed: with -quarantine,
+// it is recorded for a later run to copy again with -retry-from and the run
+// goes on, otherwise the run fails and exits.
+func (c *copier) failed(key string, versionID string, size int64, err error, message string) {
+	if c.quarantine == nil {
+		fatalObject(key, err, message)
+	}
+	logObject(objectEvent{Key: key, Action: actionError, Error: err.Error(), Message: message + ": " + err.Error() + ", quarantined"})
+	countFailure(err)
+	c.quarantine.record(quarantineEntry{Bucket: c.s3Bucket, Key: key, VersionID: versionID, Size: size, Error: err.Error(), Time: time.Now().UTC()})
+	c.copyMutex.Lock()
+	c.filesQuarantined++
+	c.copyMutex.Unlock()
+}
+
+// readQuarantine returns the keys of the objects of s3Bucket recorded in a
+// -quarantine file, once each and in order.
+func readQuarantine(path string, s3Bucket string) []string {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	keys := make(map[string]struct{})
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var entry quarantineEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Key == "" {
+			log.Fatalf("Invalid quarantine file %s, line %d is not an object entry", path, line)
+		}
+		if entry.Bucket != s3Bucket {
+			log.Fatalf("Quarantine file %s, line %d is an object of bucket %s, not %s", path, line, entry.Bucket, s3Bucket)
+		}
+		keys[entry.Key] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("Error reading quarantine file %s: %v", path, err)
+	}
+
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	log.Printf("Retrying %s objects from %s", printer.Sprintf("%d", len(sorted)), path)
+	return sorted
+}
+
+// retryLister returns an objectLister listing the objects of keys under
+// prefix, as they are in S3 now, in pages of up to 1000 objects. Objects
+// deleted since they failed are left out.
+func retryLister(ctx context.Context, s3Client *s3.S3, s3Bucket string, keys []string, prefix string) objectLister {
+	return func(fn func(page *s3.ListObjectsV2Output, lastPage bool) bool) error {
+		page := &s3.ListObjectsV2Output{}
+		for _, key := range keys {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			output, err := s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+				Bucket: aws.String(s3Bucket),
+				Key:    aws.String(key),
+			})
+			if isS3NotFound(err) {
+				log.Printf("Object %s – no longer in S3, not retrying", key)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("getting object %s to retry: %w", key, err)
+			}
+
+			page.Contents = append(page.Contents, &s3.Object{
+				Key:          aws.String(key),
+				Size:         output.ContentLength,
+				ETag:         output.ETag,
+				LastModified: output.LastModified,
+			})
+			if len(page.Contents) < 1000 {
+				continue
+			}
+			if !fn(page, false) {
+				return nil
+			}
+			page = &s3.ListObjectsV2Output{}
+		}
+		fn(page, true)
+		return nil
+	}
+}
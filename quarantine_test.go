@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadQuarantine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "failed.jsonl")
+	q := createQuarantine(path)
+	// A key failing in several versions, or in several runs, is retried once
+	for _, entry := range []quarantineEntry{
+		{Bucket: "bucket", Key: "b/2.txt", VersionID: "v2", Size: 2, Error: "timeout"},
+		{Bucket: "bucket", Key: "a/1.txt", Size: 1, Error: "reset"},
+		{Bucket: "bucket", Key: "b/2.txt", VersionID: "v1", Size: 2, Error: "timeout"},
+		{Bucket: "bucket", Key: "unicode/é 🚀.txt", Size: 3, Error: "throttled"},
+	} {
+		entry.Time = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+		q.record(entry)
+	}
+	q.close()
+
+	// Blank lines, such as a trailing one added by hand, are left out
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString("\n  \n"); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	got := readQuarantine(path, "bucket")
+	if want := []string{"a/1.txt", "b/2.txt", "unicode/é 🚀.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("readQuarantine = %q, want %q", got, want)
+	}
+}
+
+func TestReadQuarantineEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "failed.jsonl")
+	createQuarantine(path).close()
+	if got := readQuarantine(path, "bucket"); len(got) != 0 {
+		t.Errorf("readQuarantine of an empty file = %q, want no key", got)
+	}
+}
+
+func TestSameFile(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "failed.jsonl")
+	if err := os.WriteFile(existing, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link.jsonl")
+	if err := os.Symlink(existing, link); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{a: existing, b: existing, want: true},
+		{a: existing, b: filepath.Join(dir, ".", "failed.jsonl"), want: true},
+		{a: existing, b: link, want: true},
+		{a: filepath.Join(dir, "new.jsonl"), b: filepath.Join(dir, "new.jsonl"), want: true},
+		{a: existing, b: filepath.Join(dir, "new.jsonl"), want: false},
+	}
+	for _, test := range tests {
+		if got := sameFile(test.a, test.b); got != test.want {
+			t.Errorf("sameFile(%q, %q) = %t, want %t", test.a, test.b, got, test.want)
+		}
+	}
+}
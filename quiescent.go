@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// listedObject is what a listing tells about an object, enough to notice
+// that it was written or deleted between two listings.
+type listedObject struct {
+	size         int64
+	etag         string
+	lastModified time.Time
+}
+
+// snapshotListing returns the objects listed by list, by key.
+func snapshotListing(list objectLister) (map[string]listedObject, error) {
+	objects := make(map[string]listedObject)
+	err := list(func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, s3Object := range page.Contents {
+			objects[*s3Object.Key] = listedObject{
+				size:         aws.Int64Value(s3Object.Size),
+				etag:         aws.StringValue(s3Object.ETag),
+				lastModified: aws.TimeValue(s3Object.LastModified),
+			}
+		}
+		return true
+	})
+	return objects, err
+}
+
+// changedKeys returns the keys of the objects created, modified or deleted
+// between the before and after listings, in key order.
+func changedKeys(before, after map[string]listedObject) []string {
+	var keys []string
+	for key, object := range before {
+		if afterObject, ok := after[key]; !ok || afterObject != object {
+			keys = append(keys, key)
+		}
+	}
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// requireQuiescent lists the objects twice, wait apart, and exits if any
+// changed in between, since a bucket still being written to would not be
+// entirely copied by a single run. It returns early, without checking, if
+// ctx is done.
+func requireQuiescent(ctx context.Context, list objectLister, wait time.Duration) {
+	log.Printf("Listing objects to check that none changes in %s", wait)
+	before, err := snapshotListing(list)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return
+	}
+
+	log.Printf("Listing objects again, %s objects listed the first time", printer.Sprintf("%d", len(before)))
+	after, err := snapshotListing(list)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	changed := changedKeys(before, after)
+	if len(changed) == 0 {
+		log.Printf("No object changed in %s", wait)
+		return
+	}
+	const maxLogged = 10
+	for i, key := range changed {
+		if i == maxLogged {
+			log.Printf("And %s more objects changed", printer.Sprintf("%d", len(changed)-maxLogged))
+			break
+		}
+		log.Printf("Object %s changed", key)
+	}
+	log.Fatalf("%s objects changed in %s, the bucket is still being written to. Stop the writers first, or run without -require-quiescent",
+		printer.Sprintf("%d", len(changed)), wait)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Objects larger than -parallel-download-threshold are downloaded from S3 as
+// consecutive byte ranges of rangeSize bytes, several at a time, so a single
+// large object is not limited to the throughput of one connection.
+const rangeSize = 16 * 1024 * 1024
+
+// getObjectInRanges is like GetObject, but downloads the content in ranges
+// with up to concurrency ranged GETs in flight. The returned output carries
+// the headers of a HeadObject call, including the checksum of the whole
+// object, which individual ranged GETs do not return.
+func getObjectInRanges(ctx context.Context, s3Client *s3.S3, input *s3.GetObjectInput, concurrency int) (*s3.GetObjectOutput, error) {
+	output, err := headObjectOutput(ctx, s3Client, input)
+	if err != nil {
+		return nil, err
+	}
+
+	// IfMatch makes sure all the ranges come from the same content
+	fetch := func(ctx context.Context, offset, size int64) ([]byte, error) {
+		body, err := getObjectRange(ctx, s3Client, input, output.ETag, offset, size)
+		if err != nil {
+			return nil, err
+		}
+		defer body.Close()
+
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) != size {
+			return nil, fmt.Errorf("range at offset %d: expected %d bytes, got %d", offset, size, len(data))
+		}
+		return data, nil
+	}
+
+	output.Body = newParallelRangeReader(ctx, aws.Int64Value(output.ContentLength), concurrency, fetch)
+	return output, nil
+}
+
+// headObjectOutput returns the headers of the object GetObject would read,
+// from HeadObject, with an empty body.
+func headObjectOutput(ctx context.Context, s3Client *s3.S3, input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	headOutput, err := s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:       input.Bucket,
+		Key:          input.Key,
+		VersionId:    input.VersionId,
+		ChecksumMode: input.ChecksumMode,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3.GetObjectOutput{
+		Body:                 http.NoBody,
+		ContentLength:        headOutput.ContentLength,
+		ContentType:          headOutput.ContentType,
+		CacheControl:         headOutput.CacheControl,
+		ContentEncoding:      headOutput.ContentEncoding,
+		ContentDisposition:   headOutput.ContentDisposition,
+		ContentLanguage:      headOutput.ContentLanguage,
+		ETag:                 headOutput.ETag,
+		LastModified:         headOutput.LastModified,
+		Metadata:             headOutput.Metadata,
+		StorageClass:         headOutput.StorageClass,
+		VersionId:            headOutput.VersionId,
+		ServerSideEncryption: headOutput.ServerSideEncryption,
+		SSEKMSKeyId:          headOutput.SSEKMSKeyId,
+		SSECustomerAlgorithm: headOutput.SSECustomerAlgorithm,
+		ChecksumCRC32C:       headOutput.ChecksumCRC32C,
+	}, nil
+}
+
+// getObjectRange returns the content of a range of the object input is
+// about, failing unless the object still has the given ETag.
+func getObjectRange(ctx context.Context, s3Client *s3.S3, input *s3.GetObjectInput, etag *string, offset, size int64) (io.ReadCloser, error) {
+	output, err := s3Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket:    input.Bucket,
+		Key:       input.Key,
+		VersionId: input.VersionId,
+		Range:     aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+size-1)),
+		IfMatch:   etag,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.Body, nil
+}
+
+type rangeResult struct {
+	data   []byte
+	crc32c uint32
+	err    error
+}
+
+// parallelRangeReader reads content of the given size by fetching it in
+// consecutive ranges concurrently, returning them in order. At most
+// concurrency ranges are fetched or waiting to be read at any time.
+type parallelRangeReader struct {
+	cancel  context.CancelFunc
+	ranges  chan chan rangeResult
+	current []byte
+	err     error
+
+	// CRC32C checksum of the ranges read so far, combined from the
+	// checksums computed as each range was received
+	crc32c uint32
+}
+
+func newParallelRangeReader(ctx context.Context, size int64, concurrency int, fetch func(ctx context.Context, offset, size int64) ([]byte, error)) *parallelRangeReader {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &parallelRangeReader{
+		cancel: cancel,
+		ranges: make(chan chan rangeResult, concurrency),
+	}
+
+	go func() {
+		defer close(r.ranges)
+		for offset := int64(0); offset < size; offset += rangeSize {
+			length := int64(rangeSize)
+			if offset+length > size {
+				length = size - offset
+			}
+
+			result := make(chan rangeResult, 1)
+			select {
+			case r.ranges <- result:
+			case <-ctx.Done():
+				return
+			}
+
+			go func(offset, length int64) {
+				data, err := fetch(ctx, offset, length)
+				result <- rangeResult{data: data, crc32c: crc32.Checksum(data, crc32cTable), err: err}
+			}(offset, length)
+		}
+	}()
+
+	return r
+}
+
+func (r *parallelRangeReader) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		result, ok := <-r.ranges
+		if !ok {
+			r.err = io.EOF
+			continue
+		}
+		received := <-result
+		r.current, r.err = received.data, received.err
+		r.crc32c = crc32cCombine(r.crc32c, received.crc32c, int64(len(received.data)))
+	}
+
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+// checksum returns the CRC32C checksum of the content read so far, combined
+// from the checksums of its ranges.
+func (r *parallelRangeReader) checksum() uint32 {
+	return r.crc32c
+}
+
+// Close stops fetching ranges that have not been read yet.
+func (r *parallelRangeReader) Close() error {
+	r.cancel()
+	return nil
+}
+
+// crc32cCombine returns the CRC32C checksum of the concatenation of two
+// blocks of content, given the checksum of each and the length of the second,
+// like zlib's crc32_combine.
+func crc32cCombine(crc1, crc2 uint32, len2 int64) uint32 {
+	if len2 <= 0 {
+		return crc1
+	}
+
+	// Operator for one zero bit, then for two and four
+	var even, odd [32]uint32
+	odd[0] = crc32.Castagnoli
+	row := uint32(1)
+	for i := 1; i < 32; i++ {
+		odd[i] = row
+		row <<= 1
+	}
+	gf2MatrixSquare(even[:], odd[:])
+	gf2MatrixSquare(odd[:], even[:])
+
+	// Apply len2 zero bytes to crc1, squaring the operator for each bit of
+	// len2
+	for {
+		gf2MatrixSquare(even[:], odd[:])
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(even[:], crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+
+		gf2MatrixSquare(odd[:], even[:])
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(odd[:], crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+	}
+	return crc1 ^ crc2
+}
+
+func gf2MatrixTimes(matrix []uint32, vector uint32) uint32 {
+	var sum uint32
+	for i := 0; vector != 0; i, vector = i+1, vector>>1 {
+		if vector&1 != 0 {
+			sum ^= matrix[i]
+		}
+	}
+	return sum
+}
+
+func gf2MatrixSquare(square, matrix []uint32) {
+	for i := range square {
+		square[i] = gf2MatrixTimes(matrix, matrix[i])
+	}
+}
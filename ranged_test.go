@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"hash/crc32"
+	"testing"
+)
+
+func TestCRC32CCombine(t *testing.T) {
+	table := crc32.MakeTable(crc32.Castagnoli)
+	content := bytes.Repeat([]byte("0123456789abcdefghijklmnopqrstuvwxyz"), 40000)
+	tests := []struct {
+		name  string
+		first int
+		size  int
+	}{
+		{name: "both empty", first: 0, size: 0},
+		{name: "second empty", first: 10, size: 10},
+		{name: "first empty", first: 0, size: 10},
+		{name: "one byte each", first: 1, size: 2},
+		{name: "odd split", first: 7, size: 1001},
+		{name: "large second", first: 3, size: len(content)},
+		{name: "large first", first: len(content) - 5, size: len(content)},
+	}
+	for _, test := range tests {
+		crc1 := crc32.Checksum(content[:test.first], table)
+		crc2 := crc32.Checksum(content[test.first:test.size], table)
+		got := crc32cCombine(crc1, crc2, int64(test.size-test.first))
+		if want := crc32.Checksum(content[:test.size], table); got != want {
+			t.Errorf("%s: crc32cCombine = %08x, want %08x", test.name, got, want)
+		}
+	}
+}
+
+// The checksums of the parts of a composite upload are combined in order.
+func TestCRC32CCombineParts(t *testing.T) {
+	table := crc32.MakeTable(crc32.Castagnoli)
+	tests := []struct {
+		partSize int
+		size     int
+	}{
+		{partSize: 1, size: 1000},
+		{partSize: 4096, size: 500000},
+		{partSize: 65537, size: 500000},
+		{partSize: 500000, size: 500000},
+	}
+	for _, test := range tests {
+		content := bytes.Repeat([]byte{0x00, 0xff, 0xa5, 0x5a, 0x01}, test.size/5)
+		var crc uint32
+		for offset := 0; offset < len(content); offset += test.partSize {
+			end := offset + test.partSize
+			if end > len(content) {
+				end = len(content)
+			}
+			crc = crc32cCombine(crc, crc32.Checksum(content[offset:end], table), int64(end-offset))
+		}
+		if want := crc32.Checksum(content, table); crc != want {
+			t.Errorf("parts of %d bytes: combined checksum %08x, want %08x", test.partSize, crc, want)
+		}
+	}
+}
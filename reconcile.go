@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"google.golang.org/api/iterator"
+)
+
+// listedGCSObject is what reconcile keeps of every object of the GCS
+// listing.
+type listedGCSObject struct {
+	size int64
+	etag string
+}
+
+// listGCSObjects returns the objects under prefix in a GCS bucket that belong
+// to objectShard, by name.
+func listGCSObjects(ctx context.Context, bucketHandle *storage.BucketHandle, prefix string, objectShard *shard) map[string]listedGCSObject {
+	query := &storage.Query{Prefix: prefix}
+	if err := query.SetAttrSelection([]string{"Name", "Size", "Metadata"}); err != nil {
+		log.Fatal(err)
+	}
+	objects := make(map[string]listedGCSObject)
+	it := bucketHandle.Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return objects
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !isFolderKey(attrs.Name) && objectShard.contains(attrs.Name) {
+			objects[attrs.Name] = listedGCSObject{size: sourceSize(attrs), etag: attrs.Metadata[metadataKeyETag]}
+		}
+	}
+}
+
+// reconcileObject compares an object of the inventory with its GCS object
+// in the listing.
+func reconcileObject(s3Object *s3.Object, gcsObject listedGCSObject, ok bool) verifyResult {
+	result := verifyResult{
+		Key:    *s3Object.Key,
+		Status: verifyStatusMatch,
+		S3Size: s3Object.Size,
+		S3ETag: *s3Object.ETag,
+	}
+	if !ok {
+		result.Status = verifyStatusMissingInGCS
+		return result
+	}
+
+	result.GCSSize = aws.Int64(gcsObject.size)
+	result.GCSETag = gcsObject.etag
+	if *s3Object.Size != gcsObject.size {
+		result.Reasons = append(result.Reasons, "size")
+	}
+	if *s3Object.ETag != gcsObject.etag {
+		result.Reasons = append(result.Reasons, "checksum")
+	}
+	if len(result.Reasons) > 0 {
+		result.Status = verifyStatusMismatch
+	}
+	return result
+}
+
+// runReconcile compares an S3 Inventory report generated after the cutover
+// with a listing of the GCS bucket, and reports every object of the
+// inventory that is not safely in GCS. It is the last check before the S3
+// bucket is deleted, so it reads nothing else from S3: the inventory is the
+// record of what the bucket held.
+func runReconcile(args []string) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	inventoryFlag := flags.String("inventory", "", "s3:// URI of the manifest.json of an S3 Inventory report of the bucket, generated after the cutover")
+	reportPath := flags.String("report", "-", "Write the gap list, the objects missing from GCS or different, to this file as JSON lines (default: standard output)")
+	outputFormat := addOutputFlag(flags)
+	var objectShard shard
+	flags.Var(&objectShard, "shard", "Only reconcile the i-th of N disjoint sets of keys, e.g. 2/4")
+	var splitSize int64
+	flags.Var((*byteSize)(&splitSize), "split-size", "Expect objects larger than this size to have been split into parts (see copy -split-size)")
+	var s3Opts s3Options
+	addS3Flags(flags, &s3Opts)
+	var gcsOpts gcsOptions
+	addGCSFlags(flags, &gcsOpts)
+	addLogFlags(flags)
+	flags.Parse(args)
+	setupLogging()
+	checkOutputFormat(*outputFormat)
+
+	if *inventoryFlag == "" || len(flags.Args()) < 2 || len(flags.Args()) > 3 {
+		log.Fatal("Usage: ./s3-to-gcs reconcile -inventory s3://<bucket>/<path>/manifest.json [-report <file>] [-output json|csv|table] [-split-size <size>] [-shard <i>/<N>] <S3 bucket> <GCS bucket> [optional object key prefix]")
+	}
+
+	buckets, objectKeyPrefix := parseBucketArgs(flags.Args(), "s3", "gs")
+	s3Bucket, gcsBucket := buckets[0], buckets[1]
+
+	log.Printf("Reconciling the inventory of S3 bucket %s with GCS bucket %s", s3Bucket, gcsBucket)
+	if objectKeyPrefix != "" {
+		log.Printf("Object key prefix: %s", objectKeyPrefix)
+	}
+	if objectShard.count > 1 {
+		log.Printf("Shard: %s", objectShard.String())
+	}
+	s3Opts.log()
+	gcsOpts.log()
+
+	var report io.Writer = os.Stdout
+	if *reportPath != "-" {
+		reportFile, err := os.Create(*reportPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer reportFile.Close()
+		report = reportFile
+	}
+	encoder := json.NewEncoder(report)
+	var table *tableWriter
+	if *outputFormat != outputJSON {
+		table = newTableWriter(report, *outputFormat, "key", "status", "reasons", "s3Size", "gcsSize", "s3ETag", "gcsETag", "error")
+	}
+
+	ctx := context.Background()
+	s3Client := newS3Client(s3Opts)
+	listObjects := objectShard.filter(inventoryLister(ctx, s3Client, *inventoryFlag, s3Bucket, objectKeyPrefix))
+
+	client := newGCSClient(ctx, gcsOpts)
+	defer client.Close()
+	gcsBucketHandle := gcsOpts.bucket(client, gcsBucket)
+
+	// The inventory is not sorted, so the whole GCS listing is kept in memory
+	log.Printf("Listing GCS bucket %s", gcsBucket)
+	gcsObjects := listGCSObjects(ctx, gcsBucketHandle, objectKeyPrefix, &objectShard)
+	log.Printf("Listed %s GCS objects", printer.Sprintf("%d", len(gcsObjects)))
+
+	counts := make(verifyCounts)
+	err := listObjects(func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, s3Object := range page.Contents {
+			if isFolderKey(*s3Object.Key) {
+				continue
+			}
+
+			var result verifyResult
+			if splitSize > 0 && *s3Object.Size > splitSize {
+				for _, name := range splitObjectNames(*s3Object.Key, *s3Object.Size, splitSize) {
+					delete(gcsObjects, name)
+				}
+				result = verifySplitObject(ctx, gcsBucketHandle, s3Object)
+			} else {
+				gcsObject, ok := gcsObjects[*s3Object.Key]
+				result = reconcileObject(s3Object, gcsObject, ok)
+			}
+			delete(gcsObjects, *s3Object.Key)
+
+			counts[result.Status]++
+			if result.Status == verifyStatusMatch {
+				continue
+			}
+			if table != nil {
+				table.write(result.Key, result.Status, strings.Join(result.Reasons, ";"), formatOptionalInt(result.S3Size),
+					formatOptionalInt(result.GCSSize), result.S3ETag, result.GCSETag, result.Error)
+			} else if err := encoder.Encode(result); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if table != nil {
+		table.flush()
+	}
+	counts.log()
+
+	// Objects written to GCS since the cutover are expected, they are no
+	// gap of the S3 bucket
+	if len(gcsObjects) > 0 {
+		log.Printf("%s GCS objects are not in the inventory, written since the cutover or deleted from S3 before it", printer.Sprintf("%d", len(gcsObjects)))
+	}
+
+	if gaps := counts[verifyStatusMismatch] + counts[verifyStatusMissingInGCS]; gaps > 0 {
+		log.Fatalf("Reconciliation found %s gaps, do not delete the S3 bucket yet", printer.Sprintf("%d", gaps))
+	}
+	log.Print("Reconciliation succeeded, every object of the inventory is in GCS")
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// metadataKeySourceKey is the metadata entry recording the S3 key of a GCS
+// object whose name was rewritten, to tell which key owns the name when two
+// keys are rewritten into it.
+const metadataKeySourceKey = "SourceKey"
+
+// Policies of -on-collision for an S3 key rewritten into the GCS name of
+// another key.
+const (
+	collisionFail = "fail"
+	collisionSkip = "skip"
+)
+
+// renameRule rewrites the part of a name matching pattern into replacement,
+// only the first match unless global.
+type renameRule struct {
+	value       string
+	pattern     *regexp.Regexp
+	replacement string
+	global      bool
+}
+
+func (r renameRule) apply(name string) string {
+	if r.global {
+		return r.pattern.ReplaceAllString(name, r.replacement)
+	}
+	match := r.pattern.FindStringSubmatchIndex(name)
+	if match == nil {
+		return name
+	}
+	replaced := r.pattern.ExpandString(nil, r.replacement, name, match)
+	return name[:match[0]] + string(replaced) + name[match[1]:]
+}
+
+// renameRules is a flag.Value collecting the rules of every -rename flag,
+// parsed from sed style substitutions, "s<d><regexp><d><replacement><d>" with
+// any delimiter <d> and an optional g flag to replace every match. The
+// delimiter is escaped with a backslash, and the replacement refers to
+// groups as $1 or ${name}.
+type renameRules []renameRule
+
+func (r *renameRules) String() string {
+	if r == nil {
+		return ""
+	}
+	rules := make([]string, len(*r))
+	for i, rule := range *r {
+		rules[i] = rule.value
+	}
+	return strings.Join(rules, " ")
+}
+
+func (r *renameRules) Set(value string) error {
+	if len(value) < 2 || value[0] != 's' {
+		return fmt.Errorf("invalid rename %q, expected s#<regexp>#<replacement>#", value)
+	}
+	delimiter := value[1]
+	if delimiter == '\\' || (delimiter >= 'a' && delimiter <= 'z') || (delimiter >= 'A' && delimiter <= 'Z') || (delimiter >= '0' && delimiter <= '9') {
+		return fmt.Errorf("invalid rename %q, the delimiter cannot be a backslash, a letter or a digit", value)
+	}
+
+	// The regexp, the replacement and the flags, where an escaped delimiter
+	// stands for itself
+	var fields []string
+	var field strings.Builder
+	for i := 2; i < len(value); i++ {
+		switch {
+		case value[i] == '\\' && i+1 < len(value) && value[i+1] == delimiter:
+			if len(fields) == 0 {
+				field.WriteString(regexp.QuoteMeta(string(delimiter)))
+			} else {
+				field.WriteByte(delimiter)
+			}
+			i++
+		case value[i] == delimiter && len(fields) < 2:
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(value[i])
+		}
+	}
+	if len(fields) < 2 {
+		return fmt.Errorf("invalid rename %q, expected s%c<regexp>%c<replacement>%c", value, delimiter, delimiter, delimiter)
+	}
+	flags := field.String()
+	if flags != "" && flags != "g" {
+		return fmt.Errorf("invalid rename %q, the only flag is g", value)
+	}
+	if fields[0] == "" {
+		return fmt.Errorf("invalid rename %q, the regexp cannot be empty", value)
+	}
+
+	pattern, err := regexp.Compile(fields[0])
+	if err != nil {
+		return fmt.Errorf("invalid rename %q: %w", value, err)
+	}
+	*r = append(*r, renameRule{value: value, pattern: pattern, replacement: fields[1], global: flags == "g"})
+	return nil
+}
+
+// templateVariables are the variables of -name-template besides the
+// numbered components of the key, and whether they depend on the
+// LastModified time of the object.
+var templateVariables = map[string]bool{
+	"key":   false, // The key, once -strip-prefix and -rename applied
+	"s3key": false, // The S3 key as is
+	"dir":   false, // The key up to its last "/", "" if none
+	"base":  false, // The key after its last "/"
+	"name":  false, // base without its extension
+	"ext":   false, // The extension of base, with its dot, "" if none
+	"year":  true,
+	"month": true,
+	"day":   true,
+	"hour":  true,
+	"date":  true, // year-month-day
+}
+
+// templateField is a literal part of a name template, or a variable.
+type templateField struct {
+	literal  string
+	variable string
+}
+
+// nameTemplate is a flag.Value holding the -name-template GCS objects are
+// named after, in which {variable} is replaced by one of
+// templateVariables, or {n} by the nth "/" separated component of the key,
+// counting from 1. Times are in UTC.
+type nameTemplate struct {
+	value  string
+	fields []templateField
+}
+
+func (t *nameTemplate) String() string {
+	if t == nil {
+		return ""
+	}
+	return t.value
+}
+
+func (t *nameTemplate) Set(value string) error {
+	var fields []templateField
+	rest := value
+	for rest != "" {
+		start := strings.IndexByte(rest, '{')
+		if start == -1 {
+			fields = append(fields, templateField{literal: rest})
+			break
+		}
+		if start > 0 {
+			fields = append(fields, templateField{literal: rest[:start]})
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end == -1 {
+			return fmt.Errorf("invalid name template %q, { without }", value)
+		}
+		variable := rest[start+1 : start+end]
+		if _, ok := templateVariables[variable]; !ok {
+			if n, err := strconv.Atoi(variable); err != nil || n < 1 {
+				return fmt.Errorf("invalid name template %q, unknown variable {%s}", value, variable)
+			}
+		}
+		fields = append(fields, templateField{variable: variable})
+		rest = rest[start+end+1:]
+	}
+	t.value = value
+	t.fields = fields
+	return nil
+}
+
+// usesTime reports whether the names depend on the LastModified time of
+// the objects.
+func (t *nameTemplate) usesTime() bool {
+	for _, field := range t.fields {
+		if templateVariables[field.variable] {
+			return true
+		}
+	}
+	return false
+}
+
+// expand returns the name of the GCS object of the S3 key s3Key, rewritten
+// into key, last modified at lastModified.
+func (t *nameTemplate) expand(s3Key string, key string, lastModified time.Time) string {
+	lastModified = lastModified.UTC()
+	var name strings.Builder
+	for _, field := range t.fields {
+		switch field.variable {
+		case "":
+			name.WriteString(field.literal)
+		case "key":
+			name.WriteString(key)
+		case "s3key":
+			name.WriteString(s3Key)
+		case "dir":
+			if i := strings.LastIndexByte(key, '/'); i != -1 {
+				name.WriteString(key[:i])
+			}
+		case "base":
+			name.WriteString(path.Base(key))
+		case "name":
+			base := path.Base(key)
+			name.WriteString(strings.TrimSuffix(base, path.Ext(base)))
+		case "ext":
+			name.WriteString(path.Ext(key))
+		case "year":
+			name.WriteString(lastModified.Format("2006"))
+		case "month":
+			name.WriteString(lastModified.Format("01"))
+		case "day":
+			name.WriteString(lastModified.Format("02"))
+		case "hour":
+			name.WriteString(lastModified.Format("15"))
+		case "date":
+			name.WriteString(lastModified.Format("2006-01-02"))
+		default:
+			// Components past the last one are empty
+			n, _ := strconv.Atoi(field.variable)
+			if components := strings.Split(key, "/"); n <= len(components) {
+				name.WriteString(components[n-1])
+			}
+		}
+	}
+	return name.String()
+}
+
+// rewritesKeys reports whether the GCS objects are named other than after
+// the keys of their S3 object.
+func (o *copyOptions) rewritesKeys() bool {
+	return o.stripPrefix != "" || len(o.renames) > 0 || o.nameTemplate.value != "" || o.addPrefix != ""
+}
+
+// gcsName returns the name of the GCS object of an S3 key last modified at
+// lastModified: -strip-prefix is removed from keys starting with it, then
+// the -rename rules applied in order, then -name-template expanded, then
+// -add-prefix prepended.
+func (o *copyOptions) gcsName(key string, lastModified time.Time) string {
+	name := strings.TrimPrefix(key, o.stripPrefix)
+	for _, rule := range o.renames {
+		name = rule.apply(name)
+	}
+	if o.nameTemplate.value != "" {
+		name = o.nameTemplate.expand(key, name, lastModified)
+	}
+	return o.addPrefix + name
+}
+
+// gcsName returns the name of the GCS object of an S3 object. An object
+// named nothing at all cannot be copied.
+func (c *copier) gcsName(s3Object *s3.Object) string {
+	name := c.options.gcsName(*s3Object.Key, aws.TimeValue(s3Object.LastModified))
+	if name == "" {
+		fatalObject(*s3Object.Key, errors.New("the rewritten GCS object name is empty"), "Error naming the GCS object of object "+*s3Object.Key)
+	}
+	return name
+}
+
+// collides reports whether the GCS object name of s3Object in gcsBucket is
+// that of another S3 key, and was handled by -on-collision: failing the run,
+// or skipping the object. The name belongs to the key recorded on the GCS
+// object by the copy that wrote it, sourceKey, or to the first key of the
+// run rewritten into it when the object records none or does not exist.
+func (c *copier) collides(s3Object *s3.Object, gcsBucket string, name string, sourceKey string) bool {
+	if c.names == nil {
+		return false
+	}
+	key := *s3Object.Key
+	other := sourceKey
+	if sourceKey == "" || sourceKey == key {
+		c.namesMutex.Lock()
+		claimed := gcsBucket + "/" + name
+		other = c.names[claimed]
+		if other == "" || sourceKey == key {
+			c.names[claimed] = key
+			other = ""
+		}
+		c.namesMutex.Unlock()
+	}
+	if other == "" || other == key {
+		return false
+	}
+
+	if c.options.onCollision == collisionFail {
+		fatalObject(key, fmt.Errorf("GCS object %s is that of object %s too", name, other), "Error naming the GCS object of object "+key)
+	}
+	c.skipObject(s3Object, reasonNameCollision, "Object %s – skipping, rewritten into GCS object %s, which is that of object %s", key, name, other)
+	c.copyMutex.Lock()
+	c.filesCollided++
+	c.copyMutex.Unlock()
+	return true
+}
+
+// otherSourceKey returns the S3 key recorded on a GCS object an S3 key was
+// rewritten into, if it is not key but another key rewritten into the same
+// name, and "" otherwise.
+func (c *copier) otherSourceKey(ctx context.Context, gcsObject *storage.ObjectHandle, key string) (string, error) {
+	if !c.options.rewritesKeys() {
+		return "", nil
+	}
+	attrs, err := gcsObject.Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if sourceKey := attrs.Metadata[metadataKeySourceKey]; sourceKey != key {
+		return sourceKey, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestRenameRulesSet(t *testing.T) {
+	tests := []struct {
+		rule string
+		name string
+		want string
+	}{
+		{rule: "s#^logs/#archive/#", name: "logs/2020/a.txt", want: "archive/2020/a.txt"},
+		{rule: "s#^logs/#archive/#", name: "data/logs/a.txt", want: "data/logs/a.txt"},
+		{rule: "s|a|b|", name: "banana", want: "bbnana"},
+		{rule: "s|a|b|g", name: "banana", want: "bbnbnb"},
+		{rule: "s#a##g", name: "banana", want: "bnn"},
+		// An escaped delimiter stands for itself, not for a regexp
+		{rule: `s.a\.b.X.`, name: "a.b axb", want: "X axb"},
+		{rule: `s.a\.b.X.g`, name: "axb a.b a.b", want: "axb X X"},
+		{rule: `s/a\/b/c/`, name: "x/a/b/y", want: "x/c/y"},
+		{rule: `s#x#a\#b#`, name: "x", want: "a#b"},
+		{rule: `s#(\w+)/(\w+)#$2/$1#`, name: "dir/file.txt", want: "file/dir.txt"},
+		{rule: `s#(?P<year>\d{4})-(?P<rest>.*)#${year}/${rest}#`, name: "2020-01.log", want: "2020/01.log"},
+		{rule: `s#(\d)#<$1>#g`, name: "a1b22", want: "a<1>b<2><2>"},
+		{rule: `s#(\d)#<$1>#`, name: "a1b22", want: "a<1>b22"},
+	}
+	for _, test := range tests {
+		var rules renameRules
+		if err := rules.Set(test.rule); err != nil {
+			t.Errorf("Set(%q): %v", test.rule, err)
+			continue
+		}
+		if got := rules[0].apply(test.name); got != test.want {
+			t.Errorf("%s applied to %q = %q, want %q", test.rule, test.name, got, test.want)
+		}
+	}
+}
+
+func TestRenameRulesSetInvalid(t *testing.T) {
+	for _, rule := range []string{
+		"",
+		"s",
+		"x#a#b#",
+		"sa#b#",
+		"s1a1b1",
+		`s\a\b\`,
+		"s#a#b",
+		"s#a#b#x",
+		"s#a#b#c#",
+		"s##b#",
+		"s#(#b#",
+	} {
+		var rules renameRules
+		if err := rules.Set(rule); err == nil {
+			t.Errorf("Set(%q) = nil, want an error", rule)
+		}
+	}
+}
+
+func TestRenameRulesString(t *testing.T) {
+	var rules renameRules
+	for _, rule := range []string{"s#a#b#", "s|c|d|g"} {
+		if err := rules.Set(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := rules.String(), "s#a#b# s|c|d|g"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestNameTemplateExpand(t *testing.T) {
+	// 22:00 on the 4th 5 hours west of UTC is 03:00 on the 5th in UTC
+	lastModified := time.Date(2021, 3, 4, 22, 0, 0, 0, time.FixedZone("", -5*3600))
+	tests := []struct {
+		template string
+		s3Key    string
+		key      string
+		want     string
+	}{
+		{template: "fixed", key: "a/b.txt", want: "fixed"},
+		{template: "{key}", s3Key: "src/a/b.txt", key: "a/b.txt", want: "a/b.txt"},
+		{template: "{s3key}", s3Key: "src/a/b.txt", key: "a/b.txt", want: "src/a/b.txt"},
+		{template: "{dir}|{base}|{name}|{ext}", key: "a/b/c.tar.gz", want: "a/b|c.tar.gz|c.tar|.gz"},
+		{template: "{dir}|{base}|{name}|{ext}", key: "c", want: "|c|c|"},
+		{template: "{ext}", key: "dir.d/file", want: ""},
+		{template: "{1}-{3}-{5}", key: "a/b/c", want: "a-c-"},
+		{template: "{2}/{base}", key: "a/b/c.txt", want: "b/c.txt"},
+		{template: "{year}/{month}/{day}/{hour}/{date}", key: "a", want: "2021/03/05/03/2021-03-05"},
+		{template: "backup/{date}/{key}", key: "a/b.txt", want: "backup/2021-03-05/a/b.txt"},
+	}
+	for _, test := range tests {
+		var template nameTemplate
+		if err := template.Set(test.template); err != nil {
+			t.Errorf("Set(%q): %v", test.template, err)
+			continue
+		}
+		if got := template.expand(test.s3Key, test.key, lastModified); got != test.want {
+			t.Errorf("%s expanded for %q = %q, want %q", test.template, test.key, got, test.want)
+		}
+	}
+}
+
+func TestNameTemplateSetInvalid(t *testing.T) {
+	for _, template := range []string{"{key", "{unknown}", "{0}", "{-1}", "{}", "a/{KEY}"} {
+		var nameTemplate nameTemplate
+		if err := nameTemplate.Set(template); err == nil {
+			t.Errorf("Set(%q) = nil, want an error", template)
+		}
+	}
+}
+
+func TestNameTemplateUsesTime(t *testing.T) {
+	tests := []struct {
+		template string
+		want     bool
+	}{
+		{template: "{key}", want: false},
+		{template: "{dir}/{1}/{name}{ext}", want: false},
+		{template: "{date}/{key}", want: true},
+		{template: "{key}.{hour}", want: true},
+	}
+	for _, test := range tests {
+		var template nameTemplate
+		if err := template.Set(test.template); err != nil {
+			t.Fatal(err)
+		}
+		if got := template.usesTime(); got != test.want {
+			t.Errorf("%s usesTime() = %t, want %t", test.template, got, test.want)
+		}
+	}
+}
+
+func TestCopyOptionsGCSName(t *testing.T) {
+	var options copyOptions
+	options.stripPrefix = "src/"
+	if err := options.renames.Set(`s#\.jpeg$#.jpg#`); err != nil {
+		t.Fatal(err)
+	}
+	if err := options.nameTemplate.Set("{year}/{key}"); err != nil {
+		t.Fatal(err)
+	}
+	options.addPrefix = "imported/"
+	lastModified := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{key: "src/a/b.jpeg", want: "imported/2020/a/b.jpg"},
+		{key: "other/b.jpeg", want: "imported/2020/other/b.jpg"},
+		{key: "src/a/b.jpeg.txt", want: "imported/2020/a/b.jpeg.txt"},
+	}
+	for _, test := range tests {
+		if got := options.gcsName(test.key, lastModified); got != test.want {
+			t.Errorf("gcsName(%q) = %q, want %q", test.key, got, test.want)
+		}
+	}
+	if !options.rewritesKeys() {
+		t.Error("rewritesKeys() = false, want true")
+	}
+	if (&copyOptions{}).rewritesKeys() {
+		t.Error("rewritesKeys() of no rewrite = true, want false")
+	}
+}
+
+func TestCopierCollides(t *testing.T) {
+	c := &copier{options: copyOptions{addPrefix: "imported/", onCollision: collisionSkip}, names: make(map[string]string)}
+	object := func(key string) *s3.Object {
+		return &s3.Object{Key: aws.String(key), Size: aws.Int64(1)}
+	}
+	// Keys in the order they are compared, with the key recorded on the
+	// GCS object, if any
+	tests := []struct {
+		key       string
+		bucket    string
+		name      string
+		sourceKey string
+		want      bool
+	}{
+		{key: "a", bucket: "bucket", name: "n"},
+		{key: "a", bucket: "bucket", name: "n"},
+		{key: "b", bucket: "bucket", name: "n", want: true},
+		{key: "b", bucket: "tier", name: "n"},
+		{key: "c", bucket: "bucket", name: "m", sourceKey: "d", want: true},
+		// The key recorded on the GCS object owns the name
+		{key: "d", bucket: "bucket", name: "m", sourceKey: "d"},
+		{key: "e", bucket: "bucket", name: "m", want: true},
+		{key: "f", bucket: "bucket", name: "o", sourceKey: "f"},
+	}
+	for i, test := range tests {
+		if got := c.collides(object(test.key), test.bucket, test.name, test.sourceKey); got != test.want {
+			t.Errorf("%d: collides(%s, %s/%s, %q) = %t, want %t", i, test.key, test.bucket, test.name, test.sourceKey, got, test.want)
+		}
+	}
+	if c.filesCollided != 3 {
+		t.Errorf("%d files collided, want 3", c.filesCollided)
+	}
+
+	// Without rewrites, names are keys and cannot collide
+	if (&copier{}).collides(object("a"), "bucket", "a", "b") {
+		t.Error("collides without rewrites = true, want false")
+	}
+}
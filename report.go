@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// reportSummary is the global summary written by report merge.
+type reportSummary struct {
+	Reports  []string         `json:"reports"`
+	Objects  int64            `json:"objects"`
+	Statuses map[string]int64 `json:"statuses"`
+	Failures int64            `json:"failures"`
+}
+
+func runReport(args []string) {
+	if len(args) == 0 || args[0] != "merge" {
+		log.Fatal("Usage: ./s3-to-gcs report merge [-summary <file>] [-output json|csv|table] [-failures <file>] <verify report>...")
+	}
+
+	flags := flag.NewFlagSet("report merge", flag.ExitOnError)
+	summaryPath := flags.String("summary", "-", "Write the summary to this file (default: standard output)")
+	outputFormat := addOutputFlag(flags)
+	failuresPath := flags.String("failures", "", "Write the results that are not a match, in key order, to this file as JSON lines")
+	addLogFlags(flags)
+	flags.Parse(args[1:])
+	setupLogging()
+	checkOutputFormat(*outputFormat)
+
+	if len(flags.Args()) == 0 {
+		log.Fatal("Usage: ./s3-to-gcs report merge [-summary <file>] [-output json|csv|table] [-failures <file>] <verify report>...")
+	}
+
+	// Reports of shards should not overlap, but if they do the result from
+	// the last report given wins, as from the most recent run
+	results := make(map[string]verifyResult)
+	for _, path := range flags.Args() {
+		for key, result := range readVerifyReport(path, "", &shard{}) {
+			results[key] = result
+		}
+	}
+
+	summary := reportSummary{
+		Reports:  flags.Args(),
+		Objects:  int64(len(results)),
+		Statuses: make(map[string]int64),
+	}
+	var failures []verifyResult
+	for _, result := range results {
+		summary.Statuses[result.Status]++
+		if result.Status != verifyStatusMatch {
+			failures = append(failures, result)
+		}
+	}
+	summary.Failures = int64(len(failures))
+
+	if *failuresPath != "" {
+		sort.Slice(failures, func(i, j int) bool { return failures[i].Key < failures[j].Key })
+		failuresFile, err := os.Create(*failuresPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		encoder := json.NewEncoder(failuresFile)
+		for _, failure := range failures {
+			if err := encoder.Encode(failure); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := failuresFile.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var output io.Writer = os.Stdout
+	if *summaryPath != "-" {
+		summaryFile, err := os.Create(*summaryPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer summaryFile.Close()
+		output = summaryFile
+	}
+	if *outputFormat == outputJSON {
+		encoder := json.NewEncoder(output)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(summary); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		// A row per status, in the order they are logged
+		statuses := make([]string, 0, len(summary.Statuses))
+		for status := range summary.Statuses {
+			statuses = append(statuses, status)
+		}
+		sort.Strings(statuses)
+		table := newTableWriter(output, *outputFormat, "status", "objects")
+		for _, status := range statuses {
+			table.write(status, strconv.FormatInt(summary.Statuses[status], 10))
+		}
+		table.flush()
+	}
+
+	verifyCounts(summary.Statuses).log()
+	log.Printf("Merged %s reports, %s objects, %s failures", printer.Sprintf("%d", len(flags.Args())),
+		printer.Sprintf("%d", summary.Objects), printer.Sprintf("%d", summary.Failures))
+}
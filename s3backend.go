@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// s3Destination writes objects to an S3 bucket. The CRC32C checksum of every
+// object is recorded in its metadata so later runs can compare contents.
+type s3Destination struct {
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+}
+
+func newS3Destination(client *s3.S3, bucket string) *s3Destination {
+	return &s3Destination{
+		client:   client,
+		uploader: s3manager.NewUploaderWithClient(client),
+		bucket:   bucket,
+	}
+}
+
+func (d *s3Destination) String() string {
+	return "s3://" + d.bucket
+}
+
+// s3Metadata looks up an S3 user metadata entry. The SDK canonicalizes the
+// case of metadata keys, so the lookup is case insensitive.
+func s3Metadata(metadata map[string]*string, key string) (string, bool) {
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) {
+			return aws.StringValue(v), true
+		}
+	}
+	return "", false
+}
+
+func (d *s3Destination) Stat(ctx context.Context, key string) (*objectInfo, error) {
+	output, err := d.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(key),
+	})
+	if isS3NotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info := &objectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(output.ContentLength),
+		LastModified: aws.TimeValue(output.LastModified),
+		ContentType:  aws.StringValue(output.ContentType),
+		Metadata:     make(map[string]string),
+	}
+	info.CRC32C, _ = s3Metadata(output.Metadata, metadataKeyCRC32C)
+	for k, v := range output.Metadata {
+		info.Metadata[k] = aws.StringValue(v)
+	}
+	return info, nil
+}
+
+func (d *s3Destination) Write(ctx context.Context, info objectInfo, body io.Reader) (string, error) {
+	metadata := make(map[string]*string, len(info.Metadata)+1)
+	for k, v := range info.Metadata {
+		metadata[k] = aws.String(v)
+	}
+
+	// The checksum has to be known up front to be recorded in the metadata
+	if info.CRC32C != "" {
+		metadata[metadataKeyCRC32C] = aws.String(info.CRC32C)
+	}
+
+	crc32cHash := crc32.New(crc32cTable)
+	input := &s3manager.UploadInput{
+		Bucket:   aws.String(d.bucket),
+		Key:      aws.String(info.Key),
+		Body:     io.TeeReader(body, crc32cHash),
+		Metadata: metadata,
+	}
+	if info.ContentType != "" {
+		input.ContentType = aws.String(info.ContentType)
+	}
+
+	// The uploader aborts its multipart upload if anything fails
+	if _, err := d.uploader.UploadWithContext(ctx, input); err != nil {
+		return "", err
+	}
+
+	crc32cSum := encodeCRC32C(crc32cHash.Sum32())
+	if info.CRC32C != "" && info.CRC32C != crc32cSum {
+		d.delete(ctx, info.Key)
+		return "", fmt.Errorf("checksum mismatch:\n  Source CRC32C: %s\n  Read CRC32C: %s", info.CRC32C, crc32cSum)
+	}
+
+	return crc32cSum, nil
+}
+
+func (d *s3Destination) delete(ctx context.Context, key string) {
+	_, err := d.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil && !isS3NotFound(err) {
+		log.Printf("Error deleting corrupt object %s: %v", key, err)
+	}
+}
+
+// s3Source reads the current version of objects from an S3 bucket. Listings
+// carry neither checksums nor user metadata, so objects are compared by size
+// and modification time and copied without their metadata.
+type s3Source struct {
+	client *s3.S3
+	bucket string
+}
+
+func newS3Source(client *s3.S3, bucket string) *s3Source {
+	return &s3Source{client: client, bucket: bucket}
+}
+
+func (s *s3Source) String() string {
+	return "s3://" + s.bucket
+}
+
+func (s *s3Source) List(ctx context.Context, prefix string, fn func(objectInfo) error) error {
+	var fnErr error
+	err := s.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			if isFolderKey(aws.StringValue(object.Key)) {
+				continue
+			}
+			fnErr = fn(objectInfo{
+				Key:          aws.StringValue(object.Key),
+				Size:         aws.Int64Value(object.Size),
+				LastModified: aws.TimeValue(object.LastModified),
+			})
+			if fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+func (s *s3Source) Open(ctx context.Context, info objectInfo) (io.ReadCloser, error) {
+	output, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(info.Key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.Body, nil
+}
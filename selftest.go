@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"google.golang.org/api/iterator"
+)
+
+// defaultSelftestPrefix is the default of -prefix of the selftest
+// subcommand. Every run works under a new prefix below it.
+const defaultSelftestPrefix = "s3-to-gcs-selftest/"
+
+// selftestObject is an object the self-test creates in S3 and expects in GCS.
+type selftestObject struct {
+	key string
+
+	// versions are the contents of its versions, oldest first. Only the last
+	// one is written to an unversioned bucket
+	versions [][]byte
+
+	// Written with PutObject, and expected on the GCS object
+	contentType     string
+	contentEncoding string
+	cacheControl    string
+	disposition     string
+	language        string
+	metadata        map[string]string
+
+	// Server side encryption in S3, AES256 or aws:kms with kmsKeyID
+	serverSideEncryption string
+	kmsKeyID             string
+
+	// folder is a folder placeholder, which is not copied
+	folder bool
+}
+
+// selftestObjects returns the matrix of objects created by the self-test:
+// the edge cases migrations tend to trip on.
+func selftestObjects(kmsKeyID string) []selftestObject {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(bytes.Repeat([]byte("compressed by the uploader "), 100))
+	writer.Close()
+
+	objects := []selftestObject{
+		{key: "empty", versions: [][]byte{{}}},
+		{key: "unicode/日本語 ファイル.txt", versions: [][]byte{[]byte("unicode key\n")}},
+		{key: "unicode/émoji 🚀.txt", versions: [][]byte{[]byte("emoji key\n")}},
+		{key: "special/a+b=c&d #1?%20.txt", versions: [][]byte{[]byte("reserved characters\n")}},
+		{key: "special//double slash.txt", versions: [][]byte{[]byte("double slash\n")}},
+		{key: "folder/", versions: [][]byte{{}}, folder: true},
+		{
+			key:          "metadata.html",
+			versions:     [][]byte{[]byte("<p>metadata</p>\n")},
+			contentType:  "text/html; charset=utf-8",
+			cacheControl: "public, max-age=3600",
+			disposition:  `attachment; filename="metadata file.html"`,
+			language:     "en-GB",
+			metadata:     map[string]string{"owner": "selftest", "quoted": `"a=b; c,d"`},
+		},
+		{key: "gzip.txt", versions: [][]byte{compressed.Bytes()}, contentType: "text/plain", contentEncoding: "gzip"},
+		// Objects larger than a part are uploaded in 5 MiB parts
+		{key: "multipart.bin", versions: [][]byte{bytes.Repeat([]byte{0xa5}, int(s3manager.MinUploadPartSize)+1024)}},
+		{key: "versions.txt", versions: [][]byte{[]byte("version 1\n"), []byte("version 2\n"), []byte("version 3\n")}},
+		{key: "sse-s3.txt", versions: [][]byte{[]byte("encrypted with SSE-S3\n")}, serverSideEncryption: s3.ServerSideEncryptionAes256},
+	}
+	if kmsKeyID != "" {
+		objects = append(objects, selftestObject{key: "sse-kms.txt", versions: [][]byte{[]byte("encrypted with SSE-KMS\n")},
+			serverSideEncryption: s3.ServerSideEncryptionAwsKms, kmsKeyID: kmsKeyID})
+	}
+	return objects
+}
+
+// put writes the versions of the object to S3 under prefix, only the last
+// one if versionEnabled is false.
+func (o selftestObject) put(ctx context.Context, uploader *s3manager.Uploader, bucket string, prefix string, versionEnabled bool) error {
+	versions := o.versions
+	if !versionEnabled {
+		versions = versions[len(versions)-1:]
+	}
+	for _, body := range versions {
+		input := &s3manager.UploadInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(prefix + o.key),
+			Body:   bytes.NewReader(body),
+		}
+		if o.contentType != "" {
+			input.ContentType = aws.String(o.contentType)
+		}
+		if o.contentEncoding != "" {
+			input.ContentEncoding = aws.String(o.contentEncoding)
+		}
+		if o.cacheControl != "" {
+			input.CacheControl = aws.String(o.cacheControl)
+		}
+		if o.disposition != "" {
+			input.ContentDisposition = aws.String(o.disposition)
+		}
+		if o.language != "" {
+			input.ContentLanguage = aws.String(o.language)
+		}
+		if len(o.metadata) > 0 {
+			input.Metadata = aws.StringMap(o.metadata)
+		}
+		if o.serverSideEncryption != "" {
+			input.ServerSideEncryption = aws.String(o.serverSideEncryption)
+		}
+		if o.kmsKeyID != "" {
+			input.SSEKMSKeyId = aws.String(o.kmsKeyID)
+		}
+		if _, err := uploader.UploadWithContext(ctx, input); err != nil {
+			return fmt.Errorf("error writing object %s to bucket %s: %w", prefix+o.key, bucket, err)
+		}
+	}
+	return nil
+}
+
+// check reads the GCS object back and returns what does not match the last
+// version written to S3.
+func (o selftestObject) check(ctx context.Context, bucket *storage.BucketHandle, prefix string) error {
+	object := bucket.Object(prefix + o.key)
+	attrs, err := object.Attrs(ctx)
+	if o.folder {
+		if err == nil {
+			return errors.New("folder placeholder copied")
+		}
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	expect := func(field, want, got string) {
+		if want != got {
+			problems = append(problems, fmt.Sprintf("%s is %q, expected %q", field, got, want))
+		}
+	}
+	if o.contentType != "" {
+		expect("Content-Type", o.contentType, attrs.ContentType)
+	}
+	expect("Content-Encoding", o.contentEncoding, attrs.ContentEncoding)
+	expect("Cache-Control", o.cacheControl, attrs.CacheControl)
+	expect("Content-Disposition", o.disposition, attrs.ContentDisposition)
+	expect("Content-Language", o.language, attrs.ContentLanguage)
+	// S3 returns the names of user metadata entries capitalized
+	for key, value := range o.metadata {
+		var got string
+		for gcsKey, gcsValue := range attrs.Metadata {
+			if strings.EqualFold(gcsKey, key) {
+				got = gcsValue
+			}
+		}
+		expect("metadata "+key, value, got)
+	}
+
+	// Compressed objects are compared as stored, not as served
+	reader, err := object.ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	want := o.versions[len(o.versions)-1]
+	if !bytes.Equal(content, want) {
+		problems = append(problems, fmt.Sprintf("content of %d bytes with MD5 %x, expected %d bytes with MD5 %x",
+			len(content), md5.Sum(content), len(want), md5.Sum(want)))
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// forwardedFlag is a flag of the self-test that is also given, as it was
+// given, to the commands it runs.
+type forwardedFlag struct {
+	flag.Value
+	name string
+	args *[]string
+}
+
+func (f forwardedFlag) Set(value string) error {
+	*f.args = append(*f.args, "-"+f.name+"="+value)
+	return f.Value.Set(value)
+}
+
+func (f forwardedFlag) IsBoolFlag() bool {
+	boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && boolFlag.IsBoolFlag()
+}
+
+// forwardFlags registers the flags of from in flags, recording those given
+// in args.
+func forwardFlags(flags *flag.FlagSet, from *flag.FlagSet, args *[]string) {
+	from.VisitAll(func(f *flag.Flag) {
+		flags.Var(forwardedFlag{Value: f.Value, name: f.Name, args: args}, f.Name, f.Usage)
+	})
+}
+
+// selftest runs the commands of a self-test and records its checks.
+type selftest struct {
+	executable string
+	dir        string
+	failures   []string
+	checks     int
+}
+
+// check records the result of a check.
+func (t *selftest) check(name string, err error) {
+	t.checks++
+	if err != nil {
+		log.Printf("Self-test: %s – FAILED: %v", name, err)
+		t.failures = append(t.failures, name)
+		return
+	}
+	log.Printf("Self-test: %s – ok", name)
+}
+
+// run runs the program with args. Unless the command is verify, it returns
+// the summary of the run.
+func (t *selftest) run(name string, args ...string) (*runSummary, error) {
+	summaryPath := filepath.Join(t.dir, fmt.Sprintf("summary-%d.json", t.checks))
+	copying := args[0] != "verify"
+	if copying {
+		args = append([]string{"-summary-file=" + summaryPath}, args...)
+	}
+	log.Printf("Self-test: %s: %s %s", name, filepath.Base(t.executable), strings.Join(args, " "))
+	cmd := exec.Command(t.executable, args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil || !copying {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(summaryPath)
+	if err != nil {
+		return nil, err
+	}
+	var summary runSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
+
+// checkRequesterPays returns an error unless the S3 bucket is requester
+// pays.
+func checkRequesterPays(ctx context.Context, s3Client *s3.S3, bucket string) error {
+	output, err := s3Client.GetBucketRequestPaymentWithContext(ctx, &s3.GetBucketRequestPaymentInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		return err
+	}
+	if payer := aws.StringValue(output.Payer); payer != s3.PayerRequester {
+		return fmt.Errorf("the bucket is paid by its %s, it is not requester pays", payer)
+	}
+	return nil
+}
+
+// checkRestored returns the size of an S3 object restored from the Glacier
+// Flexible Retrieval or Deep Archive storage class, or an error if it is not
+// one.
+func checkRestored(ctx context.Context, s3Client *s3.S3, bucket string, key string) (int64, error) {
+	output, err := s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return 0, err
+	}
+	switch storageClass := aws.StringValue(output.StorageClass); storageClass {
+	case s3.StorageClassGlacier, s3.StorageClassDeepArchive:
+	default:
+		return 0, fmt.Errorf("storage class is %q, expected %s or %s", storageClass, s3.StorageClassGlacier, s3.StorageClassDeepArchive)
+	}
+	if restore := aws.StringValue(output.Restore); !strings.Contains(restore, `ongoing-request="false"`) {
+		return 0, fmt.Errorf("not restored, restore status %q", restore)
+	}
+	return aws.Int64Value(output.ContentLength), nil
+}
+
+// copyRestored copies the restored S3 object under prefix of the GCS
+// bucket, with -retry-from and -add-prefix, and checks its copy.
+func (t *selftest) copyRestored(ctx context.Context, s3Client *s3.S3, s3Bucket string, bucket *storage.BucketHandle, gcsBucket string, prefix string, key string, args []string) error {
+	size, err := checkRestored(ctx, s3Client, s3Bucket, key)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(quarantineEntry{Bucket: s3Bucket, Key: key, Size: size, Time: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	retryFile := filepath.Join(t.dir, "restored.jsonl")
+	if err := os.WriteFile(retryFile, append(line, '\n'), 0o644); err != nil {
+		return err
+	}
+
+	args = append(append(append([]string(nil), args...), "-retry-from="+retryFile, "-add-prefix="+prefix), s3Bucket, gcsBucket)
+	summary, err := t.run("restored object copy", args...)
+	if err != nil {
+		return err
+	}
+	if summary.FilesCopied != 1 {
+		return fmt.Errorf("copied %d object versions, expected 1", summary.FilesCopied)
+	}
+	attrs, err := bucket.Object(prefix + key).Attrs(ctx)
+	if err != nil {
+		return err
+	}
+	if attrs.Size != size {
+		return fmt.Errorf("copy of %d bytes, expected %d bytes", attrs.Size, size)
+	}
+	return nil
+}
+
+// deleteS3Prefix deletes every version and delete marker under prefix.
+func deleteS3Prefix(ctx context.Context, s3Client *s3.S3, bucket string, prefix string) error {
+	var identifiers []*s3.ObjectIdentifier
+	err := s3Client.ListObjectVersionsPagesWithContext(ctx, &s3.ListObjectVersionsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		for _, version := range page.Versions {
+			identifiers = append(identifiers, &s3.ObjectIdentifier{Key: version.Key, VersionId: version.VersionId})
+		}
+		for _, marker := range page.DeleteMarkers {
+			identifiers = append(identifiers, &s3.ObjectIdentifier{Key: marker.Key, VersionId: marker.VersionId})
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(identifiers); start += 1000 {
+		end := start + 1000
+		if end > len(identifiers) {
+			end = len(identifiers)
+		}
+		output, err := s3Client.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &s3.Delete{Objects: identifiers[start:end], Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+		if len(output.Errors) > 0 {
+			return fmt.Errorf("error deleting object %s: %s", aws.StringValue(output.Errors[0].Key), aws.StringValue(output.Errors[0].Message))
+		}
+	}
+	return nil
+}
+
+// deleteGCSPrefix deletes every generation of the objects under prefix.
+func deleteGCSPrefix(ctx context.Context, bucket *storage.BucketHandle, prefix string) error {
+	it := bucket.Objects(ctx, &storage.Query{Prefix: prefix, Versions: true})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := bucket.Object(attrs.Name).Generation(attrs.Generation).Delete(ctx); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			return err
+		}
+	}
+}
+
+// runSelftest creates a matrix of tricky objects under a scratch prefix of
+// the S3 bucket, migrates them to the GCS bucket with this program, checks
+// the copies, verifies them, copies again to check nothing is copied twice,
+// and deletes the objects from both buckets.
+func runSelftest(args []string) {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	prefixFlag := flags.String("prefix", defaultSelftestPrefix, "Scratch prefix of both buckets the objects of the self-test are created under, in a new directory every run")
+	kmsKeyFlag := flags.String("s3-kms-key", "", "ID, alias or ARN of an AWS KMS key to also test an SSE-KMS encrypted object with (default: no SSE-KMS object)")
+	keepFlag := flags.Bool("keep", false, "Keep the objects of the self-test in both buckets instead of deleting them")
+	requesterPaysFlag := flags.Bool("requester-pays", false, "Also check that the S3 bucket is requester pays, for a self-test of a requester pays bucket with -s3-request-payer requester")
+	restoredKeyFlag := flags.String("restored-key", "", "Key of an object of the S3 bucket restored from GLACIER or DEEP_ARCHIVE, to also copy it under the scratch prefix of the GCS bucket (default: no restored object)")
+
+	// The identity flags are also given to the copies and verification,
+	// and the GCS key only to the copies
+	var s3Opts s3Options
+	var gcsOpts gcsOptions
+	var forwarded, copyForwarded []string
+	shared := flag.NewFlagSet("", flag.ExitOnError)
+	addS3Flags(shared, &s3Opts)
+	addGCSFlags(shared, &gcsOpts)
+	forwardFlags(flags, shared, &forwarded)
+	copyOnly := flag.NewFlagSet("", flag.ExitOnError)
+	addGCSKMSKeyFlag(copyOnly, &gcsOpts)
+	forwardFlags(flags, copyOnly, &copyForwarded)
+	addLogFlags(flags)
+	flags.Parse(args)
+	setupLogging()
+
+	if len(flags.Args()) != 2 {
+		log.Fatal("Usage: ./s3-to-gcs selftest [-prefix <prefix>] [-s3-kms-key <key>] [-keep] [-requester-pays] [-restored-key <key>] [-aws-profile <name>] [-aws-role-arn <ARN>] [-aws-external-id <ID>] [-gcs-credentials-file <file>] [-gcs-impersonate-service-account <email>] [-gcs-user-project <project>] [-gcs-kms-key <key>] [-s3-request-payer requester] [-s3-endpoint <URL>] [-s3-force-path-style] [-s3-disable-ssl] <S3 bucket> <GCS bucket>")
+	}
+	buckets, prefix := parseBucketArgs(flags.Args(), "s3", "gs")
+	if prefix != "" {
+		log.Fatal("The self-test works under -prefix, the buckets cannot have a prefix")
+	}
+	if *requesterPaysFlag && s3Opts.requestPayer == "" {
+		log.Fatal("-requester-pays requires -s3-request-payer requester")
+	}
+	s3Bucket, gcsBucket := buckets[0], buckets[1]
+	scratch := *prefixFlag + time.Now().UTC().Format("20060102T150405Z") + "/"
+
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	dir, err := os.MkdirTemp("", "s3-to-gcs-selftest-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	t := &selftest{executable: executable, dir: dir}
+
+	log.Printf("Self-test of S3 bucket %s and GCS bucket %s under prefix %s", s3Bucket, gcsBucket, scratch)
+	s3Opts.log()
+	gcsOpts.log()
+
+	ctx := context.Background()
+	s3Client := newS3Client(s3Opts)
+	client := newGCSClient(ctx, gcsOpts)
+	defer client.Close()
+	gcsBucketHandle := gcsOpts.bucket(client, gcsBucket)
+	versionEnabled := s3VersioningEnabled(s3Client, s3Bucket, assumeVersioningAuto)
+
+	// Every request of the self-test and of its copies then goes to a
+	// requester pays bucket
+	if *requesterPaysFlag {
+		t.check("requester pays bucket", checkRequesterPays(ctx, s3Client, s3Bucket))
+	}
+
+	objects := selftestObjects(*kmsKeyFlag)
+	uploader := s3manager.NewUploaderWithClient(s3Client, func(u *s3manager.Uploader) {
+		u.PartSize = s3manager.MinUploadPartSize
+	})
+	var expectedCopies int64
+	for _, object := range objects {
+		if err := object.put(ctx, uploader, s3Bucket, scratch, versionEnabled); err != nil {
+			log.Fatal(err)
+		}
+		switch {
+		case object.folder:
+		case versionEnabled:
+			expectedCopies += int64(len(object.versions))
+		default:
+			expectedCopies++
+		}
+	}
+	log.Printf("Self-test: created %d objects in S3 bucket %s", len(objects), s3Bucket)
+
+	location := []string{s3Bucket, gcsBucket, scratch}
+	copyArgs := append(append(append([]string(nil), forwarded...), copyForwarded...), location...)
+	summary, err := t.run("first copy", copyArgs...)
+	if err == nil && summary.FilesCopied != expectedCopies {
+		err = fmt.Errorf("copied %d object versions, expected %d", summary.FilesCopied, expectedCopies)
+	}
+	t.check("first copy", err)
+
+	for _, object := range objects {
+		t.check("object "+object.key, object.check(ctx, gcsBucketHandle, scratch))
+	}
+
+	verifyArgs := append(append([]string{"verify", "-report=" + filepath.Join(dir, "verify.jsonl")}, forwarded...), location...)
+	_, err = t.run("verify", verifyArgs...)
+	t.check("verify", err)
+
+	summary, err = t.run("second copy", copyArgs...)
+	if err == nil && summary.FilesCopied != 0 {
+		err = fmt.Errorf("copied %d object versions again, expected none", summary.FilesCopied)
+	}
+	t.check("second copy", err)
+
+	// Restoring an object takes hours, so the object is one restored
+	// beforehand, outside the scratch prefix, and left in S3
+	if *restoredKeyFlag != "" {
+		restoredArgs := append(append([]string(nil), forwarded...), copyForwarded...)
+		t.check("restored object "+*restoredKeyFlag, t.copyRestored(ctx, s3Client, s3Bucket, gcsBucketHandle, gcsBucket, scratch+"restored/", *restoredKeyFlag, restoredArgs))
+	}
+
+	if *keepFlag {
+		log.Printf("Self-test: keeping the objects under %s in both buckets", scratch)
+	} else {
+		t.check("delete S3 objects", deleteS3Prefix(ctx, s3Client, s3Bucket, scratch))
+		t.check("delete GCS objects", deleteGCSPrefix(ctx, gcsBucketHandle, scratch))
+	}
+
+	if len(t.failures) > 0 {
+		log.Fatalf("Self-test failed %d of %d checks: %s", len(t.failures), t.checks, strings.Join(t.failures, ", "))
+	}
+	log.Printf("Self-test passed %d checks", t.checks)
+}
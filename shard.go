@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// shard is a flag.Value parsed from "i/N", selecting the i-th of N disjoint
+// sets of keys, so that N instances of the tool can share a bucket. Keys
+// are assigned to shards by their hash.
+type shard struct {
+	index int // From 1 to count
+	count int
+}
+
+func (s *shard) String() string {
+	if s.count == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", s.index, s.count)
+}
+
+func (s *shard) Set(value string) error {
+	index, count, ok := strings.Cut(value, "/")
+	if !ok {
+		return fmt.Errorf("invalid shard %q, expected i/N", value)
+	}
+	i, err := strconv.Atoi(index)
+	if err != nil {
+		return fmt.Errorf("invalid shard %q, expected i/N", value)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 || i < 1 || i > n {
+		return fmt.Errorf("invalid shard %q, expected i/N with i from 1 to N", value)
+	}
+	s.index, s.count = i, n
+	return nil
+}
+
+// contains reports whether key belongs to the shard. The names of the
+// manifest and parts of a split object belong to the shard of its key, so
+// that each instance finds them along with the object.
+func (s *shard) contains(key string) bool {
+	if s.count <= 1 {
+		return true
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(splitObjectKey(key)))
+	return int(hash.Sum32()%uint32(s.count)) == s.index-1
+}
+
+// filter returns an objectLister listing the objects of list that belong to
+// the shard.
+func (s *shard) filter(list objectLister) objectLister {
+	if s.count <= 1 {
+		return list
+	}
+	return func(fn func(page *s3.ListObjectsV2Output, lastPage bool) bool) error {
+		return list(func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			contents := make([]*s3.Object, 0, len(page.Contents))
+			for _, s3Object := range page.Contents {
+				if s.contains(*s3Object.Key) {
+					contents = append(contents, s3Object)
+				}
+			}
+			filtered := *page
+			filtered.Contents = contents
+			return fn(&filtered, lastPage)
+		})
+	}
+}
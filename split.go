@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Objects larger than -split-size are stored in GCS as a sequence of part
+// objects, "<key>.part-00000", "<key>.part-00001", ..., next to a JSON
+// manifest, "<key>.manifest.json", describing how to reassemble them.
+
+const splitManifestSuffix = ".manifest.json"
+
+// splitManifest is the JSON document stored next to the parts of a split
+// object.
+type splitManifest struct {
+	Key       string      `json:"key"`
+	SourceKey string      `json:"sourceKey,omitempty"`
+	VersionID string      `json:"versionId,omitempty"`
+	Size      int64       `json:"size"`
+	ETag      string      `json:"etag"`
+	PartSize  int64       `json:"partSize"`
+	Parts     []splitPart `json:"parts"`
+
+	// generation is that of the manifest object read, not part of it
+	generation int64
+}
+
+// splitPart describes a single part object of a split object.
+type splitPart struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	CRC32C string `json:"crc32c"`
+	MD5    string `json:"md5"`
+}
+
+func splitManifestName(key string) string {
+	return key + splitManifestSuffix
+}
+
+func splitPartName(key string, part int) string {
+	return fmt.Sprintf("%s.part-%05d", key, part)
+}
+
+// splitObjectKey returns the key of the split object name is the manifest or
+// a part of, or name itself if it is neither.
+func splitObjectKey(name string) string {
+	if key, ok := strings.CutSuffix(name, splitManifestSuffix); ok {
+		return key
+	}
+	if i := strings.LastIndex(name, ".part-"); i != -1 {
+		number := name[i+len(".part-"):]
+		if len(number) >= 5 && strings.Trim(number, "0123456789") == "" {
+			return name[:i]
+		}
+	}
+	return name
+}
+
+func splitPartCount(size, partSize int64) int {
+	return int((size + partSize - 1) / partSize)
+}
+
+// splitObjectNames returns the names of the manifest and the part objects a
+// split object of the given size is stored as.
+func splitObjectNames(key string, size, partSize int64) []string {
+	names := []string{splitManifestName(key)}
+	for i := 0; i < splitPartCount(size, partSize); i++ {
+		names = append(names, splitPartName(key, i))
+	}
+	return names
+}
+
+// readSplitManifest reads the manifest of a split object. It returns nil if
+// the object has not been split into GCS.
+func readSplitManifest(ctx context.Context, bucket *storage.BucketHandle, key string) (*splitManifest, error) {
+	reader, err := bucket.Object(splitManifestName(key)).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	manifest := &splitManifest{generation: reader.Attrs.Generation}
+	if err := json.NewDecoder(reader).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest for object %s: %w", key, err)
+	}
+	return manifest, nil
+}
+
+// writeSplitManifest writes the manifest of a split object, with the
+// Custom-Time of its parts. It is written last, once all the parts are in
+// place, conditioned on conditions.
+func writeSplitManifest(ctx context.Context, bucket *storage.BucketHandle, manifest *splitManifest, conditions *storage.Conditions, kmsKey string, customTime time.Time) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return err
+	}
+
+	object := bucket.Object(splitManifestName(manifest.Key)).Retryer(gcsRetryer, gcsRetryErrors, storage.WithPolicy(storage.RetryAlways))
+	_, err := uploadToGCS(ctx, object, conditions, &body, func(writer *storage.Writer) {
+		writer.ContentType = "application/json"
+		writer.Metadata = map[string]string{metadataKeyETag: manifest.ETag}
+		writer.KMSKeyName = kmsKey
+		writer.CustomTime = customTime
+	})
+	return err
+}
+
+// verifySplitObject compares an S3 object with the manifest and the parts it
+// was split into.
+func verifySplitObject(ctx context.Context, bucket *storage.BucketHandle, s3Object *s3.Object) verifyResult {
+	result := verifyResult{
+		Key:    *s3Object.Key,
+		S3Size: s3Object.Size,
+		S3ETag: *s3Object.ETag,
+	}
+
+	manifest, err := readSplitManifest(ctx, bucket, *s3Object.Key)
+	if err != nil {
+		result.Status = verifyStatusMismatch
+		result.Error = err.Error()
+		return result
+	}
+	if manifest == nil {
+		result.Status = verifyStatusMissingInGCS
+		return result
+	}
+
+	result.GCSSize = aws.Int64(manifest.Size)
+	result.GCSETag = manifest.ETag
+
+	sizeMatch := manifest.Size == *s3Object.Size
+	checksumMatch := manifest.ETag == *s3Object.ETag
+
+	for _, part := range manifest.Parts {
+		attrs, err := bucket.Object(part.Name).Attrs(ctx)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			result.Reasons = append(result.Reasons, "missing-part")
+			break
+		}
+		if err != nil {
+			result.Status = verifyStatusMismatch
+			result.Error = err.Error()
+			return result
+		}
+		if attrs.Size != part.Size || encodeCRC32C(attrs.CRC32C) != part.CRC32C || base64.StdEncoding.EncodeToString(attrs.MD5) != part.MD5 {
+			checksumMatch = false
+		}
+	}
+	if !sizeMatch {
+		result.Reasons = append(result.Reasons, "size")
+	}
+	if !checksumMatch {
+		result.Reasons = append(result.Reasons, "checksum")
+	}
+
+	result.Status = verifyStatusMatch
+	if len(result.Reasons) > 0 {
+		result.Status = verifyStatusMismatch
+	}
+	return result
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// sseCKey is a customer-provided key objects are encrypted with, for the
+// objects under prefix in bucket, or every object read with an empty bucket.
+type sseCKey struct {
+	bucket string
+	prefix string
+	key    string // The 256 bit key, not encoded
+}
+
+// sseCKeys are the keys of -s3-sse-c-key and -s3-sse-c-key-file, the most
+// specific first.
+type sseCKeys []sseCKey
+
+// decodeSSECKey decodes a base64 encoded AES-256 key.
+func decodeSSECKey(value string) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != 32 {
+		return "", fmt.Errorf("invalid SSE-C key, expected a base64 encoded 256 bit key")
+	}
+	return string(key), nil
+}
+
+// loadSSECKeys returns the key of -s3-sse-c-key, or those of the
+// -s3-sse-c-key-file at path, whose lines are "s3://<bucket>/<prefix> <key>".
+// Blank lines and lines starting with # are ignored.
+func loadSSECKeys(key string, path string) (sseCKeys, error) {
+	if key != "" && path != "" {
+		return nil, fmt.Errorf("-s3-sse-c-key and -s3-sse-c-key-file cannot be used together")
+	}
+	if key != "" {
+		decoded, err := decodeSSECKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return sseCKeys{{key: decoded}}, nil
+	}
+	if path == "" {
+		return nil, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var keys sseCKeys
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected s3://<bucket>/<prefix> <key>", path, lineNumber)
+		}
+		l, err := parseLocation(fields[0])
+		if err != nil || l.scheme != "s3" {
+			return nil, fmt.Errorf("%s:%d: invalid location %q, expected s3://<bucket>/<prefix>", path, lineNumber, fields[0])
+		}
+		decoded, err := decodeSSECKey(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+		keys = append(keys, sseCKey{bucket: l.bucket, prefix: l.prefix, key: decoded})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// The longest prefix an object is under wins
+	sort.SliceStable(keys, func(i, j int) bool { return len(keys[i].prefix) > len(keys[j].prefix) })
+	return keys, nil
+}
+
+// forObject returns the key of an object, "" if it is not encrypted with a
+// customer-provided key.
+func (keys sseCKeys) forObject(bucket, key string) string {
+	for _, k := range keys {
+		if (k.bucket == "" || k.bucket == bucket) && strings.HasPrefix(key, k.prefix) {
+			return k.key
+		}
+	}
+	return ""
+}
+
+// useSSECKeys makes s3Client send the customer-provided key of every object
+// it reads or reads the metadata of. The SDK encodes the key and adds its
+// MD5 digest.
+func useSSECKeys(s3Client *s3.S3, keys sseCKeys) {
+	setKey := func(bucket, key *string, algorithm, customerKey **string) {
+		if *customerKey != nil {
+			return
+		}
+		if k := keys.forObject(aws.StringValue(bucket), aws.StringValue(key)); k != "" {
+			*algorithm = aws.String(s3.ServerSideEncryptionAes256)
+			*customerKey = aws.String(k)
+		}
+	}
+	// Before the SDK checks that keys are only sent over HTTPS
+	s3Client.Handlers.Validate.PushFront(func(r *request.Request) {
+		switch input := r.Params.(type) {
+		case *s3.GetObjectInput:
+			setKey(input.Bucket, input.Key, &input.SSECustomerAlgorithm, &input.SSECustomerKey)
+		case *s3.HeadObjectInput:
+			setKey(input.Bucket, input.Key, &input.SSECustomerAlgorithm, &input.SSECustomerKey)
+		case *s3.GetObjectAttributesInput:
+			setKey(input.Bucket, input.Key, &input.SSECustomerAlgorithm, &input.SSECustomerKey)
+		}
+	})
+}
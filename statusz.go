@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Stages of the transfers shown on the status page.
+const (
+	stageGetting   = "getting object"
+	stageCopying   = "copying"
+	stageCopyPart  = "copying part"
+	stageUpdating  = "updating metadata"
+	stageVerifying = "verifying"
+)
+
+// recentErrorCount is the number of recent errors the status page keeps.
+const recentErrorCount = 20
+
+// transferStatus is an object, or a part of one, being copied or verified.
+type transferStatus struct {
+	key       string
+	versionID string
+	size      int64
+	started   time.Time
+	stage     string // Protected by the mutex of the status board
+	bytes     atomic.Int64
+}
+
+// reader counts the bytes of the transfer as they are read.
+func (t *transferStatus) reader(reader io.Reader) io.Reader {
+	return &meteredReader{reader: reader, total: &t.bytes}
+}
+
+// statusBoard keeps track of what the copies and verifications are doing,
+// for the status page.
+type statusBoard struct {
+	mutex         sync.Mutex
+	transfers     map[*transferStatus]struct{}
+	lastListedKey string
+}
+
+func newStatusBoard() *statusBoard {
+	return &statusBoard{transfers: make(map[*transferStatus]struct{})}
+}
+
+// start adds a transfer in the given stage, until finish is called.
+func (b *statusBoard) start(stage, key, versionID string, size int64) *transferStatus {
+	t := &transferStatus{key: key, versionID: versionID, size: size, started: time.Now(), stage: stage}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.transfers[t] = struct{}{}
+	return t
+}
+
+func (b *statusBoard) setStage(t *transferStatus, stage string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	t.stage = stage
+}
+
+func (b *statusBoard) finish(t *transferStatus) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.transfers, t)
+}
+
+// listed records the last object read from the listing.
+func (b *statusBoard) listed(key string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.lastListedKey = key
+}
+
+// recentError is an error shown on the status page. Most errors end the run,
+// so these are mostly those of requests that are retried, and mismatches.
+type recentError struct {
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`
+	Message string    `json:"message"`
+}
+
+// recentErrors are the last recentErrorCount errors, oldest first.
+var recentErrors struct {
+	mutex  sync.Mutex
+	errors []recentError
+}
+
+func recordRecentError(source string, message string) {
+	recentErrors.mutex.Lock()
+	defer recentErrors.mutex.Unlock()
+	if len(recentErrors.errors) == recentErrorCount {
+		recentErrors.errors = recentErrors.errors[1:]
+	}
+	recentErrors.errors = append(recentErrors.errors, recentError{Time: time.Now(), Source: source, Message: message})
+}
+
+// recordS3Retries records the errors S3 requests are retried after, and
+// counts them towards the circuit breaker.
+func recordS3Retries(s3Client *s3.S3) {
+	s3Client.Handlers.Retry.PushBack(func(r *request.Request) {
+		if r.Error != nil && (r.IsErrorRetryable() || r.IsErrorThrottle()) {
+			recordRecentError("S3 "+r.Operation.Name, r.Error.Error())
+			countError("S3 " + r.Operation.Name + " retried: " + errorCategory(r.Error))
+			retryCircuit.record()
+		}
+	})
+}
+
+// gcsRetryErrors retries the GCS requests the client library would retry,
+// recording the errors they are retried after and counting them towards the
+// circuit breaker.
+var gcsRetryErrors = storage.WithErrorFunc(func(err error) bool {
+	retry := storage.ShouldRetry(err)
+	if retry {
+		recordRecentError("GCS", err.Error())
+		countError("GCS retried: " + errorCategory(err))
+		retryCircuit.record()
+	}
+	return retry
+})
+
+// workerStatus is a transfer on the status page.
+type workerStatus struct {
+	Stage     string  `json:"stage"`
+	Key       string  `json:"key"`
+	VersionID string  `json:"versionId,omitempty"`
+	Size      int64   `json:"size"`
+	Bytes     int64   `json:"bytes"`
+	Duration  float64 `json:"durationSeconds"`
+	Rate      float64 `json:"bytesPerSecond"`
+}
+
+// statusPage is the response of the status endpoint.
+type statusPage struct {
+	Time          time.Time      `json:"time"`
+	Uptime        float64        `json:"uptimeSeconds"`
+	Goroutines    int            `json:"goroutines"`
+	LastListedKey string         `json:"lastListedKey,omitempty"`
+	CopiesRunning int            `json:"copiesRunning"`
+	Concurrency   int            `json:"concurrency"`
+	VerifyQueue   int            `json:"verifyQueue"`
+	Pending       int            `json:"pendingObjects"`
+	MaxPending    int            `json:"maxPendingObjects,omitempty"`
+	CircuitOpen   *time.Time     `json:"circuitBreakerOpenUntil,omitempty"`
+	Workers       []workerStatus `json:"workers"`
+	RecentErrors  []recentError  `json:"recentErrors"`
+}
+
+// statusPage returns the state of the copies of c.
+func (c *copier) statusPage() statusPage {
+	now := time.Now()
+	page := statusPage{
+		Time:       now,
+		Uptime:     now.Sub(c.copyStartTime).Seconds(),
+		Goroutines: runtime.NumGoroutine(),
+	}
+	page.CopiesRunning, page.Concurrency = c.copySlots.usage()
+	if c.verifier != nil {
+		page.VerifyQueue = len(c.verifier.tasks)
+	}
+	if c.pending != nil {
+		page.Pending, page.MaxPending = c.pending.depth()
+	}
+	if closesAt := retryCircuit.closesAt(); !closesAt.IsZero() {
+		page.CircuitOpen = &closesAt
+	}
+
+	c.status.mutex.Lock()
+	page.LastListedKey = c.status.lastListedKey
+	for t := range c.status.transfers {
+		worker := workerStatus{
+			Stage:     t.stage,
+			Key:       t.key,
+			VersionID: t.versionID,
+			Size:      t.size,
+			Bytes:     t.bytes.Load(),
+			Duration:  now.Sub(t.started).Seconds(),
+		}
+		if worker.Duration > 0 {
+			worker.Rate = float64(worker.Bytes) / worker.Duration
+		}
+		page.Workers = append(page.Workers, worker)
+	}
+	c.status.mutex.Unlock()
+	// The longest running first, they are the likeliest to be stuck
+	sort.Slice(page.Workers, func(i, j int) bool { return page.Workers[i].Duration > page.Workers[j].Duration })
+
+	recentErrors.mutex.Lock()
+	page.RecentErrors = append([]recentError(nil), recentErrors.errors...)
+	recentErrors.mutex.Unlock()
+	return page
+}
+
+// serveStatus serves the status page of c, as text, or as JSON with
+// format=json.
+func serveStatus(w http.ResponseWriter, r *http.Request, c *copier) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	page := c.statusPage()
+	if r.FormValue("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Time: %s, uptime: %s, goroutines: %d\n", page.Time.UTC().Format(time.RFC3339), formatDuration(time.Duration(page.Uptime*float64(time.Second))), page.Goroutines)
+	fmt.Fprintf(w, "Copies running: %d of %d, verifications queued: %d\n", page.CopiesRunning, page.Concurrency, page.VerifyQueue)
+	if page.MaxPending > 0 {
+		fmt.Fprintf(w, "Objects listed and not copied yet: %d of at most %d\n", page.Pending, page.MaxPending)
+	}
+	if page.CircuitOpen != nil {
+		fmt.Fprintf(w, "Circuit breaker open, no new copy until %s\n", page.CircuitOpen.UTC().Format(time.RFC3339))
+	}
+	if page.LastListedKey != "" {
+		fmt.Fprintf(w, "Last object listed: %s\n", page.LastListedKey)
+	}
+
+	fmt.Fprintf(w, "\nWorkers (%d):\n", len(page.Workers))
+	for _, worker := range page.Workers {
+		key := worker.Key
+		if worker.VersionID != "" {
+			key += " (version " + worker.VersionID + ")"
+		}
+		fmt.Fprintf(w, "  %s %s – %s of %s in %s, MB/sec: %.2f\n", worker.Stage, key, formatBytes(worker.Bytes), formatBytes(worker.Size),
+			formatDuration(time.Duration(worker.Duration*float64(time.Second))), worker.Rate/(1024*1024))
+	}
+
+	fmt.Fprintf(w, "\nRecent errors (%d):\n", len(page.RecentErrors))
+	for _, recent := range page.RecentErrors {
+		fmt.Fprintf(w, "  %s %s: %s\n", recent.Time.UTC().Format(time.RFC3339), recent.Source, recent.Message)
+	}
+}
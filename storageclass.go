@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// defaultStorageClassMap is the mapping of -storage-class-map default, to
+// the GCS storage classes of similar cost and minimum storage duration.
+var defaultStorageClassMap = storageClassMap{
+	s3.ObjectStorageClassStandardIa:  "NEARLINE",
+	s3.ObjectStorageClassOnezoneIa:   "NEARLINE",
+	s3.ObjectStorageClassGlacierIr:   "COLDLINE",
+	s3.ObjectStorageClassGlacier:     "ARCHIVE",
+	s3.ObjectStorageClassDeepArchive: "ARCHIVE",
+}
+
+// storageClassMap is a flag.Value mapping S3 storage classes to the GCS
+// storage classes objects are written with, parsed from comma separated
+// "<S3 class>=<GCS class>" pairs, or "default" for defaultStorageClassMap.
+// Flags given several times add to the mapping.
+type storageClassMap map[string]string
+
+func (m *storageClassMap) String() string {
+	if m == nil {
+		return ""
+	}
+	pairs := make([]string, 0, len(*m))
+	for s3Class, gcsClass := range *m {
+		pairs = append(pairs, s3Class+"="+gcsClass)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (m *storageClassMap) Set(value string) error {
+	if *m == nil {
+		*m = make(storageClassMap)
+	}
+	for _, pair := range strings.Split(value, ",") {
+		if pair == "default" {
+			for s3Class, gcsClass := range defaultStorageClassMap {
+				(*m)[s3Class] = gcsClass
+			}
+			continue
+		}
+
+		s3Class, gcsClass, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid storage class mapping %q, expected <S3 class>=<GCS class> or default", pair)
+		}
+		s3Class = strings.ToUpper(s3Class)
+		if !isS3StorageClass(s3Class) {
+			return fmt.Errorf("invalid S3 storage class %q, expected one of %s", s3Class, strings.Join(s3.ObjectStorageClass_Values(), ", "))
+		}
+		if !isGCSStorageClass(gcsClass) {
+			return fmt.Errorf("invalid GCS storage class %q, expected one of %s", gcsClass, strings.Join(gcsStorageClasses, ", "))
+		}
+		(*m)[s3Class] = strings.ToUpper(gcsClass)
+	}
+	return nil
+}
+
+// gcsClass returns the GCS storage class of an object of the given S3
+// storage class, "" for the default storage class of the bucket. S3 omits
+// the storage class of STANDARD objects.
+func (m storageClassMap) gcsClass(s3Class *string) string {
+	class := aws.StringValue(s3Class)
+	if class == "" {
+		class = s3.ObjectStorageClassStandard
+	}
+	return m[class]
+}
+
+func isS3StorageClass(value string) bool {
+	for _, storageClass := range s3.ObjectStorageClass_Values() {
+		if value == storageClass {
+			return true
+		}
+	}
+	return false
+}
+
+// storageClass returns the GCS storage class to write an object version
+// with: that of its tier, else the mapping of its S3 storage class.
+func (c *copier) storageClass(tierClass string, s3Class *string) string {
+	if tierClass != "" {
+		return tierClass
+	}
+	return c.options.storageClassMap.gcsClass(s3Class)
+}
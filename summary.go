@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"google.golang.org/api/googleapi"
+)
+
+// Statuses of a run in its summary.
+const (
+	runCompleted = "completed" // Every object was handled
+	runStopped   = "stopped"   // Stopped early by a signal, -run-timeout or -run-deadline
+	runFailed    = "failed"    // An object could not be copied
+)
+
+// topErrorCount is the number of error categories in the summary.
+const topErrorCount = 5
+
+func addSummaryFlags(flags *flag.FlagSet) *string {
+	return flags.String("summary-file", "", "Write the summary of the run, including the most frequent errors, to this file as JSON when it ends, even if it fails")
+}
+
+// runErrors counts the errors of the run by category, the objects that
+// could not be copied and the mismatches found, for the summary. Unlike
+// recentErrors, nothing is ever dropped.
+var runErrors struct {
+	mutex      sync.Mutex
+	categories map[string]int64
+	failed     int64
+	mismatched int64
+}
+
+func countError(category string) {
+	runErrors.mutex.Lock()
+	defer runErrors.mutex.Unlock()
+	if runErrors.categories == nil {
+		runErrors.categories = make(map[string]int64)
+	}
+	runErrors.categories[category]++
+}
+
+// resetRunErrors forgets the errors counted so far.
+func resetRunErrors() {
+	runErrors.mutex.Lock()
+	defer runErrors.mutex.Unlock()
+	runErrors.categories = nil
+	runErrors.failed = 0
+	runErrors.mismatched = 0
+}
+
+// countMismatch counts a mismatch found, by its reason.
+func countMismatch(reason string) {
+	category := "mismatch"
+	if reason != "" {
+		category += ": " + reason
+	}
+	countError(category)
+	runErrors.mutex.Lock()
+	defer runErrors.mutex.Unlock()
+	runErrors.mismatched++
+}
+
+// countFailure counts an object that could not be copied, by the kind of
+// its error.
+func countFailure(err error) {
+	countError("failed: " + errorCategory(err))
+	runErrors.mutex.Lock()
+	defer runErrors.mutex.Unlock()
+	runErrors.failed++
+}
+
+// errorCategory names the kind of an error: the error code of S3, the HTTP
+// status of GCS, or the start of the message of the others, without the
+// details that make each one unique.
+func errorCategory(err error) string {
+	if errors.Is(err, errObjectTimeout) {
+		return "object timeout"
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		return awsErr.Code()
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return fmt.Sprintf("HTTP %d", apiErr.Code)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return "network error"
+	}
+	message, _, _ := strings.Cut(err.Error(), "\n")
+	message, _, _ = strings.Cut(message, ":")
+	return message
+}
+
+// errorCount is an error category in the summary.
+type errorCount struct {
+	Category string `json:"category"`
+	Count    int64  `json:"count"`
+}
+
+// topErrors returns the n most frequent error categories, most frequent
+// first.
+func topErrors(n int) []errorCount {
+	runErrors.mutex.Lock()
+	defer runErrors.mutex.Unlock()
+	counts := make([]errorCount, 0, len(runErrors.categories))
+	for category, count := range runErrors.categories {
+		counts = append(counts, errorCount{Category: category, Count: count})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Category < counts[j].Category
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+// runSummary is the summary of a run, logged and written to -summary-file
+// when it ends.
+type runSummary struct {
+	Status          string       `json:"status"`
+	FilesCopied     int64        `json:"filesCopied"`
+	BytesCopied     int64        `json:"bytesCopied"`
+	FilesUpToDate   int64        `json:"filesUpToDate"`
+	BytesUpToDate   int64        `json:"bytesUpToDate"`
+	FilesSkipped    int64        `json:"filesSkipped"`
+	FilesFailed     int64        `json:"filesFailed"`
+	FilesMismatched int64        `json:"filesMismatched"`
+	BytesRead       int64        `json:"bytesRead"`
+	Started         time.Time    `json:"started"`
+	Finished        time.Time    `json:"finished"`
+	ElapsedSeconds  float64      `json:"elapsedSeconds"`
+	BytesPerSecond  float64      `json:"bytesPerSecond"`
+	TopErrors       []errorCount `json:"topErrors"`
+}
+
+func (c *copier) summary(status string) runSummary {
+	c.copyMutex.Lock()
+	defer c.copyMutex.Unlock()
+	finished := time.Now()
+	summary := runSummary{
+		Status:         status,
+		FilesCopied:    c.filesCopied,
+		BytesCopied:    c.totalBytesCopied,
+		FilesUpToDate:  c.filesIdentical,
+		BytesUpToDate:  c.totalBytesIdentical,
+		FilesSkipped:   c.filesTooLarge + c.filesExistingElsewhere + c.filesKept + c.filesArchived + c.filesCollided,
+		BytesRead:      c.bytesRead.Load(),
+		Started:        c.copyStartTime,
+		Finished:       finished,
+		ElapsedSeconds: finished.Sub(c.copyStartTime).Seconds(),
+		TopErrors:      topErrors(topErrorCount),
+	}
+	if summary.ElapsedSeconds > 0 {
+		summary.BytesPerSecond = float64(summary.BytesCopied) / summary.ElapsedSeconds
+	}
+	runErrors.mutex.Lock()
+	summary.FilesFailed = runErrors.failed
+	summary.FilesMismatched = runErrors.mismatched
+	runErrors.mutex.Unlock()
+	return summary
+}
+
+func (s runSummary) log() {
+	log.Printf("Summary: run %s in %s", s.Status, formatDuration(s.Finished.Sub(s.Started)))
+	log.Printf("Summary: copied %s files (%s), up to date %s files (%s), skipped %s files, failed %s files, mismatched %s files",
+		printer.Sprintf("%d", s.FilesCopied), formatBytes(s.BytesCopied),
+		printer.Sprintf("%d", s.FilesUpToDate), formatBytes(s.BytesUpToDate),
+		printer.Sprintf("%d", s.FilesSkipped), printer.Sprintf("%d", s.FilesFailed), printer.Sprintf("%d", s.FilesMismatched))
+	log.Printf("Summary: average throughput %.2f MB/sec (read from S3: %s)", s.BytesPerSecond/(1024*1024), formatBytes(s.BytesRead))
+	if len(s.TopErrors) == 0 {
+		log.Print("Summary: no errors")
+		return
+	}
+	for _, e := range s.TopErrors {
+		log.Printf("Summary: %s errors: %s", printer.Sprintf("%d", e.Count), e.Category)
+	}
+}
+
+// finishSummary logs the summary of the run, and writes it to path if not
+// empty. It is only done once, the first failure ending the run wins over
+// the end of the others.
+func (c *copier) finishSummary(path string, status string) {
+	c.summaryOnce.Do(func() {
+		summary := c.summary(status)
+		summary.log()
+		summary.write(path)
+	})
+}
+
+// write writes the summary to path as JSON, if not empty.
+func (s runSummary) write(path string) {
+	if path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Wrote summary to %s", path)
+}
+
+// failureSummary is called by fatalObject before exiting, to report the
+// summary of the run failing. nil unless a copier reports one.
+var failureSummary func()
+
+// summarizeFailures makes a failed copy report the summary of the run
+// before exiting.
+func (c *copier) summarizeFailures(path string) {
+	failureSummary = func() {
+		c.finishSummary(path, runFailed)
+	}
+}
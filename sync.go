@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// location is where objects are read from or written to: an S3 or GCS bucket
+// and key prefix, or a local directory.
+type location struct {
+	scheme string // "s3", "gs" or "file"
+	bucket string // Bucket name, or directory path for "file"
+	prefix string
+}
+
+// parseLocation parses an s3://bucket/prefix, gs://bucket/prefix or
+// file:///path URI. Anything else is taken as a local path.
+func parseLocation(uri string) (location, error) {
+	scheme, rest, ok := strings.Cut(uri, "://")
+	if !ok {
+		return location{scheme: "file", bucket: uri}, nil
+	}
+
+	switch scheme {
+	case "file":
+		if rest == "" {
+			return location{}, fmt.Errorf("%q has no path", uri)
+		}
+		return location{scheme: scheme, bucket: rest}, nil
+	case "s3", "gs":
+		bucket, prefix, _ := strings.Cut(rest, "/")
+		if scheme == "s3" && isS3AccessPoint(rest) {
+			// The resource of an access point ARN is accesspoint/<name>
+			name, objectPrefix, _ := strings.Cut(prefix, "/")
+			bucket, prefix = bucket+"/"+name, objectPrefix
+		}
+		if bucket == "" {
+			return location{}, fmt.Errorf("%q has no bucket name", uri)
+		}
+		if scheme == "s3" {
+			checkS3Bucket(bucket)
+		}
+		return location{scheme: scheme, bucket: bucket, prefix: prefix}, nil
+	}
+	return location{}, fmt.Errorf("%q has an unsupported scheme, expected s3://, gs:// or file://", uri)
+}
+
+// backends creates the Source and Destination of every location lazily,
+// creating the clients it needs once.
+type backends struct {
+	ctx       context.Context
+	s3Opts    s3Options
+	s3Client  *s3.S3
+	gcsOpts   gcsOptions
+	gcsClient *storage.Client
+}
+
+func (b *backends) s3() *s3.S3 {
+	if b.s3Client == nil {
+		b.s3Client = newS3Client(b.s3Opts)
+	}
+	return b.s3Client
+}
+
+func (b *backends) gcs() *storage.Client {
+	if b.gcsClient == nil {
+		b.gcsClient = newGCSClient(b.ctx, b.gcsOpts)
+	}
+	return b.gcsClient
+}
+
+func (b *backends) close() {
+	if b.gcsClient != nil {
+		b.gcsClient.Close()
+	}
+}
+
+func (b *backends) source(l location) Source {
+	var src Source
+	switch l.scheme {
+	case "s3":
+		src = newS3Source(b.s3(), l.bucket)
+	case "gs":
+		src = newGCSSource(b.gcsOpts.bucket(b.gcs(), l.bucket), l.bucket)
+	default:
+		return newFSSource(l.bucket)
+	}
+	if l.prefix != "" {
+		src = prefixedSource{Source: src, prefix: l.prefix}
+	}
+	return src
+}
+
+func (b *backends) destination(l location) Destination {
+	var dst Destination
+	switch l.scheme {
+	case "s3":
+		dst = newS3Destination(b.s3(), l.bucket)
+	case "gs":
+		dst = newGCSDestination(b.gcsOpts.bucket(b.gcs(), l.bucket), l.bucket, b.gcsOpts.kmsKey)
+	default:
+		return newFSDestination(l.bucket)
+	}
+	if l.prefix != "" {
+		dst = prefixedDestination{Destination: dst, prefix: l.prefix}
+	}
+	return dst
+}
+
+func runSync(args []string) {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	var bandwidthLimit bandwidth
+	var logSample logSampler
+	flags.Var(&logSample, "log-sample", "Only log one in this many lines about objects copied or skipped, e.g. 1/1000")
+	flags.Var(&bandwidthLimit, "bandwidth-limit", "Limit the total transfer rate of all copies, e.g. 200MiB/s (default: no limit)")
+	forceFlag := flags.Bool("force", false, "Force copying objects, skipping comparison")
+	modifyWindow := addModifyWindowFlag(flags)
+	var chaos chaosOptions
+	addChaosFlags(flags, &chaos)
+	var s3Opts s3Options
+	addS3Flags(flags, &s3Opts)
+	var gcsOpts gcsOptions
+	addGCSFlags(flags, &gcsOpts)
+	addGCSKMSKeyFlag(flags, &gcsOpts)
+	addLogFlags(flags)
+	addTracingFlags(flags)
+	flags.Parse(args)
+	setupLogging()
+	setupTracing()
+	defer shutdownTracing()
+
+	if len(flags.Args()) != 2 {
+		log.Fatal("Usage: ./s3-to-gcs sync [-force] [-modify-window <duration>] [-trace] [-bandwidth-limit <rate>] [-log-sample 1/<n>] [-chaos-failure-rate <fraction>] [-chaos-delay <duration>] [-chaos-throttle <rate>] <source URI> <destination URI>")
+	}
+
+	chaos.validate()
+	checkModifyWindow(*modifyWindow)
+
+	srcLocation, err := parseLocation(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("Invalid source: %v", err)
+	}
+	dstLocation, err := parseLocation(flags.Arg(1))
+	if err != nil {
+		log.Fatalf("Invalid destination: %v", err)
+	}
+
+	ctx := context.Background()
+	b := &backends{ctx: ctx, s3Opts: s3Opts, gcsOpts: gcsOpts}
+	defer b.close()
+
+	src, dst := chaos.wrap(b.source(srcLocation), b.destination(dstLocation))
+
+	log.Printf("Source: %s", src)
+	log.Printf("Destination: %s", dst)
+	log.Printf("Force copy: %t", *forceFlag)
+	if *modifyWindow > 0 {
+		log.Printf("Modify window: %s", *modifyWindow)
+	}
+	if bandwidthLimit > 0 {
+		log.Printf("Bandwidth limit: %s", bandwidthLimit.String())
+	}
+	s3Opts.log()
+	gcsOpts.log()
+	chaos.log()
+
+	t := newTransferrer(ctx, src, dst, transferOptions{
+		force:          *forceFlag,
+		bandwidthLimit: int64(bandwidthLimit),
+		logSample:      &logSample,
+		modifyWindow:   *modifyWindow,
+	})
+	if err := t.run(""); err != nil {
+		log.Fatal(err)
+	}
+
+	t.reportStats()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// newBandwidthLimiter returns a token bucket, refilled at bytesPerSecond,
+// shared by every copy to cap the total transfer rate. It returns nil, for no
+// limit, if bytesPerSecond is not positive.
+func newBandwidthLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	// A tenth of a second's worth of bytes, but no less than a whole io.Copy
+	// buffer
+	burst := int(bytesPerSecond / 10)
+	if burst < 32*1024 {
+		burst = 32 * 1024
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+}
+
+// throttledReader waits for limiter tokens for every byte read through it.
+type throttledReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *rate.Limiter
+}
+
+// throttle limits reads from reader to the rate of limiter, if not nil. The
+// rate can be changed while reading.
+func throttle(ctx context.Context, reader io.Reader, limiter *rate.Limiter) io.Reader {
+	if limiter == nil {
+		return reader
+	}
+	return &throttledReader{ctx: ctx, reader: reader, limiter: limiter}
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if r.limiter.Limit() == rate.Inf {
+		return r.reader.Read(p)
+	}
+	if len(p) > r.limiter.Burst() {
+		p = p[:r.limiter.Burst()]
+	}
+	n, err := r.reader.Read(p)
+
+	// The burst may have been lowered since, so tokens are waited for in
+	// chunks it allows
+	for waited := 0; waited < n; {
+		chunk := n - waited
+		if burst := r.limiter.Burst(); chunk > burst && burst > 0 {
+			chunk = burst
+		}
+		if waitErr := r.limiter.WaitN(r.ctx, chunk); waitErr != nil {
+			if err == nil {
+				err = waitErr
+			}
+			break
+		}
+		waited += chunk
+	}
+	return n, err
+}
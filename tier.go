@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// gcsStorageClasses are the storage classes objects can be written with.
+var gcsStorageClasses = []string{"STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE"}
+
+// tierRule routes the objects last modified at least age ago to another
+// bucket, with another storage class, or both.
+type tierRule struct {
+	age          time.Duration
+	bucket       string // "" for the destination bucket
+	storageClass string // "" for the default storage class of the bucket
+}
+
+func (r tierRule) String() string {
+	var destination []string
+	if r.bucket != "" {
+		destination = append(destination, "gs://"+r.bucket)
+	}
+	if r.storageClass != "" {
+		destination = append(destination, r.storageClass)
+	}
+	return formatAge(r.age) + "=" + strings.Join(destination, ",")
+}
+
+// tierRules is a flag.Value collecting the rules of every -tier flag, parsed
+// from "<age>=<destination>" where the destination is gs://<bucket>, a
+// storage class, or both separated by a comma.
+type tierRules []tierRule
+
+func (t *tierRules) String() string {
+	if t == nil {
+		return ""
+	}
+	rules := make([]string, len(*t))
+	for i, rule := range *t {
+		rules[i] = rule.String()
+	}
+	return strings.Join(rules, " ")
+}
+
+func (t *tierRules) Set(value string) error {
+	age, destination, ok := strings.Cut(value, "=")
+	if !ok || destination == "" {
+		return fmt.Errorf("invalid tier %q, expected <age>=gs://<bucket>, <age>=<storage class> or <age>=gs://<bucket>,<storage class>", value)
+	}
+
+	var rule tierRule
+	var err error
+	if rule.age, err = parseAge(age); err != nil {
+		return err
+	}
+	for _, part := range strings.Split(destination, ",") {
+		switch {
+		case strings.HasPrefix(part, "gs://") && rule.bucket == "":
+			bucket, prefix, err := parseGCSURI(part)
+			if err != nil {
+				return err
+			}
+			// Objects keep their key in every tier
+			if prefix != "" {
+				return fmt.Errorf("invalid tier %q, the bucket cannot have a prefix", value)
+			}
+			rule.bucket = bucket
+		case isGCSStorageClass(part) && rule.storageClass == "":
+			rule.storageClass = strings.ToUpper(part)
+		default:
+			return fmt.Errorf("invalid tier destination %q in %q, expected gs://<bucket> or a storage class (%s)", part, value, strings.Join(gcsStorageClasses, ", "))
+		}
+	}
+
+	for _, existing := range *t {
+		if existing.age == rule.age {
+			return fmt.Errorf("invalid tier %q, another tier has the same age", value)
+		}
+	}
+	*t = append(*t, rule)
+	// The oldest tier an object is old enough for wins
+	sort.Slice(*t, func(i, j int) bool { return (*t)[i].age > (*t)[j].age })
+	return nil
+}
+
+// forObject returns the rule of the oldest tier the object is old enough
+// for, or nil if it stays in the destination bucket.
+func (t tierRules) forObject(s3Object *s3.Object, now time.Time) *tierRule {
+	if s3Object.LastModified == nil {
+		return nil
+	}
+	age := now.Sub(*s3Object.LastModified)
+	for i := range t {
+		if age >= t[i].age {
+			return &t[i]
+		}
+	}
+	return nil
+}
+
+// routesToOtherBuckets tells whether a rule copies objects to another
+// bucket than the destination one.
+func (t tierRules) routesToOtherBuckets() bool {
+	for _, rule := range t {
+		if rule.bucket != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func isGCSStorageClass(value string) bool {
+	for _, storageClass := range gcsStorageClasses {
+		if strings.EqualFold(value, storageClass) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAge parses an age such as "365d", in days, or any Go duration such
+// as "36h".
+func parseAge(value string) (time.Duration, error) {
+	var age time.Duration
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid age %q", value)
+		}
+		age = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if age, err = time.ParseDuration(value); err != nil {
+			return 0, fmt.Errorf("invalid age %q, expected days such as 365d or a duration such as 36h", value)
+		}
+	}
+	if age <= 0 {
+		return 0, fmt.Errorf("invalid age %q, must be positive", value)
+	}
+	return age, nil
+}
+
+// formatAge formats an age in days when it is a whole number of days.
+func formatAge(age time.Duration) string {
+	if age%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", age/(24*time.Hour))
+	}
+	return age.String()
+}
+
+// destination returns the bucket an object is copied to, and the storage
+// class it is written with, "" for the default of the bucket.
+func (c *copier) destination(s3Object *s3.Object) (bucket string, storageClass string) {
+	rule := c.options.tiers.forObject(s3Object, time.Now())
+	if rule == nil {
+		return c.gcsBucket, ""
+	}
+
+	c.copyMutex.Lock()
+	c.filesTiered[rule.String()]++
+	c.copyMutex.Unlock()
+
+	if rule.bucket == "" {
+		return c.gcsBucket, rule.storageClass
+	}
+	return rule.bucket, rule.storageClass
+}
+
+// deleteObject deletes the GCS object of a key removed from S3, from the
+// destination bucket and from the buckets of the tiers, since its age is no
+// longer known.
+func (c *copier) deleteObject(ctx context.Context, key string) error {
+	name := c.gcsName(&s3.Object{Key: aws.String(key)})
+	for _, bucketHandle := range c.bucketHandles {
+		// The object of another key rewritten into the same name is left
+		other, err := c.otherSourceKey(ctx, bucketHandle.Object(name), key)
+		if err != nil {
+			return err
+		}
+		if other != "" {
+			log.Printf("Object %s – removed from S3, GCS object %s is that of object %s, leaving it", key, name, other)
+			continue
+		}
+		err = bucketHandle.Object(name).Delete(ctx)
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of every object copied. Until setupTracing
+// installs a provider, its spans are not recorded.
+var tracer = otel.Tracer("github.com/deorus/s3-to-gcs")
+
+var tracingEnabled bool
+
+// shutdownTracing flushes the spans not exported yet. It is a no-op unless
+// tracing is enabled.
+var shutdownTracing = func() {}
+
+// addTracingFlags registers the flags controlling tracing.
+func addTracingFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&tracingEnabled, "trace", false, "Export OpenTelemetry traces of every object copied over OTLP/HTTP, configured by the OTEL_EXPORTER_OTLP_* environment variables")
+}
+
+// setupTracing installs the OTLP exporter once the flags have been parsed.
+func setupTracing() {
+	if !tracingEnabled {
+		return
+	}
+
+	ctx := context.Background()
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("s3-to-gcs")))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	tracer = provider.Tracer("github.com/deorus/s3-to-gcs")
+
+	shutdownTracing = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			log.Printf("Error exporting traces: %v", err)
+		}
+	}
+	log.Print("Tracing: OTLP")
+}
+
+// startObjectSpan starts a span about an object.
+func startObjectSpan(ctx context.Context, name string, key string, size int64) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(
+		attribute.String("object.key", key),
+		attribute.Int64("object.size", size),
+	))
+}
+
+// endSpan ends a span, recording err if not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
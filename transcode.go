@@ -0,0 +1,129 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// Transcodings of the content of objects on the way to GCS.
+const (
+	transcodeGzip   = "gzip"   // Compressed, with -gzip
+	transcodeGunzip = "gunzip" // Decompressed, with -gunzip
+)
+
+// Metadata entries recording that the content of an object was transcoded,
+// and the size of the S3 object, which the size of the GCS object no longer
+// is.
+const (
+	metadataKeyTranscoded = "Transcoded"
+	metadataKeySourceSize = "SourceSize"
+)
+
+// parseList splits a comma separated flag value, leaving out empty entries.
+func parseList(value string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// transcoding returns how to transcode the content of an S3 object with
+// -gzip or -gunzip, "" to copy it as is. Objects are transcoded if they
+// match one of -gzip-extensions or -gzip-content-types, or any object
+// without either. Only objects without a Content-Encoding are compressed,
+// and objects with Content-Encoding: gzip decompressed.
+func (o *copyOptions) transcoding(key string, contentType string, contentEncoding string) string {
+	var transcoding string
+	switch {
+	case o.gzip && contentEncoding == "":
+		transcoding = transcodeGzip
+	case o.gunzip && strings.EqualFold(contentEncoding, "gzip"):
+		transcoding = transcodeGunzip
+	default:
+		return ""
+	}
+	if len(o.gzipExtensions) == 0 && len(o.gzipContentTypes) == 0 {
+		return transcoding
+	}
+	extension := path.Ext(key)
+	for _, e := range o.gzipExtensions {
+		if strings.EqualFold(extension, e) {
+			return transcoding
+		}
+	}
+	// Parameters such as charset=utf-8 do not change the type
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, t := range o.gzipContentTypes {
+		t = strings.ToLower(t)
+		if prefix, ok := strings.CutSuffix(t, "/*"); (ok && strings.HasPrefix(mediaType, prefix+"/")) || mediaType == t {
+			return transcoding
+		}
+	}
+	return ""
+}
+
+// transcodedEncoding returns the Content-Encoding of a GCS object whose S3
+// object has contentEncoding, once transcoded.
+func transcodedEncoding(transcoding string, contentEncoding string) string {
+	switch transcoding {
+	case transcodeGzip:
+		return "gzip"
+	case transcodeGunzip:
+		return ""
+	}
+	return contentEncoding
+}
+
+// gunzipReader decompresses a reader, reading the gzip header on the first
+// Read, so that its errors are reading errors.
+type gunzipReader struct {
+	reader     io.Reader
+	decompress *gzip.Reader
+}
+
+func (r *gunzipReader) Read(p []byte) (int, error) {
+	if r.decompress == nil {
+		decompress, err := gzip.NewReader(r.reader)
+		if err != nil {
+			return 0, err
+		}
+		r.decompress = decompress
+	}
+	return r.decompress.Read(p)
+}
+
+// transcodeReader returns body transcoded. Closing it stops the compression
+// of a body that is not read to the end.
+func transcodeReader(body io.Reader, transcoding string) io.ReadCloser {
+	if transcoding == transcodeGunzip {
+		return io.NopCloser(&gunzipReader{reader: body})
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		compress := gzip.NewWriter(writer)
+		_, err := io.Copy(compress, body)
+		if err == nil {
+			err = compress.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+	return reader
+}
+
+// sourceSize returns the size of the S3 object a GCS object was copied from,
+// which is that of the GCS object unless it was transcoded.
+func sourceSize(attrs *storage.ObjectAttrs) int64 {
+	if size, err := strconv.ParseInt(attrs.Metadata[metadataKeySourceSize], 10, 64); err == nil {
+		return size
+	}
+	return attrs.Size
+}
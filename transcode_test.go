@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestTranscoding(t *testing.T) {
+	tests := []struct {
+		name            string
+		options         copyOptions
+		key             string
+		contentType     string
+		contentEncoding string
+		want            string
+	}{
+		{name: "gzip", options: copyOptions{gzip: true}, key: "a.bin", want: transcodeGzip},
+		{name: "gzip of an encoded object", options: copyOptions{gzip: true}, key: "a.txt", contentEncoding: "br", want: ""},
+		{name: "gzip of a compressed object", options: copyOptions{gzip: true}, key: "a.txt", contentEncoding: "gzip", want: ""},
+		{name: "gunzip", options: copyOptions{gunzip: true}, key: "a.txt", contentEncoding: "GZIP", want: transcodeGunzip},
+		{name: "gunzip of an uncompressed object", options: copyOptions{gunzip: true}, key: "a.txt", want: ""},
+		{name: "neither", key: "a.txt", want: ""},
+		{name: "extension", options: copyOptions{gzip: true, gzipExtensions: []string{".txt", ".csv"}}, key: "dir/a.TXT", want: transcodeGzip},
+		{name: "other extension", options: copyOptions{gzip: true, gzipExtensions: []string{".txt", ".csv"}}, key: "dir.txt/a.bin", want: ""},
+		{name: "content type with parameters", options: copyOptions{gzip: true, gzipContentTypes: []string{"text/*", "application/json"}}, key: "a", contentType: "Text/HTML; charset=utf-8", want: transcodeGzip},
+		{name: "exact content type", options: copyOptions{gzip: true, gzipContentTypes: []string{"text/*", "application/json"}}, key: "a", contentType: "application/json", want: transcodeGzip},
+		{name: "longer content type", options: copyOptions{gzip: true, gzipContentTypes: []string{"text/*", "application/json"}}, key: "a", contentType: "application/jsonl", want: ""},
+		{name: "content type prefix", options: copyOptions{gzip: true, gzipContentTypes: []string{"text/*"}}, key: "a", contentType: "textual/plain", want: ""},
+		{name: "extension or content type", options: copyOptions{gzip: true, gzipExtensions: []string{".log"}, gzipContentTypes: []string{"text/*"}}, key: "a.log", contentType: "application/octet-stream", want: transcodeGzip},
+	}
+	for _, test := range tests {
+		if got := test.options.transcoding(test.key, test.contentType, test.contentEncoding); got != test.want {
+			t.Errorf("%s: transcoding = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTranscodedEncoding(t *testing.T) {
+	tests := []struct {
+		transcoding     string
+		contentEncoding string
+		want            string
+	}{
+		{transcoding: transcodeGzip, contentEncoding: "", want: "gzip"},
+		{transcoding: transcodeGunzip, contentEncoding: "gzip", want: ""},
+		{transcoding: "", contentEncoding: "br", want: "br"},
+		{transcoding: "", contentEncoding: "", want: ""},
+	}
+	for _, test := range tests {
+		if got := transcodedEncoding(test.transcoding, test.contentEncoding); got != test.want {
+			t.Errorf("transcodedEncoding(%q, %q) = %q, want %q", test.transcoding, test.contentEncoding, got, test.want)
+		}
+	}
+}
+
+func TestTranscodeReaderRoundTrip(t *testing.T) {
+	for _, content := range [][]byte{{}, []byte("a"), bytes.Repeat([]byte("compressible content "), 10000)} {
+		compressed, err := io.ReadAll(transcodeReader(bytes.NewReader(content), transcodeGzip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decompressed, err := io.ReadAll(transcodeReader(bytes.NewReader(compressed), transcodeGunzip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decompressed, content) {
+			t.Errorf("round trip of %d bytes returned %d bytes", len(content), len(decompressed))
+		}
+	}
+}
+
+// Content that is not gzip fails on the first Read, as a reading error.
+func TestTranscodeReaderNotGzip(t *testing.T) {
+	if _, err := io.ReadAll(transcodeReader(strings.NewReader("not compressed"), transcodeGunzip)); err == nil {
+		t.Error("gunzip of uncompressed content succeeded, want an error")
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// transferOptions control a transfer between a Source and a Destination.
+type transferOptions struct {
+	force          bool
+	bandwidthLimit int64
+	logSample      *logSampler
+
+	// Modification times this far apart count as equal when objects have no
+	// checksums to compare
+	modifyWindow time.Duration
+}
+
+// transferrer copies objects from any Source to any Destination. Unlike the
+// copier, which knows about S3 versions and GCS generations, it only copies
+// the current content and attributes of every object.
+type transferrer struct {
+	ctx     context.Context
+	src     Source
+	dst     Destination
+	options transferOptions
+
+	// Shared by all copies to enforce -bandwidth-limit, nil without a limit
+	limiter *rate.Limiter
+
+	wg sync.WaitGroup
+
+	// Buffered channel to control the number of concurrent copy operations
+	copySemaphore chan struct{}
+
+	copyMutex        sync.Mutex
+	copyStartTime    time.Time
+	filesCopied      int64
+	totalBytesCopied int64
+	bytesRead        atomic.Int64
+
+	filesIdentical      int64
+	totalBytesIdentical int64
+}
+
+func newTransferrer(ctx context.Context, src Source, dst Destination, options transferOptions) *transferrer {
+	return &transferrer{
+		ctx:           ctx,
+		src:           src,
+		dst:           dst,
+		options:       options,
+		limiter:       newBandwidthLimiter(options.bandwidthLimit),
+		copySemaphore: make(chan struct{}, defaultCopyConcurrency()),
+		copyStartTime: time.Now(),
+	}
+}
+
+// addModifyWindowFlag registers -modify-window for transfers, which compare
+// modification times when objects have no checksums.
+func addModifyWindowFlag(flags *flag.FlagSet) *time.Duration {
+	return flags.Duration("modify-window", 0, "Treat modification times this far apart as equal when objects have no checksums to compare, e.g. 2s")
+}
+
+// checkModifyWindow exits if window is not a valid -modify-window value.
+func checkModifyWindow(window time.Duration) {
+	if window < 0 {
+		log.Fatalf("Invalid -modify-window value %s, must not be negative", window)
+	}
+}
+
+func (t *transferrer) reportStats() {
+	t.copyMutex.Lock()
+	defer t.copyMutex.Unlock()
+	logCopyStats(t.filesCopied, t.totalBytesCopied, t.bytesRead.Load(), t.copyStartTime)
+	logIdenticalStats(t.filesIdentical, t.totalBytesIdentical, t.copyStartTime)
+}
+
+func (t *transferrer) copyFile(info objectInfo) {
+	defer t.wg.Done()
+	defer func() { <-t.copySemaphore }() // Release the semaphore when the function exits
+
+	copyStartTime := time.Now()
+	ctx, span := startObjectSpan(t.ctx, "copy object", info.Key, info.Size)
+	defer span.End()
+
+	_, openSpan := tracer.Start(ctx, "open source object")
+	reader, err := t.src.Open(t.ctx, info)
+	if err != nil {
+		endSpan(openSpan, err)
+		endSpan(span, err)
+		fatalObject(info.Key, err, "Error reading object "+info.Key+" from "+t.src.String())
+	}
+	openSpan.End()
+	defer reader.Close()
+
+	// The source is read while the destination is written
+	writeCtx, writeSpan := tracer.Start(ctx, "write destination object")
+	counter := &countingReader{reader: throttle(t.ctx, &meteredReader{reader: reader, total: &t.bytesRead}, t.limiter)}
+	if _, err := t.dst.Write(writeCtx, info, counter); err != nil {
+		endSpan(writeSpan, err)
+		endSpan(span, err)
+		fatalObject(info.Key, err, "Error copying object "+info.Key+" to "+t.dst.String())
+	}
+	writeSpan.End()
+
+	t.copyMutex.Lock()
+	t.totalBytesCopied += counter.count
+	t.filesCopied++
+	t.copyMutex.Unlock()
+
+	duration := time.Since(copyStartTime)
+	t.options.logSample.log(objectEvent{
+		Key:      info.Key,
+		Action:   actionCopied,
+		Bytes:    counter.count,
+		Duration: duration.Seconds(),
+		Message:  fmt.Sprintf("Object %s – copied %s in %s", info.Key, formatBytes(counter.count), formatDuration(duration)),
+	})
+}
+
+// logObject logs a sampled line about an object.
+func (t *transferrer) logObject(info objectInfo, action string, format string, v ...any) {
+	t.options.logSample.log(objectEvent{
+		Key:     info.Key,
+		Action:  action,
+		Bytes:   info.Size,
+		Message: fmt.Sprintf(format, v...),
+	})
+}
+
+// transferObject compares an object with its counterpart in the destination
+// and copies it when needed.
+func (t *transferrer) transferObject(info objectInfo) {
+	if !t.options.force {
+		dstInfo, err := t.dst.Stat(t.ctx, info.Key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if upToDate(info, dstInfo, t.options.modifyWindow) {
+			t.logObject(info, actionMatch, "Object %s match (size: %d)", info.Key, info.Size)
+			t.copyMutex.Lock()
+			t.filesIdentical++
+			t.totalBytesIdentical += info.Size
+			t.copyMutex.Unlock()
+			return
+		}
+		if dstInfo != nil {
+			t.logObject(info, actionCopy, "Object %s – changed, copying", info.Key)
+		} else {
+			t.logObject(info, actionCopy, "Object %s – copying", info.Key)
+		}
+	} else {
+		t.logObject(info, actionCopy, "Object %s – copying", info.Key)
+	}
+
+	t.wg.Add(1)
+	t.copySemaphore <- struct{}{} // Acquire the semaphore
+	go t.copyFile(info)
+}
+
+// run transfers every object whose key starts with prefix.
+func (t *transferrer) run(prefix string) error {
+	stopReporting := reportStatsPeriodically(t.reportStats)
+	defer stopReporting()
+
+	err := t.src.List(t.ctx, prefix, func(info objectInfo) error {
+		t.transferObject(info)
+		return nil
+	})
+	t.wg.Wait()
+	return err
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// meteredReader adds the bytes read through it to a total shared by several
+// readers, as they are read.
+type meteredReader struct {
+	reader io.Reader
+	total  *atomic.Int64
+}
+
+func (r *meteredReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.total.Add(int64(n))
+	return n, err
+}
+
+func runGCSToS3(args []string) {
+	flags := flag.NewFlagSet("gcs-to-s3", flag.ExitOnError)
+	var bandwidthLimit bandwidth
+	var logSample logSampler
+	flags.Var(&logSample, "log-sample", "Only log one in this many lines about objects copied or skipped, e.g. 1/1000")
+	flags.Var(&bandwidthLimit, "bandwidth-limit", "Limit the total transfer rate of all copies, e.g. 200MiB/s (default: no limit)")
+	forceFlag := flags.Bool("force", false, "Force copying objects, skipping checksum comparison")
+	modifyWindow := addModifyWindowFlag(flags)
+	var s3Opts s3Options
+	addS3Flags(flags, &s3Opts)
+	var gcsOpts gcsOptions
+	addGCSFlags(flags, &gcsOpts)
+	addLogFlags(flags)
+	addTracingFlags(flags)
+	flags.Parse(args)
+	setupLogging()
+	setupTracing()
+	defer shutdownTracing()
+
+	if len(flags.Args()) < 2 || len(flags.Args()) > 3 {
+		log.Fatal("Usage: ./s3-to-gcs gcs-to-s3 [-force] [-modify-window <duration>] [-trace] [-bandwidth-limit <rate>] [-log-sample 1/<n>] <GCS bucket> <S3 bucket> [optional object key prefix]")
+	}
+
+	checkModifyWindow(*modifyWindow)
+
+	buckets, objectKeyPrefix := parseBucketArgs(flags.Args(), "gs", "s3")
+	gcsBucket, s3Bucket := buckets[0], buckets[1]
+
+	log.Printf("GCS bucket: %s", gcsBucket)
+	log.Printf("S3 bucket: %s", s3Bucket)
+	if objectKeyPrefix != "" {
+		log.Printf("Object key prefix: %s", objectKeyPrefix)
+	}
+	log.Printf("Force copy: %t", *forceFlag)
+	if *modifyWindow > 0 {
+		log.Printf("Modify window: %s", *modifyWindow)
+	}
+	if bandwidthLimit > 0 {
+		log.Printf("Bandwidth limit: %s", bandwidthLimit.String())
+	}
+	s3Opts.log()
+	gcsOpts.log()
+
+	ctx := context.Background()
+	client := newGCSClient(ctx, gcsOpts)
+	defer client.Close()
+
+	t := newTransferrer(ctx, newGCSSource(gcsOpts.bucket(client, gcsBucket), gcsBucket), newS3Destination(newS3Client(s3Opts), s3Bucket), transferOptions{
+		force:          *forceFlag,
+		bandwidthLimit: int64(bandwidthLimit),
+		logSample:      &logSample,
+		modifyWindow:   *modifyWindow,
+	})
+	if err := t.run(objectKeyPrefix); err != nil {
+		log.Fatal(err)
+	}
+
+	t.reportStats()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Values of -transfer-manifest-format.
+const (
+	manifestFormatJSON = "json"
+	manifestFormatCSV  = "csv"
+)
+
+// transferRecord is the line of the transfer manifest about an object that
+// was copied, already up to date or skipped.
+type transferRecord struct {
+	Time              time.Time `json:"time"`
+	Key               string    `json:"key"`
+	Size              int64     `json:"size"`
+	VersionID         string    `json:"versionId,omitempty"`
+	SourceETag        string    `json:"sourceETag,omitempty"`
+	DestinationCRC32C string    `json:"destinationCRC32C,omitempty"`
+	Action            string    `json:"action"`
+	Reason            string    `json:"reason,omitempty"` // Why an object was not copied
+	Duration          float64   `json:"durationSeconds"`
+}
+
+var transferManifestColumns = []string{"time", "key", "size", "versionId", "sourceETag", "destinationCRC32C", "action", "durationSeconds", "reason"}
+
+// transferManifest writes a record of every object processed to a file, as an
+// audit trail of the migration. Records are written as soon as the object is
+// handled, so the manifest of an interrupted run is complete up to that point.
+type transferManifest struct {
+	path string
+	file *os.File
+
+	mutex   sync.Mutex
+	encoder *json.Encoder
+	writer  *csv.Writer
+}
+
+// createTransferManifest creates the manifest file, replacing any previous
+// one, in the given format.
+func createTransferManifest(path string, format string) *transferManifest {
+	file, err := os.Create(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	m := &transferManifest{path: path, file: file}
+	if format == manifestFormatCSV {
+		m.writer = csv.NewWriter(file)
+		m.writeCSV(transferManifestColumns)
+	} else {
+		m.encoder = json.NewEncoder(file)
+	}
+	return m
+}
+
+// record adds a record to the manifest. It is a no-op on a nil manifest.
+func (m *transferManifest) record(r transferRecord) {
+	if m == nil {
+		return
+	}
+	r.Time = time.Now()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.writer != nil {
+		m.writeCSV([]string{
+			r.Time.UTC().Format(time.RFC3339Nano),
+			r.Key,
+			strconv.FormatInt(r.Size, 10),
+			r.VersionID,
+			r.SourceETag,
+			r.DestinationCRC32C,
+			r.Action,
+			strconv.FormatFloat(r.Duration, 'f', 3, 64),
+			r.Reason,
+		})
+		return
+	}
+	if err := m.encoder.Encode(r); err != nil {
+		log.Fatal("Error writing transfer manifest " + m.path + ": " + err.Error())
+	}
+}
+
+// writeCSV writes a row and flushes it, since the program may exit on an
+// error at any time.
+func (m *transferManifest) writeCSV(row []string) {
+	m.writer.Write(row)
+	m.writer.Flush()
+	if err := m.writer.Error(); err != nil {
+		log.Fatal("Error writing transfer manifest " + m.path + ": " + err.Error())
+	}
+}
+
+func (m *transferManifest) close() {
+	if m == nil {
+		return
+	}
+	if err := m.file.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
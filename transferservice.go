@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"google.golang.org/api/storagetransfer/v1"
+)
+
+// Statuses of a finished Storage Transfer Service operation.
+const (
+	transferOperationFailed  = "FAILED"
+	transferOperationAborted = "ABORTED"
+)
+
+// transferServiceOptions control the transfer-service subcommand.
+type transferServiceOptions struct {
+	project      string
+	roleARN      string
+	pollInterval time.Duration
+	concurrency  int
+	fixupOnly    bool
+}
+
+// runTransferJob creates a one-time Storage Transfer Service job copying the
+// objects under prefix from the S3 bucket to the GCS bucket, runs it and
+// waits for it to finish. The bytes go from S3 to GCS without going through
+// the machine running the tool.
+func runTransferJob(ctx context.Context, service *storagetransfer.Service, s3Client *s3.S3, s3Bucket, gcsBucket, prefix string, options transferServiceOptions) {
+	source := &storagetransfer.AwsS3Data{BucketName: s3Bucket, RoleArn: options.roleARN}
+	// Without a role, the service is given the access key of the tool,
+	// which must not be temporary
+	if options.roleARN == "" {
+		credentials, err := s3Client.Config.Credentials.GetWithContext(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if credentials.SessionToken != "" {
+			log.Fatal("The AWS credentials are temporary, which Storage Transfer Service cannot use, give it a role to assume with -sts-role-arn")
+		}
+		source.AwsAccessKey = &storagetransfer.AwsAccessKey{AccessKeyId: credentials.AccessKeyID, SecretAccessKey: credentials.SecretAccessKey}
+	}
+	spec := &storagetransfer.TransferSpec{
+		AwsS3DataSource: source,
+		GcsDataSink:     &storagetransfer.GcsData{BucketName: gcsBucket},
+		TransferOptions: &storagetransfer.TransferOptions{OverwriteWhen: "DIFFERENT"},
+	}
+	if prefix != "" {
+		spec.ObjectConditions = &storagetransfer.ObjectConditions{IncludePrefixes: []string{prefix}}
+	}
+
+	job, err := service.TransferJobs.Create(&storagetransfer.TransferJob{
+		ProjectId:    options.project,
+		Description:  fmt.Sprintf("s3-to-gcs s3://%s/%s to gs://%s", s3Bucket, prefix, gcsBucket),
+		Status:       "ENABLED",
+		TransferSpec: spec,
+	}).Context(ctx).Do()
+	if err != nil {
+		log.Fatal("Error creating transfer job: " + err.Error())
+	}
+	log.Printf("Created transfer job %s", job.Name)
+
+	operation, err := service.TransferJobs.Run(job.Name, &storagetransfer.RunTransferJobRequest{ProjectId: options.project}).Context(ctx).Do()
+	if err != nil {
+		log.Fatal("Error running transfer job " + job.Name + ": " + err.Error())
+	}
+	log.Printf("Started transfer operation %s", operation.Name)
+
+	for {
+		var transfer storagetransfer.TransferOperation
+		if len(operation.Metadata) > 0 {
+			if err := json.Unmarshal(operation.Metadata, &transfer); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if counters := transfer.Counters; counters != nil {
+			log.Printf("Transfer %s: copied %s of %s files (%s of %s), failed %s files",
+				operation.Name, printer.Sprintf("%d", counters.ObjectsCopiedToSink), printer.Sprintf("%d", counters.ObjectsFoundFromSource),
+				formatBytes(counters.BytesCopiedToSink), formatBytes(counters.BytesFoundFromSource), printer.Sprintf("%d", counters.ObjectsFromSourceFailed))
+		}
+		if operation.Done {
+			if operation.Error != nil {
+				log.Fatalf("Transfer operation %s failed: %s", operation.Name, operation.Error.Message)
+			}
+			for _, summary := range transfer.ErrorBreakdowns {
+				log.Printf("Transfer %s: %s errors: %s", operation.Name, printer.Sprintf("%d", summary.ErrorCount), summary.ErrorCode)
+			}
+			switch transfer.Status {
+			case transferOperationFailed, transferOperationAborted:
+				log.Fatalf("Transfer operation %s ended with status %s", operation.Name, transfer.Status)
+			}
+			log.Printf("Transfer operation %s finished with status %s", operation.Name, transfer.Status)
+			return
+		}
+
+		select {
+		case <-time.After(options.pollInterval):
+		case <-ctx.Done():
+			log.Fatal(ctx.Err())
+		}
+		if operation, err = service.TransferOperations.Get(operation.Name).Context(ctx).Do(); err != nil {
+			log.Fatal("Error getting transfer operation: " + err.Error())
+		}
+	}
+}
+
+// transferFixup counts the objects of the fix-up after a transfer.
+type transferFixup struct {
+	fixed      atomic.Int64
+	upToDate   atomic.Int64
+	missing    atomic.Int64
+	mismatched atomic.Int64
+	changed    atomic.Int64
+}
+
+// fixupTransferredObject gives a GCS object copied by Storage Transfer
+// Service the metadata entries the copies of the tool have, once its size,
+// and its MD5 when the ETag of the S3 object is one, match the S3 object, so
+// that later copies, verify and reconcile see it as up to date.
+func (f *transferFixup) fixupTransferredObject(ctx context.Context, bucket *storage.BucketHandle, s3Object *s3.Object) {
+	key := *s3Object.Key
+	object := bucket.Object(key)
+	attrs, err := object.Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		logObject(objectEvent{Key: key, Action: actionMismatch, Reason: reasonGCSMissing, Bytes: *s3Object.Size,
+			Message: "Object " + key + " – not in GCS after the transfer"})
+		f.missing.Add(1)
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if attrs.Metadata[metadataKeyETag] == *s3Object.ETag {
+		f.upToDate.Add(1)
+		return
+	}
+
+	md5Sum := s3ContentMD5(s3Object.ETag, nil, nil)
+	if attrs.Size != *s3Object.Size || (md5Sum != nil && len(attrs.MD5) > 0 && !bytes.Equal(md5Sum, attrs.MD5)) {
+		logObject(objectEvent{Key: key, Action: actionMismatch, Reason: reasonContentMismatch, Bytes: *s3Object.Size,
+			Message: fmt.Sprintf("Object %s – does not match after the transfer:\n  S3 size: %d\n  GCS size: %d\n  S3 ETag: %s\n  GCS MD5: %s",
+				key, *s3Object.Size, attrs.Size, *s3Object.ETag, base64.StdEncoding.EncodeToString(attrs.MD5))})
+		f.mismatched.Add(1)
+		return
+	}
+
+	metadata := make(map[string]string, len(attrs.Metadata)+4)
+	for name, value := range attrs.Metadata {
+		metadata[name] = value
+	}
+	metadata[metadataKeyETag] = *s3Object.ETag
+	metadata[metadataKeyCRC32C] = encodeCRC32C(attrs.CRC32C)
+	if len(attrs.MD5) > 0 {
+		metadata[metadataKeyMD5] = base64.StdEncoding.EncodeToString(attrs.MD5)
+	}
+	if s3Object.LastModified != nil {
+		metadata[metadataKeyLastModified] = s3Object.LastModified.UTC().Format(time.RFC3339)
+	}
+	// The object must not have been replaced since it was compared
+	_, err = object.If(storage.Conditions{GenerationMatch: attrs.Generation, MetagenerationMatch: attrs.Metageneration}).
+		Update(ctx, storage.ObjectAttrsToUpdate{Metadata: metadata})
+	if isPreconditionFailed(err) {
+		logObject(objectEvent{Key: key, Action: actionSkip, Reason: reasonGCSChanged, Bytes: *s3Object.Size,
+			Message: "Object " + key + " – written to GCS by another writer since it was checked, leaving it"})
+		f.changed.Add(1)
+		return
+	}
+	if err != nil {
+		log.Fatal("Error updating object " + key + " in bucket " + attrs.Bucket + ": " + err.Error())
+	}
+	logObject(objectEvent{Key: key, Action: actionMatch, Bytes: *s3Object.Size, Message: "Object " + key + " – metadata fixed up"})
+	f.fixed.Add(1)
+}
+
+func runTransferService(args []string) {
+	flags := flag.NewFlagSet("transfer-service", flag.ExitOnError)
+	var options transferServiceOptions
+	flags.StringVar(&options.project, "project", "", "Google Cloud project the transfer job is created in")
+	flags.StringVar(&options.roleARN, "sts-role-arn", "", "ARN of the AWS role Storage Transfer Service assumes to read the S3 bucket (default: give it the access key of the AWS credentials)")
+	flags.DurationVar(&options.pollInterval, "poll-interval", 30*time.Second, "How often to check the progress of the transfer")
+	flags.IntVar(&options.concurrency, "concurrency", runtime.NumCPU(), "Number of objects fixed up concurrently once the transfer is done")
+	flags.BoolVar(&options.fixupOnly, "fixup-only", false, "Only fix up and check the objects of an earlier transfer, without creating a transfer job")
+	var s3Opts s3Options
+	addS3Flags(flags, &s3Opts)
+	var gcsOpts gcsOptions
+	addGCSFlags(flags, &gcsOpts)
+	addLogFlags(flags)
+	flags.Parse(args)
+	setupLogging()
+
+	if len(flags.Args()) < 2 || len(flags.Args()) > 3 || (options.project == "" && !options.fixupOnly) {
+		log.Fatal("Usage: ./s3-to-gcs transfer-service -project <project> [-sts-role-arn <ARN>] [-poll-interval <duration>] [-concurrency <n>] [-fixup-only] <S3 bucket> <GCS bucket> [optional object key prefix]")
+	}
+	if options.concurrency < 1 {
+		log.Fatalf("Invalid -concurrency value %d, must be at least 1", options.concurrency)
+	}
+	if options.pollInterval <= 0 {
+		log.Fatalf("Invalid -poll-interval value %s, must be positive", options.pollInterval)
+	}
+	// Storage Transfer Service only reads from AWS itself
+	if s3Opts.endpoint != "" {
+		log.Fatal("-s3-endpoint cannot be used with transfer-service, Storage Transfer Service only reads from Amazon S3")
+	}
+
+	buckets, objectKeyPrefix := parseBucketArgs(flags.Args(), "s3", "gs")
+	s3Bucket, gcsBucket := buckets[0], buckets[1]
+
+	log.Printf("S3 bucket: %s", s3Bucket)
+	log.Printf("GCS bucket: %s", gcsBucket)
+	if objectKeyPrefix != "" {
+		log.Printf("Object key prefix: %s", objectKeyPrefix)
+	}
+	if !options.fixupOnly {
+		log.Printf("Project: %s", options.project)
+		if options.roleARN != "" {
+			log.Printf("Storage Transfer Service role: %s", options.roleARN)
+		}
+	}
+	s3Opts.log()
+	gcsOpts.log()
+
+	ctx := context.Background()
+	s3Client := newS3Client(s3Opts)
+	if !options.fixupOnly {
+		service, err := storagetransfer.NewService(ctx, gcsClientOptions(ctx, gcsOpts, storagetransfer.CloudPlatformScope)...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		runTransferJob(ctx, service, s3Client, s3Bucket, gcsBucket, objectKeyPrefix, options)
+	}
+
+	client := newGCSClient(ctx, gcsOpts)
+	defer client.Close()
+	bucket := gcsOpts.bucket(client, gcsBucket)
+
+	var fixup transferFixup
+	var wg sync.WaitGroup
+	objects := make(chan *s3.Object)
+	for i := 0; i < options.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s3Object := range objects {
+				fixup.fixupTransferredObject(ctx, bucket, s3Object)
+			}
+		}()
+	}
+	err := bucketLister(ctx, s3Client, s3Bucket, objectKeyPrefix)(func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, s3Object := range page.Contents {
+			if !isFolderKey(aws.StringValue(s3Object.Key)) {
+				objects <- s3Object
+			}
+		}
+		return true
+	})
+	close(objects)
+	wg.Wait()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Fixed up %s files, already fixed up %s files, missing %s files, mismatched %s files, changed meanwhile %s files",
+		printer.Sprintf("%d", fixup.fixed.Load()), printer.Sprintf("%d", fixup.upToDate.Load()),
+		printer.Sprintf("%d", fixup.missing.Load()), printer.Sprintf("%d", fixup.mismatched.Load()),
+		printer.Sprintf("%d", fixup.changed.Load()))
+	if fixup.missing.Load() > 0 || fixup.mismatched.Load() > 0 {
+		log.Fatal("Some objects were not transferred as they are in S3, copy them with the copy of a bucket")
+	}
+}
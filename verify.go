@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"google.golang.org/api/iterator"
+)
+
+// Statuses reported by the verify subcommand for every object.
+const (
+	verifyStatusMatch        = "match"
+	verifyStatusMismatch     = "mismatch"
+	verifyStatusMissingInGCS = "missing-in-gcs"
+	verifyStatusMissingInS3  = "missing-in-s3"
+)
+
+// verifyResult is a single line of the verify report.
+type verifyResult struct {
+	Key     string   `json:"key"`
+	Status  string   `json:"status"`
+	Reasons []string `json:"reasons,omitempty"`
+	S3Size  *int64   `json:"s3Size,omitempty"`
+	GCSSize *int64   `json:"gcsSize,omitempty"`
+	S3ETag  string   `json:"s3ETag,omitempty"`
+	GCSETag string   `json:"gcsETag,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// s3Lister walks a ListObjectsV2 listing one object at a time.
+type s3Lister struct {
+	client *s3.S3
+	input  *s3.ListObjectsV2Input
+	page   []*s3.Object
+	done   bool
+}
+
+func (l *s3Lister) next(ctx context.Context) (*s3.Object, error) {
+	for len(l.page) == 0 {
+		if l.done {
+			return nil, nil
+		}
+		output, err := l.client.ListObjectsV2WithContext(ctx, l.input)
+		if err != nil {
+			return nil, err
+		}
+		l.page = output.Contents
+		if output.NextContinuationToken == nil {
+			l.done = true
+		} else {
+			l.input.ContinuationToken = output.NextContinuationToken
+		}
+	}
+	object := l.page[0]
+	l.page = l.page[1:]
+	return object, nil
+}
+
+// isFolderKey reports whether a key is a folder placeholder, which the tool
+// never copies.
+func isFolderKey(key string) bool {
+	return key == "" || key[len(key)-1:] == "/"
+}
+
+func nextS3File(ctx context.Context, lister *s3Lister, objectShard *shard) *s3.Object {
+	for {
+		object, err := lister.next(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if object == nil || (!isFolderKey(*object.Key) && objectShard.contains(*object.Key)) {
+			return object
+		}
+	}
+}
+
+func nextGCSFile(it *storage.ObjectIterator, objectShard *shard) *storage.ObjectAttrs {
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return nil
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !isFolderKey(attrs.Name) && objectShard.contains(attrs.Name) {
+			return attrs
+		}
+	}
+}
+
+// compareMetadata reports whether the S3 user metadata matches the GCS custom
+// metadata, ignoring the entries the tool adds itself and the S3 tags copied
+// to entries starting with tagPrefix. Values GCS cannot hold are compared
+// escaped.
+func compareMetadata(s3Metadata map[string]*string, gcsMetadata map[string]string, tagPrefix string) bool {
+	count := 0
+	for key, value := range gcsMetadata {
+		if isToolMetadataKey(key) || (tagPrefix != "" && strings.HasPrefix(key, tagPrefix)) {
+			continue
+		}
+		s3Value, ok := s3Metadata[key]
+		if !ok || s3Value == nil {
+			return false
+		}
+		if sanitized, _ := sanitizeMetadataValue(*s3Value); sanitized != value {
+			return false
+		}
+		count++
+	}
+	return count == len(s3Metadata)
+}
+
+func isSplitName(splitNames map[string]struct{}, name string) bool {
+	_, ok := splitNames[name]
+	return ok
+}
+
+// verifyOptions control how verifyBuckets compares objects.
+type verifyOptions struct {
+	skipMetadata bool
+	tagPrefix    string
+	concurrency  int
+	splitSize    int64
+	shard        shard
+}
+
+// verifyBuckets compares every object under the prefix in the S3 and GCS
+// buckets, calling writeResult, possibly concurrently, with the result of
+// each comparison.
+func verifyBuckets(ctx context.Context, s3Client *s3.S3, s3Bucket string, gcsBucketHandle *storage.BucketHandle, objectKeyPrefix string, options verifyOptions, writeResult func(verifyResult)) {
+	s3ObjectsInput := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s3Bucket),
+	}
+	if objectKeyPrefix != "" {
+		s3ObjectsInput.Prefix = aws.String(objectKeyPrefix)
+	}
+	lister := &s3Lister{client: s3Client, input: s3ObjectsInput}
+	gcsIterator := gcsBucketHandle.Objects(ctx, &storage.Query{Prefix: objectKeyPrefix})
+
+	compareFn := func(s3Object *s3.Object, gcsAttrs *storage.ObjectAttrs) verifyResult {
+		result := verifyResult{
+			Key:     *s3Object.Key,
+			S3Size:  s3Object.Size,
+			GCSSize: aws.Int64(gcsAttrs.Size),
+			S3ETag:  *s3Object.ETag,
+			GCSETag: gcsAttrs.Metadata[metadataKeyETag],
+		}
+
+		if *s3Object.Size != sourceSize(gcsAttrs) {
+			result.Reasons = append(result.Reasons, "size")
+		}
+
+		checksumMatch := result.S3ETag == result.GCSETag
+		if recordedCRC32C, ok := gcsAttrs.Metadata[metadataKeyCRC32C]; ok && recordedCRC32C != encodeCRC32C(gcsAttrs.CRC32C) {
+			checksumMatch = false
+		}
+
+		metadataMatch := true
+		if !options.skipMetadata {
+			headOutput, err := s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+				Bucket: aws.String(s3Bucket),
+				Key:    s3Object.Key,
+			})
+			if err != nil {
+				result.Status = verifyStatusMismatch
+				result.Error = err.Error()
+				return result
+			}
+			if md5Sum := s3ContentMD5(headOutput.ETag, headOutput.ServerSideEncryption, headOutput.SSECustomerAlgorithm); md5Sum != nil && len(gcsAttrs.MD5) > 0 && gcsAttrs.Metadata[metadataKeyTranscoded] == "" && !bytes.Equal(md5Sum, gcsAttrs.MD5) {
+				checksumMatch = false
+			}
+			metadataMatch = compareMetadata(headOutput.Metadata, gcsAttrs.Metadata, options.tagPrefix)
+		}
+
+		if !checksumMatch {
+			result.Reasons = append(result.Reasons, "checksum")
+		}
+		if !metadataMatch {
+			result.Reasons = append(result.Reasons, "metadata")
+		}
+
+		return result
+	}
+
+	wg := sync.WaitGroup{}
+	verifySemaphore := make(chan struct{}, options.concurrency)
+
+	// Names of the manifests and parts of split objects, which are verified
+	// along with the S3 object they belong to
+	splitNames := make(map[string]struct{})
+
+	s3Object := nextS3File(ctx, lister, &options.shard)
+	gcsAttrs := nextGCSFile(gcsIterator, &options.shard)
+
+	// Both listings are sorted by key, so they can be merged in a single pass.
+	// The manifest and part names of a split object sort after its key, so
+	// they are known by the time the GCS listing reaches them.
+	for s3Object != nil || gcsAttrs != nil {
+		switch {
+		case s3Object != nil && options.splitSize > 0 && *s3Object.Size > options.splitSize:
+			for _, name := range splitObjectNames(*s3Object.Key, *s3Object.Size, options.splitSize) {
+				splitNames[name] = struct{}{}
+			}
+			wg.Add(1)
+			verifySemaphore <- struct{}{}
+			go func(s3Object *s3.Object) {
+				defer wg.Done()
+				defer func() { <-verifySemaphore }()
+
+				writeResult(verifySplitObject(ctx, gcsBucketHandle, s3Object))
+			}(s3Object)
+			s3Object = nextS3File(ctx, lister, &options.shard)
+		case gcsAttrs != nil && isSplitName(splitNames, gcsAttrs.Name):
+			delete(splitNames, gcsAttrs.Name)
+			gcsAttrs = nextGCSFile(gcsIterator, &options.shard)
+		case gcsAttrs == nil || (s3Object != nil && *s3Object.Key < gcsAttrs.Name):
+			writeResult(verifyResult{
+				Key:    *s3Object.Key,
+				Status: verifyStatusMissingInGCS,
+				S3Size: s3Object.Size,
+				S3ETag: *s3Object.ETag,
+			})
+			s3Object = nextS3File(ctx, lister, &options.shard)
+		case s3Object == nil || gcsAttrs.Name < *s3Object.Key:
+			writeResult(verifyResult{
+				Key:     gcsAttrs.Name,
+				Status:  verifyStatusMissingInS3,
+				GCSSize: aws.Int64(gcsAttrs.Size),
+				GCSETag: gcsAttrs.Metadata[metadataKeyETag],
+			})
+			gcsAttrs = nextGCSFile(gcsIterator, &options.shard)
+		default:
+			wg.Add(1)
+			verifySemaphore <- struct{}{}
+			go func(s3Object *s3.Object, gcsAttrs *storage.ObjectAttrs) {
+				defer wg.Done()
+				defer func() { <-verifySemaphore }()
+
+				result := compareFn(s3Object, gcsAttrs)
+				if result.Status == "" {
+					result.Status = verifyStatusMatch
+					if len(result.Reasons) > 0 {
+						result.Status = verifyStatusMismatch
+					}
+				}
+				writeResult(result)
+			}(s3Object, gcsAttrs)
+			s3Object = nextS3File(ctx, lister, &options.shard)
+			gcsAttrs = nextGCSFile(gcsIterator, &options.shard)
+		}
+	}
+
+	wg.Wait()
+}
+
+// readVerifyReport reads the results of a verify report for the keys starting
+// with prefix in objectShard.
+func readVerifyReport(path, prefix string, objectShard *shard) map[string]verifyResult {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	if !isJSONReport(reader) {
+		log.Fatalf("Invalid report %s: -baseline and report merge require reports written with -output json", path)
+	}
+	results := make(map[string]verifyResult)
+	decoder := json.NewDecoder(reader)
+	for {
+		var result verifyResult
+		err := decoder.Decode(&result)
+		if errors.Is(err, io.EOF) {
+			return results
+		}
+		if err != nil {
+			log.Fatalf("Invalid report %s: %v", path, err)
+		}
+		if strings.HasPrefix(result.Key, prefix) && objectShard.contains(result.Key) {
+			results[result.Key] = result
+		}
+	}
+}
+
+// isJSONReport tells whether the report read from r is made of JSON lines,
+// rather than the CSV or table of -output csv or table, skipping the white
+// space it starts with. An empty report is.
+func isJSONReport(r *bufio.Reader) bool {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return true
+		}
+		if !unicode.IsSpace(rune(b)) {
+			r.UnreadByte()
+			return b == '{'
+		}
+	}
+}
+
+// verifyBaseline compares the objects of an S3 bucket with the results of a
+// previous verify report instead of the GCS bucket. An object matches if it
+// matched in the baseline and its size and ETag have not changed since.
+// Objects that were not good in the baseline keep their status.
+func verifyBaseline(ctx context.Context, s3Client *s3.S3, s3Bucket string, prefix string, objectShard *shard, baseline map[string]verifyResult, writeResult func(verifyResult)) {
+	err := s3Client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s3Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, s3Object := range page.Contents {
+			if isFolderKey(*s3Object.Key) || !objectShard.contains(*s3Object.Key) {
+				continue
+			}
+
+			baselineResult, ok := baseline[*s3Object.Key]
+			delete(baseline, *s3Object.Key)
+
+			result := verifyResult{
+				Key:     *s3Object.Key,
+				Status:  verifyStatusMatch,
+				S3Size:  s3Object.Size,
+				GCSSize: baselineResult.GCSSize,
+				S3ETag:  *s3Object.ETag,
+				GCSETag: baselineResult.GCSETag,
+			}
+			switch {
+			case !ok || baselineResult.Status == verifyStatusMissingInS3:
+				result.Status = verifyStatusMissingInGCS
+				result.Reasons = []string{"not-in-baseline"}
+			case baselineResult.Status != verifyStatusMatch:
+				result.Status = baselineResult.Status
+				result.Reasons = baselineResult.Reasons
+			case aws.Int64Value(baselineResult.S3Size) != *s3Object.Size || baselineResult.S3ETag != *s3Object.ETag:
+				result.Status = verifyStatusMismatch
+				result.Reasons = []string{"changed-since-baseline"}
+			}
+			writeResult(result)
+		}
+		return true
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// What is left of the baseline was deleted from S3 since, or was never
+	// in S3
+	keys := make([]string, 0, len(baseline))
+	for key := range baseline {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		baselineResult := baseline[key]
+		if baselineResult.Status == verifyStatusMissingInGCS {
+			continue
+		}
+		writeResult(verifyResult{
+			Key:     key,
+			Status:  verifyStatusMissingInS3,
+			GCSSize: baselineResult.GCSSize,
+			GCSETag: baselineResult.GCSETag,
+		})
+	}
+}
+
+// verifyCounts counts verification results by status.
+type verifyCounts map[string]int64
+
+func (counts verifyCounts) log() {
+	statuses := make([]string, 0, len(counts))
+	for status := range counts {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	for _, status := range statuses {
+		log.Printf("%s: %s", status, printer.Sprintf("%d", counts[status]))
+	}
+}
+
+func runVerify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	reportPath := flags.String("report", "-", "Write the JSON lines report to this file (default: standard output)")
+	outputFormat := addOutputFlag(flags)
+	baselinePath := flags.String("baseline", "", "Compare the S3 bucket with this earlier report instead of the GCS bucket")
+	var options verifyOptions
+	flags.BoolVar(&options.skipMetadata, "skip-metadata", false, "Only compare size and checksums, skipping the per-object S3 HeadObject call")
+	flags.StringVar(&options.tagPrefix, "tag-prefix", defaultTagPrefix, "Ignore the GCS metadata entries starting with this prefix, the S3 tags copied with -copy-tags")
+	flags.IntVar(&options.concurrency, "concurrency", runtime.NumCPU(), "Number of objects compared concurrently")
+	flags.Var(&options.shard, "shard", "Only verify the i-th of N disjoint sets of keys, e.g. 2/4, as copied with the same -shard")
+	flags.Var((*byteSize)(&options.splitSize), "split-size", "Expect objects larger than this size to have been split into parts (see copy -split-size)")
+	var s3Opts s3Options
+	addS3Flags(flags, &s3Opts)
+	var gcsOpts gcsOptions
+	addGCSFlags(flags, &gcsOpts)
+	addLogFlags(flags)
+	flags.Parse(args)
+	setupLogging()
+	checkOutputFormat(*outputFormat)
+
+	schemes := []string{"s3", "gs"}
+	if *baselinePath != "" {
+		schemes = schemes[:1]
+	}
+	if len(flags.Args()) < len(schemes) || len(flags.Args()) > len(schemes)+1 {
+		log.Fatal("Usage: ./s3-to-gcs verify [-report <file>] [-output json|csv|table] [-skip-metadata] [-tag-prefix <prefix>] [-concurrency <n>] [-split-size <size>] [-shard <i>/<N>] <S3 bucket> <GCS bucket> [optional object key prefix]\n" +
+			"       ./s3-to-gcs verify -baseline <report> [-report <file>] [-output json|csv|table] [-shard <i>/<N>] <S3 bucket> [optional object key prefix]")
+	}
+
+	buckets, objectKeyPrefix := parseBucketArgs(flags.Args(), schemes...)
+	s3Bucket := buckets[0]
+
+	if *baselinePath != "" {
+		log.Printf("Verifying S3 bucket %s against report %s", s3Bucket, *baselinePath)
+	} else {
+		log.Printf("Verifying S3 bucket %s against GCS bucket %s", s3Bucket, buckets[1])
+	}
+	if objectKeyPrefix != "" {
+		log.Printf("Object key prefix: %s", objectKeyPrefix)
+	}
+	if options.shard.count > 1 {
+		log.Printf("Shard: %s", options.shard.String())
+	}
+
+	var report io.Writer = os.Stdout
+	if *reportPath != "-" {
+		reportFile, err := os.Create(*reportPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer reportFile.Close()
+		report = reportFile
+	}
+
+	s3Opts.log()
+	gcsOpts.log()
+	s3Client := newS3Client(s3Opts)
+
+	var reportMutex sync.Mutex
+	encoder := json.NewEncoder(report)
+	var table *tableWriter
+	if *outputFormat != outputJSON {
+		table = newTableWriter(report, *outputFormat, "key", "status", "reasons", "s3Size", "gcsSize", "s3ETag", "gcsETag", "error")
+	}
+	counts := make(verifyCounts)
+
+	writeResultFn := func(result verifyResult) {
+		reportMutex.Lock()
+		defer reportMutex.Unlock()
+		counts[result.Status]++
+		if table != nil {
+			table.write(result.Key, result.Status, strings.Join(result.Reasons, ";"), formatOptionalInt(result.S3Size),
+				formatOptionalInt(result.GCSSize), result.S3ETag, result.GCSETag, result.Error)
+			return
+		}
+		if err := encoder.Encode(result); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	if *baselinePath != "" {
+		baseline := readVerifyReport(*baselinePath, objectKeyPrefix, &options.shard)
+		verifyBaseline(ctx, s3Client, s3Bucket, objectKeyPrefix, &options.shard, baseline, writeResultFn)
+	} else {
+		client := newGCSClient(ctx, gcsOpts)
+		defer client.Close()
+
+		gcsBucketHandle := gcsOpts.bucket(client, buckets[1])
+		verifyBuckets(ctx, s3Client, s3Bucket, gcsBucketHandle, objectKeyPrefix, options, writeResultFn)
+	}
+
+	if table != nil {
+		table.flush()
+	}
+	counts.log()
+
+	if counts[verifyStatusMismatch] > 0 || counts[verifyStatusMissingInGCS] > 0 || counts[verifyStatusMissingInS3] > 0 {
+		log.Fatal("Verification failed")
+	}
+	log.Print("Verification succeeded")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIsJSONReport(t *testing.T) {
+	result := verifyResult{Key: "a.txt", Status: verifyStatusMatch}
+	var jsonReport bytes.Buffer
+	if err := json.NewEncoder(&jsonReport).Encode(result); err != nil {
+		t.Fatal(err)
+	}
+	tableReport := func(format string) string {
+		var buffer bytes.Buffer
+		table := newTableWriter(&buffer, format, "key", "status")
+		table.write(result.Key, result.Status)
+		table.flush()
+		return buffer.String()
+	}
+
+	tests := []struct {
+		name   string
+		report string
+		want   bool
+	}{
+		{name: "json", report: jsonReport.String(), want: true},
+		{name: "json after blank lines", report: "\n  \n" + jsonReport.String(), want: true},
+		{name: "empty", report: "", want: true},
+		{name: "csv", report: tableReport(outputCSV), want: false},
+		{name: "table", report: tableReport(outputTable), want: false},
+	}
+	for _, test := range tests {
+		if got := isJSONReport(bufio.NewReader(strings.NewReader(test.report))); got != test.want {
+			t.Errorf("%s: isJSONReport = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReadVerifyReport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.jsonl")
+	report := "\n" + `{"key":"a/1.txt","status":"match"}` + "\n" + `{"key":"b/2.txt","status":"mismatch","reasons":["etag"]}` + "\n"
+	if err := os.WriteFile(path, []byte(report), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got := readVerifyReport(path, "b/", &shard{})
+	want := map[string]verifyResult{"b/2.txt": {Key: "b/2.txt", Status: verifyStatusMismatch, Reasons: []string{"etag"}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readVerifyReport = %+v, want %+v", got, want)
+	}
+}
+
+// TestReadVerifyReportRejectsCSV reads a CSV report in a child process,
+// since readVerifyReport exits the program on invalid reports.
+func TestReadVerifyReportRejectsCSV(t *testing.T) {
+	if path := os.Getenv("S3_TO_GCS_VERIFY_REPORT"); path != "" {
+		readVerifyReport(path, "", &shard{})
+		return
+	}
+
+	path := filepath.Join(t.TempDir(), "report.csv")
+	if err := os.WriteFile(path, []byte("key,status\na.txt,match\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestReadVerifyReportRejectsCSV$")
+	cmd.Env = append(os.Environ(), "S3_TO_GCS_VERIFY_REPORT="+path)
+	output, err := cmd.CombinedOutput()
+	want := "report merge require reports written with -output json"
+	if err == nil || !strings.Contains(string(output), want) {
+		t.Errorf("readVerifyReport of a CSV report failed with %v: %q, want %q", err, output, want)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// s3EventMessage is the body of an S3 event notification.
+type s3EventMessage struct {
+	// Event is set to "s3:TestEvent" when the notification is configured
+	Event   string          `json:"Event"`
+	Records []s3EventRecord `json:"Records"`
+}
+
+type s3EventRecord struct {
+	EventName string `json:"eventName"`
+	S3        struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			Key       string `json:"key"`
+			VersionID string `json:"versionId"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+// snsEnvelope wraps S3 event notifications delivered to SQS through SNS.
+type snsEnvelope struct {
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+}
+
+// parseS3EventMessage parses the body of an SQS message, unwrapping it from
+// an SNS notification if needed.
+func parseS3EventMessage(body string) (*s3EventMessage, error) {
+	envelope := snsEnvelope{}
+	if err := json.Unmarshal([]byte(body), &envelope); err == nil && envelope.Type == "Notification" {
+		body = envelope.Message
+	}
+
+	message := &s3EventMessage{}
+	if err := json.Unmarshal([]byte(body), message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func isS3NotFound(err error) bool {
+	var requestFailure awserr.RequestFailure
+	return errors.As(err, &requestFailure) && requestFailure.StatusCode() == http.StatusNotFound
+}
+
+func runWatch(args []string) {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	var options copyOptions
+	addCopyFlags(flags, &options)
+	var s3Opts s3Options
+	addS3Flags(flags, &s3Opts)
+	var gcsOpts gcsOptions
+	addGCSFlags(flags, &gcsOpts)
+	addGCSKMSKeyFlag(flags, &gcsOpts)
+	queueURL := flags.String("queue-url", "", "URL of the SQS queue receiving the S3 event notifications of the bucket")
+	deleteRemovedFlag := flags.Bool("delete-removed", false, "Delete GCS objects when their S3 object is removed")
+	runTimeout := flags.Duration("run-timeout", 0, "Stop receiving event notifications after this long, e.g. 5h45m, letting the copies in progress complete (default: no limit)")
+	runDeadline := flags.Duration("run-deadline", 0, "Exit after this long, e.g. 6h, abandoning the copies still in progress, whose messages are received again (default: no limit)")
+	controlAddr := addControlFlags(flags)
+	metricsFile := addMetricsFlags(flags)
+	summaryFile := addSummaryFlags(flags)
+	yes := addConfirmFlags(flags)
+	idleExit := flags.Duration("idle-exit", 0, "Stop watching once no event notification has arrived for this long, e.g. 1h (default: never)")
+	addLogFlags(flags)
+	addTracingFlags(flags)
+	flags.Parse(args)
+	setupLogging()
+	setupTracing()
+	defer shutdownTracing()
+
+	if len(flags.Args()) < 2 || len(flags.Args()) > 3 || *queueURL == "" {
+		log.Fatal("Usage: ./s3-to-gcs watch -queue-url <SQS queue URL> [-delete-removed] [-yes] [-idle-exit <duration>] [-run-timeout <duration>] [-run-deadline <duration>] [-control-addr <host:port>] [-metrics-file <file>] [-summary-file <file>] [-trace] [copy flags] <S3 bucket> <GCS bucket> [optional object key prefix]")
+	}
+
+	options.validate()
+	options.requireYes("watch", *yes, *deleteRemovedFlag)
+	// Objects removed from S3 have no LastModified time to find their name
+	// with
+	if *deleteRemovedFlag && options.nameTemplate.usesTime() {
+		log.Fatal("-delete-removed cannot be used with a -name-template using the modification time")
+	}
+	checkRunDeadline(*runTimeout, *runDeadline)
+
+	buckets, objectKeyPrefix := parseBucketArgs(flags.Args(), "s3", "gs")
+	s3Bucket, gcsBucket := buckets[0], buckets[1]
+
+	log.Printf("Watching queue %s", *queueURL)
+	log.Printf("S3 bucket: %s", s3Bucket)
+	log.Printf("GCS bucket: %s", gcsBucket)
+	if objectKeyPrefix != "" {
+		log.Printf("Object key prefix: %s", objectKeyPrefix)
+	}
+	options.log()
+	s3Opts.log()
+	gcsOpts.log()
+	log.Printf("Delete removed objects: %t", *deleteRemovedFlag)
+	if *idleExit > 0 {
+		log.Printf("Idle exit: %s", *idleExit)
+	}
+	if *runTimeout > 0 {
+		log.Printf("Run timeout: %s", *runTimeout)
+	}
+	if *runDeadline > 0 {
+		log.Printf("Run deadline: %s", *runDeadline)
+	}
+
+	// Unlike S3 requests, SQS requests are not sent with -aws-role-arn
+	s3Client := newS3Client(s3Opts)
+	sqsClient := sqs.New(newAWSSession(s3Opts))
+
+	versionEnabled := s3VersioningEnabled(s3Client, s3Bucket, options.assumeVersioning)
+
+	// Copies in progress are allowed to complete after a signal or the run
+	// timeout, only receiving new messages stops
+	ctx := context.Background()
+	receiveCtx, stop := stopContext(ctx, *runTimeout)
+	defer stop()
+
+	client := newGCSClient(ctx, gcsOpts)
+	defer client.Close()
+
+	c := newCopier(ctx, options, s3Client, s3Bucket, client, gcsOpts, gcsBucket, versionEnabled)
+	defer c.close()
+	c.summarizeFailures(*summaryFile)
+	stopDeadline := c.enforceRunDeadline(*runDeadline, *summaryFile, *metricsFile)
+	serveControl(*controlAddr, c)
+
+	stopReporting := c.reportStatsPeriodically()
+
+	handleRecordFn := func(record s3EventRecord) {
+		// Keys are URL encoded in event notifications
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			log.Printf("Invalid key %q in event notification: %v", record.S3.Object.Key, err)
+			return
+		}
+
+		// Notifications name the bucket behind an access point, which is
+		// the only bucket the queue receives events of anyway
+		if (record.S3.Bucket.Name != s3Bucket && !isS3AccessPoint(s3Bucket)) || !strings.HasPrefix(key, objectKeyPrefix) || isFolderKey(key) {
+			return
+		}
+
+		// Events can arrive late or out of order, so the current state of
+		// the object is what gets replicated
+		headOutput, err := s3Client.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(s3Bucket),
+			Key:    aws.String(key),
+		})
+		exists := err == nil
+		if err != nil && !isS3NotFound(err) {
+			log.Fatal("Error getting object " + key + " from bucket " + s3Bucket + ": " + err.Error())
+		}
+
+		switch {
+		case strings.HasPrefix(record.EventName, "ObjectCreated:") && exists:
+			c.copyObject(&s3.Object{
+				Key:          aws.String(key),
+				Size:         headOutput.ContentLength,
+				ETag:         headOutput.ETag,
+				LastModified: headOutput.LastModified,
+			}, nil)
+		case strings.HasPrefix(record.EventName, "ObjectRemoved:") && !exists && *deleteRemovedFlag:
+			logObject(objectEvent{Key: key, Action: actionDelete, Message: "Object " + key + " – removed from S3, deleting"})
+			if err := c.deleteObject(ctx, key); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	lastMessageTime := time.Now()
+	for {
+		if *idleExit > 0 && time.Since(lastMessageTime) >= *idleExit {
+			log.Printf("No event notification for %s", *idleExit)
+			break
+		}
+
+		receiveOutput, err := sqsClient.ReceiveMessageWithContext(receiveCtx, &sqs.ReceiveMessageInput{
+			QueueUrl:            queueURL,
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(20),
+		})
+		if receiveCtx.Err() != nil {
+			logStopReason(receiveCtx, *runTimeout)
+			break
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if len(receiveOutput.Messages) > 0 {
+			lastMessageTime = time.Now()
+		}
+
+		var handled []*sqs.DeleteMessageBatchRequestEntry
+		for _, message := range receiveOutput.Messages {
+			event, err := parseS3EventMessage(aws.StringValue(message.Body))
+			if err != nil {
+				log.Printf("Ignoring message %s: %v", aws.StringValue(message.MessageId), err)
+			} else {
+				for _, record := range event.Records {
+					handleRecordFn(record)
+				}
+			}
+
+			handled = append(handled, &sqs.DeleteMessageBatchRequestEntry{
+				Id:            message.MessageId,
+				ReceiptHandle: message.ReceiptHandle,
+			})
+		}
+
+		// Messages are only deleted once their objects are safely copied
+		c.wait()
+		c.waitVerified()
+
+		if len(handled) > 0 {
+			deleteOutput, err := sqsClient.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+				QueueUrl: queueURL,
+				Entries:  handled,
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, failed := range deleteOutput.Failed {
+				log.Printf("Error deleting message %s: %s", aws.StringValue(failed.Id), aws.StringValue(failed.Message))
+			}
+		}
+	}
+
+	log.Print("Stopped watching, waiting for copies in progress")
+	c.wait()
+	c.waitVerified()
+
+	stopDeadline()
+	stopReporting()
+
+	c.reportSummary()
+
+	// Watching has no end, every message received was handled
+	c.writeMetrics(*metricsFile, true)
+	c.finishSummary(*summaryFile, runCompleted)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Statuses of the waves reported by the waves subcommand.
+const (
+	waveStatusSignedOff = "signed-off"
+	waveStatusPartial   = "partial"
+	waveStatusReady     = "ready"
+	waveStatusBlocked   = "blocked"
+)
+
+// waveNamePattern restricts wave names to what can be part of the name of
+// their sign-off files.
+var waveNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// wave is a named group of prefixes of the S3 bucket migrated together.
+type wave struct {
+	Name     string   `json:"name"`
+	Prefixes []string `json:"prefixes"`
+	After    []string `json:"after,omitempty"` // Waves to sign off first
+}
+
+// wavePlan is the -wave-plan file, assigning prefixes to waves. The sign-off
+// summaries of the waves are written next to it.
+type wavePlan struct {
+	Waves []wave `json:"waves"`
+
+	path string
+}
+
+// loadWavePlan reads a wave plan and checks that its waves are named, only
+// run after waves defined before them, and do not share objects.
+func loadWavePlan(path string) (*wavePlan, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	plan := &wavePlan{path: path}
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(plan); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(plan.Waves) == 0 {
+		return nil, fmt.Errorf("%s: no waves", path)
+	}
+
+	defined := make(map[string]bool)
+	prefixWaves := make(map[string]string)
+	for _, w := range plan.Waves {
+		if !waveNamePattern.MatchString(w.Name) {
+			return nil, fmt.Errorf("%s: invalid wave name %q, expected letters, digits, '.', '_' and '-'", path, w.Name)
+		}
+		if defined[w.Name] {
+			return nil, fmt.Errorf("%s: wave %s is defined twice", path, w.Name)
+		}
+		if len(w.Prefixes) == 0 {
+			return nil, fmt.Errorf("%s: wave %s has no prefixes", path, w.Name)
+		}
+		// Waves defined later cannot be waited for, so the order has no cycle
+		for _, after := range w.After {
+			if !defined[after] {
+				return nil, fmt.Errorf("%s: wave %s runs after %s, which is not defined before it", path, w.Name, after)
+			}
+		}
+		// An object under two prefixes would be copied in both waves
+		for _, prefix := range w.Prefixes {
+			for other, otherWave := range prefixWaves {
+				if strings.HasPrefix(prefix, other) || strings.HasPrefix(other, prefix) {
+					return nil, fmt.Errorf("%s: prefix %q of wave %s overlaps prefix %q of wave %s", path, prefix, w.Name, other, otherWave)
+				}
+			}
+			prefixWaves[prefix] = w.Name
+		}
+		defined[w.Name] = true
+	}
+	return plan, nil
+}
+
+// wave returns the wave of the plan with the given name.
+func (p *wavePlan) wave(name string) (*wave, error) {
+	for i := range p.Waves {
+		if p.Waves[i].Name == name {
+			return &p.Waves[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no wave %s in %s", name, p.path)
+}
+
+// waveSignoff is the sign-off summary of a wave, written once a run copied
+// every object of its prefixes, in the shard of the run.
+type waveSignoff struct {
+	Wave           string    `json:"wave"`
+	Prefixes       []string  `json:"prefixes"`
+	S3Bucket       string    `json:"s3Bucket"`
+	GCSBucket      string    `json:"gcsBucket"`
+	Shard          string    `json:"shard,omitempty"`
+	Started        time.Time `json:"started"`
+	Finished       time.Time `json:"finished"`
+	FilesCopied    int64     `json:"filesCopied"`
+	BytesCopied    int64     `json:"bytesCopied"`
+	FilesUpToDate  int64     `json:"filesUpToDate"`
+	BytesUpToDate  int64     `json:"bytesUpToDate"`
+	FilesSkipped   int64     `json:"filesSkipped"`
+	FilesDeleted   int64     `json:"filesDeleted"`
+	FilesVerified  int64     `json:"filesDeepVerified"`
+	DeepVerified   bool      `json:"deepVerified"`
+	RecordedSource bool      `json:"recordedForDeletion"`
+}
+
+// signoffPath returns the path of the sign-off summary of a wave, for the
+// given shard.
+func (p *wavePlan) signoffPath(name string, objectShard *shard) string {
+	if objectShard.count > 1 {
+		name += fmt.Sprintf(".shard-%d-of-%d", objectShard.index, objectShard.count)
+	}
+	return filepath.Join(filepath.Dir(p.path), name+".signoff.json")
+}
+
+func readSignoff(path string) (waveSignoff, error) {
+	var signoff waveSignoff
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return signoff, err
+	}
+	if err := json.Unmarshal(data, &signoff); err != nil {
+		return signoff, fmt.Errorf("%s: %w", path, err)
+	}
+	return signoff, nil
+}
+
+// signoffs returns the sign-off summaries of a wave, one per shard, and
+// whether every shard of the wave is signed off.
+func (p *wavePlan) signoffs(name string) ([]waveSignoff, bool) {
+	signoff, err := readSignoff(p.signoffPath(name, &shard{}))
+	if err == nil {
+		return []waveSignoff{signoff}, true
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		log.Fatal(err)
+	}
+
+	// Every shard of a run with -shard signs off its part of the wave
+	paths, err := filepath.Glob(filepath.Join(filepath.Dir(p.path), name+".shard-*-of-*.signoff.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	var signoffs []waveSignoff
+	count := 0
+	for _, path := range paths {
+		signoff, err := readSignoff(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var s shard
+		if err := s.Set(signoff.Shard); err != nil {
+			log.Fatalf("%s: %v", path, err)
+		}
+		if count != 0 && s.count != count {
+			log.Fatalf("Wave %s was signed off by runs with different -shard counts, remove the sign-off files of the other count", name)
+		}
+		count = s.count
+		signoffs = append(signoffs, signoff)
+	}
+	return signoffs, count > 0 && len(signoffs) == count
+}
+
+// checkOrder exits unless the waves w runs after are signed off, for the
+// same buckets.
+func (p *wavePlan) checkOrder(w *wave, s3Bucket string, gcsBucket string) {
+	for _, after := range w.After {
+		signoffs, complete := p.signoffs(after)
+		if !complete {
+			log.Fatalf("Wave %s runs after wave %s, which is not signed off, run -wave %s first (with every shard)", w.Name, after, after)
+		}
+		for _, signoff := range signoffs {
+			if signoff.S3Bucket != s3Bucket || signoff.GCSBucket != gcsBucket {
+				log.Fatalf("Wave %s was signed off for S3 bucket %s and GCS bucket %s, not %s and %s", after, signoff.S3Bucket, signoff.GCSBucket, s3Bucket, gcsBucket)
+			}
+		}
+	}
+}
+
+// signOffWave writes the sign-off summary of a wave whose objects have all
+// been copied, and logs it.
+func (c *copier) signOffWave(plan *wavePlan, w *wave, objectShard *shard, filesDeleted int64) {
+	c.copyMutex.Lock()
+	signoff := waveSignoff{
+		Wave:           w.Name,
+		Prefixes:       w.Prefixes,
+		S3Bucket:       c.s3Bucket,
+		GCSBucket:      c.gcsBucket,
+		Shard:          objectShard.String(),
+		Started:        c.copyStartTime,
+		Finished:       time.Now(),
+		FilesCopied:    c.filesCopied,
+		BytesCopied:    c.totalBytesCopied,
+		FilesUpToDate:  c.filesIdentical,
+		BytesUpToDate:  c.totalBytesIdentical,
+		FilesSkipped:   c.filesTooLarge + c.filesExistingElsewhere + c.filesKept + c.filesArchived,
+		FilesDeleted:   filesDeleted + c.filesDeletedByMarker,
+		DeepVerified:   c.verifier != nil,
+		RecordedSource: c.options.deleteSource,
+	}
+	c.copyMutex.Unlock()
+	if c.verifier != nil {
+		signoff.FilesVerified = c.verifier.filesVerified.Load()
+	}
+
+	path := plan.signoffPath(w.Name, objectShard)
+	data, err := json.MarshalIndent(signoff, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		log.Fatal("Error writing sign-off summary " + path + ": " + err.Error())
+	}
+	log.Printf("Wave %s signed off: %s files copied (%s), %s up to date (%s), %s skipped, sign-off summary written to %s",
+		w.Name, printer.Sprintf("%d", signoff.FilesCopied), formatBytes(signoff.BytesCopied),
+		printer.Sprintf("%d", signoff.FilesUpToDate), formatBytes(signoff.BytesUpToDate),
+		printer.Sprintf("%d", signoff.FilesSkipped), path)
+}
+
+// waveReport is the state of a wave reported by the waves subcommand, with
+// the totals of its sign-off summaries.
+type waveReport struct {
+	Wave          string     `json:"wave"`
+	Status        string     `json:"status"`
+	Prefixes      []string   `json:"prefixes"`
+	After         []string   `json:"after,omitempty"`
+	Shards        int        `json:"shardsSignedOff,omitempty"`
+	FilesCopied   int64      `json:"filesCopied"`
+	BytesCopied   int64      `json:"bytesCopied"`
+	FilesUpToDate int64      `json:"filesUpToDate"`
+	BytesUpToDate int64      `json:"bytesUpToDate"`
+	FilesSkipped  int64      `json:"filesSkipped"`
+	Finished      *time.Time `json:"finished,omitempty"`
+}
+
+// runWaves reports the status of the waves of a plan, from their sign-off
+// summaries: signed off, partly signed off by some of its shards, ready to
+// run, or blocked by waves to sign off first.
+func runWaves(args []string) {
+	flags := flag.NewFlagSet("waves", flag.ExitOnError)
+	outputFormat := addOutputFlag(flags)
+	addLogFlags(flags)
+	flags.Parse(args)
+	setupLogging()
+	checkOutputFormat(*outputFormat)
+
+	if len(flags.Args()) != 1 {
+		log.Fatal("Usage: ./s3-to-gcs waves [-output json|csv|table] <wave plan>")
+	}
+	plan, err := loadWavePlan(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	signedOff := make(map[string]bool)
+	reports := make([]waveReport, 0, len(plan.Waves))
+	for _, w := range plan.Waves {
+		report := waveReport{Wave: w.Name, Prefixes: w.Prefixes, After: w.After}
+		signoffs, complete := plan.signoffs(w.Name)
+		for _, signoff := range signoffs {
+			report.FilesCopied += signoff.FilesCopied
+			report.BytesCopied += signoff.BytesCopied
+			report.FilesUpToDate += signoff.FilesUpToDate
+			report.BytesUpToDate += signoff.BytesUpToDate
+			report.FilesSkipped += signoff.FilesSkipped
+			if report.Finished == nil || signoff.Finished.After(*report.Finished) {
+				finished := signoff.Finished
+				report.Finished = &finished
+			}
+		}
+		if len(signoffs) > 0 && signoffs[0].Shard != "" {
+			report.Shards = len(signoffs)
+		}
+
+		switch {
+		case complete:
+			report.Status = waveStatusSignedOff
+			signedOff[w.Name] = true
+		case len(signoffs) > 0:
+			report.Status = waveStatusPartial
+		default:
+			report.Status = waveStatusReady
+			for _, after := range w.After {
+				if !signedOff[after] {
+					report.Status = waveStatusBlocked
+				}
+			}
+		}
+		reports = append(reports, report)
+	}
+
+	if *outputFormat == outputJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, report := range reports {
+			if err := encoder.Encode(report); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return
+	}
+	table := newTableWriter(os.Stdout, *outputFormat, "wave", "status", "prefixes", "after", "filesCopied", "bytesCopied", "filesUpToDate", "bytesUpToDate", "filesSkipped", "finished")
+	for _, report := range reports {
+		finished := ""
+		if report.Finished != nil {
+			finished = report.Finished.UTC().Format(time.RFC3339)
+		}
+		table.write(report.Wave, report.Status, strings.Join(report.Prefixes, ";"), strings.Join(report.After, ";"),
+			strconv.FormatInt(report.FilesCopied, 10), strconv.FormatInt(report.BytesCopied, 10),
+			strconv.FormatInt(report.FilesUpToDate, 10), strconv.FormatInt(report.BytesUpToDate, 10),
+			strconv.FormatInt(report.FilesSkipped, 10), finished)
+	}
+	table.flush()
+}